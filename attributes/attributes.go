@@ -0,0 +1,180 @@
+package attributes
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/wildmatch"
+)
+
+const (
+	infoAttributesFile   string = "info/attributes"
+	perDirAttributesFile string = ".gitattributes"
+)
+
+// The values of attributes which are set or unset rather than given a
+// value, as in "diff" and "-diff"
+const (
+	Set   string = "true"
+	Unset string = "false"
+)
+
+// Built in macros, which set several attributes at once
+var macros = map[string][]string{
+	"binary": {"-diff", "-merge", "-text"},
+}
+
+// Matcher looks up the attributes of paths, using the .gitattributes file
+// of each directory and .git/info/attributes, which takes precedence.
+// The .gitattributes files are read the first time a path inside their
+// directory is checked.
+type Matcher struct {
+	infoAttributes []rule
+	perDir         map[string][]rule
+}
+
+type rule struct {
+	pattern  string
+	base     string
+	anchored bool
+	attrs    []string
+}
+
+// NewMatcher will create a matcher for the working tree, reading the
+// repository's attributes file.
+func NewMatcher() (*Matcher, error) {
+	infoAttributes, err := readRules(gitdir.Path(infoAttributesFile), "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Matcher{
+		infoAttributes: infoAttributes,
+		perDir:         make(map[string][]rule),
+	}, nil
+}
+
+// Get returns the value of the attribute for the path. Set and Unset are
+// returned for attributes without a value, and false if the attribute
+// is not specified. Files in deeper directories take precedence, and
+// within a file the last matching line decides.
+func (m *Matcher) Get(filepath string, name string) (string, bool) {
+	value, found := "", false
+	check := func(rules []rule) {
+		for _, r := range rules {
+			if !r.matches(filepath) {
+				continue
+			}
+			for _, attr := range r.attrs {
+				if v, ok := attrValue(attr, name); ok {
+					value, found = v, v != ""
+				}
+			}
+		}
+	}
+
+	check(m.rules(""))
+	components := strings.Split(filepath, "/")
+	for i := 1; i < len(components); i++ {
+		check(m.rules(strings.Join(components[:i], "/")))
+	}
+	check(m.infoAttributes)
+
+	return value, found
+}
+
+// attrValue returns the value an attribute of a line gives to the named
+// attribute, where "!name" makes it unspecified again
+func attrValue(attr string, name string) (string, bool) {
+	if expanded, ok := macros[attr]; ok {
+		value, found := "", false
+		for _, a := range expanded {
+			if v, ok := attrValue(a, name); ok {
+				value, found = v, true
+			}
+		}
+		return value, found
+	}
+
+	switch {
+	case attr == name:
+		return Set, true
+	case attr == "-"+name:
+		return Unset, true
+	case attr == "!"+name:
+		return "", true
+	case strings.HasPrefix(attr, name+"="):
+		return attr[len(name)+1:], true
+	}
+	return "", false
+}
+
+// rules returns the rules of the .gitattributes file in the directory,
+// where the root of the working tree is the empty string
+func (m *Matcher) rules(dir string) []rule {
+	rules, ok := m.perDir[dir]
+	if !ok {
+		// An unreadable .gitattributes is treated the same as a missing one
+		rules, _ = readRules(path.Join(dir, perDirAttributesFile), dir)
+		m.perDir[dir] = rules
+	}
+	return rules
+}
+
+func readRules(filename string, base string) ([]rule, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []rule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		r, ok := parseRule(scanner.Text(), base)
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseRule parses a line of an attributes file, returning false if the
+// line is blank, a comment or a negative pattern, which git forbids
+func parseRule(line string, base string) (rule, bool) {
+	fields := strings.Fields(strings.TrimSuffix(line, "\r"))
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "!") {
+		return rule{}, false
+	}
+
+	r := rule{pattern: fields[0], base: base, attrs: fields[1:]}
+
+	// A slash anywhere ties the pattern to the directory of the file,
+	// otherwise it matches names at any depth
+	if strings.Contains(r.pattern, "/") {
+		r.anchored = true
+		r.pattern = strings.TrimPrefix(r.pattern, "/")
+	}
+	return r, true
+}
+
+func (r rule) matches(filepath string) bool {
+	relative := filepath
+	if r.base != "" {
+		if !strings.HasPrefix(filepath, r.base+"/") {
+			return false
+		}
+		relative = filepath[len(r.base)+1:]
+	}
+
+	if r.anchored {
+		return wildmatch.Match(r.pattern, relative, wildmatch.Pathname)
+	}
+	return wildmatch.Match(r.pattern, path.Base(relative), wildmatch.Pathname)
+}
@@ -1,25 +1,281 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mattherman/mhgit/diff"
+	"github.com/mattherman/mhgit/ignore"
+	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/pathspec"
 	"github.com/spf13/cobra"
 )
 
 // addCmd represents the add command
 var addCmd = &cobra.Command{
-	Use:   "add [files...]",
+	Use:   "add [pathspec...]",
 	Short: "Add file contents to the index",
-	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		if addPatch {
+			addPatchHunks(args)
+			return
+		}
+		if len(args) == 0 && !addAll && !addUpdate {
+			fmt.Println("Nothing specified, nothing added.")
+			return
+		}
 		addFiles(args)
 	},
 }
 
+var addAll bool
+var addUpdate bool
+var addDryRun bool
+var addIntentToAdd bool
+var addForce bool
+var addPatch bool
+
 func init() {
 	rootCmd.AddCommand(addCmd)
+	addCmd.Flags().BoolVarP(&addAll, "all", "A", false, "Add, modify, and remove index entries to match the working tree. Without a pathspec the whole working tree is updated.")
+	addCmd.Flags().BoolVarP(&addUpdate, "update", "u", false, "Update the index only where it already has an entry matching the pathspec. New files are not added.")
+	addCmd.Flags().BoolVarP(&addDryRun, "dry-run", "n", false, "Don’t actually add the files, just show what would be added or removed.")
+	addCmd.Flags().BoolVarP(&addIntentToAdd, "intent-to-add", "N", false, "Record only the fact that new paths will be added later.")
+	addCmd.Flags().BoolVarP(&addForce, "force", "f", false, "Allow adding otherwise ignored files.")
+	addCmd.Flags().BoolVarP(&addPatch, "patch", "p", false, "Interactively choose hunks of patch between the index and the work tree and add them to the index.")
+}
+
+// stagedChanges represents the changes needed to make the index match
+// the working tree for the paths matched by a pathspec
+type stagedChanges struct {
+	updated []string
+	added   []string
+	removed []string
+	ignored []string
+}
+
+func addFiles(args []string) {
+	spec, err := pathspec.Parse(args)
+	if err != nil {
+		fmt.Printf("Failed to parse the pathspec: %v\n", err)
+		return
+	}
+
+	changes, err := findStagedChanges(spec)
+	if err != nil {
+		fmt.Printf("Failed to find the files to add: %v\n", err)
+		return
+	}
+
+	unmatched := spec.Unmatched()
+	if len(unmatched) > 0 {
+		fmt.Printf("Failed to add files: pathspec '%s' did not match any files\n", unmatched[0])
+		return
+	}
+
+	if len(changes.ignored) > 0 {
+		fmt.Println("The following paths are ignored by one of your .gitignore files:")
+		for _, path := range changes.ignored {
+			fmt.Println(path)
+		}
+		fmt.Println("Use -f if you really want to add them.")
+	}
+
+	if addDryRun {
+		for _, path := range append(changes.updated, changes.added...) {
+			fmt.Printf("add '%s'\n", path)
+		}
+		for _, path := range changes.removed {
+			fmt.Printf("remove '%s'\n", path)
+		}
+		return
+	}
+
+	batch, err := index.NewBatch()
+	if err != nil {
+		fmt.Printf("Failed to update the index: %v\n", err)
+		return
+	}
+	defer batch.Rollback()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	added := changes.added
+	if addIntentToAdd {
+		err = batch.IntentToAdd(changes.added)
+		if err != nil {
+			fmt.Printf("Failed to create the index entry: %v\n", err)
+			return
+		}
+		added = nil
+	}
+
+	err = batch.Add(ctx, append(changes.updated, added...))
+	if err != nil {
+		fmt.Printf("Failed to create the index entry: %v\n", err)
+		return
+	}
+
+	for _, path := range changes.removed {
+		batch.Remove(path)
+	}
+
+	err = batch.Commit()
+	if err != nil {
+		fmt.Printf("Failed to write the index: %v\n", err)
+	}
+}
+
+// addPatchHunks lets the user choose which hunks of the changes to
+// tracked files to stage. The working tree is not changed.
+func addPatchHunks(args []string) {
+	spec, err := pathspec.Parse(args)
+	if err != nil {
+		fmt.Printf("Failed to parse the pathspec: %v\n", err)
+		return
+	}
+
+	patches, entries, err := worktreePatches(spec)
+	if err != nil {
+		fmt.Printf("Failed to compare the index and working tree: %v\n", err)
+		return
+	}
+	if len(patches) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+
+	var staged []patchResult
+	err = choosePatchHunks(stagePatchMode, patches, func(patch filePatch, chosen []diff.Hunk) error {
+		data, remove, err := patch.result(stagePatchMode, chosen)
+		staged = append(staged, patchResult{path: patch.path, mode: entries[patch.path].Mode, data: data, remove: remove})
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Failed to apply the chosen hunks: %v\n", err)
+		return
+	}
+
+	err = updateIndexContent(staged)
+	if err != nil {
+		fmt.Printf("Failed to update the index: %v\n", err)
+	}
+}
+
+// findStagedChanges compares the working tree against the index for
+// the paths matched by the pathspec. Every path in the index is matched
+// against the pathspec so that naming an unchanged file is not treated
+// as a pathspec that matched nothing.
+func findStagedChanges(spec *pathspec.Pathspec) (stagedChanges, error) {
+	var changes stagedChanges
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	modified, deleted, err := index.Refresh(ctx)
+	if err != nil {
+		return changes, err
+	}
+
+	idx, err := index.ReadIndex()
+	if err != nil {
+		return changes, err
+	}
+
+	tracked := make(map[string]bool)
+	for _, entry := range idx.Entries {
+		tracked[entry.Path] = true
+		spec.Match(entry.Path)
+	}
+
+	changes.updated = filterPaths(spec, modified)
+	changes.removed = filterPaths(spec, deleted)
+
+	// Adding a conflicted path resolves it with the working tree version
+	for _, conflict := range idx.Conflicts() {
+		if !spec.Match(conflict.Path) {
+			continue
+		}
+		if _, err := os.Lstat(conflict.Path); err == nil {
+			changes.updated = append(changes.updated, conflict.Path)
+		} else {
+			changes.removed = append(changes.removed, conflict.Path)
+		}
+	}
+
+	if addUpdate {
+		return changes, nil
+	}
+
+	// Forcing includes ignored files, so every file is a candidate
+	var untracked []string
+	if addForce {
+		files, err := workingTreeFiles(".")
+		if err != nil {
+			return changes, err
+		}
+		for _, file := range files {
+			if !tracked[file] {
+				untracked = append(untracked, file)
+			}
+		}
+	} else {
+		untracked, err = index.UntrackedFiles()
+		if err != nil {
+			return changes, err
+		}
+	}
+	changes.added = filterPaths(spec, untracked)
+	if addForce {
+		return changes, nil
+	}
+
+	// Ignored files are reported when they are named explicitly
+	matcher, err := ignore.NewMatcher()
+	if err != nil {
+		return changes, err
+	}
+	for _, path := range spec.Literals() {
+		info, err := os.Lstat(path)
+		if err != nil || tracked[path] || !matcher.Ignored(path, info.IsDir()) {
+			continue
+		}
+
+		spec.Match(path)
+		changes.ignored = append(changes.ignored, path)
+	}
+
+	return changes, nil
 }
 
-func addFiles(files []string) {
-	for _, file := range files {
-		updateIndex(file, true, false)
+func filterPaths(spec *pathspec.Pathspec, paths []string) []string {
+	var matched []string
+	for _, path := range paths {
+		if spec.Match(path) {
+			matched = append(matched, path)
+		}
 	}
+	return matched
+}
+
+// workingTreeFiles returns every file below the directory, including
+// ignored files
+func workingTreeFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		files = append(files, filepath.ToSlash(path))
+		return nil
+	})
+	return files, err
 }
@@ -2,53 +2,517 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/mattherman/mhgit/config"
 	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/remote"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/mattherman/mhgit/wildmatch"
 	"github.com/spf13/cobra"
 )
 
 var branchCmd = &cobra.Command{
-	Use:   "branch",
-	Short: "A brief description of your command",
+	Use:   "branch [<name> [<start-point>] | <pattern>...]",
+	Short: "List, create, or delete branches",
+	Long: `List, create, or delete branches.
+
+Without arguments, the branches are listed and the current one is
+marked with an asterisk. Given a name, a branch is created pointing to
+the start point, which is HEAD by default.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) > 0 {
-			createBranch(args[0])
-		} else {
-			listBranches()
+		switch {
+		case branchDelete || branchForceDelete:
+			deleteBranches(args)
+		case branchMove || branchForceMove:
+			moveBranch(args, true, branchForceMove)
+		case branchCopy || branchForceCopy:
+			moveBranch(args, false, branchForceCopy)
+		case cmd.Flags().Changed("set-upstream-to"):
+			setUpstream(branchUpstream, args)
+		case branchUnsetUpstream:
+			unsetUpstream(args)
+		case branchShowCurrent:
+			branch, _ := refs.CurrentBranch()
+			if branch != "" {
+				fmt.Println(branch)
+			}
+		case len(args) > 0 && !branchListMode(cmd):
+			createBranch(args)
+		default:
+			listBranches(args)
 		}
-
 	},
 }
 
+var branchDelete bool
+var branchForceDelete bool
+var branchForce bool
+var branchMove bool
+var branchForceMove bool
+var branchCopy bool
+var branchForceCopy bool
+var branchUpstream string
+var branchUnsetUpstream bool
+var branchShowCurrent bool
+var branchVerbose int
+var branchAll bool
+var branchRemotes bool
+var branchList bool
+var branchMerged string
+var branchNoMerged string
+var branchContains string
+var branchSort []string
+var branchFormat string
+
 func init() {
 	rootCmd.AddCommand(branchCmd)
+	flags := branchCmd.Flags()
+	flags.BoolVarP(&branchDelete, "delete", "d", false, "Delete a branch. The branch must be fully merged into its upstream, or HEAD if it has none.")
+	flags.BoolVarP(&branchForceDelete, "force-delete", "D", false, "Delete a branch even if it is not fully merged.")
+	flags.BoolVarP(&branchForce, "force", "f", false, "Reset an existing branch to the start point, or delete or rename a branch regardless of its state.")
+	flags.BoolVarP(&branchMove, "move", "m", false, "Rename a branch along with its reflog and configuration.")
+	flags.BoolVarP(&branchForceMove, "force-move", "M", false, "Rename a branch even if the new name already exists.")
+	flags.BoolVarP(&branchCopy, "copy", "c", false, "Copy a branch along with its reflog and configuration.")
+	flags.BoolVarP(&branchForceCopy, "force-copy", "C", false, "Copy a branch even if the new name already exists.")
+	flags.StringVarP(&branchUpstream, "set-upstream-to", "u", "", "Set up the branch to track the given upstream branch.")
+	flags.BoolVar(&branchUnsetUpstream, "unset-upstream", false, "Remove the upstream information of the branch.")
+	flags.BoolVar(&branchShowCurrent, "show-current", false, "Print the name of the current branch.")
+	flags.CountVarP(&branchVerbose, "verbose", "v", "Show the commit and subject of each branch. Given twice, show the upstream branch and how far ahead or behind it is.")
+	flags.BoolVarP(&branchAll, "all", "a", false, "List both local and remote-tracking branches.")
+	flags.BoolVarP(&branchRemotes, "remotes", "r", false, "List or delete remote-tracking branches.")
+	flags.BoolVarP(&branchList, "list", "l", false, "List the branches matching the patterns.")
+	flags.StringVar(&branchMerged, "merged", "", "Only list branches merged into the commit, HEAD by default.")
+	flags.StringVar(&branchNoMerged, "no-merged", "", "Only list branches not merged into the commit, HEAD by default.")
+	flags.StringVar(&branchContains, "contains", "", "Only list branches containing the commit, HEAD by default.")
+	flags.StringSliceVar(&branchSort, "sort", nil, "Sort by the key, such as refname or -committerdate. Can be given more than once.")
+	flags.StringVar(&branchFormat, "format", "", "Print each branch using the format, such as '%(refname:short) %(objectname)'.")
+	flags.Lookup("merged").NoOptDefVal = "HEAD"
+	flags.Lookup("no-merged").NoOptDefVal = "HEAD"
+	flags.Lookup("contains").NoOptDefVal = "HEAD"
+}
+
+// branchListMode returns true if the arguments are patterns of branches
+// to list rather than a branch to create
+func branchListMode(cmd *cobra.Command) bool {
+	for _, flag := range []string{"list", "verbose", "all", "remotes", "merged", "no-merged", "contains", "sort", "format"} {
+		if cmd.Flags().Changed(flag) {
+			return true
+		}
+	}
+	return false
 }
 
-func createBranch(branchName string) {
-	err := refs.CreateBranch(branchName)
+func createBranch(args []string) {
+	if len(args) > 2 {
+		fmt.Println("Failed to create branch: too many arguments")
+		return
+	}
+
+	branchName := args[0]
+	startPoint := "HEAD"
+	if len(args) == 2 {
+		startPoint = args[1]
+	}
+
+	commitHash, err := revision.ResolveCommit(startPoint)
+	if err != nil {
+		fmt.Printf("Failed to create branch: not a valid object name: '%s'\n", startPoint)
+		return
+	}
+
+	current, _ := refs.CurrentBranch()
+	if branchForce && current == branchName {
+		fmt.Printf("Failed to create branch: cannot force update the current branch '%s'\n", branchName)
+		return
+	}
+
+	err = refs.CreateBranch(branchName, commitHash, startPoint, branchForce)
 	if err != nil {
 		fmt.Printf("Failed to create branch: %v\n", err)
 	}
 }
 
-func listBranches() {
+func deleteBranches(names []string) {
+	if len(names) == 0 {
+		fmt.Println("Failed to delete branch: branch name required")
+		return
+	}
+
+	current, _ := refs.CurrentBranch()
+	for _, name := range names {
+		fullName := "refs/heads/" + name
+		if branchRemotes {
+			fullName = "refs/remotes/" + name
+		}
+
+		hash, err := refs.ResolveRef(fullName)
+		if err != nil {
+			fmt.Printf("Failed to delete branch: branch '%s' not found.\n", name)
+			continue
+		}
+
+		if !branchRemotes {
+			if name == current {
+				wd, _ := os.Getwd()
+				fmt.Printf("Failed to delete branch: cannot delete branch '%s' checked out at '%s'\n", name, wd)
+				continue
+			}
+			if !branchForceDelete && !branchForce && !branchMergedForDelete(name, hash) {
+				fmt.Printf("Failed to delete branch: the branch '%s' is not fully merged.\n", name)
+				fmt.Printf("If you are sure you want to delete it, run 'mhgit branch -D %s'.\n", name)
+				continue
+			}
+		}
+
+		err = refs.DeleteRef(fullName, hash)
+		if err != nil {
+			fmt.Printf("Failed to delete branch %s: %v\n", name, err)
+			continue
+		}
+
+		if branchRemotes {
+			fmt.Printf("Deleted remote-tracking branch %s (was %s).\n", name, hash[:7])
+			continue
+		}
+		err = config.RenameSection("branch."+name, "")
+		if err != nil {
+			fmt.Printf("Failed to remove the configuration of branch %s: %v\n", name, err)
+		}
+		fmt.Printf("Deleted branch %s (was %s).\n", name, hash[:7])
+	}
+}
+
+// branchMergedForDelete returns true if the branch is merged into its
+// upstream, or into HEAD if it does not have one
+func branchMergedForDelete(name string, hash string) bool {
+	target := "HEAD"
+	if upstream, ok := upstreamRef(name); ok {
+		if _, err := refs.ResolveRef(upstream); err == nil {
+			target = upstream
+		}
+	}
+
+	targetHash, err := revision.ResolveCommit(target)
+	if err != nil {
+		return false
+	}
+	merged, err := revision.IsAncestor(hash, targetHash)
+	return err == nil && merged
+}
+
+// moveBranch renames or copies a branch along with its reflog and its
+// configuration. The current branch is used if only one name is given.
+func moveBranch(args []string, rename bool, force bool) {
+	action := "rename"
+	if !rename {
+		action = "copy"
+	}
+
+	var oldName, newName string
+	switch len(args) {
+	case 1:
+		oldName, _ = refs.CurrentBranch()
+		newName = args[0]
+		if oldName == "" {
+			fmt.Printf("Failed to %s branch: HEAD is not on a branch\n", action)
+			return
+		}
+	case 2:
+		oldName, newName = args[0], args[1]
+	default:
+		fmt.Printf("Failed to %s branch: branch name required\n", action)
+		return
+	}
+
+	err := refs.CheckBranchName(newName)
+	if err != nil {
+		fmt.Printf("Failed to %s branch: %v\n", action, err)
+		return
+	}
+
+	oldRef := "refs/heads/" + oldName
+	newRef := "refs/heads/" + newName
+	current, _ := refs.CurrentBranch()
+	if _, err := refs.ReadRef(oldRef); err != nil {
+		// The current branch can be renamed before it has any commits
+		if rename && oldName == current && err == refs.ErrNotFound {
+			err = refs.UpdateSymbolicRef("HEAD", newRef, "")
+			if err != nil {
+				fmt.Printf("Failed to rename branch: %v\n", err)
+			}
+			return
+		}
+		fmt.Printf("Failed to %s branch: no branch named '%s'\n", action, oldName)
+		return
+	}
+
+	if oldName == newName {
+		return
+	}
+	if hash, err := refs.ResolveRef(newRef); err == nil {
+		if !force && !branchForce {
+			fmt.Printf("Failed to %s branch: a branch named '%s' already exists\n", action, newName)
+			return
+		}
+		if newName == current {
+			fmt.Printf("Failed to %s branch: cannot force update the current branch\n", action)
+			return
+		}
+		err = refs.DeleteRef(newRef, hash)
+		if err == nil {
+			err = config.RenameSection("branch."+newName, "")
+		}
+		if err != nil {
+			fmt.Printf("Failed to %s branch: %v\n", action, err)
+			return
+		}
+	}
+
+	if rename {
+		err = refs.RenameRef(oldRef, newRef, fmt.Sprintf("Branch: renamed %s to %s", oldRef, newRef))
+		if err == nil {
+			err = config.RenameSection("branch."+oldName, "branch."+newName)
+		}
+	} else {
+		err = refs.CopyRef(oldRef, newRef, fmt.Sprintf("Branch: copied %s to %s", oldRef, newRef))
+		if err == nil {
+			err = config.CopySection("branch."+oldName, "branch."+newName)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Failed to %s branch: %v\n", action, err)
+	}
+}
+
+// setUpstream configures a branch, the current one by default, to track
+// a local or remote-tracking branch
+func setUpstream(upstream string, args []string) {
+	branch, ok := targetBranch(args)
+	if !ok {
+		return
+	}
+	if _, err := refs.ResolveRef("refs/heads/" + branch); err != nil {
+		fmt.Printf("Failed to set upstream: branch '%s' does not exist\n", branch)
+		return
+	}
+
+	upstreamName, err := refs.ExpandRef(upstream)
+	if err != nil {
+		fmt.Printf("Failed to set upstream: the requested upstream branch '%s' does not exist\n", upstream)
+		return
+	}
+
+	var remote, merge string
+	switch {
+	case strings.HasPrefix(upstreamName, "refs/heads/"):
+		remote, merge = ".", upstreamName
+	case strings.HasPrefix(upstreamName, "refs/remotes/"):
+		remote, merge = splitRemoteBranch(strings.TrimPrefix(upstreamName, "refs/remotes/"))
+	default:
+		fmt.Printf("Failed to set upstream: '%s' is not a branch\n", upstream)
+		return
+	}
+
+	err = config.Set("branch."+branch+".remote", remote)
+	if err == nil {
+		err = config.Set("branch."+branch+".merge", merge)
+	}
+	if err != nil {
+		fmt.Printf("Failed to set upstream: %v\n", err)
+		return
+	}
+	fmt.Printf("branch '%s' set up to track '%s'.\n", branch, shortRefName(upstreamName))
+}
+
+// splitRemoteBranch splits "origin/main" into the remote and the ref of
+// the branch on that remote. The fetch refspecs of the remotes decide
+// which ref it tracks, and otherwise the longest configured remote name
+// is preferred since remote names may contain slashes.
+func splitRemoteBranch(name string) (string, string) {
+	names, _ := remote.List()
+	for _, configured := range names {
+		if r, err := remote.Get(configured); err == nil {
+			if source, ok := r.RemoteRef("refs/remotes/" + name); ok {
+				return configured, source
+			}
+		}
+	}
+
+	remoteName := ""
+	for _, configured := range names {
+		if strings.HasPrefix(name, configured+"/") && len(configured) > len(remoteName) {
+			remoteName = configured
+		}
+	}
+	if remoteName == "" {
+		remoteName = strings.SplitN(name, "/", 2)[0]
+	}
+	return remoteName, "refs/heads/" + strings.TrimPrefix(name, remoteName+"/")
+}
+
+func unsetUpstream(args []string) {
+	branch, ok := targetBranch(args)
+	if !ok {
+		return
+	}
+	if _, ok := upstreamRef(branch); !ok {
+		fmt.Printf("Failed to unset upstream: branch '%s' has no upstream information\n", branch)
+		return
+	}
+
+	err := config.Unset("branch." + branch + ".remote")
+	if err == nil {
+		err = config.Unset("branch." + branch + ".merge")
+	}
+	if err != nil {
+		fmt.Printf("Failed to unset upstream: %v\n", err)
+	}
+}
+
+// targetBranch returns the branch given as the only argument, or the
+// current branch if there are no arguments
+func targetBranch(args []string) (string, bool) {
+	if len(args) > 1 {
+		fmt.Println("Failed to update branch: too many arguments")
+		return "", false
+	}
+	if len(args) == 1 {
+		return args[0], true
+	}
+
+	branch, err := refs.CurrentBranch()
+	if err != nil || branch == "" {
+		fmt.Println("Failed to update branch: HEAD is not on a branch")
+		return "", false
+	}
+	return branch, true
+}
+
+func listBranches(patterns []string) {
 	currentBranch, err := refs.CurrentBranch()
 	if err != nil {
 		fmt.Printf("Failed to lookup the current branch: %v\n", err)
 		return
 	}
 
-	branches, err := refs.ListBranches()
+	var refList []refs.Ref
+	for _, prefix := range branchListPrefixes() {
+		found, err := refs.IterRefs(prefix)
+		if err != nil {
+			fmt.Printf("Failed to retrieve branches: %v\n", err)
+			return
+		}
+		refList = append(refList, found...)
+	}
+
+	// Like git, a commit following a filter without "=" belongs to it
+	for _, filter := range []*string{&branchMerged, &branchNoMerged, &branchContains} {
+		if *filter == "HEAD" && len(patterns) > 0 {
+			if _, err := revision.ResolveCommit(patterns[0]); err == nil {
+				*filter = patterns[0]
+				patterns = patterns[1:]
+			}
+		}
+	}
+
+	listed := newListedRefs(matchBranchPatterns(refList, patterns))
+	listed, err = filterRefs(listed, branchMerged, branchNoMerged, branchContains)
+	if err != nil {
+		fmt.Printf("Failed to filter branches: %v\n", err)
+		return
+	}
+	err = sortRefs(listed, branchSort)
 	if err != nil {
-		fmt.Printf("Failed to retrieve branches: %v\n", err)
+		fmt.Printf("Failed to sort branches: %v\n", err)
 		return
 	}
 
-	for _, branch := range branches {
-		if branch == currentBranch {
-			fmt.Printf("* %s\n", branch)
-		} else {
-			fmt.Printf("  %s\n", branch)
+	if branchFormat != "" {
+		for _, r := range listed {
+			line, err := formatRef(branchFormat, r)
+			if err != nil {
+				fmt.Printf("Failed to format branch: %v\n", err)
+				return
+			}
+			fmt.Println(line)
+		}
+		return
+	}
+
+	// A detached HEAD is listed first, as if it were a branch
+	if currentBranch == "" && !branchRemotes && len(patterns) == 0 {
+		if commitHash, err := refs.LatestCommit(); err == nil {
+			head := &listedRef{Ref: refs.Ref{Name: fmt.Sprintf("(HEAD detached at %s)", commitHash[:7]), Hash: commitHash}}
+			listed = append([]*listedRef{head}, listed...)
+		}
+	}
+
+	width := 0
+	for _, r := range listed {
+		if len(branchDisplayName(r)) > width {
+			width = len(branchDisplayName(r))
+		}
+	}
+
+	for _, r := range listed {
+		marker := " "
+		if r.Name == "refs/heads/"+currentBranch || strings.HasPrefix(r.Name, "(HEAD detached") {
+			marker = "*"
+		}
+		name := branchDisplayName(r)
+		if r.Symbolic() {
+			name += " -> " + shortRefName(r.Target)
+		}
+
+		if branchVerbose == 0 || r.Symbolic() {
+			fmt.Printf("%s %s\n", marker, name)
+			continue
+		}
+
+		tracking := ""
+		if upstream, ok := upstreamRef(strings.TrimPrefix(r.Name, "refs/heads/")); ok && branchVerbose > 1 && strings.HasPrefix(r.Name, "refs/heads/") {
+			tracking = trackingInfo(r.Hash, upstream, true) + " "
+		}
+		fmt.Printf("%s %-*s %s %s%s\n", marker, width, name, r.Hash[:7], tracking, r.subject())
+	}
+}
+
+// branchListPrefixes returns which refs are listed as branches
+func branchListPrefixes() []string {
+	switch {
+	case branchAll:
+		return []string{"refs/heads/", "refs/remotes/"}
+	case branchRemotes:
+		return []string{"refs/remotes/"}
+	}
+	return []string{"refs/heads/"}
+}
+
+// branchDisplayName returns the name a branch is listed with
+func branchDisplayName(r *listedRef) string {
+	if strings.HasPrefix(r.Name, "refs/remotes/") && branchAll {
+		return strings.TrimPrefix(r.Name, "refs/")
+	}
+	return shortRefName(r.Name)
+}
+
+// matchBranchPatterns keeps the branches matching any of the patterns
+func matchBranchPatterns(refList []refs.Ref, patterns []string) []refs.Ref {
+	if len(patterns) == 0 {
+		return refList
+	}
+
+	var matched []refs.Ref
+	for _, ref := range refList {
+		name := shortRefName(ref.Name)
+		for _, pattern := range patterns {
+			if wildmatch.Match(pattern, name, 0) {
+				matched = append(matched, ref)
+				break
+			}
 		}
 	}
+	return matched
 }
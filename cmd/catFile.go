@@ -1,47 +1,414 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
 
+	"github.com/mattherman/mhgit/attributes"
+	"github.com/mattherman/mhgit/config"
 	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/revision"
 	"github.com/spf13/cobra"
 )
 
+// The format of --batch and --batch-check when none is given
+const defaultBatchFormat = "%(objectname) %(objecttype) %(objectsize)"
+
 // catFileCmd represents the catFile command
 var catFileCmd = &cobra.Command{
-	Use:   "cat-file [object]",
+	Use:   "cat-file (-t | -s | -e | -p | <type> | --textconv) <object> | (--batch | --batch-check | --batch-command)[=<format>]",
 	Short: "Provide content or type and size information for repository objects.",
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Provide content or type and size information for repository objects.
+
+With --batch, --batch-check or --batch-command the objects are read from
+the standard input, one per line, and each is printed as a line in the
+format, by default "%(objectname) %(objecttype) %(objectsize)". --batch
+follows the line with the content of the object and a newline. Missing
+objects are printed as "<object> missing" and abbreviated hashes of more
+than one object as "<object> ambiguous". --batch-command reads the
+commands "contents <object>", "info <object>" and, with --buffer, "flush".`,
 	Run: func(cmd *cobra.Command, args []string) {
-		CatFile(args[0], prettyPrint, outputObjectType, outputObjectSize)
+		mode := catFileBatchMode(cmd)
+		if mode != "" {
+			if len(args) > 0 {
+				fmt.Println("Failed to read objects: batch modes do not take arguments")
+				os.Exit(1)
+			}
+			err := catFileBatch(mode)
+			if err != nil {
+				fmt.Printf("Failed to read objects: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		switch {
+		case len(args) == 2:
+			CatFileAs(args[0], args[1])
+		case len(args) != 1:
+			fmt.Println("Failed to read object: expected an object")
+		case checkExists:
+			if !catFileExists(args[0]) {
+				os.Exit(1)
+			}
+		default:
+			CatFile(args[0], prettyPrint, outputObjectType, outputObjectSize)
+		}
 	},
 }
 
 var prettyPrint bool
 var outputObjectType bool
 var outputObjectSize bool
+var checkExists bool
+var catFileTextconv bool
+var catFileBatchFormat string
+var catFileBatchCheckFormat string
+var catFileBatchCommandFormat string
+var catFileAllObjects bool
+var catFileBuffer bool
 
 func init() {
 	rootCmd.AddCommand(catFileCmd)
-	catFileCmd.Flags().BoolVarP(&prettyPrint, "pretty", "p", false, "Pretty-print the object based on type.")
-	catFileCmd.Flags().BoolVarP(&outputObjectType, "type", "t", false, "Output the type of the object.")
-	catFileCmd.Flags().BoolVarP(&outputObjectSize, "size", "s", false, "Output the size of the object.")
+	flags := catFileCmd.Flags()
+	flags.BoolVarP(&prettyPrint, "pretty", "p", false, "Pretty-print the object based on type.")
+	flags.BoolVarP(&outputObjectType, "type", "t", false, "Output the type of the object.")
+	flags.BoolVarP(&outputObjectSize, "size", "s", false, "Output the size of the object.")
+	flags.BoolVarP(&checkExists, "exists", "e", false, "Exit with zero status if the object exists and is valid, without printing anything.")
+	flags.BoolVar(&catFileTextconv, "textconv", false, "Convert a blob given as <rev>:<path> with the textconv command of its diff driver.")
+	flags.StringVar(&catFileBatchFormat, "batch", "", "Print the information and content of each object read from the standard input.")
+	flags.StringVar(&catFileBatchCheckFormat, "batch-check", "", "Print the information of each object read from the standard input.")
+	flags.StringVar(&catFileBatchCommandFormat, "batch-command", "", "Run the contents, info and flush commands read from the standard input.")
+	flags.BoolVar(&catFileAllObjects, "batch-all-objects", false, "Print every object in the repository instead of reading the standard input.")
+	flags.BoolVar(&catFileBuffer, "buffer", false, "Only flush the output at the end or on the flush command.")
+	for _, name := range []string{"batch", "batch-check", "batch-command"} {
+		flags.Lookup(name).NoOptDefVal = defaultBatchFormat
+	}
 }
 
 // CatFile will inspect a stored Git object or return an error if it
 // cannot be found.
 func CatFile(objectName string, outputObject bool, outputType bool, outputSize bool) {
-	obj, err := objects.ReadObject(objectName)
+	// Names such as tags and branches are accepted as well as hashes
+	hash, err := revision.Resolve(objectName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	obj, err := objects.ReadObject(hash)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
+	switch {
+	case outputType:
+		fmt.Println(obj.Type())
+	case outputSize:
+		fmt.Printf("%d\n", obj.Size())
+	case catFileTextconv:
+		_, path, ok := revision.SplitPath(objectName)
+		if !ok {
+			fmt.Printf("Failed to convert object: <rev>:<path> required, only '%s' given\n", objectName)
+			return
+		}
+		data, err := textconv(path, obj.Data)
+		if err != nil {
+			fmt.Printf("Failed to convert object: %v\n", err)
+			return
+		}
+		os.Stdout.Write(data)
+	default:
+		fmt.Print(obj)
+	}
+}
+
+// CatFileAs will print the raw content of the object, peeling tags
+// until an object of the type is found
+func CatFileAs(objectType string, objectName string) {
+	hash, err := revision.Resolve(objectName)
+	if err == nil {
+		hash, err = revision.Peel(hash, objectType)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	obj, err := objects.ReadObject(hash)
 	if err != nil {
 		fmt.Println(err)
-	} else {
-		if outputType {
-			fmt.Println(obj.Type())
-		} else if outputSize {
-			fmt.Printf("%d\n", obj.Size())
+		return
+	}
+	os.Stdout.Write(obj.Data)
+}
+
+func catFileExists(objectName string) bool {
+	hash, err := revision.Resolve(objectName)
+	if err != nil {
+		return false
+	}
+	_, err = objects.ReadObject(hash)
+	return err == nil
+}
+
+// catFileBatchMode returns which of --batch, --batch-check and
+// --batch-command was given, or an empty string for none
+func catFileBatchMode(cmd *cobra.Command) string {
+	for _, mode := range []string{"batch", "batch-check", "batch-command"} {
+		if cmd.Flags().Changed(mode) {
+			return mode
+		}
+	}
+	if catFileAllObjects {
+		return "batch-check"
+	}
+	return ""
+}
+
+func catFileBatch(mode string) error {
+	format := map[string]string{
+		"batch":         catFileBatchFormat,
+		"batch-check":   catFileBatchCheckFormat,
+		"batch-command": catFileBatchCommandFormat,
+	}[mode]
+	if format == "" {
+		format = defaultBatchFormat
+	}
+
+	batch := &objectBatch{
+		out:    bufio.NewWriter(os.Stdout),
+		format: format,
+		rest:   strings.Contains(format, "%(rest)"),
+	}
+	defer batch.out.Flush()
+
+	if catFileAllObjects {
+		hashes, err := objects.ListObjects()
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			err = batch.print(hash, mode == "batch")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	input := bufio.NewReader(os.Stdin)
+	for {
+		line, err := input.ReadString('\n')
+		if line == "" && err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if mode == "batch-command" {
+			err = batch.command(line)
 		} else {
-			fmt.Printf("%v\n", obj)
+			err = batch.print(line, mode == "batch")
 		}
+		if err != nil {
+			return err
+		}
+
+		if !catFileBuffer {
+			err = batch.out.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// objectBatch prints the objects requested by the input of a batch mode
+type objectBatch struct {
+	out    *bufio.Writer
+	format string
+	rest   bool
+}
+
+// command runs a line of --batch-command input
+func (b *objectBatch) command(line string) error {
+	command, argument := line, ""
+	if space := strings.IndexByte(line, ' '); space != -1 {
+		command, argument = line[:space], line[space+1:]
+	}
+
+	switch command {
+	case "contents":
+		return b.print(argument, true)
+	case "info":
+		return b.print(argument, false)
+	case "flush":
+		if !catFileBuffer {
+			return fmt.Errorf("flush is only for --buffer mode")
+		}
+		return b.out.Flush()
+	}
+	return fmt.Errorf("unknown command: '%s'", line)
+}
+
+// print writes the line describing the object, followed by its content
+// if requested
+func (b *objectBatch) print(input string, contents bool) error {
+	name, rest := input, ""
+	if b.rest {
+		if i := strings.IndexAny(input, " \t"); i != -1 {
+			name, rest = input[:i], input[i+1:]
+		}
+	}
+
+	hash, err := revision.Resolve(name)
+	if _, ok := err.(*objects.AmbiguousError); ok {
+		fmt.Fprintf(b.out, "%s ambiguous\n", name)
+		return nil
+	}
+
+	// Only the type and size are needed unless the content is printed
+	var obj objects.Object
+	var size int
+	if err == nil && contents {
+		obj, err = objects.ReadObject(hash)
+	} else if err == nil {
+		obj.ObjectType, size, err = objects.ReadObjectHeader(hash)
+	}
+	if err != nil {
+		fmt.Fprintf(b.out, "%s missing\n", name)
+		return nil
+	}
+
+	if catFileTextconv && contents && obj.Type() == "blob" {
+		if _, path, ok := revision.SplitPath(name); ok {
+			obj.Data, err = textconv(path, obj.Data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if contents {
+		size = obj.Size()
+	}
+
+	line, err := expandBatchFormat(b.format, hash, obj.Type(), size, rest)
+	if err != nil {
+		return err
+	}
+	b.out.WriteString(line + "\n")
+	if contents {
+		b.out.Write(obj.Data)
+		b.out.WriteString("\n")
+	}
+	return nil
+}
+
+// expandBatchFormat replaces the %(atom) placeholders of a batch format
+func expandBatchFormat(format string, hash string, objectType string, size int, rest string) (string, error) {
+	var builder strings.Builder
+	for {
+		start := strings.Index(format, "%(")
+		if start == -1 {
+			builder.WriteString(format)
+			return builder.String(), nil
+		}
+		end := strings.IndexByte(format[start:], ')')
+		if end == -1 {
+			return "", fmt.Errorf("malformed format string %s", format)
+		}
+		builder.WriteString(format[:start])
+
+		atom := format[start+2 : start+end]
+		switch atom {
+		case "objectname":
+			builder.WriteString(hash)
+		case "objecttype":
+			builder.WriteString(objectType)
+		case "objectsize":
+			builder.WriteString(strconv.Itoa(size))
+		case "objectsize:disk":
+			size, _, err := objects.ObjectStorage(hash)
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(strconv.FormatInt(size, 10))
+		case "deltabase":
+			_, base, err := objects.ObjectStorage(hash)
+			if err != nil {
+				return "", err
+			}
+			if base == "" {
+				base = strings.Repeat("0", len(hash))
+			}
+			builder.WriteString(base)
+		case "rest":
+			builder.WriteString(rest)
+		default:
+			return "", fmt.Errorf("unknown format element: %s", atom)
+		}
+		format = format[start+end+1:]
+	}
+}
+
+// The attributes of the working tree, read once for every blob converted
+var textconvAttributes *attributes.Matcher
+
+// textconv converts a blob for display with the textconv command of its
+// diff driver, as chosen by the diff attribute of the path and set by
+// diff.<driver>.textconv. Blobs without such a driver are returned as
+// they are.
+func textconv(path string, data []byte) ([]byte, error) {
+	if textconvAttributes == nil {
+		matcher, err := attributes.NewMatcher()
+		if err != nil {
+			return nil, err
+		}
+		textconvAttributes = matcher
+	}
+
+	driver, ok := textconvAttributes.Get(path, "diff")
+	if !ok || driver == attributes.Set || driver == attributes.Unset {
+		return data, nil
+	}
+	cfg, err := config.Read()
+	if err != nil {
+		return nil, err
+	}
+	command, ok := cfg.Get("diff." + driver + ".textconv")
+	if !ok {
+		return data, nil
+	}
+
+	file, err := ioutil.TempFile("", "mhgit-textconv-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	conversion := exec.Command("sh", "-c", command+` "$@"`, command, file.Name())
+	conversion.Stdout = &output
+	conversion.Stderr = os.Stderr
+	err = conversion.Run()
+	if err != nil {
+		return nil, fmt.Errorf("textconv command '%s' failed: %v", command, err)
 	}
+	return output.Bytes(), nil
 }
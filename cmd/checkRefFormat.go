@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mattherman/mhgit/refs"
+	"github.com/spf13/cobra"
+)
+
+// checkRefFormatCmd represents the check-ref-format command
+var checkRefFormatCmd = &cobra.Command{
+	Use:   "check-ref-format <refname>",
+	Short: "Ensure that a reference name is well formed",
+	Long: `Ensure that a reference name is well formed.
+
+The exit status is zero if the name is valid and one otherwise, so the
+command can be used by scripts. With --normalize or --branch the valid
+name is printed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		if checkRefFormatBranch {
+			if err := refs.CheckBranchName(name); err != nil {
+				fmt.Printf("fatal: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println(name)
+			return
+		}
+
+		if checkRefFormatNormalize {
+			name = refs.NormalizeRefName(name)
+		}
+		if err := refs.CheckRefFormat(name, checkRefFormatOneLevel); err != nil {
+			os.Exit(1)
+		}
+		if checkRefFormatNormalize {
+			fmt.Println(name)
+		}
+	},
+}
+
+var checkRefFormatOneLevel bool
+var checkRefFormatNormalize bool
+var checkRefFormatBranch bool
+
+func init() {
+	rootCmd.AddCommand(checkRefFormatCmd)
+	checkRefFormatCmd.Flags().BoolVar(&checkRefFormatOneLevel, "allow-onelevel", false, "Allow names with a single component, such as HEAD.")
+	checkRefFormatCmd.Flags().BoolVar(&checkRefFormatNormalize, "normalize", false, "Remove leading slashes and repeated slashes, and print the name.")
+	checkRefFormatCmd.Flags().BoolVar(&checkRefFormatBranch, "branch", false, "Check the name as a branch name and print it.")
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/diff"
+	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pathspec"
+	"github.com/spf13/cobra"
+)
+
+// checkoutCmd represents the checkout command
+var checkoutCmd = &cobra.Command{
+	Use:   "checkout [pathspec...]",
+	Short: "Restore working tree files from the index",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && !checkoutPatch {
+			return fmt.Errorf("requires at least 1 arg(s), only received 0")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if checkoutPatch {
+			checkoutPatchHunks(args)
+		} else {
+			checkoutPaths(args)
+		}
+	},
+}
+
+var checkoutPatch bool
+
+func init() {
+	rootCmd.AddCommand(checkoutCmd)
+	checkoutCmd.Flags().BoolVarP(&checkoutPatch, "patch", "p", false, "Interactively choose hunks of the difference between the index and the work tree to discard.")
+}
+
+// checkoutPaths will overwrite the files matched by the pathspec with
+// their content in the index
+func checkoutPaths(args []string) {
+	spec, err := pathspec.Parse(args)
+	if err != nil {
+		fmt.Printf("Failed to parse the pathspec: %v\n", err)
+		return
+	}
+
+	idx, err := index.ReadIndex()
+	if err != nil {
+		fmt.Printf("Could not read index: %v\n", err)
+		return
+	}
+
+	var entries []index.Entry
+	for _, entry := range idx.Entries {
+		if spec.Match(entry.Path) && entry.Stage() == index.StageMerged && !entry.IntentToAdd() {
+			entries = append(entries, entry)
+		}
+	}
+
+	unmatched := spec.Unmatched()
+	if len(unmatched) > 0 {
+		fmt.Printf("Failed to check out files: pathspec '%s' did not match any file(s) known to git\n", unmatched[0])
+		return
+	}
+
+	for _, entry := range entries {
+		var data []byte
+		if entry.Mode != objects.ModeGitlink {
+			data, err = readBlob(entry.Hash)
+		}
+		if err == nil {
+			err = writeWorktreeFile(entry.Path, data, entry.Mode)
+		}
+		if err != nil {
+			fmt.Printf("Failed to check out %s: %v\n", entry.Path, err)
+			return
+		}
+	}
+}
+
+// checkoutPatchHunks lets the user choose which hunks of the changes
+// in the working tree to discard
+func checkoutPatchHunks(args []string) {
+	spec, err := pathspec.Parse(args)
+	if err != nil {
+		fmt.Printf("Failed to parse the pathspec: %v\n", err)
+		return
+	}
+
+	patches, entries, err := worktreePatches(spec)
+	if err != nil {
+		fmt.Printf("Failed to compare the index and working tree: %v\n", err)
+		return
+	}
+	if len(patches) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+
+	// Discarding only changes the working tree, so each file is
+	// written as soon as its hunks have been chosen
+	err = choosePatchHunks(discardPatchMode, patches, func(patch filePatch, chosen []diff.Hunk) error {
+		data, _, err := patch.result(discardPatchMode, chosen)
+		if err != nil {
+			return err
+		}
+		return writeWorktreeFile(patch.path, data, entries[patch.path].Mode)
+	})
+	if err != nil {
+		fmt.Printf("Failed to apply the chosen hunks: %v\n", err)
+	}
+}
+
+// writeWorktreeFile will replace the file in the working tree with the
+// given content, creating any missing directories. The file is created
+// as a symbolic link or executable file depending on the mode.
+func writeWorktreeFile(path string, data []byte, mode int32) error {
+	err := checkWorktreePath(path)
+	if err != nil {
+		return err
+	}
+	if mode == objects.ModeGitlink {
+		// The nested repository itself is not checked out
+		return os.MkdirAll(path, 0755)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Replacing the file rather than writing into it lets a change of
+	// file type or permissions take effect
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if mode == objects.ModeSymlink && symlinksSupported() {
+		return os.Symlink(string(data), path)
+	}
+
+	perm := os.FileMode(0644)
+	if mode == objects.ModeExecutable {
+		perm = 0755
+	}
+	return ioutil.WriteFile(path, data, perm)
+}
+
+// checkWorktreePath returns an error if writing the path of the working
+// tree could leave it, through a component such as ".." or ".git" or a
+// directory that is a symbolic link
+func checkWorktreePath(path string) error {
+	slashed := filepath.ToSlash(path)
+	err := objects.CheckPath(slashed)
+	if err != nil {
+		return err
+	}
+	components := strings.Split(slashed, "/")
+	for i := 1; i < len(components); i++ {
+		dir := filepath.FromSlash(strings.Join(components[:i], "/"))
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("'%s' is beyond a symbolic link", path)
+		}
+	}
+	return nil
+}
+
+// symlinksSupported returns false if core.symlinks is disabled, in which
+// case symbolic links are checked out as files containing their target
+func symlinksSupported() bool {
+	cfg, err := config.Read()
+	if err != nil {
+		return true
+	}
+	symlinks, err := cfg.Bool("core.symlinks", true)
+	return err != nil || symlinks
+}
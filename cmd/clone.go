@@ -0,0 +1,598 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pathspec"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/transport"
+	"github.com/spf13/cobra"
+)
+
+// The name given to the repository a clone was made from
+const cloneRemoteName = "origin"
+
+// cloneCmd represents the clone command
+var cloneCmd = &cobra.Command{
+	Use:   "clone [--bare | --mirror] [--branch <name>] [--depth <depth>] [--no-hardlinks] [-q] <repository> [<directory>]",
+	Short: "Clone a repository into a new directory",
+	Long: `Clone a repository on the local file system, given by its path or a
+file:// URL, into a new directory.
+
+The objects of the repository are hard linked where possible, or copied.
+Its branches become the remote-tracking branches of the remote "origin"
+and its default branch, or the one given with --branch, is checked out.
+
+--bare makes a repository without a working tree whose branches are the
+branches of the original. --mirror is the same as --bare, but copies
+every ref and configures origin to overwrite them all when fetching.
+--depth only copies the history that many commits deep, of the branch
+being checked out and the tags pointing into it.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		directory := ""
+		if len(args) > 1 {
+			directory = args[1]
+		}
+		err := clone(args[0], directory)
+		if err != nil {
+			fmt.Printf("Failed to clone: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var cloneBare bool
+var cloneMirror bool
+var cloneBranch string
+var cloneDepth int
+var cloneNoHardlinks bool
+var cloneQuiet bool
+
+func init() {
+	rootCmd.AddCommand(cloneCmd)
+	cloneCmd.Flags().BoolVar(&cloneBare, "bare", false, "Make a bare repository, without a working tree or remote-tracking branches.")
+	cloneCmd.Flags().BoolVar(&cloneMirror, "mirror", false, "Make a bare repository with a copy of every ref, which fetching keeps up to date.")
+	cloneCmd.Flags().StringVarP(&cloneBranch, "branch", "b", "", "Check out the branch, or the commit of the tag, instead of the default branch.")
+	cloneCmd.Flags().IntVar(&cloneDepth, "depth", 0, "Only copy the history this many commits deep.")
+	cloneCmd.Flags().BoolVar(&cloneNoHardlinks, "no-hardlinks", false, "Copy the objects instead of hard linking them.")
+	cloneCmd.Flags().BoolVarP(&cloneQuiet, "quiet", "q", false, "Do not report progress.")
+}
+
+// cloneSource describes the repository being cloned
+type cloneSource struct {
+	url    string
+	gitDir string
+	refs   []refs.Ref
+	head   refs.Ref
+}
+
+func clone(repository string, directory string) error {
+	if cloneDepth < 0 {
+		return fmt.Errorf("depth %d is not a positive number", cloneDepth)
+	}
+	bare := cloneBare || cloneMirror
+
+	source, err := openCloneSource(repository)
+	if err != nil {
+		return err
+	}
+
+	if directory == "" {
+		directory = cloneDirectoryName(source.url, bare)
+	}
+	entries, err := ioutil.ReadDir(directory)
+	if err == nil && len(entries) > 0 || err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("destination path '%s' already exists and is not an empty directory", directory)
+	}
+	created := os.IsNotExist(err)
+
+	if !cloneQuiet {
+		if bare {
+			fmt.Printf("Cloning into bare repository '%s'...\n", directory)
+		} else {
+			fmt.Printf("Cloning into '%s'...\n", directory)
+		}
+	}
+
+	err = os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	err = cloneInto(source, directory, bare)
+	if err != nil {
+		// Whatever was cloned so far is useless
+		if created {
+			os.RemoveAll(directory)
+		} else {
+			entries, _ := ioutil.ReadDir(directory)
+			for _, entry := range entries {
+				os.RemoveAll(filepath.Join(directory, entry.Name()))
+			}
+		}
+	}
+	return err
+}
+
+// openCloneSource reads the refs of the repository at the path or file://
+// URL, which is either a working tree or a bare repository
+func openCloneSource(repository string) (*cloneSource, error) {
+	local, ok := transport.LocalPath(repository)
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol in '%s'", repository)
+	}
+	path, err := filepath.Abs(local)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &cloneSource{url: path}
+	source.gitDir, err = transport.FindRepository(path)
+	if err != nil {
+		return nil, fmt.Errorf("repository '%s' does not exist", repository)
+	}
+
+	gitdir.Set(source.gitDir)
+	source.refs, err = refs.IterRefs("refs/")
+	if err != nil {
+		return nil, err
+	}
+	source.head, err = refs.ReadRef("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// cloneDirectoryName returns the directory a repository is cloned into
+// when none is given, which is its name without ".git", or with it for
+// a bare clone
+func cloneDirectoryName(url string, bare bool) string {
+	name := filepath.Base(strings.TrimSuffix(filepath.Clean(url), string(filepath.Separator)+".git"))
+	name = strings.TrimSuffix(name, ".git")
+	if bare {
+		name += ".git"
+	}
+	return name
+}
+
+// cloneInto makes the directory a clone of the source. The current
+// repository is the source when called, and the clone afterwards.
+func cloneInto(source *cloneSource, directory string, bare bool) error {
+	path, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+	gitDir := path
+	if !bare {
+		gitDir = filepath.Join(path, ".git")
+	}
+
+	checkout, err := source.checkoutRef()
+	if err != nil {
+		return err
+	}
+	cloned := source.refs
+	if cloneDepth > 0 && !cloneMirror {
+		cloned = source.singleBranch(checkout)
+	}
+
+	err = createInitialDirectoriesAndFiles(gitDir)
+	if err != nil {
+		return err
+	}
+
+	// The objects are copied while the source is still the current
+	// repository, since reading them is needed to limit the depth
+	var shallow []string
+	if cloneDepth > 0 {
+		cloned, shallow, err = copyShallowHistory(cloned, checkout, gitDir)
+	} else {
+		err = copyObjectFiles(filepath.Join(source.gitDir, "objects"), filepath.Join(gitDir, "objects"), !cloneNoHardlinks)
+		if err == nil {
+			shallow, err = readShallowList()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	gitdir.Set(gitDir)
+	err = objects.WriteShallow(shallow)
+	if err != nil {
+		return err
+	}
+	err = configureClone(source, bare, checkout)
+	if err != nil {
+		return err
+	}
+	err = writeClonedRefs(source, cloned, bare, checkout)
+	if err != nil {
+		return err
+	}
+
+	if len(source.refs) == 0 {
+		fmt.Println("warning: You appear to have cloned an empty repository.")
+	}
+	if bare || (checkout == "" && source.head.Symbolic()) {
+		return nil
+	}
+
+	err = os.Chdir(path)
+	if err != nil {
+		return err
+	}
+	gitdir.Set(".git")
+	return checkoutClone()
+}
+
+// checkoutRef returns the ref of the source that is checked out by the
+// clone, which is a branch or, for --branch, possibly a tag. It is empty
+// when the source has no commits yet or HEAD is detached.
+func (s *cloneSource) checkoutRef() (string, error) {
+	if cloneBranch == "" {
+		if s.head.Symbolic() && s.find(s.head.Target) != nil {
+			return s.head.Target, nil
+		}
+		return "", nil
+	}
+
+	for _, name := range []string{"refs/heads/" + cloneBranch, "refs/tags/" + cloneBranch} {
+		if s.find(name) != nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("remote branch %s not found in upstream %s", cloneBranch, cloneRemoteName)
+}
+
+func (s *cloneSource) find(name string) *refs.Ref {
+	for i := range s.refs {
+		if s.refs[i].Name == name {
+			return &s.refs[i]
+		}
+	}
+	return nil
+}
+
+// singleBranch returns the refs that are cloned when only the history of
+// one branch is, which are the branch and the tags. Tags pointing outside
+// of the history are removed once it is known.
+func (s *cloneSource) singleBranch(checkout string) []refs.Ref {
+	if checkout == "" && !s.head.Symbolic() {
+		checkout = "HEAD"
+	}
+
+	var selected []refs.Ref
+	for _, ref := range s.refs {
+		if ref.Name == checkout || strings.HasPrefix(ref.Name, "refs/tags/") {
+			selected = append(selected, ref)
+		}
+	}
+	if checkout == "HEAD" {
+		selected = append(selected, s.head)
+	}
+	return selected
+}
+
+// copyShallowHistory writes the history of the refs up to --depth into a
+// pack of the clone. The refs whose objects were copied are returned,
+// along with the commits at the edge of the copied history.
+func copyShallowHistory(cloned []refs.Ref, checkout string, gitDir string) ([]refs.Ref, []string, error) {
+	var tips []string
+	for _, ref := range cloned {
+		if !strings.HasPrefix(ref.Name, "refs/tags/") || ref.Name == checkout {
+			commit, _, err := peelToCommit(ref.Hash)
+			if err != nil {
+				return nil, nil, err
+			}
+			tips = append(tips, commit)
+		}
+	}
+
+	commits, shallow, err := objects.History(tips, cloneDepth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Tags are walked separately, as walking the commits they point to
+	// would go past the edge of the history
+	hashes := make(map[string]bool)
+	var kept []refs.Ref
+	for _, ref := range cloned {
+		commit, tags, err := peelToCommit(ref.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Like git, tags are only copied if they point into the history
+		if !commits[commit] {
+			continue
+		}
+		for _, tag := range tags {
+			hashes[tag] = true
+		}
+		kept = append(kept, ref)
+	}
+
+	var trees []string
+	for commit := range commits {
+		parsed, err := objects.ReadCommit(commit)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[commit] = true
+		trees = append(trees, parsed.Tree)
+	}
+	reachable, err := objects.Reachable(trees)
+	if err != nil {
+		return nil, nil, err
+	}
+	for hash := range reachable {
+		hashes[hash] = true
+	}
+
+	var list []string
+	for hash := range hashes {
+		list = append(list, hash)
+	}
+	_, err = objects.WritePackTo(gitDir, list)
+	return kept, shallow, err
+}
+
+// peelToCommit follows tags until reaching a commit, returning the
+// commit and the tags on the way
+func peelToCommit(hash string) (string, []string, error) {
+	var tags []string
+	for {
+		obj, err := objects.ReadObject(hash)
+		if err != nil {
+			return "", nil, err
+		}
+		switch obj.Type() {
+		case "commit":
+			return hash, tags, nil
+		case "tag":
+			tag, err := objects.ParseTag(obj.Data)
+			if err != nil {
+				return "", nil, err
+			}
+			tags = append(tags, hash)
+			hash = tag.Object
+		default:
+			return "", nil, fmt.Errorf("%s is a %s, not a commit", hash, obj.Type())
+		}
+	}
+}
+
+// copyObjectFiles copies the object directory of the source into the
+// clone, hard linking the files where possible since objects and packs
+// are never modified
+func copyObjectFiles(source string, destination string, link bool) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		case rel == filepath.Join("info", "alternates") || strings.HasPrefix(info.Name(), "tmp_"):
+			return nil
+		}
+		if link && os.Link(path, target) == nil {
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(source string, destination string, perm os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readShallowList returns the edge of the history of a shallow source,
+// which stays the edge of the clone
+func readShallowList() ([]string, error) {
+	shallow, err := objects.ReadShallow()
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for hash := range shallow {
+		list = append(list, hash)
+	}
+	return list, nil
+}
+
+// configureClone records where the clone came from and which branch of
+// it the checked out branch follows
+func configureClone(source *cloneSource, bare bool, checkout string) error {
+	settings := [][2]string{
+		{"core.repositoryformatversion", "0"},
+		{"core.bare", fmt.Sprint(bare)},
+	}
+	if !bare {
+		settings = append(settings, [2]string{"core.logallrefupdates", "true"})
+	}
+
+	remote := "remote." + cloneRemoteName
+	settings = append(settings, [2]string{remote + ".url", source.url})
+	switch {
+	case cloneMirror:
+		settings = append(settings, [2]string{remote + ".fetch", "+refs/*:refs/*"}, [2]string{remote + ".mirror", "true"})
+	case bare:
+	case cloneDepth > 0 && strings.HasPrefix(checkout, "refs/heads/"):
+		branch := strings.TrimPrefix(checkout, "refs/heads/")
+		settings = append(settings, [2]string{remote + ".fetch", "+" + checkout + ":" + remoteTrackingRef(branch)})
+	default:
+		settings = append(settings, [2]string{remote + ".fetch", "+refs/heads/*:" + remoteTrackingRef("*")})
+	}
+
+	if !bare && strings.HasPrefix(checkout, "refs/heads/") {
+		branch := strings.TrimPrefix(checkout, "refs/heads/")
+		settings = append(settings,
+			[2]string{"branch." + branch + ".remote", cloneRemoteName},
+			[2]string{"branch." + branch + ".merge", checkout})
+	}
+
+	for _, setting := range settings {
+		err := config.Set(setting[0], setting[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func remoteTrackingRef(branch string) string {
+	return "refs/remotes/" + cloneRemoteName + "/" + branch
+}
+
+// clonedRefName returns the name a ref of the source gets in the clone,
+// or an empty string if it is not cloned. Branches become
+// remote-tracking branches unless the clone is bare.
+func clonedRefName(name string, bare bool) string {
+	switch {
+	case cloneMirror:
+		return name
+	case strings.HasPrefix(name, "refs/tags/"):
+		return name
+	case strings.HasPrefix(name, "refs/heads/") && bare:
+		return name
+	case strings.HasPrefix(name, "refs/heads/"):
+		return remoteTrackingRef(strings.TrimPrefix(name, "refs/heads/"))
+	}
+	return ""
+}
+
+// writeClonedRefs creates the refs of the clone and points HEAD at the
+// checked out branch, or at its commit when a tag is checked out
+func writeClonedRefs(source *cloneSource, cloned []refs.Ref, bare bool, checkout string) error {
+	message := "clone: from " + source.url
+
+	// HEAD is set first, so that creating the branch is logged for it
+	var err error
+	switch {
+	case strings.HasPrefix(checkout, "refs/heads/"):
+		err = refs.UpdateSymbolicRef("HEAD", checkout, "")
+	case checkout != "":
+		commit, _, peelErr := peelToCommit(source.find(checkout).Hash)
+		if peelErr != nil {
+			return peelErr
+		}
+		err = refs.DetachHead(commit, message)
+	case source.head.Symbolic():
+		// The default branch of a repository without commits
+		err = refs.UpdateSymbolicRef("HEAD", source.head.Target, "")
+	default:
+		err = refs.DetachHead(source.head.Hash, message)
+	}
+	if err != nil {
+		return err
+	}
+
+	transaction := refs.NewTransaction()
+	created := make(map[string]bool)
+	for _, ref := range cloned {
+		name := clonedRefName(ref.Name, bare)
+		if name == "" || created[name] {
+			continue
+		}
+		err = transaction.Create(name, ref.Hash, message, true)
+		if err != nil {
+			return err
+		}
+		created[name] = true
+	}
+	if !bare && strings.HasPrefix(checkout, "refs/heads/") {
+		err = transaction.Create(checkout, source.find(checkout).Hash, message, false)
+		if err != nil {
+			return err
+		}
+	}
+	err = transaction.Commit()
+	if err != nil {
+		return err
+	}
+
+	if !bare && source.head.Symbolic() {
+		head := clonedRefName(source.head.Target, bare)
+		if created[head] {
+			return refs.UpdateSymbolicRef(remoteTrackingRef("HEAD"), head, "")
+		}
+	}
+	return nil
+}
+
+// checkoutClone writes the files of the commit of HEAD into the working
+// tree and the index of a new clone
+func checkoutClone() error {
+	entries, err := commitEntries("HEAD")
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		entry := entries[path]
+		var data []byte
+		if parseMode(entry.Mode) != objects.ModeGitlink {
+			data, err = readBlob(entry.Hash)
+			if err != nil {
+				return err
+			}
+		}
+		err = writeWorktreeFile(path, data, parseMode(entry.Mode))
+		if err != nil {
+			return err
+		}
+	}
+
+	spec, err := pathspec.Parse(nil)
+	if err != nil {
+		return err
+	}
+	err = resetIndex(spec, entries)
+	if err != nil {
+		return err
+	}
+
+	// The stat information of the new files is recorded, so they are not
+	// all hashed again by the next status
+	ctx, cancel := commandContext()
+	defer cancel()
+	_, _, err = index.Refresh(ctx)
+	return err
+}
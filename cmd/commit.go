@@ -2,8 +2,9 @@ package cmd
 
 import (
 	"fmt"
-	"time"
+	"strings"
 
+	"github.com/mattherman/mhgit/ident"
 	"github.com/mattherman/mhgit/objects"
 	"github.com/mattherman/mhgit/refs"
 	"github.com/spf13/cobra"
@@ -35,29 +36,42 @@ func commit(message string) error {
 		return err
 	}
 
-	// TODO please god fix this...if can't find the file must be first commit hahaha i hate myself
-	latestCommit, _ := refs.LatestCommit()
-	parent := ""
-	if latestCommit != "" {
-		parent = fmt.Sprintf("parent %s\n", latestCommit)
+	// The first commit on a branch does not have a parent
+	var parents []string
+	reason := "commit"
+	latestCommit, err := refs.LatestCommit()
+	if err == nil {
+		parents = append(parents, latestCommit)
+	} else if err == refs.ErrUnbornBranch {
+		reason = "commit (initial)"
+	} else {
+		return err
 	}
 
-	time := time.Now()
-	unixTimestamp := int32(time.Unix())
-	_, timeZoneOffset := time.Zone()
-	formattedTimeZoneOffset := fmt.Sprintf("%03d00", timeZoneOffset/60/60)
+	author, err := ident.Author()
+	if err != nil {
+		return err
+	}
+	committer, err := ident.Committer()
+	if err != nil {
+		return err
+	}
 
-	// TODO do not hardcode name/email
-	author := fmt.Sprintf("Matthew Herman <mattherman11@gmail.com> %d %s", unixTimestamp, formattedTimeZoneOffset)
-	fullCommit := fmt.Sprintf("tree %s\n%sauthor %s\ncommitter %s\n\n%s\n", treeHash, parent, author, author, message)
-	fullCommitBytes := []byte(fullCommit)
+	fullCommit := objects.Commit{
+		Tree:      treeHash,
+		Parents:   parents,
+		Author:    author.String(),
+		Committer: committer.String(),
+		Message:   message + "\n",
+	}
 
-	obj := objects.Object{ObjectType: "commit", Data: fullCommitBytes}
+	obj := objects.Object{ObjectType: "commit", Data: fullCommit.Data()}
 	hash, err := objects.HashObject(obj, true)
 	if err != nil {
 		return err
 	}
 
-	err = refs.UpdateLatestCommit(hash)
+	subject := strings.SplitN(message, "\n", 2)[0]
+	err = refs.UpdateLatestCommit(hash, fmt.Sprintf("%s: %s", reason, subject))
 	return err
 }
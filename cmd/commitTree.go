@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/spf13/cobra"
+)
+
+// commitTreeCmd represents the commit-tree command
+var commitTreeCmd = &cobra.Command{
+	Use:   "commit-tree <tree> [-p <parent>]... [-m <message>]... [-F <file>]...",
+	Short: "Create a new commit object",
+	Long: `Create a new commit object for the tree and print its hash. No ref
+is updated.
+
+Each -m or -F gives a paragraph of the message. Without either, the
+message is read from the standard input.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		hash, err := commitTree(args[0])
+		if err != nil {
+			fmt.Printf("Failed to create the commit: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+	},
+}
+
+var commitTreeParents []string
+var commitTreeMessages []string
+var commitTreeMessageFiles []string
+
+func init() {
+	rootCmd.AddCommand(commitTreeCmd)
+	commitTreeCmd.Flags().StringArrayVarP(&commitTreeParents, "parent", "p", nil, "Add the commit as a parent. Can be given more than once.")
+	commitTreeCmd.Flags().StringArrayVarP(&commitTreeMessages, "message", "m", nil, "Use the paragraph in the commit message. Can be given more than once.")
+	commitTreeCmd.Flags().StringArrayVarP(&commitTreeMessageFiles, "file", "F", nil, "Read a paragraph of the commit message from the file, or the standard input if it is '-'.")
+}
+
+func commitTree(treeName string) (string, error) {
+	tree, err := revision.Resolve(treeName)
+	if err != nil {
+		return "", fmt.Errorf("not a valid object name %s", treeName)
+	}
+	obj, err := objects.ReadObject(tree)
+	if err != nil {
+		return "", err
+	}
+	if obj.Type() != "tree" {
+		return "", fmt.Errorf("%s is not a valid 'tree' object", tree)
+	}
+
+	var parents []string
+	seen := make(map[string]bool)
+	for _, name := range commitTreeParents {
+		parent, err := revision.ResolveCommit(name)
+		if err != nil {
+			return "", fmt.Errorf("not a valid object name %s", name)
+		}
+		if seen[parent] {
+			fmt.Printf("Ignoring duplicate parent %s\n", parent)
+			continue
+		}
+		seen[parent] = true
+		parents = append(parents, parent)
+	}
+
+	message, err := commitTreeMessage()
+	if err != nil {
+		return "", err
+	}
+
+	author, err := ident.Author()
+	if err != nil {
+		return "", err
+	}
+	committer, err := ident.Committer()
+	if err != nil {
+		return "", err
+	}
+
+	commit := objects.Commit{
+		Tree:      tree,
+		Parents:   parents,
+		Author:    author.String(),
+		Committer: committer.String(),
+		Message:   message,
+	}
+	return objects.HashObject(objects.Object{ObjectType: "commit", Data: commit.Data()}, true)
+}
+
+// commitTreeMessage joins the paragraphs given by -m and -F, or reads
+// the message from the standard input if there are none
+func commitTreeMessage() (string, error) {
+	if len(commitTreeMessages) == 0 && len(commitTreeMessageFiles) == 0 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		return string(data), err
+	}
+
+	var paragraphs []string
+	for _, message := range commitTreeMessages {
+		paragraphs = append(paragraphs, strings.TrimSuffix(message, "\n")+"\n")
+	}
+	for _, filename := range commitTreeMessageFiles {
+		var data []byte
+		var err error
+		if filename == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(filename)
+		}
+		if err != nil {
+			return "", err
+		}
+		paragraphs = append(paragraphs, string(data))
+	}
+	return strings.Join(paragraphs, "\n"), nil
+}
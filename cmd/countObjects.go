@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/spf13/cobra"
+)
+
+// countObjectsCmd represents the count-objects command
+var countObjectsCmd = &cobra.Command{
+	Use:   "count-objects [-v] [-H]",
+	Short: "Count unpacked number of objects and their disk consumption",
+	Long: `Count the loose objects of the repository and the space they take.
+
+With -v the packs are counted as well, along with the loose objects
+that are already packed and could be removed by prune, and the files in
+the object directories which are not objects or packs.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		counts, err := countObjects()
+		if err != nil {
+			fmt.Printf("Failed to count objects: %v\n", err)
+			os.Exit(1)
+		}
+
+		if !countObjectsVerbose {
+			fmt.Printf("%d objects, %s\n", counts.count, formatObjectsSize(counts.size, "kilobytes"))
+			return
+		}
+		fmt.Printf("count: %d\n", counts.count)
+		fmt.Printf("size: %s\n", formatObjectsSize(counts.size, ""))
+		fmt.Printf("in-pack: %d\n", counts.inPack)
+		fmt.Printf("packs: %d\n", counts.packs)
+		fmt.Printf("size-pack: %s\n", formatObjectsSize(counts.sizePack, ""))
+		fmt.Printf("prune-packable: %d\n", counts.prunePackable)
+		fmt.Printf("garbage: %d\n", counts.garbage)
+		fmt.Printf("size-garbage: %s\n", formatObjectsSize(counts.sizeGarbage, ""))
+	},
+}
+
+var countObjectsVerbose bool
+var countObjectsHuman bool
+
+func init() {
+	rootCmd.AddCommand(countObjectsCmd)
+	countObjectsCmd.Flags().BoolVarP(&countObjectsVerbose, "verbose", "v", false, "Also report the packs, prunable objects and garbage files.")
+	countObjectsCmd.Flags().BoolVarP(&countObjectsHuman, "human-readable", "H", false, "Print sizes in human readable units.")
+}
+
+// objectCounts holds the number of objects and files of each kind in
+// the object directory, with sizes in bytes
+type objectCounts struct {
+	count         int
+	size          int64
+	inPack        int
+	packs         int
+	sizePack      int64
+	prunePackable int
+	garbage       int
+	sizeGarbage   int64
+}
+
+func countObjects() (objectCounts, error) {
+	var counts objectCounts
+
+	dirs, err := filepath.Glob(gitdir.Path("objects", "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return counts, err
+	}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return counts, err
+		}
+		for _, file := range files {
+			hash := filepath.Base(dir) + file.Name()
+			if _, err := hex.DecodeString(hash); err != nil || len(hash) != 40 || file.IsDir() {
+				counts.garbage++
+				counts.sizeGarbage += diskUsage(file)
+				continue
+			}
+			counts.count++
+			counts.size += diskUsage(file)
+			if objects.IsPacked(hash) {
+				counts.prunePackable++
+			}
+		}
+	}
+
+	packs, err := objects.Packs()
+	if err != nil {
+		return counts, err
+	}
+	for _, pack := range packs {
+		counts.packs++
+		counts.inPack += pack.Objects
+		counts.sizePack += pack.Size
+	}
+
+	garbage, err := packGarbage()
+	if err != nil {
+		return counts, err
+	}
+	for _, file := range garbage {
+		counts.garbage++
+		counts.sizeGarbage += diskUsage(file)
+	}
+	return counts, nil
+}
+
+// diskUsage returns the space the file takes on disk, which is more
+// than its size when the file system allocates whole blocks
+func diskUsage(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
+
+// packGarbage returns the files of the pack directory which are not a
+// pack with its index or a file belonging to one
+func packGarbage() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(gitdir.Path("objects", "pack"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[string]bool)
+	for _, file := range files {
+		present[file.Name()] = true
+	}
+
+	var garbage []os.FileInfo
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		base := strings.TrimSuffix(file.Name(), ext)
+		switch ext {
+		case ".pack":
+			if present[base+".idx"] {
+				continue
+			}
+		case ".idx", ".keep", ".bitmap", ".rev", ".promisor", ".mtimes":
+			if present[base+".pack"] {
+				continue
+			}
+		}
+		garbage = append(garbage, file)
+	}
+	return garbage, nil
+}
+
+// formatObjectsSize prints a size in bytes as kibibytes, or in the most
+// suitable unit with -H. The unit is only named for plain kibibytes if
+// one is given.
+func formatObjectsSize(size int64, unit string) string {
+	if !countObjectsHuman {
+		if unit == "" {
+			return fmt.Sprintf("%d", size/1024)
+		}
+		return fmt.Sprintf("%d %s", size/1024, unit)
+	}
+
+	for _, u := range []struct {
+		name  string
+		bytes int64
+	}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}} {
+		if size > u.bytes {
+			whole := size / u.bytes
+			fraction := (size % u.bytes) * 100 / u.bytes
+			return fmt.Sprintf("%d.%02d %s", whole, fraction, u.name)
+		}
+	}
+	if size == 1 {
+		return "1 byte"
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
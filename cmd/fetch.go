@@ -0,0 +1,613 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/remote"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/mattherman/mhgit/transport"
+	"github.com/spf13/cobra"
+)
+
+// The width of the summary column of the refs reported by fetch and push
+const refSummaryWidth = 17
+
+// The refspec fetching every tag, used by --tags
+const fetchTagsRefspec = "refs/tags/*:refs/tags/*"
+
+// fetchCmd represents the fetch command
+var fetchCmd = &cobra.Command{
+	Use:   "fetch [--prune] [--tags | --no-tags] [-f] [-q] [--upload-pack <program>] [<repository> [<refspec>...]]",
+	Short: "Download objects and refs from another repository",
+	Long: `Fetch the refs of another repository along with the objects they need.
+
+The repository is a configured remote, by default the remote of the
+current branch or "origin", or a path or file:// URL. The refs fetched
+and where they are stored are given by the fetch refspecs of the remote,
+unless refspecs are given. Refs fetched with a refspec without a
+destination, and HEAD when there are no refspecs, are only written to
+FETCH_HEAD along with everything else fetched.
+
+A ref is only updated when the update is a fast-forward, unless the
+refspec starts with '+' or --force is given. Tags pointing into the
+fetched history are fetched as well, unless --no-tags is given or the
+remote sets tagOpt to "--no-tags". --tags fetches every tag. --prune
+deletes the remote-tracking refs whose refs no longer exist on the
+remote, as do fetch.prune and remote.<name>.prune.
+
+The objects are sent by upload-pack in the repository, or the program
+given with --upload-pack or remote.<name>.uploadpack.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := fetch(args)
+		if err != nil {
+			fmt.Printf("Failed to fetch: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var fetchPrune bool
+var fetchTags bool
+var fetchNoTags bool
+var fetchForce bool
+var fetchQuiet bool
+var fetchUploadPack string
+
+func init() {
+	rootCmd.AddCommand(fetchCmd)
+	fetchCmd.Flags().BoolVarP(&fetchPrune, "prune", "p", false, "Delete the remote-tracking refs whose refs no longer exist on the remote.")
+	fetchCmd.Flags().BoolVarP(&fetchTags, "tags", "t", false, "Fetch every tag of the remote.")
+	fetchCmd.Flags().BoolVarP(&fetchNoTags, "no-tags", "n", false, "Do not fetch the tags pointing into the fetched history.")
+	fetchCmd.Flags().BoolVarP(&fetchForce, "force", "f", false, "Update refs even when the update is not a fast-forward.")
+	fetchCmd.Flags().BoolVarP(&fetchQuiet, "quiet", "q", false, "Only report errors.")
+	fetchCmd.Flags().StringVar(&fetchUploadPack, "upload-pack", "", "The program run for the remote repository.")
+}
+
+// fetchedRef is a ref of the remote that was fetched, along with the
+// local ref it is stored in, if any
+type fetchedRef struct {
+	remoteName string
+	hash       string
+	localName  string
+	force      bool
+	forMerge   bool
+}
+
+// refStatus is the line reporting what happened to a ref
+type refStatus struct {
+	code    byte
+	summary string
+	from    string
+	to      string
+	reason  string
+}
+
+func fetch(args []string) error {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	} else {
+		name = defaultRemoteName()
+	}
+
+	r, err := remote.Get(name)
+	if err == remote.ErrNotFound {
+		if len(args) == 0 || !transport.Supported(name) {
+			return fmt.Errorf("'%s' does not appear to be a git repository", name)
+		}
+		// A URL fetches nothing into remote-tracking refs
+		r, err = &remote.Remote{URLs: []string{name}}, nil
+	}
+	if err != nil {
+		return err
+	}
+	url := r.URL()
+	if url == "" {
+		return fmt.Errorf("no URL configured for remote '%s'", name)
+	}
+
+	refspecs := r.Fetch
+	fromCommandLine := len(args) > 1
+	if fromCommandLine {
+		refspecs, err = remote.ParseRefspecs(args[1:], true)
+		if err != nil {
+			return err
+		}
+	}
+	tagOpt := r.TagOpt
+	if fetchTags {
+		tagOpt = "--tags"
+	} else if fetchNoTags {
+		tagOpt = "--no-tags"
+	}
+	if tagOpt == "--tags" {
+		tagsRefspec, _ := remote.ParseRefspec(fetchTagsRefspec, true)
+		refspecs = append(refspecs, tagsRefspec)
+	}
+
+	program := fetchUploadPack
+	if program == "" {
+		program = r.UploadPack
+	}
+	conn, err := transport.Connect(url, transport.UploadPackService, program)
+	if err != nil {
+		return err
+	}
+
+	fetched, err := planFetch(conn, r, refspecs, fromCommandLine)
+	if err != nil {
+		conn.End()
+		return err
+	}
+	err = checkCurrentBranchFetch(fetched)
+	if err != nil {
+		conn.End()
+		return err
+	}
+
+	var wants []string
+	wanted := make(map[string]bool)
+	for _, ref := range fetched {
+		if !wanted[ref.hash] && !objects.Exists(ref.hash) {
+			wanted[ref.hash] = true
+			wants = append(wants, ref.hash)
+		}
+	}
+	followTags := tagOpt == "" && storesRefs(fetched)
+	if len(wants) == 0 {
+		err = conn.End()
+	} else {
+		var progress io.Writer
+		if !fetchQuiet {
+			progress = &remoteProgress{w: os.Stderr, lineStart: true}
+		}
+		_, err = conn.Fetch(wants, followTags, progress)
+	}
+	if err != nil {
+		return err
+	}
+	if followTags {
+		fetched = append(fetched, followedTags(conn.Refs, fetched)...)
+	}
+
+	var statuses []refStatus
+	prune := fetchPrune
+	if !prune && r.Name != "" && !fromCommandLine {
+		prune, err = pruneConfigured(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if prune && r.Name != "" {
+		statuses, err = pruneFetched(r, conn.Refs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The credential of a URL is kept out of what is written down
+	var shown []string
+	for _, arg := range args {
+		shown = append(shown, transport.DisplayURL(arg))
+	}
+	message := strings.TrimSpace("fetch " + strings.Join(shown, " "))
+	updated, rejected := updateFetchedRefs(fetched, message)
+	statuses = append(statuses, updated...)
+	err = writeFetchHead(fetched, transport.DisplayURL(url))
+	if err != nil {
+		return err
+	}
+
+	if !fetchQuiet && len(statuses) > 0 {
+		fmt.Printf("From %s\n", transport.DisplayURL(url))
+		printRefStatuses(statuses)
+	}
+	if rejected {
+		return errors.New("some local refs could not be updated")
+	}
+	return nil
+}
+
+// defaultRemoteName returns the remote of the current branch, or
+// "origin" when it has none
+func defaultRemoteName() string {
+	branch, err := refs.CurrentBranch()
+	if err == nil && branch != "" {
+		if cfg, err := config.Read(); err == nil {
+			if name, ok := cfg.Get("branch." + branch + ".remote"); ok && name != "." {
+				return name
+			}
+		}
+	}
+	return cloneRemoteName
+}
+
+// planFetch returns the refs of the remote that the refspecs fetch and
+// where they are stored. Without refspecs, HEAD is fetched.
+func planFetch(conn *transport.Conn, r *remote.Remote, refspecs []remote.Refspec, fromCommandLine bool) ([]*fetchedRef, error) {
+	var fetched []*fetchedRef
+	planned := make(map[string]*fetchedRef)
+	add := func(name string, hash string) *fetchedRef {
+		if ref, ok := planned[name]; ok {
+			return ref
+		}
+		ref := &fetchedRef{remoteName: name, hash: hash}
+		planned[name] = ref
+		fetched = append(fetched, ref)
+		return ref
+	}
+
+	positive := 0
+	for _, refspec := range refspecs {
+		if refspec.Negative {
+			continue
+		}
+		positive++
+
+		if refspec.Pattern {
+			for _, ref := range conn.Refs {
+				destination, ok := refspec.Map(ref.Name)
+				if !ok || remote.Excluded(refspecs, ref.Name) {
+					continue
+				}
+				fetchedRef := add(ref.Name, ref.Hash)
+				if fetchedRef.localName == "" {
+					fetchedRef.localName, fetchedRef.force = destination, refspec.Force
+				}
+			}
+			continue
+		}
+
+		ref, ok := findRemoteRef(conn, refspec.Source)
+		if !ok {
+			return nil, fmt.Errorf("couldn't find remote ref %s", refspec.Source)
+		}
+		fetchedRef := add(ref.Name, ref.Hash)
+		fetchedRef.forMerge = fromCommandLine
+		if refspec.Destination != "" {
+			fetchedRef.localName = fetchDestination(refspec.Destination, ref.Name)
+			fetchedRef.force = refspec.Force
+		}
+	}
+	if positive == 0 {
+		ref, ok := findRemoteRef(conn, "HEAD")
+		if !ok {
+			return nil, errors.New("couldn't find remote ref HEAD")
+		}
+		add(ref.Name, ref.Hash).forMerge = true
+	}
+
+	if r.Name == "" {
+		return fetched, nil
+	}
+	if fromCommandLine {
+		// The remote-tracking refs of what was asked for are updated too
+		for _, ref := range fetched {
+			if destination, force, ok := remote.MapRef(r.Fetch, ref.remoteName); ok && ref.localName == "" {
+				ref.localName, ref.force = destination, force
+			}
+		}
+	} else {
+		markMergeRefs(fetched, r.Name)
+	}
+	return fetched, nil
+}
+
+// findRemoteRef finds the ref of the remote a refspec names, which may
+// be a shortened name such as "main", or a full hash
+func findRemoteRef(conn *transport.Conn, name string) (refs.Ref, bool) {
+	if name == "HEAD" || name == "" {
+		return conn.Head, conn.Head.Hash != ""
+	}
+	for _, candidate := range []string{name, "refs/" + name, "refs/tags/" + name, "refs/heads/" + name, "refs/remotes/" + name} {
+		for _, ref := range conn.Refs {
+			if ref.Name == candidate {
+				return ref, true
+			}
+		}
+	}
+	if len(name) == len(refs.ZeroHash) && isHex(name) {
+		return refs.Ref{Name: name, Hash: name}, true
+	}
+	return refs.Ref{}, false
+}
+
+// fetchDestination returns the local ref a refspec stores a ref in. A
+// destination that is not a full ref is in the namespace of the ref.
+func fetchDestination(destination string, remoteName string) string {
+	if strings.HasPrefix(destination, "refs/") {
+		return destination
+	}
+	if strings.HasPrefix(remoteName, "refs/tags/") {
+		return "refs/tags/" + destination
+	}
+	return "refs/heads/" + destination
+}
+
+// markMergeRefs marks the refs the current branch merges from the
+// remote, as configured by branch.<name>.merge
+func markMergeRefs(fetched []*fetchedRef, remoteName string) {
+	branch, err := refs.CurrentBranch()
+	if err != nil || branch == "" {
+		return
+	}
+	cfg, err := config.Read()
+	if err != nil {
+		return
+	}
+	if name, _ := cfg.Get("branch." + branch + ".remote"); name != remoteName {
+		return
+	}
+	merges := make(map[string]bool)
+	for _, merge := range cfg.GetAll("branch." + branch + ".merge") {
+		merges[merge] = true
+	}
+	for _, ref := range fetched {
+		ref.forMerge = merges[ref.remoteName]
+	}
+}
+
+// storesRefs returns true if any fetched ref is stored in a local ref,
+// which is when tags pointing into the fetched history are followed
+func storesRefs(fetched []*fetchedRef) bool {
+	for _, ref := range fetched {
+		if ref.localName != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCurrentBranchFetch refuses to update the branch checked out in a
+// working tree, since its files would no longer match it
+func checkCurrentBranchFetch(fetched []*fetchedRef) error {
+	if config.IsBare() {
+		return nil
+	}
+	head, err := refs.ReadRef("HEAD")
+	if err != nil || !head.Symbolic() {
+		return nil
+	}
+	for _, ref := range fetched {
+		if ref.localName == head.Target {
+			return fmt.Errorf("refusing to fetch into current branch %s of non-bare repository", head.Target)
+		}
+	}
+	return nil
+}
+
+// followedTags returns the tags of the remote that point to objects
+// that are now in the repository but which do not exist locally yet
+func followedTags(remoteRefs []refs.Ref, fetched []*fetchedRef) []*fetchedRef {
+	planned := make(map[string]bool)
+	for _, ref := range fetched {
+		planned[ref.remoteName] = true
+	}
+
+	var tags []*fetchedRef
+	for _, ref := range remoteRefs {
+		if !strings.HasPrefix(ref.Name, "refs/tags/") || planned[ref.Name] {
+			continue
+		}
+		if _, err := refs.ReadRef(ref.Name); err == nil {
+			continue
+		}
+		peeled := ref.Peeled
+		if peeled == "" {
+			peeled = ref.Hash
+		}
+		if objects.Exists(ref.Hash) && objects.Exists(peeled) {
+			tags = append(tags, &fetchedRef{remoteName: ref.Name, hash: ref.Hash, localName: ref.Name})
+		}
+	}
+	return tags
+}
+
+// pruneConfigured returns true if fetch.prune or remote.<name>.prune
+// ask for pruning
+func pruneConfigured(name string) (bool, error) {
+	cfg, err := config.Read()
+	if err != nil {
+		return false, err
+	}
+	prune, err := cfg.Bool("fetch.prune", false)
+	if err != nil {
+		return false, err
+	}
+	return cfg.Bool("remote."+name+".prune", prune)
+}
+
+// pruneFetched deletes the remote-tracking refs of refs that no longer
+// exist on the remote
+func pruneFetched(r *remote.Remote, remoteRefs []refs.Ref) ([]refStatus, error) {
+	stale, err := staleTrackingRefs(r, remoteRefs)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []refStatus
+	for _, ref := range stale {
+		err = refs.DeleteRef(ref.Name, ref.Hash)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, refStatus{code: '-', summary: "[deleted]", from: "(none)", to: prettyRefName(ref.Name)})
+	}
+	return statuses, nil
+}
+
+// updateFetchedRefs updates the local refs of the fetched refs, and
+// returns how each went and whether any update was rejected. A ref is
+// only updated once every object it reaches is known to be here.
+func updateFetchedRefs(fetched []*fetchedRef, message string) ([]refStatus, bool) {
+	var hashes []string
+	for _, ref := range fetched {
+		if ref.localName != "" {
+			hashes = append(hashes, ref.hash)
+		}
+	}
+	// Each ref is only checked on its own when they are not all complete
+	allConnected := transport.Connected(hashes)
+
+	var statuses []refStatus
+	rejected := false
+	for _, ref := range fetched {
+		status := refStatus{from: prettyRefName(ref.remoteName)}
+		if ref.localName == "" {
+			status.code, status.to = '*', "FETCH_HEAD"
+			switch {
+			case strings.HasPrefix(ref.remoteName, "refs/tags/"):
+				status.summary = "tag"
+			case strings.HasPrefix(ref.remoteName, "refs/remotes/"):
+				status.summary = "remote-tracking branch"
+			case strings.HasPrefix(ref.remoteName, "refs/heads/") || ref.remoteName == "HEAD":
+				status.summary = "branch"
+			}
+			statuses = append(statuses, status)
+			continue
+		}
+		status.to = prettyRefName(ref.localName)
+		if err := refs.CheckRefFormat(ref.localName, false); err != nil {
+			status.code, status.summary, status.reason = '!', "[rejected]", err.Error()
+			rejected = true
+			statuses = append(statuses, status)
+			continue
+		}
+
+		current, _ := refs.ResolveRef(ref.localName)
+		if current == ref.hash {
+			continue
+		}
+		force := ref.force || fetchForce
+		var reflog string
+		switch {
+		case !allConnected && !transport.Connected([]string{ref.hash}):
+			status.code, status.summary, status.reason = '!', "[rejected]", "missing necessary objects"
+		case current == "":
+			status.code = '*'
+			switch {
+			case strings.HasPrefix(ref.remoteName, "refs/tags/"):
+				status.summary, reflog = "[new tag]", "storing tag"
+			case strings.HasPrefix(ref.remoteName, "refs/heads/"):
+				status.summary, reflog = "[new branch]", "storing head"
+			default:
+				status.summary, reflog = "[new ref]", "storing ref"
+			}
+		case strings.HasPrefix(ref.localName, "refs/tags/"):
+			if force {
+				status.code, status.summary, reflog = 't', "[tag update]", "updating tag"
+			} else {
+				status.code, status.summary, status.reason = '!', "[rejected]", "would clobber existing tag"
+			}
+		case revision.IsFastForward(current, ref.hash):
+			status.code, status.summary, reflog = ' ', abbreviateHash(current, 7)+".."+abbreviateHash(ref.hash, 7), "fast-forward"
+		case force:
+			status.code, status.summary, reflog = '+', abbreviateHash(current, 7)+"..."+abbreviateHash(ref.hash, 7), "forced-update"
+			status.reason = "forced update"
+		default:
+			status.code, status.summary, status.reason = '!', "[rejected]", "non-fast-forward"
+		}
+
+		if reflog != "" {
+			oldHash := current
+			if oldHash == "" {
+				oldHash = refs.ZeroHash
+			}
+			err := refs.UpdateRef(ref.localName, ref.hash, oldHash, message+": "+reflog)
+			if err != nil {
+				status.code, status.summary, status.reason = '!', "[rejected]", err.Error()
+			}
+		}
+		if status.code == '!' {
+			rejected = true
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, rejected
+}
+
+// writeFetchHead records what was fetched in FETCH_HEAD, with the refs
+// to merge first
+func writeFetchHead(fetched []*fetchedRef, url string) error {
+	var merge, other bytes.Buffer
+	for _, ref := range fetched {
+		var description string
+		switch {
+		case ref.remoteName == "HEAD":
+			description = url
+		case strings.HasPrefix(ref.remoteName, "refs/heads/"):
+			description = fmt.Sprintf("branch '%s' of %s", strings.TrimPrefix(ref.remoteName, "refs/heads/"), url)
+		case strings.HasPrefix(ref.remoteName, "refs/tags/"):
+			description = fmt.Sprintf("tag '%s' of %s", strings.TrimPrefix(ref.remoteName, "refs/tags/"), url)
+		case strings.HasPrefix(ref.remoteName, "refs/remotes/"):
+			description = fmt.Sprintf("remote-tracking branch '%s' of %s", strings.TrimPrefix(ref.remoteName, "refs/remotes/"), url)
+		default:
+			description = fmt.Sprintf("'%s' of %s", ref.remoteName, url)
+		}
+
+		if ref.forMerge {
+			fmt.Fprintf(&merge, "%s\t\t%s\n", ref.hash, description)
+		} else {
+			fmt.Fprintf(&other, "%s\tnot-for-merge\t%s\n", ref.hash, description)
+		}
+	}
+	merge.Write(other.Bytes())
+	return ioutil.WriteFile(gitdir.Path("FETCH_HEAD"), merge.Bytes(), 0644)
+}
+
+// printRefStatuses prints the line of each ref, with the names aligned
+func printRefStatuses(statuses []refStatus) {
+	width := 10
+	for _, status := range statuses {
+		if len(status.from) > width {
+			width = len(status.from)
+		}
+	}
+	for _, status := range statuses {
+		line := fmt.Sprintf(" %c %-*s %-*s -> %s", status.code, refSummaryWidth, status.summary, width, status.from, status.to)
+		if status.reason != "" {
+			line += "  (" + status.reason + ")"
+		}
+		fmt.Println(line)
+	}
+}
+
+// prettyRefName removes the prefix of a branch, tag or remote-tracking
+// ref, leaving other refs whole
+func prettyRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return name
+}
+
+// remoteProgress writes the progress messages of the other side with
+// each line prefixed by "remote: "
+type remoteProgress struct {
+	w         io.Writer
+	lineStart bool
+}
+
+func (p *remoteProgress) Write(data []byte) (int, error) {
+	var out bytes.Buffer
+	for _, c := range data {
+		if p.lineStart {
+			out.WriteString("remote: ")
+		}
+		out.WriteByte(c)
+		p.lineStart = c == '\n' || c == '\r'
+	}
+	_, err := p.w.Write(out.Bytes())
+	return len(data), err
+}
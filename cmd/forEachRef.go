@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/mattherman/mhgit/wildmatch"
+	"github.com/spf13/cobra"
+)
+
+// The format used when none is given, as "<hash> <type>\t<name>"
+const defaultRefFormat = "%(objectname) %(objecttype)\t%(refname)"
+
+// forEachRefCmd represents the for-each-ref command
+var forEachRefCmd = &cobra.Command{
+	Use:   "for-each-ref [--format=<format>] [--sort=<key>] [--count=<n>] [<pattern>...]",
+	Short: "Output information on each ref",
+	Long: `Output information on each ref matching the patterns, or on every ref
+if none are given.
+
+A pattern matches refs starting with it as a path, so that "refs/heads"
+lists every branch, or refs matching it as a wildcard. The format may use
+fields such as %(refname:short), %(objectname), %(subject),
+%(committerdate:relative) or %(upstream:track). Fields starting with "*"
+describe the object an annotated tag points to.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		forEachRef(args)
+	},
+}
+
+var forEachRefFormat string
+var forEachRefSort []string
+var forEachRefCount int
+var forEachRefMerged string
+var forEachRefNoMerged string
+var forEachRefContains string
+var forEachRefPointsAt string
+
+func init() {
+	rootCmd.AddCommand(forEachRefCmd)
+	flags := forEachRefCmd.Flags()
+	flags.StringVar(&forEachRefFormat, "format", defaultRefFormat, "Print each ref using the format.")
+	flags.StringSliceVar(&forEachRefSort, "sort", nil, "Sort by the key, such as -committerdate or version:refname. Can be given more than once.")
+	flags.IntVar(&forEachRefCount, "count", 0, "Stop after showing the number of refs.")
+	flags.StringVar(&forEachRefMerged, "merged", "", "Only list refs whose commits are reachable from the commit, HEAD by default.")
+	flags.StringVar(&forEachRefNoMerged, "no-merged", "", "Only list refs whose commits are not reachable from the commit, HEAD by default.")
+	flags.StringVar(&forEachRefContains, "contains", "", "Only list refs whose commits contain the commit, HEAD by default.")
+	flags.StringVar(&forEachRefPointsAt, "points-at", "", "Only list refs pointing at the object.")
+	for _, name := range []string{"merged", "no-merged", "contains"} {
+		flags.Lookup(name).NoOptDefVal = "HEAD"
+	}
+}
+
+func forEachRef(patterns []string) {
+	refList, err := refs.IterRefs("refs/")
+	if err != nil {
+		fmt.Printf("Failed to retrieve refs: %v\n", err)
+		return
+	}
+
+	// A commit given after a filter without "=" is taken as its value
+	for _, filter := range []*string{&forEachRefMerged, &forEachRefNoMerged, &forEachRefContains} {
+		if *filter == "HEAD" && len(patterns) > 0 {
+			if _, err := revision.Resolve(patterns[0]); err == nil {
+				*filter = patterns[0]
+				patterns = patterns[1:]
+			}
+		}
+	}
+
+	var matched []refs.Ref
+	for _, ref := range refList {
+		if matchRefPatterns(patterns, ref.Name) {
+			matched = append(matched, ref)
+		}
+	}
+
+	listed := newListedRefs(matched)
+	listed, err = filterRefs(listed, forEachRefMerged, forEachRefNoMerged, forEachRefContains)
+	if err == nil && forEachRefPointsAt != "" {
+		listed, err = pointsAt(listed, forEachRefPointsAt)
+	}
+	if err != nil {
+		fmt.Printf("Failed to filter refs: %v\n", err)
+		return
+	}
+	err = sortRefs(listed, forEachRefSort)
+	if err != nil {
+		fmt.Printf("Failed to sort refs: %v\n", err)
+		return
+	}
+
+	if forEachRefCount > 0 && len(listed) > forEachRefCount {
+		listed = listed[:forEachRefCount]
+	}
+	for _, r := range listed {
+		line, err := formatRef(forEachRefFormat, r)
+		if err != nil {
+			fmt.Printf("Failed to format ref: %v\n", err)
+			return
+		}
+		fmt.Println(line)
+	}
+}
+
+// matchRefPatterns returns true if there are no patterns or the ref
+// matches one of them, either as a leading path such as "refs/heads"
+// or as a wildcard
+func matchRefPatterns(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(name, pattern) &&
+			(len(name) == len(pattern) || strings.HasSuffix(pattern, "/") || name[len(pattern)] == '/') {
+			return true
+		}
+		if wildmatch.HasWildcard(pattern) && wildmatch.Match(pattern, name, wildmatch.Pathname) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/mattherman/mhgit/fsmonitor"
+	"github.com/spf13/cobra"
+)
+
+// How long to wait for a newly started daemon to accept clients
+const fsmonitorStartTimeout = 5 * time.Second
+
+// fsmonitorDaemonCmd represents the fsmonitor--daemon command
+var fsmonitorDaemonCmd = &cobra.Command{
+	Use:       "fsmonitor--daemon (start|stop|status|run)",
+	Short:     "A built-in file system monitor daemon",
+	Args:      cobra.OnlyValidArgs,
+	ValidArgs: []string{"start", "stop", "status", "run"},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+
+		switch args[0] {
+		case "start":
+			startFsmonitorDaemon()
+		case "stop":
+			err := fsmonitor.Stop()
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "status":
+			workTree, err := fsmonitor.Status()
+			if err != nil {
+				fmt.Println("fsmonitor-daemon is not watching this repository")
+			} else {
+				fmt.Printf("fsmonitor-daemon is watching '%s'\n", workTree)
+			}
+		case "run":
+			err := fsmonitor.Run()
+			if err != nil {
+				fmt.Printf("Failed to run the fsmonitor daemon: %v\n", err)
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fsmonitorDaemonCmd)
+}
+
+// startFsmonitorDaemon runs the daemon in a new background process and
+// waits until it is ready to answer queries
+func startFsmonitorDaemon() {
+	if _, err := fsmonitor.Status(); err == nil {
+		fmt.Println("fsmonitor-daemon is already running")
+		return
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Failed to start the fsmonitor daemon: %v\n", err)
+		return
+	}
+
+	daemon := exec.Command(executable, "fsmonitor--daemon", "run")
+	daemon.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = daemon.Start()
+	if err != nil {
+		fmt.Printf("Failed to start the fsmonitor daemon: %v\n", err)
+		return
+	}
+	daemon.Process.Release()
+
+	deadline := time.Now().Add(fsmonitorStartTimeout)
+	for time.Now().Before(deadline) {
+		workTree, err := fsmonitor.Status()
+		if err == nil {
+			fmt.Printf("fsmonitor-daemon is watching '%s'\n", workTree)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	fmt.Println("Failed to start the fsmonitor daemon: timed out waiting for it to accept clients")
+}
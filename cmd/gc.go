@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/spf13/cobra"
+)
+
+// The settings used by gc when they are not configured
+const (
+	defaultGcPruneExpire   = "2.weeks.ago"
+	defaultGcAuto          = 6700
+	defaultGcAutoPackLimit = 50
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc [--auto] [--prune=<date> | --no-prune] [-q]",
+	Short: "Cleanup unnecessary files and optimize the local repository",
+	Long: `Cleanup unnecessary files and optimize the local repository.
+
+gc packs the refs, expires old reflog entries as configured by
+gc.reflogExpire, repacks every reachable object into a single pack and
+prunes the unreachable loose objects older than gc.pruneExpire, two
+weeks by default. Objects are reachable from the refs, the reflogs and
+the index.
+
+With --auto, nothing is done unless there are more than gc.auto loose
+objects or more than gc.autoPackLimit packs.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.Read()
+		if err != nil {
+			fmt.Printf("Failed to read the config: %v\n", err)
+			os.Exit(1)
+		}
+
+		if gcAuto {
+			needed, err := gcNeeded(cfg)
+			if err != nil {
+				fmt.Printf("Failed to count objects: %v\n", err)
+				os.Exit(1)
+			}
+			if !needed {
+				return
+			}
+			if !gcQuiet {
+				fmt.Println("Auto packing the repository for optimum performance.")
+			}
+		}
+
+		expire := gcPrune
+		if !cmd.Flags().Changed("prune") {
+			var ok bool
+			expire, ok = cfg.Get("gc.pruneExpire")
+			if !ok {
+				expire = defaultGcPruneExpire
+			}
+		}
+		if gcNoPrune {
+			expire = "never"
+		}
+
+		err = gc(expire)
+		if err != nil {
+			fmt.Printf("Failed to collect garbage: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var gcAuto bool
+var gcPrune string
+var gcNoPrune bool
+var gcQuiet bool
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().BoolVar(&gcAuto, "auto", false, "Only collect garbage if there are too many loose objects or packs.")
+	gcCmd.Flags().StringVar(&gcPrune, "prune", defaultGcPruneExpire, "Prune unreachable loose objects older than the date, 'now' or 'never'.")
+	gcCmd.Flags().Lookup("prune").NoOptDefVal = defaultGcPruneExpire
+	gcCmd.Flags().BoolVar(&gcNoPrune, "no-prune", false, "Do not prune any unreachable objects.")
+	gcCmd.Flags().BoolVarP(&gcQuiet, "quiet", "q", false, "Do not report progress.")
+}
+
+// gc runs each step of garbage collection in turn, pruning unreachable
+// objects last modified before the expiry date
+func gc(expire string) error {
+	now := time.Now()
+	var expiry time.Time
+	prune := strings.ToLower(expire) != "never" && strings.ToLower(expire) != "false"
+	if prune {
+		var err error
+		expiry, err = ident.ParseApproxDate(expire, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := refs.PackRefs()
+	if err != nil {
+		return fmt.Errorf("unable to pack refs: %v", err)
+	}
+
+	err = expireAllReflogs()
+	if err != nil {
+		return err
+	}
+
+	// Unreachable objects of the old packs are kept as loose objects, so
+	// that they are pruned by age like any other
+	err = repack(true, true, true, gcQuiet)
+	if err != nil {
+		return fmt.Errorf("unable to repack: %v", err)
+	}
+
+	if prune {
+		err = pruneObjects(expiry, false, false)
+		if err != nil {
+			return fmt.Errorf("unable to prune objects: %v", err)
+		}
+	}
+
+	// The commit-graph written by git may name commits that were just
+	// pruned, and it is only a cache, so it is removed rather than left
+	// out of date
+	os.Remove(gitdir.Path("objects", "info", "commit-graph"))
+	os.RemoveAll(gitdir.Path("objects", "info", "commit-graphs"))
+	return nil
+}
+
+// expireAllReflogs removes the entries of every reflog older than
+// gc.reflogExpire, 90 days by default
+func expireAllReflogs() error {
+	expiry, err := reflogExpiryTime()
+	if err != nil {
+		return fmt.Errorf("unable to parse gc.reflogExpire: %v", err)
+	}
+	names, err := refs.ListReflogs()
+	if err != nil {
+		return fmt.Errorf("unable to list the reflogs: %v", err)
+	}
+	for _, name := range names {
+		_, err = refs.ExpireReflog(name, expiry)
+		if err != nil {
+			return fmt.Errorf("unable to expire the reflog of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// gcNeeded decides whether gc --auto has work to do. Like git, the loose
+// objects are estimated from a single object directory, which holds
+// 1/256th of them on average.
+func gcNeeded(cfg *config.Config) (bool, error) {
+	limit, err := cfg.Int("gc.auto", defaultGcAuto)
+	if err != nil || limit <= 0 {
+		return false, err
+	}
+	packLimit, err := cfg.Int("gc.autoPackLimit", defaultGcAutoPackLimit)
+	if err != nil {
+		return false, err
+	}
+
+	loose, err := filepath.Glob(gitdir.Path("objects", "17", strings.Repeat("[0-9a-f]", 38)))
+	if err != nil {
+		return false, err
+	}
+	if len(loose) > (limit+255)/256 {
+		return true, nil
+	}
+
+	packs, err := objects.Packs()
+	if err != nil {
+		return false, err
+	}
+	return packLimit > 0 && len(packs) > packLimit, nil
+}
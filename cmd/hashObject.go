@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/mattherman/mhgit/objects"
 	"github.com/spf13/cobra"
@@ -9,28 +12,86 @@ import (
 
 // hashObjectCmd represents the hashObject command
 var hashObjectCmd = &cobra.Command{
-	Use:   "hash-object [file]",
+	Use:   "hash-object [-t <type>] [-w] [--literally] [--stdin] [--stdin-paths] [file...]",
 	Short: "Compute object ID and optionally creates a blob from a file.",
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Compute object ID and optionally creates a blob from a file.
+
+The content is checked to be a valid object of the given type, which
+--literally skips so that any type and content can be written. With
+--stdin the content is read from the standard input before any files,
+and with --stdin-paths the names of the files are read from it instead.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		HashObject(args[0], write)
+		if readStdin && readStdinPaths {
+			fmt.Println("Failed to hash objects: --stdin and --stdin-paths cannot be combined")
+			return
+		}
+		if readStdinPaths && len(args) > 0 {
+			fmt.Println("Failed to hash objects: --stdin-paths does not take file arguments")
+			return
+		}
+		if !readStdin && !readStdinPaths && len(args) == 0 {
+			fmt.Println("Failed to hash objects: no file given")
+			return
+		}
+
+		if readStdin {
+			data, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Printf("Failed to read the standard input: %v\n", err)
+				return
+			}
+			printObjectHash(data, objectType, write)
+		}
+
+		filenames := args
+		if readStdinPaths {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				filenames = append(filenames, scanner.Text())
+			}
+		}
+		for _, filename := range filenames {
+			HashObject(filename, write)
+		}
 	},
 }
 
 var objectType string
 var write bool
+var readStdin bool
+var readStdinPaths bool
+var hashLiterally bool
 
 func init() {
 	rootCmd.AddCommand(hashObjectCmd)
 	hashObjectCmd.Flags().BoolVarP(&write, "write", "w", false, "Whether or not to write the object to the git object store.")
 	hashObjectCmd.Flags().StringVarP(&objectType, "type", "t", "blob", "The type of object. Defaults to 'blob'.")
+	hashObjectCmd.Flags().BoolVar(&readStdin, "stdin", false, "Read the object from the standard input.")
+	hashObjectCmd.Flags().BoolVar(&readStdinPaths, "stdin-paths", false, "Read the names of the files to hash from the standard input, one per line.")
+	hashObjectCmd.Flags().BoolVar(&hashLiterally, "literally", false, "Allow any type and content, even if they do not form a valid object.")
 }
 
 // HashObject will hash an existing file and write it to the object store
 // if desired.
 func HashObject(filename string, write bool) {
-	hash, err := objects.HashFile(filename, write)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Println("The file was not found")
+		return
+	}
+	printObjectHash(data, objectType, write)
+}
+
+func printObjectHash(data []byte, objectType string, write bool) {
+	obj := objects.Object{Data: data, ObjectType: objectType}
+	if !hashLiterally {
+		if err := objects.CheckObject(obj); err != nil {
+			fmt.Printf("Failed to hash the object: %v\n", err)
+			return
+		}
+	}
 
+	hash, err := objects.HashObject(obj, write)
 	if err != nil {
 		fmt.Println(err)
 	} else {
@@ -4,22 +4,33 @@ import (
 	"fmt"
 
 	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/pathspec"
 	"github.com/spf13/cobra"
 )
 
 // lsFilesCmd represents the lsFiles command
 var lsFilesCmd = &cobra.Command{
-	Use:   "ls-files",
+	Use:   "ls-files [pathspec...]",
 	Short: "Show information about files in the index and the working tree",
 	Run: func(cmd *cobra.Command, args []string) {
+		spec, err := pathspec.Parse(args)
+		if err != nil {
+			fmt.Printf("Failed to parse the pathspec: %v\n", err)
+			return
+		}
+
 		index, err := index.ReadIndex()
 		if err != nil {
 			fmt.Printf("Could not read index: %v\n", err)
 		}
 
 		for _, entry := range index.Entries {
-			if showStaged {
-				fmt.Printf("%o %s 0\t %s\n", entry.Mode, entry.Hash, entry.Path)
+			if (showUnmerged && entry.Stage() == 0) || !spec.Match(entry.Path) {
+				continue
+			}
+
+			if showStaged || showUnmerged {
+				fmt.Printf("%06o %s %d\t%s\n", entry.Mode, entry.Hash, entry.Stage(), entry.Path)
 			} else {
 				fmt.Printf("%s\n", entry.Path)
 			}
@@ -28,8 +39,10 @@ var lsFilesCmd = &cobra.Command{
 }
 
 var showStaged bool
+var showUnmerged bool
 
 func init() {
 	rootCmd.AddCommand(lsFilesCmd)
 	lsFilesCmd.Flags().BoolVarP(&showStaged, "stage", "s", false, "Show staged contents' mode bits, object name, and stage number in the output.")
+	lsFilesCmd.Flags().BoolVarP(&showUnmerged, "unmerged", "u", false, "Show unmerged files in the output (forces --stage).")
 }
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/spf13/cobra"
+)
+
+// lsTreeCmd represents the ls-tree command
+var lsTreeCmd = &cobra.Command{
+	Use:   "ls-tree [-d] [-r] [-t] [-l] [-z] [--name-only] [--object-only] [--abbrev[=<n>]] <tree-ish> [<path>...]",
+	Short: "List the contents of a tree object",
+	Long: `List the contents of a tree object, one entry per line as
+"<mode> <type> <object>\t<path>".
+
+Paths limit the listing to the entries they name. A path naming a
+directory lists the directory itself, or its contents if the path ends
+with a slash. Subtrees are only listed, not entered, unless -r is given.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := lsTree(args[0], args[1:])
+		if err != nil {
+			fmt.Printf("Failed to list the tree: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var lsTreeOnlyTrees bool
+var lsTreeRecursive bool
+var lsTreeShowTrees bool
+var lsTreeLong bool
+var lsTreeNullTerminated bool
+var lsTreeNameOnly bool
+var lsTreeObjectOnly bool
+var lsTreeAbbrev int
+
+func init() {
+	rootCmd.AddCommand(lsTreeCmd)
+	flags := lsTreeCmd.Flags()
+	flags.BoolVarP(&lsTreeOnlyTrees, "dirs", "d", false, "Only show trees.")
+	flags.BoolVarP(&lsTreeRecursive, "recursive", "r", false, "Recurse into subtrees.")
+	flags.BoolVarP(&lsTreeShowTrees, "trees", "t", false, "Show trees even when recursing into them.")
+	flags.BoolVarP(&lsTreeLong, "long", "l", false, "Show the size of blobs.")
+	flags.BoolVarP(&lsTreeNullTerminated, "null", "z", false, "Terminate entries with NUL instead of a newline.")
+	flags.BoolVar(&lsTreeNameOnly, "name-only", false, "Only show the paths of the entries.")
+	flags.BoolVar(&lsTreeObjectOnly, "object-only", false, "Only show the objects of the entries.")
+	flags.IntVar(&lsTreeAbbrev, "abbrev", 0, "Abbreviate hashes to the number of characters, 7 by default.")
+	flags.Lookup("abbrev").NoOptDefVal = "7"
+}
+
+func lsTree(treeish string, paths []string) error {
+	hash, err := revision.Resolve(treeish)
+	if err != nil {
+		return fmt.Errorf("not a valid object name %s", treeish)
+	}
+	tree, err := revision.Peel(hash, "tree")
+	if err != nil {
+		return fmt.Errorf("not a tree object: %s", treeish)
+	}
+	return listTree(tree, "", paths)
+}
+
+func listTree(hash string, prefix string, paths []string) error {
+	entries, err := objects.ReadTree(hash)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := prefix + entry.Name
+		show, descend := lsTreeSelect(path, entry.IsTree(), paths)
+		if show && (!lsTreeOnlyTrees || entry.IsTree()) {
+			err = printTreeEntry(entry, path)
+			if err != nil {
+				return err
+			}
+		}
+		if descend {
+			err = listTree(entry.Hash, path+"/", paths)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lsTreeSelect returns whether the entry at the path is shown and
+// whether its subtree is entered
+func lsTreeSelect(path string, isTree bool, paths []string) (bool, bool) {
+	inside := len(paths) == 0
+	exact, ancestor, contents := false, false, false
+	for _, p := range paths {
+		base := strings.TrimSuffix(p, "/")
+		switch {
+		case path == base:
+			exact = true
+			contents = contents || strings.HasSuffix(p, "/")
+		case strings.HasPrefix(path, base+"/") || base == "" || base == ".":
+			inside = true
+		case strings.HasPrefix(base, path+"/"):
+			ancestor = true
+		}
+	}
+
+	// Trees are shown once instead of their contents, or along with
+	// them when -t or -d is given
+	var descend bool
+	switch {
+	case inside:
+		descend = isTree && lsTreeRecursive
+	case exact:
+		descend = isTree && (contents || lsTreeRecursive)
+	case ancestor:
+		return lsTreeShowTrees, true
+	default:
+		return false, false
+	}
+	return !descend || lsTreeShowTrees || lsTreeOnlyTrees, descend
+}
+
+func printTreeEntry(entry objects.TreeEntry, path string) error {
+	terminator := "\n"
+	if lsTreeNullTerminated {
+		terminator = "\000"
+	}
+
+	hash := entry.Hash
+	if lsTreeAbbrev > 0 {
+		hash = abbreviateHash(hash, lsTreeAbbrev)
+	}
+
+	switch {
+	case lsTreeNameOnly:
+		fmt.Print(path + terminator)
+		return nil
+	case lsTreeObjectOnly:
+		fmt.Print(hash + terminator)
+		return nil
+	}
+
+	mode, err := strconv.ParseUint(entry.Mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %s for %s", entry.Mode, path)
+	}
+	if !lsTreeLong {
+		fmt.Printf("%06o %s %s\t%s%s", mode, entry.Type(), hash, path, terminator)
+		return nil
+	}
+
+	size := "-"
+	if entry.Type() == "blob" {
+		obj, err := objects.ReadObject(entry.Hash)
+		if err != nil {
+			return err
+		}
+		size = strconv.Itoa(obj.Size())
+	}
+	fmt.Printf("%06o %s %s %7s\t%s%s", mode, entry.Type(), hash, size, path, terminator)
+	return nil
+}
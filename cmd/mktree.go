@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mattherman/mhgit/objects"
+	"github.com/spf13/cobra"
+)
+
+// mktreeCmd represents the mktree command
+var mktreeCmd = &cobra.Command{
+	Use:   "mktree [-z] [--missing] [--batch]",
+	Short: "Build a tree object from ls-tree formatted text",
+	Long: `Build a tree object from ls-tree formatted text.
+
+Each line of the standard input gives an entry of the tree as
+"<mode> <type> <object>\t<name>", the way ls-tree prints it. The entries
+are sorted before the tree is written and its hash is printed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := mktree()
+		if err != nil {
+			fmt.Printf("Failed to create the tree: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var mktreeNullTerminated bool
+var mktreeMissing bool
+var mktreeBatch bool
+
+func init() {
+	rootCmd.AddCommand(mktreeCmd)
+	mktreeCmd.Flags().BoolVarP(&mktreeNullTerminated, "null", "z", false, "Read entries terminated by NUL instead of newlines.")
+	mktreeCmd.Flags().BoolVar(&mktreeMissing, "missing", false, "Allow entries for objects which are not in the repository.")
+	mktreeCmd.Flags().BoolVar(&mktreeBatch, "batch", false, "Build several trees, separated by blank lines, printing the hash of each.")
+}
+
+func mktree() error {
+	scanner := bufio.NewScanner(os.Stdin)
+	if mktreeNullTerminated {
+		scanner.Split(splitNull)
+	}
+
+	var entries []objects.TreeEntry
+	pending := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" && mktreeBatch {
+			if err := writeMktree(entries); err != nil {
+				return err
+			}
+			entries, pending = nil, false
+			continue
+		}
+
+		entry, err := parseMktreeEntry(line)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		pending = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if pending || !mktreeBatch {
+		return writeMktree(entries)
+	}
+	return nil
+}
+
+func writeMktree(entries []objects.TreeEntry) error {
+	data, err := objects.TreeData(entries)
+	if err != nil {
+		return err
+	}
+	hash, err := objects.HashObject(objects.Object{ObjectType: "tree", Data: data}, true)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+// parseMktreeEntry parses a line of ls-tree output, checking that the
+// object has the type its mode requires
+func parseMktreeEntry(line string) (objects.TreeEntry, error) {
+	tab := strings.IndexByte(line, '\t')
+	if tab == -1 {
+		return objects.TreeEntry{}, fmt.Errorf("input format error: %s", line)
+	}
+	fields := strings.Split(line[:tab], " ")
+	if len(fields) != 3 {
+		return objects.TreeEntry{}, fmt.Errorf("input format error: %s", line)
+	}
+
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return objects.TreeEntry{}, fmt.Errorf("input format error: %s", line)
+	}
+	entry := objects.TreeEntry{
+		Mode: strconv.FormatUint(mode, 8),
+		Name: line[tab+1:],
+		Hash: fields[2],
+	}
+	if entry.Name == "" || strings.Contains(entry.Name, "/") {
+		return objects.TreeEntry{}, fmt.Errorf("path '%s' contains a slash or is empty", entry.Name)
+	}
+	if fields[1] != entry.Type() {
+		return objects.TreeEntry{}, fmt.Errorf("entry '%s' object type (%s) doesn't match mode type (%s)", entry.Name, fields[1], entry.Type())
+	}
+
+	// Submodule commits live in another repository
+	if entry.Type() == "commit" {
+		return entry, nil
+	}
+	obj, err := objects.ReadObject(entry.Hash)
+	if err != nil {
+		if mktreeMissing {
+			return entry, nil
+		}
+		return objects.TreeEntry{}, fmt.Errorf("entry '%s' object %s is unavailable", entry.Name, entry.Hash)
+	}
+	if obj.Type() != entry.Type() {
+		return objects.TreeEntry{}, fmt.Errorf("entry '%s' object %s is a %s but specified type was (%s)", entry.Name, entry.Hash, obj.Type(), entry.Type())
+	}
+	return entry, nil
+}
+
+// splitNull splits the input into NUL terminated records
+func splitNull(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i != -1 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattherman/mhgit/index"
+	"github.com/spf13/cobra"
+)
+
+// mvCmd represents the mv command
+var mvCmd = &cobra.Command{
+	Use:   "mv <source>... <destination>",
+	Short: "Move or rename a file, a directory, or a symlink",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		moveFiles(args[:len(args)-1], args[len(args)-1])
+	},
+}
+
+var mvForce bool
+var mvDryRun bool
+var mvSkipErrors bool
+
+func init() {
+	rootCmd.AddCommand(mvCmd)
+	mvCmd.Flags().BoolVarP(&mvForce, "force", "f", false, "Force renaming or moving of a file even if the target exists.")
+	mvCmd.Flags().BoolVarP(&mvDryRun, "dry-run", "n", false, "Do nothing; only show what would happen.")
+	mvCmd.Flags().BoolVarP(&mvSkipErrors, "skip-errors", "k", false, "Skip move or rename actions which would lead to an error condition.")
+}
+
+// move represents the rename of a single file or directory in the
+// working tree, along with the index entries it renames
+type move struct {
+	source      string
+	destination string
+	entries     map[string]string
+}
+
+func moveFiles(sources []string, destination string) {
+	idx, err := index.ReadIndex()
+	if err != nil {
+		fmt.Printf("Could not read index: %v\n", err)
+		return
+	}
+
+	destination = cleanPath(destination)
+	info, err := os.Stat(destination)
+	intoDirectory := err == nil && info.IsDir()
+	if !intoDirectory && len(sources) > 1 {
+		fmt.Printf("Failed to move files: destination '%s' is not a directory\n", destination)
+		return
+	}
+
+	var moves []move
+	for _, source := range sources {
+		source = cleanPath(source)
+		target := destination
+		if intoDirectory {
+			target = path.Join(destination, path.Base(source))
+		}
+
+		m, err := planMove(idx, source, target)
+		if err != nil {
+			if mvSkipErrors {
+				continue
+			}
+			fmt.Printf("Failed to move files: %v, source=%s, destination=%s\n", err, source, target)
+			return
+		}
+		moves = append(moves, m)
+	}
+
+	for _, m := range moves {
+		fmt.Printf("Renaming %s to %s\n", m.source, m.destination)
+	}
+	if mvDryRun || len(moves) == 0 {
+		return
+	}
+
+	batch, err := index.NewBatch()
+	if err != nil {
+		fmt.Printf("Failed to update the index: %v\n", err)
+		return
+	}
+	defer batch.Rollback()
+
+	for _, m := range moves {
+		err = os.Rename(m.source, m.destination)
+		if err != nil {
+			fmt.Printf("Failed to rename %s: %v\n", m.source, err)
+			return
+		}
+		for oldPath, newPath := range m.entries {
+			err = batch.Rename(oldPath, newPath)
+			if err != nil {
+				fmt.Printf("Failed to update the index entry: %v\n", err)
+				return
+			}
+		}
+	}
+
+	err = batch.Commit()
+	if err != nil {
+		fmt.Printf("Failed to write the index: %v\n", err)
+	}
+}
+
+// planMove checks that the source can be moved to the destination and
+// finds the index entries that need renaming
+func planMove(idx index.Index, source string, destination string) (move, error) {
+	m := move{source: source, destination: destination, entries: make(map[string]string)}
+
+	info, err := os.Lstat(source)
+	if err != nil {
+		return m, errors.New("bad source")
+	}
+	if source == destination || strings.HasPrefix(destination, source+"/") {
+		return m, errors.New("can not move directory into itself")
+	}
+
+	for _, entry := range idx.Entries {
+		if entry.Path != source && !(info.IsDir() && strings.HasPrefix(entry.Path, source+"/")) {
+			continue
+		}
+		if entry.Stage() != index.StageMerged {
+			return m, errors.New("conflicted")
+		}
+		m.entries[entry.Path] = destination + strings.TrimPrefix(entry.Path, source)
+	}
+	if len(m.entries) == 0 {
+		if info.IsDir() {
+			return m, errors.New("source directory is empty")
+		}
+		return m, errors.New("not under version control")
+	}
+
+	// Only a file can be forced to replace another file
+	if destinationInfo, err := os.Lstat(destination); err == nil {
+		if !mvForce || info.IsDir() || destinationInfo.IsDir() {
+			return m, errors.New("destination exists")
+		}
+	}
+	if _, err := os.Stat(filepath.Dir(destination)); err != nil {
+		return m, errors.New("destination directory does not exist")
+	}
+
+	return m, nil
+}
+
+// cleanPath normalises a path given on the command line to the form
+// used in the index
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "./")
+}
@@ -0,0 +1,549 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mattherman/mhgit/diff"
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pathspec"
+)
+
+const hunkEditFile = "addp-hunk-edit.diff"
+
+// patchMode describes how the hunks chosen interactively are used. In
+// the forward direction the chosen hunks are applied to the old side of
+// the diff, otherwise they are reverse applied to the new side.
+type patchMode struct {
+	prompt  string
+	action  string
+	reverse bool
+}
+
+var stagePatchMode = patchMode{prompt: "Stage %s", action: "stage %s"}
+var unstagePatchMode = patchMode{prompt: "Unstage %s", action: "unstage %s", reverse: true}
+var discardPatchMode = patchMode{prompt: "Discard %s from worktree", action: "discard %s from worktree", reverse: true}
+
+// filePatch represents the differences between two versions of a file,
+// either of which may be missing
+type filePatch struct {
+	path       string
+	oldLines   []string
+	newLines   []string
+	oldMissing bool
+	newMissing bool
+	hunks      []diff.Hunk
+}
+
+func newFilePatch(path string, oldData []byte, oldMissing bool, newData []byte, newMissing bool) filePatch {
+	patch := filePatch{
+		path:       path,
+		oldLines:   diff.SplitLines(oldData),
+		newLines:   diff.SplitLines(newData),
+		oldMissing: oldMissing,
+		newMissing: newMissing,
+	}
+	patch.hunks = diff.Diff(patch.oldLines, patch.newLines)
+	return patch
+}
+
+// deletion returns true if the patch deletes the whole file, which is
+// chosen as a single change rather than hunk by hunk
+func (p filePatch) deletion() bool {
+	return p.newMissing && !p.oldMissing
+}
+
+func (p filePatch) header() string {
+	oldName, newName := "a/"+p.path, "b/"+p.path
+	if p.oldMissing {
+		oldName = "/dev/null"
+	}
+	if p.newMissing {
+		newName = "/dev/null"
+	}
+	return fmt.Sprintf("diff --git a/%s b/%s\n--- %s\n+++ %s\n", p.path, p.path, oldName, newName)
+}
+
+// result computes the new content of the side of the patch the mode
+// changes, given the chosen hunks. It returns true for remove if the
+// file should no longer exist.
+func (p filePatch) result(mode patchMode, chosen []diff.Hunk) ([]byte, bool, error) {
+	if p.deletion() {
+		// Reversing a deletion restores the whole file
+		if mode.reverse {
+			return []byte(strings.Join(p.oldLines, "")), false, nil
+		}
+		return nil, true, nil
+	}
+
+	if !mode.reverse {
+		lines, err := diff.Apply(p.oldLines, chosen)
+		return []byte(strings.Join(lines, "")), false, err
+	}
+
+	var reversed []diff.Hunk
+	for _, hunk := range chosen {
+		reversed = append(reversed, hunk.Reverse())
+	}
+	lines, err := diff.Apply(p.newLines, reversed)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Reversing every hunk of a new file removes it
+	remove := p.oldMissing && len(lines) == 0
+	return []byte(strings.Join(lines, "")), remove, nil
+}
+
+// choosePatchHunks will show the hunks of each file and ask which of
+// them to use. The function is called with the hunks chosen for each
+// file that has any, and stops at the first error.
+func choosePatchHunks(mode patchMode, patches []filePatch, use func(filePatch, []diff.Hunk) error) error {
+	input := bufio.NewReader(os.Stdin)
+	quit := false
+
+	for _, patch := range patches {
+		if quit {
+			break
+		}
+		if len(patch.hunks) == 0 && !patch.deletion() {
+			continue
+		}
+		fmt.Print(patch.header())
+
+		var chosen []diff.Hunk
+		var err error
+		if patch.deletion() {
+			chosen, quit, err = chooseDeletion(mode, patch, input)
+		} else {
+			chosen, quit, err = chooseHunks(mode, patch, input)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(chosen) > 0 {
+			err = use(patch, chosen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func chooseDeletion(mode patchMode, patch filePatch, input *bufio.Reader) ([]diff.Hunk, bool, error) {
+	for {
+		fmt.Printf(mode.prompt+" [y,n,q,a,d,?]? ", "deletion")
+		answer, err := readAnswer(input)
+		if err != nil {
+			return nil, true, err
+		}
+
+		switch answer {
+		case "y", "a":
+			return patch.hunks, false, nil
+		case "n", "d":
+			return nil, false, nil
+		case "q":
+			return nil, true, nil
+		default:
+			printPatchHelp(mode, "deletion", false, false)
+		}
+	}
+}
+
+// The decisions made about each hunk
+const (
+	hunkUndecided = iota
+	hunkChosen
+	hunkSkipped
+)
+
+func chooseHunks(mode patchMode, patch filePatch, input *bufio.Reader) ([]diff.Hunk, bool, error) {
+	hunks := append([]diff.Hunk(nil), patch.hunks...)
+	decisions := make([]int, len(hunks))
+	quit := false
+
+	for i := 0; i < len(hunks) && !quit; {
+		if decisions[i] != hunkUndecided {
+			i++
+			continue
+		}
+
+		hunk := hunks[i]
+		canSplit := len(hunk.Split()) > 1
+		options := "y,n,q,a,d"
+		if canSplit {
+			options += ",s"
+		}
+		options += ",e,?"
+
+		fmt.Print(hunk.String())
+		fmt.Printf("(%d/%d) "+mode.prompt+" [%s]? ", i+1, len(hunks), "this hunk", options)
+		answer, err := readAnswer(input)
+		if err != nil {
+			return nil, true, err
+		}
+
+		switch answer {
+		case "y":
+			decisions[i] = hunkChosen
+		case "n":
+			decisions[i] = hunkSkipped
+		case "a", "d", "q":
+			decision := hunkChosen
+			if answer != "a" {
+				decision = hunkSkipped
+			}
+			for j := i; j < len(hunks); j++ {
+				if decisions[j] == hunkUndecided {
+					decisions[j] = decision
+				}
+			}
+			quit = answer == "q"
+		case "s":
+			if !canSplit {
+				printPatchHelp(mode, "this hunk", canSplit, true)
+				continue
+			}
+			split := hunk.Split()
+			fmt.Printf("Split into %d hunks.\n", len(split))
+			hunks = append(hunks[:i], append(split, hunks[i+1:]...)...)
+			decisions = append(decisions[:i], append(make([]int, len(split)), decisions[i+1:]...)...)
+		case "e":
+			edited, ok, err := editHunk(mode, hunk)
+			if err != nil {
+				return nil, true, err
+			}
+			if !ok {
+				continue
+			}
+			if _, _, err := patch.result(mode, []diff.Hunk{edited}); err != nil {
+				fmt.Printf("Your edited hunk does not apply: %v\n", err)
+				continue
+			}
+			hunks[i] = edited
+			decisions[i] = hunkChosen
+		default:
+			printPatchHelp(mode, "this hunk", canSplit, true)
+		}
+	}
+
+	var chosen []diff.Hunk
+	for i, hunk := range hunks {
+		if decisions[i] == hunkChosen {
+			chosen = append(chosen, hunk)
+		}
+	}
+	return chosen, quit, nil
+}
+
+// readAnswer reads a line of input, treating the end of the input
+// the same as quitting
+func readAnswer(input *bufio.Reader) (string, error) {
+	line, err := input.ReadString('\n')
+	if err == io.EOF && line == "" {
+		fmt.Println()
+		return "q", nil
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func printPatchHelp(mode patchMode, target string, canSplit bool, canEdit bool) {
+	action := fmt.Sprintf(mode.action, target)
+	fmt.Printf("y - %s\n", action)
+	fmt.Printf("n - do not %s\n", action)
+	fmt.Printf("q - quit; do not %s or any of the remaining ones\n", action)
+	fmt.Printf("a - %s and all later hunks in the file\n", action)
+	fmt.Printf("d - do not %s or any of the later hunks in the file\n", action)
+	if canSplit {
+		fmt.Println("s - split the current hunk into smaller hunks")
+	}
+	if canEdit {
+		fmt.Println("e - manually edit the current hunk")
+	}
+	fmt.Println("? - print help")
+}
+
+// editHunk will open the hunk in the user's editor and parse the result.
+// It returns false if the user removed every line to abort the edit.
+func editHunk(mode patchMode, hunk diff.Hunk) (diff.Hunk, bool, error) {
+	removeLine, addLine := "-", "+"
+	if mode.reverse {
+		removeLine, addLine = "+", "-"
+	}
+
+	var builder strings.Builder
+	builder.WriteString("# Manual hunk edit mode -- see bottom for a quick guide.\n")
+	builder.WriteString(hunk.String())
+	builder.WriteString("# ---\n")
+	fmt.Fprintf(&builder, "# To remove '%s' lines, make them ' ' lines (context).\n", removeLine)
+	fmt.Fprintf(&builder, "# To remove '%s' lines, delete them.\n", addLine)
+	builder.WriteString("# Lines starting with # will be removed.\n")
+	builder.WriteString("# If all lines of the hunk are removed, the edit is aborted and the hunk is left unchanged.\n")
+
+	err := ioutil.WriteFile(gitdir.Path(hunkEditFile), []byte(builder.String()), 0644)
+	if err != nil {
+		return diff.Hunk{}, false, err
+	}
+	defer os.Remove(gitdir.Path(hunkEditFile))
+
+	err = runEditor(gitdir.Path(hunkEditFile))
+	if err != nil {
+		return diff.Hunk{}, false, err
+	}
+
+	data, err := ioutil.ReadFile(gitdir.Path(hunkEditFile))
+	if err != nil {
+		return diff.Hunk{}, false, err
+	}
+
+	var lines []string
+	for _, line := range diff.SplitLines(data) {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if strings.TrimSpace(strings.Join(lines, "")) == "" {
+		return diff.Hunk{}, false, nil
+	}
+
+	edited, err := diff.ParseHunk(strings.Join(lines, ""))
+	if err != nil {
+		fmt.Printf("Your edited hunk could not be parsed: %v\n", err)
+		return diff.Hunk{}, false, nil
+	}
+	return edited, true, nil
+}
+
+// runEditor will open the file in the editor chosen by the environment
+func runEditor(filename string) error {
+	editor := "vi"
+	for _, variable := range []string{"GIT_EDITOR", "VISUAL", "EDITOR"} {
+		if value := os.Getenv(variable); value != "" {
+			editor = value
+			break
+		}
+	}
+
+	// The editor may include arguments, so let the shell split them
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, filename)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// readBlob returns the content of the blob with the given hash
+func readBlob(hash string) ([]byte, error) {
+	obj, err := objects.ReadObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Type() != "blob" {
+		return nil, fmt.Errorf("object %s is a %s, not a blob", hash, obj.Type())
+	}
+	return obj.Data, nil
+}
+
+// indexBlob returns the content staged for an index entry. Entries
+// added with intent-to-add have no content staged yet.
+func indexBlob(entry index.Entry) ([]byte, error) {
+	if entry.IntentToAdd() {
+		return nil, nil
+	}
+	return readBlob(entry.Hash)
+}
+
+// worktreePatches returns the differences between the index and the
+// working tree for the tracked files matched by the pathspec, along
+// with the index entries of those files
+func worktreePatches(spec *pathspec.Pathspec) ([]filePatch, map[string]index.Entry, error) {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	modified, deleted, err := index.Refresh(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idx, err := index.ReadIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changed := make(map[string]bool)
+	for _, path := range modified {
+		changed[path] = false
+	}
+	for _, path := range deleted {
+		changed[path] = true
+	}
+
+	var patches []filePatch
+	entries := make(map[string]index.Entry)
+	for _, entry := range idx.Entries {
+		isDeleted, isChanged := changed[entry.Path]
+		// The content of a nested repository cannot be patched
+		if entry.Stage() != index.StageMerged || !isChanged || entry.Mode == objects.ModeGitlink || !spec.Match(entry.Path) {
+			continue
+		}
+
+		oldData, err := indexBlob(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var newData []byte
+		if !isDeleted {
+			newData, err = readWorktreeContent(entry.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		patches = append(patches, newFilePatch(entry.Path, oldData, false, newData, isDeleted))
+		entries[entry.Path] = entry
+	}
+
+	return patches, entries, nil
+}
+
+// readWorktreeContent reads the content of a file of the working tree as
+// it is stored, which for a symbolic link is the path it points to
+func readWorktreeContent(path string) ([]byte, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return ioutil.ReadFile(path)
+	}
+	target, err := os.Readlink(path)
+	return []byte(target), err
+}
+
+// patchResult represents the new content of a file after applying the
+// chosen hunks
+type patchResult struct {
+	path   string
+	mode   int32
+	data   []byte
+	remove bool
+}
+
+// resetPatchHunks lets the user choose which hunks of the staged
+// changes to unstage
+func resetPatchHunks(commit string, args []string) {
+	spec, err := pathspec.Parse(args)
+	if err != nil {
+		fmt.Printf("Failed to parse the pathspec: %v\n", err)
+		return
+	}
+
+	head, err := commitEntries(commit)
+	if err != nil {
+		fmt.Printf("Failed to read %s: %v\n", commit, err)
+		return
+	}
+
+	paths, staged, err := stagedPaths(spec, head)
+	if err != nil {
+		fmt.Printf("Could not read index: %v\n", err)
+		return
+	}
+
+	var patches []filePatch
+	modes := make(map[string]int32)
+	for _, path := range paths {
+		headEntry, inHead := head[path]
+		entry, isStaged := staged[path]
+		if inHead && isStaged && headEntry.Hash == entry.Hash {
+			continue
+		}
+		if parseMode(headEntry.Mode) == objects.ModeGitlink || entry.Mode == objects.ModeGitlink {
+			continue
+		}
+
+		var oldData, newData []byte
+		if inHead {
+			modes[path] = parseMode(headEntry.Mode)
+			oldData, err = readBlob(headEntry.Hash)
+			if err != nil {
+				fmt.Printf("Failed to read %s from HEAD: %v\n", path, err)
+				return
+			}
+		}
+		if isStaged {
+			modes[path] = entry.Mode
+			newData, err = indexBlob(entry)
+			if err != nil {
+				fmt.Printf("Failed to read %s from the index: %v\n", path, err)
+				return
+			}
+		}
+
+		patches = append(patches, newFilePatch(path, oldData, !inHead, newData, !isStaged))
+	}
+	if len(patches) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+
+	var unstaged []patchResult
+	err = choosePatchHunks(unstagePatchMode, patches, func(patch filePatch, chosen []diff.Hunk) error {
+		data, remove, err := patch.result(unstagePatchMode, chosen)
+		unstaged = append(unstaged, patchResult{path: patch.path, mode: modes[patch.path], data: data, remove: remove})
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Failed to apply the chosen hunks: %v\n", err)
+		return
+	}
+
+	err = updateIndexContent(unstaged)
+	if err != nil {
+		fmt.Printf("Failed to update the index: %v\n", err)
+	}
+}
+
+// updateIndexContent will stage the content of each result, writing
+// the blobs to the object database
+func updateIndexContent(results []patchResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	batch, err := index.NewBatch()
+	if err != nil {
+		return err
+	}
+	defer batch.Rollback()
+
+	for _, result := range results {
+		if result.remove {
+			batch.Remove(result.path)
+			continue
+		}
+
+		hash, err := objects.HashObject(objects.Object{ObjectType: "blob", Data: result.data}, true)
+		if err != nil {
+			return err
+		}
+		batch.AddCacheInfo(result.mode, hash, result.path)
+	}
+
+	return batch.Commit()
+}
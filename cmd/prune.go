@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/spf13/cobra"
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune [-n] [-v] [--expire <time>]",
+	Short: "Prune all unreachable objects from the object database",
+	Long: `Remove the loose objects that cannot be reached from any ref, reflog
+or the index, along with loose objects that are already in a pack.
+
+With --expire only unreachable objects older than the time are removed,
+so objects written by commands that are still running are kept.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		expiry := time.Now()
+		if pruneExpire != "" {
+			var err error
+			expiry, err = ident.ParseApproxDate(pruneExpire, expiry)
+			if err != nil {
+				fmt.Printf("Failed to parse the expiry time: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		err := pruneObjects(expiry, pruneDryRun, pruneVerbose || pruneDryRun)
+		if err != nil {
+			fmt.Printf("Failed to prune objects: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var pruneDryRun bool
+var pruneVerbose bool
+var pruneExpire string
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "n", false, "Only show the objects that would be removed.")
+	pruneCmd.Flags().BoolVarP(&pruneVerbose, "verbose", "v", false, "Show the objects that are removed.")
+	pruneCmd.Flags().StringVar(&pruneExpire, "expire", "", "Only remove unreachable objects older than the time, such as '2.weeks.ago'.")
+}
+
+// reachableObjects returns every object reachable from the refs, HEAD,
+// the old and new values of every reflog entry and the index
+func reachableObjects() (map[string]bool, error) {
+	var roots []string
+
+	all, err := refs.IterRefs("")
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range all {
+		roots = append(roots, ref.Hash)
+	}
+	if head, err := refs.ResolveRef("HEAD"); err == nil {
+		roots = append(roots, head)
+	}
+
+	names, err := refs.ListReflogs()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		entries, err := refs.ReadReflog(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			for _, hash := range []string{entry.Old, entry.New} {
+				if hash != refs.ZeroHash {
+					roots = append(roots, hash)
+				}
+			}
+		}
+	}
+
+	idx, err := index.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range idx.Entries {
+		// Files added with --intent-to-add have no content yet
+		if entry.Mode != objects.ModeGitlink && !entry.IntentToAdd() {
+			roots = append(roots, entry.Hash)
+		}
+	}
+	roots = append(roots, cacheTreeHashes(idx.CacheTree)...)
+
+	return objects.Reachable(roots)
+}
+
+// cacheTreeHashes returns the trees remembered by the index that are
+// still valid, since the next commit may use them without writing them
+func cacheTreeHashes(tree *index.CacheTree) []string {
+	if tree == nil || !tree.Valid() {
+		return nil
+	}
+	hashes := []string{tree.Hash}
+	for _, subtree := range tree.Subtrees {
+		hashes = append(hashes, cacheTreeHashes(subtree)...)
+	}
+	return hashes
+}
+
+// pruneObjects removes the unreachable loose objects last modified no
+// later than the expiry time, then the loose objects that are packed.
+// The unreachable objects modified after the expiry time are kept along
+// with every object they lead to, since a command that is still running
+// may be about to reference them.
+func pruneObjects(expiry time.Time, dryRun bool, verbose bool) error {
+	reachable, err := reachableObjects()
+	if err != nil {
+		return err
+	}
+	loose, err := objects.LooseObjects()
+	if err != nil {
+		return err
+	}
+
+	var expired, recent []string
+	for _, hash := range loose {
+		if reachable[hash] {
+			continue
+		}
+		info, err := os.Stat(objects.LooseObjectPath(hash))
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(expiry) {
+			recent = append(recent, hash)
+		} else {
+			expired = append(expired, hash)
+		}
+	}
+
+	// What the recent objects lead to may not have been written yet
+	kept, err := objects.ReachableExisting(recent)
+	if err != nil {
+		return err
+	}
+	for _, hash := range expired {
+		if kept[hash] {
+			continue
+		}
+
+		if verbose {
+			objectType := "unknown"
+			if obj, err := objects.ReadObject(hash); err == nil {
+				objectType = obj.Type()
+			}
+			fmt.Printf("%s %s\n", hash, objectType)
+		}
+		if !dryRun {
+			err = objects.RemoveLooseObject(hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return prunePacked(dryRun)
+}
+
+// prunePacked removes the loose objects that are also in a pack
+func prunePacked(dryRun bool) error {
+	loose, err := objects.LooseObjects()
+	if err != nil {
+		return err
+	}
+	for _, hash := range loose {
+		if !objects.IsPacked(hash) {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("rm -f %s\n", objects.LooseObjectPath(hash))
+			continue
+		}
+		err = objects.RemoveLooseObject(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
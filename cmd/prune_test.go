@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/objects"
+)
+
+// useTestRepository will make an empty repository in a temporary
+// directory the one that is used
+func useTestRepository(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), ".git")
+	for _, sub := range []string{"objects", "refs/heads"} {
+		os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644)
+
+	previous := gitdir.Get()
+	gitdir.Set(dir)
+	t.Cleanup(func() {
+		gitdir.Set(previous)
+		objects.ReloadPacks()
+	})
+}
+
+// writeTestObject writes the object, last modified at the given time
+func writeTestObject(t *testing.T, objectType string, data string, modified time.Time) string {
+	hash, err := objects.HashObject(objects.Object{Data: []byte(data), ObjectType: objectType}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(objects.LooseObjectPath(hash), modified, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestPruneKeepsObjectsOfRecentObjects(t *testing.T) {
+	useTestRepository(t)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	blob := writeTestObject(t, "blob", "old content\n", old)
+	treeData, err := objects.TreeData([]objects.TreeEntry{{Mode: "100644", Name: "a.txt", Hash: blob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := writeTestObject(t, "tree", string(treeData), old)
+	commit := writeTestObject(t, "commit", fmt.Sprintf("tree %s\nauthor A <a@example.com> 0 +0000\ncommitter A <a@example.com> 0 +0000\n\nrecent\n", tree), now)
+	garbage := writeTestObject(t, "blob", "old garbage\n", old)
+
+	err = pruneObjects(now.Add(-24*time.Hour), false, false)
+	if err != nil {
+		t.Fatalf("pruneObjects failed: %v", err)
+	}
+	for _, hash := range []string{commit, tree, blob} {
+		if !objects.Exists(hash) {
+			t.Errorf("object %s reachable from a recent commit was pruned", hash)
+		}
+	}
+	if objects.Exists(garbage) {
+		t.Errorf("the old unreachable object %s was kept", garbage)
+	}
+}
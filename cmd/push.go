@@ -0,0 +1,477 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/remote"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/mattherman/mhgit/transport"
+	"github.com/spf13/cobra"
+)
+
+// pushCmd represents the push command
+var pushCmd = &cobra.Command{
+	Use:   "push [--all | --mirror | --tags] [-f] [-d] [-u] [-n] [-q] [--receive-pack <program>] [<repository> [<refspec>...]]",
+	Short: "Update remote refs along with associated objects",
+	Long: `Update the refs of another repository from local refs, sending the
+objects they need.
+
+The repository is a configured remote, by default the remote of the
+current branch or "origin", or a path or file:// URL. Without refspecs,
+the push refspecs of the remote are used, or else the current branch is
+pushed to the branch of the same name. A refspec "<src>:<dst>" updates
+<dst> on the remote from the local revision <src>, and ":<dst>" deletes
+<dst>. --all pushes every branch, --tags every tag and --mirror every
+ref, deleting the refs of the remote that do not exist locally.
+
+An update that is not a fast-forward is rejected, unless the refspec
+starts with '+' or --force is given. The remote-tracking refs of pushed
+refs are updated, and -u makes the remote ref the upstream of each
+branch pushed.
+
+The objects are received by receive-pack in the repository, or the
+program given with --receive-pack or remote.<name>.receivepack.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := push(args)
+		if err != nil {
+			fmt.Printf("Failed to push: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var pushAll bool
+var pushMirror bool
+var pushTags bool
+var pushForce bool
+var pushDelete bool
+var pushSetUpstream bool
+var pushDryRun bool
+var pushQuiet bool
+var pushReceivePack string
+
+func init() {
+	rootCmd.AddCommand(pushCmd)
+	pushCmd.Flags().BoolVar(&pushAll, "all", false, "Push every branch.")
+	pushCmd.Flags().BoolVar(&pushMirror, "mirror", false, "Make every ref of the remote match the local refs.")
+	pushCmd.Flags().BoolVar(&pushTags, "tags", false, "Push every tag.")
+	pushCmd.Flags().BoolVarP(&pushForce, "force", "f", false, "Update refs even when the update is not a fast-forward.")
+	pushCmd.Flags().BoolVarP(&pushDelete, "delete", "d", false, "Delete the refs named on the remote.")
+	pushCmd.Flags().BoolVarP(&pushSetUpstream, "set-upstream", "u", false, "Make the remote refs pushed the upstream of the branches.")
+	pushCmd.Flags().BoolVarP(&pushDryRun, "dry-run", "n", false, "Report what would be pushed without pushing.")
+	pushCmd.Flags().BoolVarP(&pushQuiet, "quiet", "q", false, "Only report errors.")
+	pushCmd.Flags().StringVar(&pushReceivePack, "receive-pack", "", "The program run for the remote repository.")
+}
+
+// pushedRef is a local ref, or revision, pushed to a ref of the remote
+type pushedRef struct {
+	source    string
+	localName string
+	update    *transport.RefUpdate
+	force     bool
+	status    refStatus
+	rejected  bool
+}
+
+func push(args []string) error {
+	if pushDelete && len(args) < 2 {
+		return errors.New("--delete doesn't make sense without any refs")
+	}
+	if (pushAll || pushMirror) && len(args) > 1 {
+		return errors.New("--all and --mirror can't be combined with refspecs")
+	}
+
+	name := defaultRemoteName()
+	if len(args) > 0 {
+		name = args[0]
+	}
+	r, err := remote.Get(name)
+	if err == remote.ErrNotFound {
+		if len(args) == 0 || !transport.Supported(name) {
+			return fmt.Errorf("'%s' does not appear to be a git repository", name)
+		}
+		r, err = &remote.Remote{URLs: []string{name}}, nil
+	}
+	if err != nil {
+		return err
+	}
+	urls := r.PushURLList()
+	if len(urls) == 0 {
+		return fmt.Errorf("no URL configured for remote '%s'", name)
+	}
+
+	var specs []string
+	if len(args) > 1 {
+		specs = args[1:]
+	}
+	refspecs, err := pushRefspecs(r, specs)
+	if err != nil {
+		return err
+	}
+	mirror := pushMirror || (r.Mirror && len(args) < 2 && !pushAll && !pushTags)
+
+	program := pushReceivePack
+	if program == "" {
+		program = r.ReceivePack
+	}
+	failed := false
+	for _, url := range urls {
+		ok, err := pushTo(r, url, program, refspecs, mirror)
+		if err != nil {
+			return err
+		}
+		failed = failed || !ok
+	}
+	if failed {
+		return fmt.Errorf("failed to push some refs to '%s'", strings.Join(urls, "', '"))
+	}
+	return nil
+}
+
+// pushRefspecs returns the refspecs pushed, from the command line, the
+// options or the configuration of the remote
+func pushRefspecs(r *remote.Remote, args []string) ([]remote.Refspec, error) {
+	var specs []string
+	switch {
+	case pushDelete:
+		for _, arg := range args {
+			specs = append(specs, ":"+arg)
+		}
+	case len(args) > 0:
+		specs = args
+	case pushMirror || r.Mirror:
+		specs = []string{"+refs/*:refs/*"}
+	case pushAll || pushTags:
+		if pushAll {
+			specs = append(specs, "refs/heads/*:refs/heads/*")
+		}
+		if pushTags {
+			specs = append(specs, "refs/tags/*:refs/tags/*")
+		}
+	case len(r.Push) > 0:
+		return r.Push, nil
+	default:
+		branch, err := refs.CurrentBranch()
+		if err != nil {
+			return nil, err
+		}
+		if branch == "" {
+			return nil, errors.New("You are not currently on a branch.")
+		}
+		specs = []string{"refs/heads/" + branch + ":refs/heads/" + branch}
+	}
+	if pushTags && len(args) > 0 {
+		specs = append(specs, "refs/tags/*:refs/tags/*")
+	}
+	return remote.ParseRefspecs(specs, false)
+}
+
+// pushTo pushes to one URL of the remote, returning false if any ref
+// could not be updated
+func pushTo(r *remote.Remote, url string, program string, refspecs []remote.Refspec, mirror bool) (bool, error) {
+	conn, err := transport.Connect(url, transport.ReceivePackService, program)
+	if err != nil {
+		return false, err
+	}
+	pushed, err := planPush(conn.Refs, refspecs, mirror)
+	if err != nil {
+		conn.End()
+		return false, err
+	}
+
+	var updates []*transport.RefUpdate
+	for _, ref := range pushed {
+		checkPush(ref)
+		if !ref.rejected && ref.status.code != '=' {
+			updates = append(updates, ref.update)
+		}
+	}
+	if pushDryRun || len(updates) == 0 {
+		err = conn.End()
+	} else {
+		err = conn.Push(updates)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var statuses []refStatus
+	ok := true
+	for _, ref := range pushed {
+		if ref.update.Error != "" {
+			ref.status.code, ref.status.summary, ref.status.reason = '!', "[remote rejected]", ref.update.Error
+			ref.rejected = true
+		}
+		if ref.rejected {
+			ok = false
+		} else if !pushDryRun && ref.status.code != '=' {
+			err = updatePushedTrackingRef(r, ref)
+			if err != nil {
+				return false, err
+			}
+		}
+		if ref.status.code != '=' {
+			statuses = append(statuses, ref.status)
+		}
+	}
+
+	if len(statuses) == 0 {
+		fmt.Println("Everything up-to-date")
+	} else if !pushQuiet || !ok {
+		fmt.Printf("To %s\n", transport.DisplayURL(url))
+		printPushStatuses(statuses)
+	}
+	if pushSetUpstream && !pushDryRun && r.Name != "" {
+		err = setPushedUpstreams(r, pushed)
+	}
+	return ok, err
+}
+
+// planPush returns the refs of the remote that the refspecs update and
+// the local refs or revisions they are updated from
+func planPush(remoteRefs []refs.Ref, refspecs []remote.Refspec, mirror bool) ([]*pushedRef, error) {
+	remoteHashes := make(map[string]string)
+	for _, ref := range remoteRefs {
+		remoteHashes[ref.Name] = ref.Hash
+	}
+
+	var pushed []*pushedRef
+	planned := make(map[string]bool)
+	add := func(source string, localName string, hash string, destination string, force bool) {
+		if planned[destination] {
+			return
+		}
+		planned[destination] = true
+		oldHash, ok := remoteHashes[destination]
+		if !ok {
+			oldHash = refs.ZeroHash
+		}
+		pushed = append(pushed, &pushedRef{
+			source:    source,
+			localName: localName,
+			force:     force || pushForce,
+			update:    &transport.RefUpdate{Name: destination, OldHash: oldHash, NewHash: hash},
+		})
+	}
+
+	local, err := refs.IterRefs("refs/")
+	if err != nil {
+		return nil, err
+	}
+	for _, refspec := range refspecs {
+		switch {
+		case refspec.Negative:
+		case refspec.Matching:
+			for _, ref := range local {
+				if strings.HasPrefix(ref.Name, "refs/heads/") && remoteHashes[ref.Name] != "" {
+					add(ref.Name, ref.Name, ref.Hash, ref.Name, refspec.Force)
+				}
+			}
+		case refspec.Pattern:
+			for _, ref := range local {
+				destination, ok := refspec.Map(ref.Name)
+				if ok && !remote.Excluded(refspecs, ref.Name) {
+					add(ref.Name, ref.Name, ref.Hash, destination, refspec.Force)
+				}
+			}
+		case refspec.Source == "":
+			destination, ok := findPushedRemoteRef(remoteRefs, refspec.Destination)
+			if !ok {
+				return nil, fmt.Errorf("unable to delete '%s': remote ref does not exist", refspec.Destination)
+			}
+			add("", "", refs.ZeroHash, destination, true)
+		default:
+			localName, hash, err := resolvePushSource(refspec.Source)
+			if err != nil {
+				return nil, err
+			}
+			destination, err := pushDestination(remoteRefs, refspec, localName)
+			if err != nil {
+				return nil, err
+			}
+			add(refspec.Source, localName, hash, destination, refspec.Force)
+		}
+	}
+
+	if mirror {
+		// The refs of the remote that do not exist locally are deleted
+		exists := make(map[string]bool)
+		for _, ref := range local {
+			exists[ref.Name] = true
+		}
+		for _, ref := range remoteRefs {
+			if !exists[ref.Name] {
+				add("", "", refs.ZeroHash, ref.Name, true)
+			}
+		}
+	}
+	return pushed, nil
+}
+
+// resolvePushSource returns the local ref a source names, if it names
+// one, and the object it points to
+func resolvePushSource(source string) (string, string, error) {
+	if source == "HEAD" || source == "@" {
+		head, err := refs.ReadRef("HEAD")
+		if err == nil && head.Symbolic() {
+			hash, err := refs.ResolveRef(head.Target)
+			return head.Target, hash, err
+		}
+	}
+	if name, err := refs.ExpandRef(source); err == nil && strings.HasPrefix(name, "refs/") {
+		hash, err := refs.ResolveRef(name)
+		return name, hash, err
+	}
+	hash, err := revision.Resolve(source)
+	if err != nil {
+		return "", "", fmt.Errorf("src refspec %s does not match any", source)
+	}
+	return "", hash, nil
+}
+
+// pushDestination returns the ref of the remote a refspec updates. A
+// destination that is not a full ref is the ref of the remote it names,
+// or else a ref in the namespace of the local ref.
+func pushDestination(remoteRefs []refs.Ref, refspec remote.Refspec, localName string) (string, error) {
+	destination := refspec.Destination
+	if destination == "" {
+		if localName == "" {
+			return "", fmt.Errorf("the destination of '%s' must be given, as it is not a ref", refspec.Source)
+		}
+		return localName, nil
+	}
+	if strings.HasPrefix(destination, "refs/") {
+		return destination, nil
+	}
+	if name, ok := findPushedRemoteRef(remoteRefs, destination); ok {
+		return name, nil
+	}
+	switch {
+	case strings.HasPrefix(localName, "refs/heads/"):
+		return "refs/heads/" + destination, nil
+	case strings.HasPrefix(localName, "refs/tags/"):
+		return "refs/tags/" + destination, nil
+	}
+	return "", fmt.Errorf("the destination '%s' is not a full ref and the source is not a branch or tag", destination)
+}
+
+// findPushedRemoteRef finds the ref of the remote a short name names
+func findPushedRemoteRef(remoteRefs []refs.Ref, name string) (string, bool) {
+	for _, candidate := range []string{name, "refs/" + name, "refs/heads/" + name, "refs/tags/" + name} {
+		for _, ref := range remoteRefs {
+			if ref.Name == candidate {
+				return ref.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkPush decides how a ref is updated and rejects the updates the
+// remote would lose commits by, unless forced
+func checkPush(ref *pushedRef) {
+	u := ref.update
+	ref.status = refStatus{from: prettyRefName(ref.source), to: prettyRefName(u.Name)}
+
+	switch {
+	case u.OldHash == u.NewHash:
+		ref.status.code, ref.status.summary = '=', "[up to date]"
+	case u.Delete():
+		ref.status.code, ref.status.summary, ref.status.from = '-', "[deleted]", ""
+	case u.OldHash == refs.ZeroHash:
+		ref.status.code = '*'
+		switch {
+		case strings.HasPrefix(u.Name, "refs/tags/"):
+			ref.status.summary = "[new tag]"
+		case strings.HasPrefix(u.Name, "refs/heads/"):
+			ref.status.summary = "[new branch]"
+		default:
+			ref.status.summary = "[new reference]"
+		}
+	case strings.HasPrefix(u.Name, "refs/tags/") && !ref.force:
+		ref.status.code, ref.status.summary, ref.status.reason = '!', "[rejected]", "already exists"
+	case !objects.Exists(u.OldHash) && !ref.force:
+		ref.status.code, ref.status.summary, ref.status.reason = '!', "[rejected]", "fetch first"
+	case revision.IsFastForward(u.OldHash, u.NewHash):
+		ref.status.code, ref.status.summary = ' ', abbreviateHash(u.OldHash, 7)+".."+abbreviateHash(u.NewHash, 7)
+	case ref.force:
+		ref.status.code, ref.status.summary = '+', abbreviateHash(u.OldHash, 7)+"..."+abbreviateHash(u.NewHash, 7)
+		ref.status.reason = "forced update"
+	default:
+		ref.status.code, ref.status.summary, ref.status.reason = '!', "[rejected]", "non-fast-forward"
+	}
+	ref.rejected = ref.status.code == '!'
+}
+
+// updatePushedTrackingRef makes the remote-tracking ref of a pushed ref
+// match what the remote now has
+func updatePushedTrackingRef(r *remote.Remote, ref *pushedRef) error {
+	if r.Name == "" {
+		return nil
+	}
+	tracking, ok := r.TrackingRef(ref.update.Name)
+	if !ok {
+		return nil
+	}
+	if err := refs.CheckRefFormat(tracking, false); err != nil {
+		return err
+	}
+	if ref.update.Delete() {
+		if _, err := refs.ReadRef(tracking); err != nil {
+			return nil
+		}
+		return refs.DeleteRef(tracking, "")
+	}
+	return refs.UpdateRef(tracking, ref.update.NewHash, "", "update by push")
+}
+
+// setPushedUpstreams makes the branches pushed track the remote refs
+// they were pushed to
+func setPushedUpstreams(r *remote.Remote, pushed []*pushedRef) error {
+	for _, ref := range pushed {
+		if ref.rejected || ref.update.Delete() || !strings.HasPrefix(ref.localName, "refs/heads/") || !strings.HasPrefix(ref.update.Name, "refs/heads/") {
+			continue
+		}
+		branch := strings.TrimPrefix(ref.localName, "refs/heads/")
+		err := config.Set("branch."+branch+".remote", r.Name)
+		if err == nil {
+			err = config.Set("branch."+branch+".merge", ref.update.Name)
+		}
+		if err != nil {
+			return err
+		}
+		upstream, ok := r.TrackingRef(ref.update.Name)
+		if !ok {
+			upstream = remote.TrackingPrefix(r.Name) + strings.TrimPrefix(ref.update.Name, "refs/heads/")
+		}
+		fmt.Printf("branch '%s' set up to track '%s'.\n", branch, shortRefName(upstream))
+	}
+	return nil
+}
+
+// printPushStatuses prints the line of each ref pushed, with rejected
+// refs last the way git reports them
+func printPushStatuses(statuses []refStatus) {
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].code != '!' && statuses[j].code == '!'
+	})
+	for _, status := range statuses {
+		line := fmt.Sprintf(" %c %-*s ", status.code, refSummaryWidth, status.summary)
+		if status.from == "" {
+			line += status.to
+		} else {
+			line += status.from + " -> " + status.to
+		}
+		if status.reason != "" {
+			line += " (" + status.reason + ")"
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mattherman/mhgit/transport"
+	"github.com/spf13/cobra"
+)
+
+// receivePackCmd represents the receive-pack command
+var receivePackCmd = &cobra.Command{
+	Use:   "receive-pack <directory>",
+	Short: "Receive what is pushed into the repository",
+	Long: `Serve a push to the repository in the directory over standard input and
+output.
+
+The refs of the repository are advertised, then the updates of refs and
+the pack of objects they need are read. Each update is checked before it
+is applied, and its result is reported back with report-status.
+
+receive.denyDeletes refuses to delete branches, receive.denyNonFastForwards
+refuses updates that are not fast-forwards and, unless set to "ignore" or
+"warn", receive.denyCurrentBranch refuses to update the branch checked out
+in a repository with a working tree. Packs with fewer objects than
+receive.unpackLimit or transfer.unpackLimit, 100 by default, are stored
+as loose objects.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := serveRepository(args[0], transport.ReceivePack)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+			os.Exit(128)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(receivePackCmd)
+}
@@ -0,0 +1,635 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/remote"
+	"github.com/mattherman/mhgit/revision"
+)
+
+// The format git uses for dates in ref listings
+const refDateFormat = "Mon Jan 2 15:04:05 2006 -0700"
+
+// listedRef is a ref shown by branch, tag or for-each-ref. The object it
+// points to is only read once a field of the listing needs it.
+type listedRef struct {
+	refs.Ref
+	object *objects.Object
+	commit *objects.Commit
+	tag    *objects.Tag
+}
+
+func newListedRefs(refList []refs.Ref) []*listedRef {
+	var listed []*listedRef
+	for _, ref := range refList {
+		listed = append(listed, &listedRef{Ref: ref})
+	}
+	return listed
+}
+
+// readObject returns the object the ref points to
+func (r *listedRef) readObject() (*objects.Object, error) {
+	if r.object == nil {
+		obj, err := objects.ReadObject(r.Hash)
+		if err != nil {
+			return nil, err
+		}
+		r.object = &obj
+	}
+	return r.object, nil
+}
+
+// readCommit returns the commit the ref points to, or nil if the ref
+// points to another kind of object
+func (r *listedRef) readCommit() (*objects.Commit, error) {
+	if r.commit != nil {
+		return r.commit, nil
+	}
+	obj, err := r.readObject()
+	if err != nil || obj.Type() != "commit" {
+		return nil, err
+	}
+	commit, err := objects.ParseCommit(obj.Data)
+	if err != nil {
+		return nil, err
+	}
+	r.commit = &commit
+	return r.commit, nil
+}
+
+// readTag returns the annotated tag the ref points to, or nil if the
+// ref points to another kind of object
+func (r *listedRef) readTag() (*objects.Tag, error) {
+	if r.tag != nil {
+		return r.tag, nil
+	}
+	obj, err := r.readObject()
+	if err != nil || obj.Type() != "tag" {
+		return nil, err
+	}
+	tag, err := objects.ParseTag(obj.Data)
+	if err != nil {
+		return nil, err
+	}
+	r.tag = &tag
+	return r.tag, nil
+}
+
+// peeled returns the object an annotated tag points to after following
+// any chain of tags, or the object the ref points to for other refs
+func (r *listedRef) peeled() (string, error) {
+	if r.Peeled != "" {
+		return r.Peeled, nil
+	}
+	return revision.Peel(r.Hash, "")
+}
+
+// message returns the message of the commit or tag the ref points to
+func (r *listedRef) message() string {
+	if tag, err := r.readTag(); err == nil && tag != nil {
+		return tag.Message
+	}
+	commit, err := r.readCommit()
+	if err != nil || commit == nil {
+		return ""
+	}
+	return commit.Message
+}
+
+// subject returns the first paragraph of the message joined on one line
+func (r *listedRef) subject() string {
+	paragraph := strings.SplitN(strings.TrimLeft(r.message(), "\n"), "\n\n", 2)[0]
+	return strings.Join(strings.Fields(paragraph), " ")
+}
+
+// body returns the message after its first paragraph
+func (r *listedRef) body() string {
+	parts := strings.SplitN(strings.TrimLeft(r.message(), "\n"), "\n\n", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// person returns the identity of the author or committer of the commit,
+// or the tagger of the tag. The creator is whichever of the tagger and
+// the committer applies.
+func (r *listedRef) person(role string) (ident.Identity, bool) {
+	if role == "tagger" || role == "creator" {
+		if tag, err := r.readTag(); err == nil && tag != nil {
+			identity, err := ident.Parse(tag.Tagger)
+			return identity, err == nil
+		}
+		if role == "tagger" {
+			return ident.Identity{}, false
+		}
+	}
+
+	commit, err := r.readCommit()
+	if err != nil || commit == nil {
+		return ident.Identity{}, false
+	}
+	text := commit.Committer
+	if role == "author" {
+		text = commit.Author
+	}
+	identity, err := ident.Parse(text)
+	return identity, err == nil
+}
+
+// atom returns the value of a field of the format, such as "refname" or
+// "objectname:short"
+func (r *listedRef) atom(name string) (string, error) {
+	// Fields starting with "*" describe the object a tag points to
+	if strings.HasPrefix(name, "*") {
+		if tag, err := r.readTag(); err != nil || tag == nil {
+			return "", err
+		}
+		hash, err := r.peeled()
+		if err != nil {
+			return "", err
+		}
+		return (&listedRef{Ref: refs.Ref{Name: r.Name, Hash: hash}}).atom(name[1:])
+	}
+
+	field, modifier := name, ""
+	if colon := strings.Index(name, ":"); colon != -1 {
+		field, modifier = name[:colon], name[colon+1:]
+	}
+
+	switch field {
+	case "refname":
+		return formatRefName(r.Name, modifier)
+	case "objectname":
+		if modifier == "short" {
+			return r.Hash[:7], nil
+		}
+		return r.Hash, nil
+	case "objecttype":
+		obj, err := r.readObject()
+		if err != nil {
+			return "", err
+		}
+		return obj.Type(), nil
+	case "objectsize":
+		obj, err := r.readObject()
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(obj.Size()), nil
+	case "subject":
+		return r.subject(), nil
+	case "body":
+		return r.body(), nil
+	case "contents":
+		switch modifier {
+		case "subject":
+			return r.subject(), nil
+		case "body":
+			return r.body(), nil
+		}
+		return r.message(), nil
+	case "tree":
+		commit, err := r.readCommit()
+		if err != nil || commit == nil {
+			return "", err
+		}
+		return commit.Tree, nil
+	case "parent":
+		commit, err := r.readCommit()
+		if err != nil || commit == nil {
+			return "", err
+		}
+		return strings.Join(commit.Parents, " "), nil
+	case "authorname", "committername", "taggername":
+		identity, _ := r.person(strings.TrimSuffix(field, "name"))
+		return identity.Name, nil
+	case "authoremail", "committeremail", "taggeremail":
+		identity, ok := r.person(strings.TrimSuffix(field, "email"))
+		if !ok {
+			return "", nil
+		}
+		return "<" + identity.Email + ">", nil
+	case "type", "object", "tag":
+		tag, err := r.readTag()
+		if err != nil || tag == nil {
+			return "", err
+		}
+		return map[string]string{"type": tag.Type, "object": tag.Object, "tag": tag.Name}[field], nil
+	case "authordate", "committerdate", "taggerdate", "creatordate":
+		identity, ok := r.person(strings.TrimSuffix(field, "date"))
+		if !ok {
+			return "", nil
+		}
+		return formatRefDate(identity, modifier), nil
+	case "upstream":
+		upstream, ok := upstreamRef(strings.TrimPrefix(r.Name, "refs/heads/"))
+		if !ok || !strings.HasPrefix(r.Name, "refs/heads/") {
+			return "", nil
+		}
+		if modifier == "track" {
+			return trackingInfo(r.Hash, upstream, false), nil
+		}
+		if modifier == "trackshort" {
+			return trackingShort(r.Hash, upstream), nil
+		}
+		return formatRefName(upstream, modifier)
+	case "HEAD":
+		if branch, _ := refs.CurrentBranch(); branch != "" && r.Name == "refs/heads/"+branch {
+			return "*", nil
+		}
+		return " ", nil
+	case "symref":
+		if !r.Symbolic() {
+			return "", nil
+		}
+		return formatRefName(r.Target, modifier)
+	}
+	return "", fmt.Errorf("unknown field name: %s", field)
+}
+
+// formatRefName applies a modifier such as "short" or "lstrip=2" to
+// the name of a ref
+func formatRefName(name string, modifier string) (string, error) {
+	switch {
+	case modifier == "":
+		return name, nil
+	case modifier == "short":
+		return shortRefName(name), nil
+	case strings.HasPrefix(modifier, "lstrip=") || strings.HasPrefix(modifier, "strip="):
+		count, err := strconv.Atoi(modifier[strings.Index(modifier, "=")+1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid modifier: %s", modifier)
+		}
+		parts := strings.Split(name, "/")
+		if count < 0 {
+			count += len(parts)
+		}
+		if count < 0 {
+			count = 0
+		}
+		if count > len(parts) {
+			count = len(parts)
+		}
+		return strings.Join(parts[count:], "/"), nil
+	case strings.HasPrefix(modifier, "rstrip="):
+		count, err := strconv.Atoi(strings.TrimPrefix(modifier, "rstrip="))
+		if err != nil {
+			return "", fmt.Errorf("invalid modifier: %s", modifier)
+		}
+		parts := strings.Split(name, "/")
+		if count < 0 {
+			count += len(parts)
+		}
+		if count < 0 {
+			count = 0
+		}
+		if count > len(parts) {
+			count = len(parts)
+		}
+		return strings.Join(parts[:len(parts)-count], "/"), nil
+	}
+	return "", fmt.Errorf("invalid modifier: %s", modifier)
+}
+
+func formatRefDate(identity ident.Identity, modifier string) string {
+	switch modifier {
+	case "unix":
+		return strconv.FormatInt(identity.When.Unix(), 10)
+	case "raw":
+		return fmt.Sprintf("%d %s", identity.When.Unix(), identity.When.Format("-0700"))
+	case "iso", "iso8601":
+		return identity.When.Format("2006-01-02 15:04:05 -0700")
+	case "iso-strict", "iso8601-strict":
+		return identity.When.Format(time.RFC3339)
+	case "rfc", "rfc2822":
+		return identity.When.Format(time.RFC1123Z)
+	case "short":
+		return identity.When.Format("2006-01-02")
+	case "relative":
+		return ident.RelativeDate(identity.When, time.Now())
+	}
+	return identity.When.Format(refDateFormat)
+}
+
+// formatRef expands the %(field) placeholders of the format, along with
+// %% and %xx hexadecimal escapes
+func formatRef(format string, r *listedRef) (string, error) {
+	var builder strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 >= len(format) {
+			builder.WriteByte(format[i])
+			continue
+		}
+
+		switch {
+		case format[i+1] == '%':
+			builder.WriteByte('%')
+			i++
+		case format[i+1] == '(':
+			end := strings.IndexByte(format[i:], ')')
+			if end == -1 {
+				return "", fmt.Errorf("malformed format string %s", format)
+			}
+			value, err := r.atom(format[i+2 : i+end])
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(value)
+			i += end
+		case i+2 < len(format) && isHex(format[i+1:i+3]):
+			value, _ := strconv.ParseUint(format[i+1:i+3], 16, 8)
+			builder.WriteByte(byte(value))
+			i += 2
+		default:
+			builder.WriteByte('%')
+		}
+	}
+	return builder.String(), nil
+}
+
+func isHex(text string) bool {
+	_, err := strconv.ParseUint(text, 16, 64)
+	return err == nil
+}
+
+// sortRefs sorts the refs by the keys, the first key being the most
+// important. A key starting with "-" sorts in descending order and
+// "version:refname" compares version numbers within names.
+func sortRefs(listed []*listedRef, keys []string) error {
+	for _, key := range keys {
+		field := strings.TrimPrefix(key, "-")
+		if field != "version:refname" && field != "v:refname" && !knownRefField(field) {
+			return fmt.Errorf("unknown field name: %s", field)
+		}
+	}
+
+	sort.SliceStable(listed, func(i, j int) bool {
+		for _, key := range keys {
+			descending := strings.HasPrefix(key, "-")
+			field := strings.TrimPrefix(key, "-")
+			cmp := compareSortValues(field, listedSortValue(listed[i], field), listedSortValue(listed[j], field))
+			if cmp == 0 {
+				continue
+			}
+			if descending {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return listed[i].Name < listed[j].Name
+	})
+	return nil
+}
+
+// The fields that can be shown or sorted by
+var refFields = map[string]bool{
+	"refname": true, "objectname": true, "objecttype": true, "objectsize": true,
+	"subject": true, "body": true, "contents": true, "tree": true, "parent": true,
+	"authorname": true, "authoremail": true, "authordate": true,
+	"committername": true, "committeremail": true, "committerdate": true,
+	"creatordate": true, "upstream": true, "HEAD": true, "symref": true,
+	"taggername": true, "taggeremail": true, "taggerdate": true,
+	"type": true, "object": true, "tag": true,
+}
+
+func knownRefField(name string) bool {
+	name = strings.TrimPrefix(name, "*")
+	if colon := strings.Index(name, ":"); colon != -1 {
+		name = name[:colon]
+	}
+	return refFields[name]
+}
+
+// listedSortValue returns the value of the ref to sort by for the key
+func listedSortValue(r *listedRef, field string) string {
+	switch field {
+	case "version:refname", "v:refname":
+		return r.Name
+	case "authordate", "committerdate", "taggerdate", "creatordate":
+		field += ":unix"
+	}
+	value, _ := r.atom(field)
+	return value
+}
+
+func compareSortValues(field string, a string, b string) int {
+	switch field {
+	case "version:refname", "v:refname":
+		return compareVersions(a, b)
+	case "authordate", "committerdate", "taggerdate", "creatordate", "objectsize":
+		x, _ := strconv.ParseInt(a, 10, 64)
+		y, _ := strconv.ParseInt(b, 10, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// compareVersions compares names treating runs of digits as numbers,
+// so that "v1.10" sorts after "v1.9"
+func compareVersions(a string, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			i, j := digitRun(a), digitRun(b)
+			x, _ := strconv.ParseUint(a[:i], 10, 64)
+			y, _ := strconv.ParseUint(b[:j], 10, 64)
+			if x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+			a, b = a[i:], b[j:]
+			continue
+		}
+		if a[0] != b[0] {
+			if a[0] < b[0] {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func digitRun(text string) int {
+	i := 0
+	for i < len(text) && isDigit(text[i]) {
+		i++
+	}
+	return i
+}
+
+// filterRefs keeps the refs that point at a commit merged into, not
+// merged into or containing the given commits. Empty revisions are
+// not used for filtering.
+func filterRefs(listed []*listedRef, merged string, noMerged string, contains string) ([]*listedRef, error) {
+	var mergedSet, noMergedSet map[string]bool
+	var containsHash string
+	var err error
+	if merged != "" {
+		mergedSet, err = reachableFrom(merged)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if noMerged != "" {
+		noMergedSet, err = reachableFrom(noMerged)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if contains != "" {
+		containsHash, err = revision.ResolveCommit(contains)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var kept []*listedRef
+	for _, r := range listed {
+		// Tags are filtered by the commit they point to
+		hash, err := revision.Peel(r.Hash, "commit")
+		if err != nil {
+			continue
+		}
+		if mergedSet != nil && !mergedSet[hash] {
+			continue
+		}
+		if noMergedSet != nil && noMergedSet[hash] {
+			continue
+		}
+		if containsHash != "" {
+			contained, err := revision.IsAncestor(containsHash, hash)
+			if err != nil || !contained {
+				continue
+			}
+		}
+		kept = append(kept, r)
+	}
+	return kept, nil
+}
+
+func reachableFrom(rev string) (map[string]bool, error) {
+	hash, err := revision.ResolveCommit(rev)
+	if err != nil {
+		return nil, err
+	}
+	return revision.Ancestors(hash)
+}
+
+// pointsAt keeps the refs that point at the object, either directly or
+// through an annotated tag
+func pointsAt(listed []*listedRef, rev string) ([]*listedRef, error) {
+	hash, err := revision.Resolve(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []*listedRef
+	for _, r := range listed {
+		peeled, _ := r.peeled()
+		if r.Hash == hash || peeled == hash {
+			kept = append(kept, r)
+		}
+	}
+	return kept, nil
+}
+
+// upstreamRef returns the ref the branch tracks, as configured by
+// branch.<name>.remote and branch.<name>.merge
+func upstreamRef(branch string) (string, bool) {
+	cfg, err := config.Read()
+	if err != nil {
+		return "", false
+	}
+	remoteName, hasRemote := cfg.Get("branch." + branch + ".remote")
+	merge, hasMerge := cfg.Get("branch." + branch + ".merge")
+	if !hasRemote || !hasMerge {
+		return "", false
+	}
+	if remoteName == "." {
+		return merge, true
+	}
+	// The fetch refspecs of the remote decide where the branch is fetched
+	if r, err := remote.Get(remoteName); err == nil && len(r.Fetch) > 0 {
+		return r.TrackingRef(merge)
+	}
+	return remote.TrackingPrefix(remoteName) + strings.TrimPrefix(merge, "refs/heads/"), true
+}
+
+// trackingInfo describes how a branch compares to its upstream, such as
+// "[origin/main: ahead 1, behind 2]"
+func trackingInfo(hash string, upstream string, withName bool) string {
+	name := shortRefName(upstream)
+	upstreamHash, err := refs.ResolveRef(upstream)
+	if err != nil {
+		if withName {
+			return fmt.Sprintf("[%s: gone]", name)
+		}
+		return "[gone]"
+	}
+
+	ahead, behind, err := revision.AheadBehind(hash, upstreamHash)
+	if err != nil {
+		return ""
+	}
+	var counts []string
+	if ahead > 0 {
+		counts = append(counts, fmt.Sprintf("ahead %d", ahead))
+	}
+	if behind > 0 {
+		counts = append(counts, fmt.Sprintf("behind %d", behind))
+	}
+
+	switch {
+	case withName && len(counts) == 0:
+		return fmt.Sprintf("[%s]", name)
+	case withName:
+		return fmt.Sprintf("[%s: %s]", name, strings.Join(counts, ", "))
+	case len(counts) == 0:
+		return ""
+	}
+	return fmt.Sprintf("[%s]", strings.Join(counts, ", "))
+}
+
+// trackingShort describes how a branch compares to its upstream with
+// one of ">", "<", "<>" or "="
+func trackingShort(hash string, upstream string) string {
+	upstreamHash, err := refs.ResolveRef(upstream)
+	if err != nil {
+		return ""
+	}
+	ahead, behind, err := revision.AheadBehind(hash, upstreamHash)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case ahead > 0 && behind > 0:
+		return "<>"
+	case ahead > 0:
+		return ">"
+	case behind > 0:
+		return "<"
+	}
+	return "="
+}
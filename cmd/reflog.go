@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/spf13/cobra"
+)
+
+// How long reflog entries are kept when gc.reflogExpire is not set
+const defaultReflogExpiry = 90 * 24 * time.Hour
+
+// reflogCmd represents the reflog command
+var reflogCmd = &cobra.Command{
+	Use:   "reflog [show] [<ref>]",
+	Short: "Manage reflog information",
+	Long: `Manage reflog information.
+
+The reflog records every update of HEAD and the branches, so earlier
+states can be recovered with revisions such as HEAD@{1} or
+main@{yesterday}. Without a subcommand, the reflog of the ref is shown.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		showReflog(args)
+	},
+}
+
+var reflogShowCmd = &cobra.Command{
+	Use:   "show [<ref>]",
+	Short: "Show the reflog of a ref, HEAD by default",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		showReflog(args)
+	},
+}
+
+var reflogExpireCmd = &cobra.Command{
+	Use:   "expire [--expire=<time>] [--all] [<ref>...]",
+	Short: "Prune reflog entries older than the expiry time",
+	Run: func(cmd *cobra.Command, args []string) {
+		expireReflogs(args)
+	},
+}
+
+var reflogDeleteCmd = &cobra.Command{
+	Use:   "delete <ref>@{<n>}...",
+	Short: "Delete single entries from the reflog",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteReflogEntries(args)
+	},
+}
+
+var reflogExpire string
+var reflogExpireAll bool
+var reflogDryRun bool
+
+func init() {
+	rootCmd.AddCommand(reflogCmd)
+	reflogCmd.AddCommand(reflogShowCmd)
+	reflogCmd.AddCommand(reflogExpireCmd)
+	reflogCmd.AddCommand(reflogDeleteCmd)
+	reflogExpireCmd.Flags().StringVar(&reflogExpire, "expire", "", "Prune entries older than the time, such as '30.days.ago', 'now' or 'never'. Defaults to gc.reflogExpire or 90 days.")
+	reflogExpireCmd.Flags().BoolVar(&reflogExpireAll, "all", false, "Process the reflogs of all refs.")
+	reflogExpireCmd.Flags().BoolVarP(&reflogDryRun, "dry-run", "n", false, "Only show how many entries would be pruned.")
+}
+
+func showReflog(args []string) {
+	name := "HEAD"
+	if len(args) > 0 {
+		name = args[0]
+	}
+
+	fullName, err := refs.ExpandRef(name)
+	if err != nil {
+		fmt.Printf("Failed to find the ref %s: %v\n", name, err)
+		return
+	}
+
+	entries, err := refs.ReadReflog(fullName)
+	if err != nil {
+		fmt.Printf("Failed to read the reflog: %v\n", err)
+		return
+	}
+
+	for i, entry := range entries {
+		fmt.Printf("%s %s@{%d}: %s\n", entry.New[:7], name, i, entry.Message)
+	}
+}
+
+func expireReflogs(args []string) {
+	expiry, err := reflogExpiryTime()
+	if err != nil {
+		fmt.Printf("Failed to parse the expiry time: %v\n", err)
+		return
+	}
+
+	names := args
+	if reflogExpireAll {
+		names, err = refs.ListReflogs()
+		if err != nil {
+			fmt.Printf("Failed to list the reflogs: %v\n", err)
+			return
+		}
+	}
+
+	for _, name := range names {
+		fullName, err := refs.ExpandRef(name)
+		if err != nil {
+			fmt.Printf("Failed to find the ref %s: %v\n", name, err)
+			continue
+		}
+
+		if reflogDryRun {
+			entries, err := refs.ReadReflog(fullName)
+			if err != nil {
+				fmt.Printf("Failed to read the reflog of %s: %v\n", name, err)
+				continue
+			}
+			count := 0
+			for _, entry := range entries {
+				if entry.Identity.When.Before(expiry) {
+					count++
+				}
+			}
+			fmt.Printf("would prune %d entries of %s\n", count, name)
+			continue
+		}
+
+		_, err = refs.ExpireReflog(fullName, expiry)
+		if err != nil {
+			fmt.Printf("Failed to expire the reflog of %s: %v\n", name, err)
+		}
+	}
+}
+
+// reflogExpiryTime returns the time before which entries are pruned
+func reflogExpiryTime() (time.Time, error) {
+	now := time.Now()
+	expire := reflogExpire
+	if expire == "" {
+		cfg, err := config.Read()
+		if err != nil {
+			return time.Time{}, err
+		}
+		expire, _ = cfg.Get("gc.reflogExpire")
+	}
+
+	switch strings.ToLower(expire) {
+	case "":
+		return now.Add(-defaultReflogExpiry), nil
+	case "never", "false":
+		return time.Time{}, nil
+	case "all":
+		// Entries written this second are pruned as well
+		return now.Add(time.Second), nil
+	}
+	return ident.ParseApproxDate(expire, now)
+}
+
+func deleteReflogEntries(args []string) {
+	// Entries are deleted newest last, so the numbers of the remaining
+	// entries of the same ref stay the same
+	selectors := make(map[string][]int)
+	var names []string
+	for _, arg := range args {
+		at := strings.Index(arg, "@{")
+		if at == -1 || !strings.HasSuffix(arg, "}") {
+			fmt.Printf("Failed to delete %s: not a reflog entry\n", arg)
+			return
+		}
+		n, err := strconv.Atoi(arg[at+2 : len(arg)-1])
+		if err != nil || n < 0 {
+			fmt.Printf("Failed to delete %s: not a reflog entry\n", arg)
+			return
+		}
+
+		name := arg[:at]
+		if name == "" {
+			name = "HEAD"
+		}
+		fullName, err := refs.ExpandRef(name)
+		if err != nil {
+			fmt.Printf("Failed to find the ref %s: %v\n", name, err)
+			return
+		}
+		if _, ok := selectors[fullName]; !ok {
+			names = append(names, fullName)
+		}
+		selectors[fullName] = append(selectors[fullName], n)
+	}
+
+	for _, name := range names {
+		numbers := selectors[name]
+		sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+		for i, n := range numbers {
+			if i > 0 && numbers[i-1] == n {
+				continue
+			}
+			err := refs.DeleteReflogEntry(name, n)
+			if err != nil {
+				fmt.Printf("Failed to delete the reflog entry: %v\n", err)
+				return
+			}
+		}
+	}
+}
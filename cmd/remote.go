@@ -0,0 +1,1004 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/remote"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/mattherman/mhgit/transport"
+	"github.com/spf13/cobra"
+)
+
+// remoteCmd represents the remote command
+var remoteCmd = &cobra.Command{
+	Use:   "remote [-v]",
+	Short: "Manage the set of tracked repositories",
+	Long: `Manage the set of tracked repositories.
+
+Each remote has the URL of another repository along with refspecs, such
+as "+refs/heads/*:refs/remotes/origin/*", which map its branches to the
+remote-tracking branches they are fetched into. Without a subcommand,
+the names of the remotes are listed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := listRemotes(remoteVerbose)
+		if err != nil {
+			fmt.Printf("Failed to list remotes: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var remoteAddCmd = &cobra.Command{
+	Use:   "add [-t <branch>] [-m <master>] [--mirror=(fetch|push)] [--tags|--no-tags] <name> <url>",
+	Short: "Add a remote for the repository at the URL",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := addRemote(args[0], args[1], cmd.Flags().Changed("mirror"))
+		if err != nil {
+			fmt.Printf("Failed to add remote: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var remoteRemoveCmd = &cobra.Command{
+	Use:     "remove <name>",
+	Aliases: []string{"rm"},
+	Short:   "Remove a remote along with its remote-tracking branches and configuration",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := removeRemote(args[0])
+		if err != nil {
+			fmt.Printf("Failed to remove remote: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var remoteRenameCmd = &cobra.Command{
+	Use:   "rename <old> <new>",
+	Short: "Rename a remote along with its remote-tracking branches and configuration",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := renameRemote(args[0], args[1])
+		if err != nil {
+			fmt.Printf("Failed to rename remote: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var remoteSetURLCmd = &cobra.Command{
+	Use:   "set-url [--push] [--add | --delete] <name> <newurl> [<oldurl>]",
+	Short: "Change the URLs of a remote",
+	Long: `Change the URLs of a remote.
+
+The URL matching the regular expression <oldurl>, or the first URL, is
+replaced by <newurl>. With --add the URL is added instead, and with
+--delete the URLs matching the regular expression are removed.`,
+	Args: cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := setRemoteURL(args)
+		if err != nil {
+			fmt.Printf("Failed to set the URL: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var remoteShowCmd = &cobra.Command{
+	Use:   "show [-n] <name>...",
+	Short: "Show information about remotes",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, name := range args {
+			err := showRemote(name, remoteShowNoQuery)
+			if err != nil {
+				fmt.Printf("Failed to show remote: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+var remotePruneCmd = &cobra.Command{
+	Use:   "prune [-n] <name>...",
+	Short: "Delete remote-tracking branches whose branch no longer exists on the remote",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, name := range args {
+			err := pruneRemote(name, remotePruneDryRun)
+			if err != nil {
+				fmt.Printf("Failed to prune remote: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+var remoteVerbose bool
+var remoteAddTrack []string
+var remoteAddMaster string
+var remoteAddMirror string
+var remoteAddTags bool
+var remoteAddNoTags bool
+var remoteSetURLPush bool
+var remoteSetURLAdd bool
+var remoteSetURLDelete bool
+var remoteShowNoQuery bool
+var remotePruneDryRun bool
+
+func init() {
+	rootCmd.AddCommand(remoteCmd)
+	remoteCmd.AddCommand(remoteAddCmd)
+	remoteCmd.AddCommand(remoteRemoveCmd)
+	remoteCmd.AddCommand(remoteRenameCmd)
+	remoteCmd.AddCommand(remoteSetURLCmd)
+	remoteCmd.AddCommand(remoteShowCmd)
+	remoteCmd.AddCommand(remotePruneCmd)
+	remoteCmd.Flags().BoolVarP(&remoteVerbose, "verbose", "v", false, "Show the URLs of each remote.")
+	remoteAddCmd.Flags().StringSliceVarP(&remoteAddTrack, "track", "t", nil, "Only fetch the branch instead of every branch. Can be given more than once.")
+	remoteAddCmd.Flags().StringVarP(&remoteAddMaster, "master", "m", "", "Point refs/remotes/<name>/HEAD at the branch of the remote.")
+	remoteAddCmd.Flags().StringVar(&remoteAddMirror, "mirror", "", "With 'fetch', fetch every ref of the remote into the same ref locally. With 'push', make pushes mirror every local ref.")
+	remoteAddCmd.Flags().BoolVar(&remoteAddTags, "tags", false, "Fetch every tag of the remote.")
+	remoteAddCmd.Flags().BoolVar(&remoteAddNoTags, "no-tags", false, "Do not fetch tags from the remote.")
+	remoteAddCmd.Flags().Lookup("mirror").NoOptDefVal = "both"
+	remoteSetURLCmd.Flags().BoolVar(&remoteSetURLPush, "push", false, "Change the push URLs instead of the fetch URLs.")
+	remoteSetURLCmd.Flags().BoolVar(&remoteSetURLAdd, "add", false, "Add the URL instead of replacing one.")
+	remoteSetURLCmd.Flags().BoolVar(&remoteSetURLDelete, "delete", false, "Delete the URLs matching the regular expression.")
+	remoteShowCmd.Flags().BoolVarP(&remoteShowNoQuery, "no-query", "n", false, "Only show the cached information, without querying the remote.")
+	remotePruneCmd.Flags().BoolVarP(&remotePruneDryRun, "dry-run", "n", false, "Only report which branches would be pruned.")
+}
+
+func listRemotes(verbose bool) error {
+	names, err := remote.List()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !verbose {
+			fmt.Println(name)
+			continue
+		}
+		r, err := remote.Get(name)
+		if err != nil {
+			return err
+		}
+		if url := r.URL(); url != "" {
+			fmt.Printf("%s\t%s (fetch)\n", name, url)
+		}
+		for _, url := range r.PushURLList() {
+			fmt.Printf("%s\t%s (push)\n", name, url)
+		}
+	}
+	return nil
+}
+
+func addRemote(name string, url string, mirror bool) error {
+	mirrorFetch := mirror && remoteAddMirror != "push"
+	mirrorPush := mirror && remoteAddMirror != "fetch"
+	switch {
+	case mirror && remoteAddMirror != "fetch" && remoteAddMirror != "push" && remoteAddMirror != "both":
+		return fmt.Errorf("unknown mirror argument: %s", remoteAddMirror)
+	case remoteAddMaster != "" && mirror:
+		return fmt.Errorf("specifying a master branch makes no sense with --mirror")
+	case len(remoteAddTrack) > 0 && mirrorPush:
+		return fmt.Errorf("specifying branches to track makes sense only with fetch mirrors")
+	}
+
+	err := remote.CheckName(name)
+	if err != nil {
+		return err
+	}
+	if remote.Exists(name) {
+		return fmt.Errorf("remote %s already exists", name)
+	}
+
+	var fetch []string
+	switch {
+	case mirrorFetch:
+		fetch = []string{"+refs/*:refs/*"}
+	case mirrorPush:
+	case len(remoteAddTrack) > 0:
+		for _, branch := range remoteAddTrack {
+			fetch = append(fetch, fmt.Sprintf("+refs/heads/%s:%s%s", branch, remote.TrackingPrefix(name), branch))
+		}
+	default:
+		fetch = []string{remote.DefaultFetchRefspec(name)}
+	}
+	for _, refspec := range fetch {
+		if _, err := remote.ParseRefspec(refspec, true); err != nil {
+			return err
+		}
+	}
+
+	section := "remote." + name + "."
+	err = config.Set(section+"url", url)
+	if err != nil {
+		return err
+	}
+	for _, refspec := range fetch {
+		err = config.Add(section+"fetch", refspec)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mirrorPush {
+		err = config.Set(section+"mirror", "true")
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case remoteAddTags:
+		err = config.Set(section+"tagOpt", "--tags")
+	case remoteAddNoTags:
+		err = config.Set(section+"tagOpt", "--no-tags")
+	}
+	if err != nil {
+		return err
+	}
+
+	if remoteAddMaster != "" {
+		prefix := remote.TrackingPrefix(name)
+		return refs.UpdateSymbolicRef(prefix+"HEAD", prefix+remoteAddMaster, "")
+	}
+	return nil
+}
+
+// getRemote reads the configuration of a remote, with an error naming
+// it if it does not exist
+func getRemote(name string) (*remote.Remote, error) {
+	r, err := remote.Get(name)
+	if err == remote.ErrNotFound {
+		return nil, fmt.Errorf("no such remote: '%s'", name)
+	}
+	return r, err
+}
+
+func removeRemote(name string) error {
+	r, err := getRemote(name)
+	if err != nil {
+		return err
+	}
+
+	tracking, err := r.TrackingRefs()
+	if err != nil {
+		return err
+	}
+	others, err := otherRemotes(name)
+	if err != nil {
+		return err
+	}
+
+	// Refs outside refs/remotes/ are usually local branches fetched by a
+	// mirror, so they are kept, as are refs another remote fetches into
+	var removed []refs.Ref
+	var skipped []string
+	for _, ref := range tracking {
+		if !strings.HasPrefix(ref.Name, "refs/remotes/") {
+			if strings.HasPrefix(ref.Name, "refs/heads/") {
+				skipped = append(skipped, strings.TrimPrefix(ref.Name, "refs/heads/"))
+			}
+			continue
+		}
+		if !fetchedByAny(others, ref.Name) {
+			removed = append(removed, ref)
+		}
+	}
+	if head, err := refs.ReadRef(remote.TrackingPrefix(name) + "HEAD"); err == nil && head.Symbolic() {
+		removed = append(removed, head)
+	}
+
+	err = updateBranchRemotes(name, "")
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range removed {
+		if ref.Symbolic() {
+			err = refs.DeleteSymbolicRef(ref.Name)
+		} else {
+			err = refs.DeleteRef(ref.Name, ref.Hash)
+		}
+		if err != nil && err != refs.ErrNotFound {
+			return err
+		}
+	}
+
+	err = config.RenameSection("remote."+name, "")
+	if err != nil {
+		return err
+	}
+
+	switch len(skipped) {
+	case 0:
+	case 1:
+		fmt.Println("Note: A branch outside the refs/remotes/ hierarchy was not removed;")
+		fmt.Println("to delete it, use:")
+	default:
+		fmt.Println("Note: Some branches outside the refs/remotes/ hierarchy were not removed;")
+		fmt.Println("to delete them, use:")
+	}
+	for _, branch := range skipped {
+		fmt.Printf("  mhgit branch -d %s\n", branch)
+	}
+	return nil
+}
+
+// otherRemotes reads the configuration of every remote but the named one
+func otherRemotes(name string) ([]*remote.Remote, error) {
+	names, err := remote.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var others []*remote.Remote
+	for _, other := range names {
+		if other == name {
+			continue
+		}
+		r, err := remote.Get(other)
+		if err != nil {
+			return nil, err
+		}
+		others = append(others, r)
+	}
+	return others, nil
+}
+
+// fetchedByAny returns true if one of the remotes fetches into the ref
+func fetchedByAny(remotes []*remote.Remote, name string) bool {
+	for _, r := range remotes {
+		if _, ok := r.RemoteRef(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// updateBranchRemotes points the branches that fetch from or push to
+// the remote at its new name, or forgets their upstream if the new name
+// is empty because the remote is removed
+func updateBranchRemotes(oldName string, newName string) error {
+	cfg, err := config.Read()
+	if err != nil {
+		return err
+	}
+
+	update := func(key string, forget ...string) error {
+		value, ok := cfg.Get(key)
+		if !ok || value != oldName {
+			return nil
+		}
+		if newName != "" {
+			return config.Set(key, newName)
+		}
+		for _, k := range append([]string{key}, forget...) {
+			if err := config.Unset(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, branch := range cfg.Subsections("branch") {
+		section := "branch." + branch + "."
+		err = update(section+"remote", section+"merge")
+		if err == nil {
+			err = update(section + "pushremote")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return update("remote.pushdefault")
+}
+
+func renameRemote(oldName string, newName string) error {
+	r, err := getRemote(oldName)
+	if err != nil {
+		return err
+	}
+	err = remote.CheckName(newName)
+	if err != nil {
+		return err
+	}
+	if remote.Exists(newName) {
+		return fmt.Errorf("remote %s already exists", newName)
+	}
+
+	err = config.RenameSection("remote."+oldName, "remote."+newName)
+	if err != nil {
+		return err
+	}
+
+	// Refspecs fetching into the remote-tracking refs of the old name
+	// now fetch into those of the new name
+	oldPrefix, newPrefix := remote.TrackingPrefix(oldName), remote.TrackingPrefix(newName)
+	if len(r.Fetch) > 0 {
+		err = config.Unset("remote." + newName + ".fetch")
+		if err != nil {
+			return err
+		}
+		for _, refspec := range r.Fetch {
+			if strings.HasPrefix(refspec.Destination, oldPrefix) {
+				refspec.Destination = newPrefix + strings.TrimPrefix(refspec.Destination, oldPrefix)
+			}
+			err = config.Add("remote."+newName+".fetch", refspec.String())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = updateBranchRemotes(oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	tracking, err := refs.IterRefs(oldPrefix)
+	if err != nil {
+		return err
+	}
+	for _, ref := range tracking {
+		if ref.Symbolic() {
+			continue
+		}
+		renamed := newPrefix + strings.TrimPrefix(ref.Name, oldPrefix)
+		err = refs.RenameRef(ref.Name, renamed, fmt.Sprintf("remote: renamed %s to %s", ref.Name, renamed))
+		if err != nil {
+			return err
+		}
+	}
+	for _, ref := range tracking {
+		if !ref.Symbolic() {
+			continue
+		}
+		err = refs.DeleteSymbolicRef(ref.Name)
+		if err != nil {
+			return err
+		}
+		target := ref.Target
+		if strings.HasPrefix(target, oldPrefix) {
+			target = newPrefix + strings.TrimPrefix(target, oldPrefix)
+		}
+		err = refs.UpdateSymbolicRef(newPrefix+strings.TrimPrefix(ref.Name, oldPrefix), target, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setRemoteURL(args []string) error {
+	name, newURL := args[0], args[1]
+	r, err := getRemote(name)
+	if err != nil {
+		return err
+	}
+
+	key := "remote." + name + ".url"
+	urls := r.URLs
+	if remoteSetURLPush {
+		key = "remote." + name + ".pushurl"
+		urls = r.PushURLs
+	}
+
+	switch {
+	case remoteSetURLAdd && remoteSetURLDelete:
+		return fmt.Errorf("--add and --delete cannot be used together")
+	case remoteSetURLAdd || remoteSetURLDelete:
+		if len(args) > 2 {
+			return fmt.Errorf("too many arguments")
+		}
+	}
+	if remoteSetURLAdd {
+		return config.Add(key, newURL)
+	}
+	if !remoteSetURLDelete && len(args) == 2 {
+		return config.Set(key, newURL)
+	}
+
+	// The old URLs are given by a regular expression, which must match
+	pattern := newURL
+	if len(args) == 3 {
+		pattern = args[2]
+	}
+	matcher, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid old URL pattern: %s", pattern)
+	}
+	matches := 0
+	for _, url := range urls {
+		if matcher.MatchString(url) {
+			matches++
+		}
+	}
+	if matches == 0 {
+		return fmt.Errorf("no such URL found: %s", pattern)
+	}
+
+	if remoteSetURLDelete {
+		if !remoteSetURLPush && matches == len(urls) {
+			return fmt.Errorf("will not delete all non-push URLs")
+		}
+		return config.UnsetMatching(key, matcher.MatchString)
+	}
+
+	// Only the first matching URL is replaced, keeping the order
+	err = config.Unset(key)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for _, url := range urls {
+		if !replaced && matcher.MatchString(url) {
+			url, replaced = newURL, true
+		}
+		err = config.Add(key, url)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func showRemote(name string, noQuery bool) error {
+	r, err := getRemote(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("* remote %s\n", name)
+	fetchURL := r.URL()
+	if fetchURL == "" {
+		fetchURL = "(no URL)"
+	}
+	fmt.Printf("  Fetch URL: %s\n", fetchURL)
+	pushURLs := r.PushURLList()
+	if len(pushURLs) == 0 {
+		pushURLs = []string{"(no URL)"}
+	}
+	for _, url := range pushURLs {
+		fmt.Printf("  Push  URL: %s\n", url)
+	}
+
+	var remoteRefs []refs.Ref
+	if noQuery {
+		fmt.Println("  HEAD branch: (not queried)")
+		err = showTrackedBranches(r)
+	} else {
+		var head refs.Ref
+		remoteRefs, head, err = transport.ListRefs(r.URL(), r.UploadPack)
+		if err != nil {
+			return err
+		}
+		showRemoteHead(remoteRefs, head)
+		err = showRemoteBranches(r, remoteRefs)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = showPullBranches(name)
+	if err != nil {
+		return err
+	}
+	if r.Mirror {
+		fmt.Println("  Local refs will be mirrored by 'mhgit push'")
+		return nil
+	}
+	if noQuery {
+		return showPushRefspecs(r)
+	}
+	return showPushStatus(r, remoteRefs)
+}
+
+func plural(count int, suffix string) string {
+	if count == 1 {
+		return ""
+	}
+	return suffix
+}
+
+// showTrackedBranches lists the branches of the remote that have
+// remote-tracking branches, without querying the remote
+func showTrackedBranches(r *remote.Remote) error {
+	tracking, err := r.TrackingRefs()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, ref := range tracking {
+		if source, ok := r.RemoteRef(ref.Name); ok && !ref.Symbolic() {
+			names = append(names, strings.TrimPrefix(source, "refs/heads/"))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	fmt.Printf("  Remote branch%s: (status not queried)\n", plural(len(names), "es"))
+	for _, name := range names {
+		fmt.Printf("    %s\n", name)
+	}
+	return nil
+}
+
+// showRemoteHead shows the branch HEAD of the remote points to. When
+// HEAD is detached, the branches pointing to the same commit are shown.
+func showRemoteHead(remoteRefs []refs.Ref, head refs.Ref) {
+	if head.Symbolic() && head.Hash != "" {
+		fmt.Printf("  HEAD branch: %s\n", strings.TrimPrefix(head.Target, "refs/heads/"))
+		return
+	}
+
+	var candidates []string
+	for _, ref := range remoteRefs {
+		if head.Hash != "" && ref.Hash == head.Hash && strings.HasPrefix(ref.Name, "refs/heads/") {
+			candidates = append(candidates, strings.TrimPrefix(ref.Name, "refs/heads/"))
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		fmt.Println("  HEAD branch: (unknown)")
+	case 1:
+		fmt.Printf("  HEAD branch: %s\n", candidates[0])
+	default:
+		fmt.Println("  HEAD branch (remote HEAD is ambiguous, may be one of the following):")
+		for _, candidate := range candidates {
+			fmt.Printf("    %s\n", candidate)
+		}
+	}
+}
+
+// showRemoteBranches shows whether each branch of the remote is tracked
+// or would be new to the next fetch, and which remote-tracking branches
+// are stale because their branch no longer exists on the remote
+func showRemoteBranches(r *remote.Remote, remoteRefs []refs.Ref) error {
+	states := make(map[string]string)
+	for _, ref := range remoteRefs {
+		destination, ok := r.TrackingRef(ref.Name)
+		if !ok {
+			continue
+		}
+		state := "tracked"
+		if _, err := refs.ReadRef(destination); err != nil {
+			state = fmt.Sprintf("new (next fetch will store in remotes/%s)", r.Name)
+		}
+		states[strings.TrimPrefix(ref.Name, "refs/heads/")] = state
+	}
+
+	stale, err := staleTrackingRefs(r, remoteRefs)
+	if err != nil {
+		return err
+	}
+	for _, ref := range stale {
+		states[ref.Name] = "stale (use 'mhgit remote prune' to remove)"
+	}
+
+	if len(states) == 0 {
+		return nil
+	}
+	var names []string
+	width := 0
+	for name := range states {
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	fmt.Printf("  Remote branch%s:\n", plural(len(names), "es"))
+	for _, name := range names {
+		fmt.Printf("    %-*s %s\n", width, name, states[name])
+	}
+	return nil
+}
+
+// showPullBranches shows the local branches that merge with or rebase
+// onto a branch of the remote
+func showPullBranches(name string) error {
+	cfg, err := config.Read()
+	if err != nil {
+		return err
+	}
+
+	type pullBranch struct {
+		name   string
+		merges []string
+		rebase string
+	}
+	var branches []pullBranch
+	width := 0
+	for _, branch := range cfg.Subsections("branch") {
+		section := "branch." + branch + "."
+		if value, _ := cfg.Get(section + "remote"); value != name {
+			continue
+		}
+		merges := cfg.GetAll(section + "merge")
+		if len(merges) == 0 {
+			continue
+		}
+		rebase, _ := cfg.Get(section + "rebase")
+		branches = append(branches, pullBranch{name: branch, merges: merges, rebase: rebase})
+		if len(branch) > width {
+			width = len(branch)
+		}
+	}
+	if len(branches) == 0 {
+		return nil
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].name < branches[j].name
+	})
+
+	actions := make([]string, len(branches))
+	anyRebase := false
+	for i, branch := range branches {
+		switch strings.ToLower(branch.rebase) {
+		case "", "false", "no", "off", "0":
+		case "interactive", "i":
+			actions[i] = "rebases interactively onto remote"
+		default:
+			actions[i] = "rebases onto remote"
+		}
+		anyRebase = anyRebase || actions[i] != ""
+	}
+
+	fmt.Printf("  Local branch%s configured for 'mhgit pull':\n", plural(len(branches), "es"))
+	for i, branch := range branches {
+		action := actions[i]
+		if action == "" {
+			// Lined up with "rebases onto remote" the way git does
+			action = "merges with remote"
+			if anyRebase {
+				action = " " + action
+			}
+		}
+		fmt.Printf("    %-*s %s %s\n", width, branch.name, action, strings.TrimPrefix(branch.merges[0], "refs/heads/"))
+		for _, merge := range branch.merges[1:] {
+			fmt.Printf("    %-*s    and with remote %s\n", width, "", strings.TrimPrefix(merge, "refs/heads/"))
+		}
+	}
+	return nil
+}
+
+// showPushRefspecs shows the push refspecs of the remote as they are
+// configured, without querying the remote
+func showPushRefspecs(r *remote.Remote) error {
+	if len(r.Push) == 0 {
+		fmt.Println("  Local ref configured for 'mhgit push' (status not queried):")
+		fmt.Println("    (matching) pushes to (matching)")
+		return nil
+	}
+
+	refspecs := append([]remote.Refspec(nil), r.Push...)
+	sort.SliceStable(refspecs, func(i, j int) bool {
+		return refspecs[i].Source < refspecs[j].Source
+	})
+	width := 0
+	for _, refspec := range refspecs {
+		if len(refspec.Source) > width {
+			width = len(refspec.Source)
+		}
+	}
+	fmt.Printf("  Local ref%s configured for 'mhgit push' (status not queried):\n", plural(len(refspecs), "s"))
+	for _, refspec := range refspecs {
+		source, destination := refspec.Source, refspec.Destination
+		switch {
+		case refspec.Matching:
+			source, destination = "(matching)", "(matching)"
+		case source == "":
+			source = "(delete)"
+		case destination == "":
+			destination = source
+		}
+		action := "pushes to"
+		if refspec.Force {
+			action = "forces to"
+		}
+		fmt.Printf("    %-*s %s %s\n", width, source, action, destination)
+	}
+	return nil
+}
+
+// pushStatus describes how pushing a local ref would update a ref of
+// the remote
+type pushStatus struct {
+	source      string
+	destination string
+	force       bool
+	status      string
+}
+
+// showPushStatus shows what pushing to the remote would do for each
+// local branch that its push refspecs select, or for each branch that
+// also exists on the remote when no push refspecs are configured
+func showPushStatus(r *remote.Remote, remoteRefs []refs.Ref) error {
+	remoteHashes := make(map[string]string)
+	for _, ref := range remoteRefs {
+		remoteHashes[ref.Name] = ref.Hash
+	}
+	branches, err := refs.IterRefs("refs/heads/")
+	if err != nil {
+		return err
+	}
+
+	refspecs := r.Push
+	if len(refspecs) == 0 {
+		refspecs = []remote.Refspec{{Matching: true}}
+	}
+
+	var pushes []pushStatus
+	for _, refspec := range refspecs {
+		switch {
+		case refspec.Negative:
+		case refspec.Matching:
+			for _, branch := range branches {
+				if _, ok := remoteHashes[branch.Name]; ok && !remote.Excluded(refspecs, branch.Name) {
+					pushes = append(pushes, pushStatus{source: branch.Name, destination: branch.Name, force: refspec.Force})
+				}
+			}
+		case refspec.Pattern:
+			for _, branch := range branches {
+				if destination, ok := refspec.Map(branch.Name); ok && !remote.Excluded(refspecs, branch.Name) {
+					pushes = append(pushes, pushStatus{source: branch.Name, destination: destination, force: refspec.Force})
+				}
+			}
+		case refspec.Source == "":
+			pushes = append(pushes, pushStatus{destination: refspec.Destination, status: "delete"})
+		default:
+			source, err := refs.ExpandRef(refspec.Source)
+			if err != nil {
+				continue
+			}
+			destination := refspec.Destination
+			if destination == "" {
+				destination = source
+			}
+			pushes = append(pushes, pushStatus{source: source, destination: destination, force: refspec.Force})
+		}
+	}
+	if len(pushes) == 0 {
+		return nil
+	}
+
+	sourceWidth, destinationWidth := 0, 0
+	for i := range pushes {
+		push := &pushes[i]
+		if push.status == "" {
+			push.status = pushState(push.source, remoteHashes[push.destination])
+		}
+		push.source = shortRefName(push.source)
+		push.destination = shortRefName(push.destination)
+		if len(push.source) > sourceWidth {
+			sourceWidth = len(push.source)
+		}
+		if len(push.destination) > destinationWidth {
+			destinationWidth = len(push.destination)
+		}
+	}
+	sort.SliceStable(pushes, func(i, j int) bool {
+		return pushes[i].source < pushes[j].source
+	})
+
+	fmt.Printf("  Local ref%s configured for 'mhgit push':\n", plural(len(pushes), "s"))
+	for _, push := range pushes {
+		action := "pushes to"
+		if push.force {
+			action = "forces to"
+		}
+		fmt.Printf("    %-*s %s %-*s (%s)\n", sourceWidth, push.source, action, destinationWidth, push.destination, push.status)
+	}
+	return nil
+}
+
+// pushState compares a local ref with the commit of the remote it would
+// replace
+func pushState(source string, remoteHash string) string {
+	if remoteHash == "" {
+		return "create"
+	}
+	localHash, err := refs.ResolveRef(source)
+	if err != nil {
+		return "local out of date"
+	}
+	if localHash == remoteHash {
+		return "up to date"
+	}
+	if ancestor, err := revision.IsAncestor(remoteHash, localHash); err == nil && ancestor {
+		return "fast-forwardable"
+	}
+	return "local out of date"
+}
+
+// staleTrackingRefs returns the remote-tracking refs of the remote that
+// are fetched from refs which no longer exist on the remote
+func staleTrackingRefs(r *remote.Remote, remoteRefs []refs.Ref) ([]refs.Ref, error) {
+	exists := make(map[string]bool)
+	for _, ref := range remoteRefs {
+		exists[ref.Name] = true
+	}
+
+	tracking, err := r.TrackingRefs()
+	if err != nil {
+		return nil, err
+	}
+	var stale []refs.Ref
+	for _, ref := range tracking {
+		if ref.Symbolic() {
+			continue
+		}
+		if source, ok := r.RemoteRef(ref.Name); ok && !exists[source] {
+			stale = append(stale, ref)
+		}
+	}
+	return stale, nil
+}
+
+func pruneRemote(name string, dryRun bool) error {
+	r, err := getRemote(name)
+	if err != nil {
+		return err
+	}
+	remoteRefs, _, err := transport.ListRefs(r.URL(), r.UploadPack)
+	if err != nil {
+		return err
+	}
+	stale, err := staleTrackingRefs(r, remoteRefs)
+	if err != nil {
+		return err
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	// Symbolic refs such as refs/remotes/origin/HEAD may point to a
+	// pruned branch, and are no longer listed once it is gone
+	all, err := refs.IterRefs(remote.TrackingPrefix(name))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pruning %s\n", name)
+	fmt.Printf("URL: %s\n", r.URL())
+	pruned := make(map[string]bool)
+	for _, ref := range stale {
+		if dryRun {
+			fmt.Printf(" * [would prune] %s\n", shortRefName(ref.Name))
+			pruned[ref.Name] = true
+			continue
+		}
+		err = refs.DeleteRef(ref.Name, ref.Hash)
+		if err != nil {
+			return err
+		}
+		fmt.Printf(" * [pruned] %s\n", shortRefName(ref.Name))
+		pruned[ref.Name] = true
+	}
+
+	for _, ref := range all {
+		if !ref.Symbolic() || !pruned[ref.Target] {
+			continue
+		}
+		if dryRun {
+			fmt.Printf(" %s will become dangling!\n", ref.Name)
+		} else {
+			fmt.Printf(" %s has become dangling!\n", ref.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mattherman/mhgit/objects"
+	"github.com/spf13/cobra"
+)
+
+// repackCmd represents the repack command
+var repackCmd = &cobra.Command{
+	Use:   "repack [-a | -A] [-d] [-q]",
+	Short: "Pack unpacked objects in a repository",
+	Long: `Pack the reachable loose objects into a new pack.
+
+With -a every reachable object, packed or not, is put into a single pack,
+and with -d the packs and loose objects made redundant by the new pack
+are removed. -A is the same as -a, except that the unreachable objects of
+the old packs are kept as loose objects when -d removes their packs, so
+that prune can remove them once they expire.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := repack(repackAll || repackAllLoosen, repackAllLoosen, repackDelete, repackQuiet)
+		if err != nil {
+			fmt.Printf("Failed to repack: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var repackAll bool
+var repackAllLoosen bool
+var repackDelete bool
+var repackQuiet bool
+
+func init() {
+	rootCmd.AddCommand(repackCmd)
+	repackCmd.Flags().BoolVarP(&repackAll, "all", "a", false, "Pack every reachable object into a single pack.")
+	repackCmd.Flags().BoolVarP(&repackAllLoosen, "all-loosen", "A", false, "Same as -a, but keep unreachable objects of removed packs as loose objects.")
+	repackCmd.Flags().BoolVarP(&repackDelete, "delete", "d", false, "Remove the packs and loose objects that are no longer needed.")
+	repackCmd.Flags().BoolVarP(&repackQuiet, "quiet", "q", false, "Do not report the new pack.")
+}
+
+// repack writes the reachable objects into a new pack. With all, every
+// reachable object is packed and the new pack replaces the old ones when
+// redundant packs are deleted, otherwise only loose objects are packed.
+func repack(all bool, loosen bool, deleteRedundant bool, quiet bool) error {
+	reachable, err := reachableObjects()
+	if err != nil {
+		return err
+	}
+	oldPacks, err := objects.Packs()
+	if err != nil {
+		return err
+	}
+
+	var hashes []string
+	for hash := range reachable {
+		if all || !objects.IsPacked(hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+
+	if len(hashes) == 0 {
+		if !quiet {
+			fmt.Println("Nothing new to pack.")
+		}
+		return nil
+	}
+
+	name, err := objects.WritePack(hashes)
+	if err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Printf("Packed %d objects into %s\n", len(hashes), name)
+	}
+	if !deleteRedundant {
+		return objects.WritePackList()
+	}
+
+	if all {
+		for _, pack := range oldPacks {
+			if pack.Name == name {
+				continue
+			}
+			if loosen {
+				err = loosenUnreachable(pack, reachable)
+				if err != nil {
+					return err
+				}
+			}
+			err = objects.RemovePack(pack.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = objects.WritePackList()
+	if err != nil {
+		return err
+	}
+	return prunePacked(false)
+}
+
+// loosenUnreachable writes the unreachable objects of the pack as loose
+// objects, dated with the time of the pack so that they expire as if
+// they had never been packed
+func loosenUnreachable(pack objects.PackInfo, reachable map[string]bool) error {
+	hashes, err := objects.PackContents(pack.Name)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if reachable[hash] {
+			continue
+		}
+		err = objects.LoosenObject(hash, pack.ModTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
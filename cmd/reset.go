@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pathspec"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/spf13/cobra"
+)
+
+// resetCmd represents the reset command
+var resetCmd = &cobra.Command{
+	Use:   "reset [--soft | --mixed | --hard] [<commit>] [--] [pathspec...]",
+	Short: "Reset the current branch or index entries to a commit",
+	Long: `Reset the current branch or index entries to a commit.
+
+Without a pathspec, the current branch is moved to the commit, which is
+HEAD if none is given. The index is reset to match it unless --soft is
+given, and the working tree as well with --hard. The previous commit is
+saved in ORIG_HEAD and the move is recorded in the reflog.
+
+With a pathspec, only the matching index entries are reset to their
+state in the commit and the branch does not move.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		commit := "HEAD"
+		if len(args) > 0 && cmd.ArgsLenAtDash() != 0 {
+			if _, err := revision.ResolveCommit(args[0]); err == nil {
+				commit = args[0]
+				args = args[1:]
+			}
+		}
+
+		if resetPatch {
+			resetPatchHunks(commit, args)
+		} else if len(args) > 0 {
+			if resetSoft || resetHard {
+				fmt.Println("Failed to reset: cannot do a soft or hard reset with paths")
+				return
+			}
+			resetPaths(commit, args)
+		} else {
+			resetCommit(commit)
+		}
+	},
+}
+
+var resetPatch bool
+var resetSoft bool
+var resetMixed bool
+var resetHard bool
+
+func init() {
+	rootCmd.AddCommand(resetCmd)
+	resetCmd.Flags().BoolVarP(&resetPatch, "patch", "p", false, "Interactively choose hunks of the difference between the index and the commit to unstage.")
+	resetCmd.Flags().BoolVar(&resetSoft, "soft", false, "Only move the current branch, leaving the index and working tree alone.")
+	resetCmd.Flags().BoolVar(&resetMixed, "mixed", false, "Move the current branch and reset the index, but not the working tree. This is the default.")
+	resetCmd.Flags().BoolVar(&resetHard, "hard", false, "Move the current branch and reset both the index and the working tree, discarding any changes.")
+}
+
+// commitEntries returns the blobs of the tree of a commit by path. The
+// commit HEAD has none if the current branch has no commits yet.
+func commitEntries(commit string) (map[string]objects.TreeEntry, error) {
+	entries := make(map[string]objects.TreeEntry)
+
+	commitHash, err := revision.ResolveCommit(commit)
+	if commit == "HEAD" && err != nil {
+		if _, headErr := refs.LatestCommit(); headErr == refs.ErrUnbornBranch {
+			return entries, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := objects.ReadCommit(commitHash)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := objects.ReadTreeRecursive(parsed.Tree)
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		err = objects.CheckPath(blob.Name)
+		if err != nil {
+			return nil, err
+		}
+		entries[blob.Name] = blob
+	}
+	return entries, nil
+}
+
+// headEntries returns the blobs of the tree of the current commit by
+// path. There are none if the current branch has no commits yet.
+func headEntries() (map[string]objects.TreeEntry, error) {
+	return commitEntries("HEAD")
+}
+
+func parseMode(mode string) int32 {
+	value, _ := strconv.ParseInt(mode, 8, 32)
+	return int32(value)
+}
+
+// stagedPaths returns the paths matched by the pathspec that are either
+// in HEAD or in the index, along with the stage 0 entries of the index
+func stagedPaths(spec *pathspec.Pathspec, head map[string]objects.TreeEntry) ([]string, map[string]index.Entry, error) {
+	idx, err := index.ReadIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	staged := make(map[string]index.Entry)
+	seen := make(map[string]bool)
+	var paths []string
+	for _, entry := range idx.Entries {
+		if entry.Stage() == index.StageMerged {
+			staged[entry.Path] = entry
+		}
+		if !seen[entry.Path] && spec.Match(entry.Path) {
+			seen[entry.Path] = true
+			paths = append(paths, entry.Path)
+		}
+	}
+	for path := range head {
+		if !seen[path] && spec.Match(path) {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, staged, nil
+}
+
+// resetPaths will make the index entries matched by the pathspec the
+// same as in the commit. The working tree is not changed.
+func resetPaths(commit string, args []string) {
+	spec, err := pathspec.Parse(args)
+	if err != nil {
+		fmt.Printf("Failed to parse the pathspec: %v\n", err)
+		return
+	}
+
+	target, err := commitEntries(commit)
+	if err != nil {
+		fmt.Printf("Failed to read %s: %v\n", commit, err)
+		return
+	}
+
+	err = resetIndex(spec, target)
+	if err != nil {
+		fmt.Printf("Failed to update the index: %v\n", err)
+	}
+}
+
+// resetIndex makes the index entries matched by the pathspec the same
+// as the given tree entries
+func resetIndex(spec *pathspec.Pathspec, target map[string]objects.TreeEntry) error {
+	paths, staged, err := stagedPaths(spec, target)
+	if err != nil {
+		return err
+	}
+
+	batch, err := index.NewBatch()
+	if err != nil {
+		return err
+	}
+	defer batch.Rollback()
+
+	for _, path := range paths {
+		targetEntry, inTarget := target[path]
+		entry, isStaged := staged[path]
+		if !inTarget {
+			batch.Remove(path)
+		} else if !isStaged || entry.Hash != targetEntry.Hash || entry.Mode != parseMode(targetEntry.Mode) || entry.IntentToAdd() {
+			batch.AddCacheInfo(parseMode(targetEntry.Mode), targetEntry.Hash, path)
+		}
+	}
+
+	return batch.Commit()
+}
+
+// resetCommit will move the current branch to the commit, resetting the
+// index and working tree depending on the mode
+func resetCommit(commit string) {
+	commitHash, err := revision.ResolveCommit(commit)
+	if err != nil {
+		fmt.Printf("Failed to resolve %s: %v\n", commit, err)
+		return
+	}
+	parsed, err := objects.ReadCommit(commitHash)
+	if err != nil {
+		fmt.Printf("Failed to read %s: %v\n", commit, err)
+		return
+	}
+
+	oldHead, err := refs.LatestCommit()
+	if err != nil && err != refs.ErrUnbornBranch {
+		fmt.Printf("Failed to read HEAD: %v\n", err)
+		return
+	}
+
+	if !resetSoft {
+		err = resetTrackedFiles(commitHash)
+		if err != nil {
+			fmt.Printf("Failed to reset the files: %v\n", err)
+			return
+		}
+	}
+
+	if oldHead != "" {
+		err = refs.UpdateRef("ORIG_HEAD", oldHead, "", "")
+		if err != nil {
+			fmt.Printf("Failed to save ORIG_HEAD: %v\n", err)
+			return
+		}
+	}
+	err = refs.UpdateLatestCommit(commitHash, "reset: moving to "+commit)
+	if err != nil {
+		fmt.Printf("Failed to update HEAD: %v\n", err)
+		return
+	}
+
+	if resetHard {
+		subject := strings.SplitN(parsed.Message, "\n", 2)[0]
+		fmt.Printf("HEAD is now at %s %s\n", commitHash[:7], subject)
+	}
+}
+
+// resetTrackedFiles resets the whole index to the tree of the commit,
+// and with --hard the working tree as well
+func resetTrackedFiles(commit string) error {
+	target, err := commitEntries(commit)
+	if err != nil {
+		return err
+	}
+
+	if resetHard {
+		idx, err := index.ReadIndex()
+		if err != nil {
+			return err
+		}
+		for _, entry := range idx.Entries {
+			if _, ok := target[entry.Path]; !ok {
+				err = removeWorktreeFile(entry.Path)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for path, entry := range target {
+			var data []byte
+			if parseMode(entry.Mode) != objects.ModeGitlink {
+				data, err = readBlob(entry.Hash)
+				if err != nil {
+					return err
+				}
+			}
+			err = writeWorktreeFile(path, data, parseMode(entry.Mode))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	spec, err := pathspec.Parse(nil)
+	if err != nil {
+		return err
+	}
+	return resetIndex(spec, target)
+}
@@ -1,12 +1,19 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/pathspec"
 	"github.com/spf13/cobra"
 )
 
 // rmCmd represents the rm command
 var rmCmd = &cobra.Command{
-	Use:   "rm [files...]",
+	Use:   "rm [pathspec...]",
 	Short: "Remove files from the working tree and from the index",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -14,12 +21,176 @@ var rmCmd = &cobra.Command{
 	},
 }
 
+var rmCached bool
+var rmRecursive bool
+var rmForce bool
+var rmDryRun bool
+
 func init() {
 	rootCmd.AddCommand(rmCmd)
+	rmCmd.Flags().BoolVar(&rmCached, "cached", false, "Only remove paths from the index. Working tree files will be left alone.")
+	rmCmd.Flags().BoolVarP(&rmRecursive, "recursive", "r", false, "Allow recursive removal when a leading directory name is given.")
+	rmCmd.Flags().BoolVarP(&rmForce, "force", "f", false, "Override the up-to-date check.")
+	rmCmd.Flags().BoolVarP(&rmDryRun, "dry-run", "n", false, "Don’t actually remove any file(s), just show if they exist in the index.")
+}
+
+func removeFiles(args []string) {
+	spec, err := pathspec.Parse(args)
+	if err != nil {
+		fmt.Printf("Failed to parse the pathspec: %v\n", err)
+		return
+	}
+
+	idx, err := index.ReadIndex()
+	if err != nil {
+		fmt.Printf("Could not read index: %v\n", err)
+		return
+	}
+
+	var files []string
+	tracked := make(map[string]bool)
+	for _, entry := range idx.Entries {
+		if tracked[entry.Path] {
+			continue
+		}
+		tracked[entry.Path] = true
+		if spec.Match(entry.Path) {
+			files = append(files, entry.Path)
+		}
+	}
+
+	unmatched := spec.Unmatched()
+	if len(unmatched) > 0 {
+		fmt.Printf("Failed to remove files: pathspec '%s' did not match any files\n", unmatched[0])
+		return
+	}
+
+	// Naming a directory removes everything below it, which must be
+	// asked for explicitly
+	if !rmRecursive {
+		for _, path := range spec.Literals() {
+			if !tracked[path] {
+				fmt.Printf("Failed to remove files: not removing '%s' recursively without -r\n", path)
+				return
+			}
+		}
+	}
+
+	if !rmForce {
+		problems, err := checkRemovable(idx, files)
+		if err != nil {
+			fmt.Printf("Failed to check the files to remove: %v\n", err)
+			return
+		}
+		if len(problems) > 0 {
+			for _, problem := range problems {
+				fmt.Println(problem)
+			}
+			return
+		}
+	}
+
+	for _, path := range files {
+		fmt.Printf("rm '%s'\n", path)
+	}
+	if rmDryRun {
+		return
+	}
+
+	batch, err := index.NewBatch()
+	if err != nil {
+		fmt.Printf("Failed to update the index: %v\n", err)
+		return
+	}
+	defer batch.Rollback()
+
+	for _, path := range files {
+		batch.Remove(path)
+	}
+
+	err = batch.Commit()
+	if err != nil {
+		fmt.Printf("Failed to write the index: %v\n", err)
+		return
+	}
+
+	if rmCached {
+		return
+	}
+	for _, path := range files {
+		err = removeWorktreeFile(path)
+		if err != nil {
+			fmt.Printf("Failed to remove %s: %v\n", path, err)
+		}
+	}
 }
 
-func removeFiles(files []string) {
-	for _, file := range files {
-		updateIndex(file, false, true)
+// checkRemovable describes each file that cannot be removed without
+// losing changes that are not recorded anywhere else. Removing only
+// from the index is safe if the staged content matches either HEAD or
+// the file, while removing the file also requires both to match.
+func checkRemovable(idx index.Index, files []string) ([]string, error) {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	modified, _, err := index.Refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	locallyModified := make(map[string]bool)
+	for _, path := range modified {
+		locallyModified[path] = true
+	}
+
+	head, err := headEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]index.Entry)
+	for _, entry := range idx.Entries {
+		if entry.Stage() == index.StageMerged {
+			entries[entry.Path] = entry
+		}
+	}
+
+	var problems []string
+	for _, path := range files {
+		// Removing a conflicted path is how a conflict is resolved as deleted
+		entry, ok := entries[path]
+		if !ok {
+			continue
+		}
+
+		headEntry, inHead := head[path]
+		staged := !inHead || headEntry.Hash != entry.Hash || entry.IntentToAdd()
+		local := locallyModified[path]
+
+		switch {
+		case staged && local:
+			problems = append(problems, fmt.Sprintf("error: '%s' has staged content different from both the file and the HEAD (use -f to force removal)", path))
+		case rmCached:
+		case staged:
+			problems = append(problems, fmt.Sprintf("error: '%s' has changes staged in the index (use --cached to keep the file, or -f to force removal)", path))
+		case local:
+			problems = append(problems, fmt.Sprintf("error: '%s' has local modifications (use --cached to keep the file, or -f to force removal)", path))
+		}
+	}
+	return problems, nil
+}
+
+// removeWorktreeFile will delete the file along with any directories
+// left empty by its removal
+func removeWorktreeFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for dir := filepath.Dir(path); dir != "." && !strings.HasPrefix(dir, ".."); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
 	}
+	return nil
 }
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattherman/mhgit/refs"
+	"github.com/spf13/cobra"
+)
+
+// showRefCmd represents the show-ref command
+var showRefCmd = &cobra.Command{
+	Use:   "show-ref [--heads] [--tags] [-d] [-s] [--head] [<pattern>...] | --verify [-q] <ref>...",
+	Short: "List references and the objects they point to",
+	Long: `List references and the objects they point to.
+
+A pattern matches a ref if it is the full name of the ref or its last
+path components, so that "main" matches both refs/heads/main and
+refs/remotes/origin/main. With --verify the full names of the refs must
+be given instead.
+
+The exit status is one if no ref matched or a ref could not be verified.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var found bool
+		if showRefVerify {
+			found = verifyRefs(args)
+		} else {
+			found = showRefs(args)
+		}
+		if !found {
+			os.Exit(1)
+		}
+	},
+}
+
+var showRefHeads bool
+var showRefTags bool
+var showRefDereference bool
+var showRefHash int
+var showRefAbbrev int
+var showRefHead bool
+var showRefVerify bool
+var showRefQuiet bool
+
+func init() {
+	rootCmd.AddCommand(showRefCmd)
+	flags := showRefCmd.Flags()
+	flags.BoolVar(&showRefHeads, "heads", false, "Only show branches.")
+	flags.BoolVar(&showRefTags, "tags", false, "Only show tags.")
+	flags.BoolVarP(&showRefDereference, "dereference", "d", false, "Also show the object each annotated tag points to, as <tag>^{}.")
+	flags.IntVarP(&showRefHash, "hash", "s", 0, "Only show the hash of each ref, abbreviated to the number of characters if given as --hash=<n>.")
+	flags.IntVar(&showRefAbbrev, "abbrev", 0, "Abbreviate hashes to the number of characters, 7 by default.")
+	flags.BoolVar(&showRefHead, "head", false, "Also show HEAD.")
+	flags.BoolVar(&showRefVerify, "verify", false, "Require each argument to be the full name of an existing ref.")
+	flags.BoolVarP(&showRefQuiet, "quiet", "q", false, "Do not print anything, only set the exit status.")
+	flags.Lookup("hash").NoOptDefVal = "40"
+	flags.Lookup("abbrev").NoOptDefVal = "7"
+}
+
+// showRefs prints the refs matching the patterns and returns true if
+// there were any
+func showRefs(patterns []string) bool {
+	refList, err := refs.IterRefs("refs/")
+	if err != nil {
+		fmt.Printf("Failed to retrieve refs: %v\n", err)
+		return false
+	}
+	if showRefHead {
+		if head, err := refs.ResolveRef("HEAD"); err == nil {
+			refList = append([]refs.Ref{{Name: "HEAD", Hash: head}}, refList...)
+		}
+	}
+
+	found := false
+	for _, ref := range refList {
+		if !showRefSelected(ref.Name, patterns) {
+			continue
+		}
+		found = true
+		printShowRef(ref)
+	}
+	return found
+}
+
+// showRefSelected returns true if the ref is allowed by --heads and
+// --tags and its name ends with one of the patterns
+func showRefSelected(name string, patterns []string) bool {
+	if name != "HEAD" && (showRefHeads || showRefTags) {
+		if !(showRefHeads && strings.HasPrefix(name, "refs/heads/")) && !(showRefTags && strings.HasPrefix(name, tagPrefix)) {
+			return false
+		}
+	}
+	if len(patterns) == 0 || name == "HEAD" {
+		return true
+	}
+	for _, pattern := range patterns {
+		if name == pattern || strings.HasSuffix(name, "/"+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRefs prints the refs given by their full names, failing at the
+// first one that does not exist
+func verifyRefs(names []string) bool {
+	if len(names) == 0 {
+		fmt.Println("Failed to verify refs: --verify requires a reference")
+		return false
+	}
+
+	for _, name := range names {
+		hash, err := refs.ResolveRef(name)
+		if err != nil || !(strings.HasPrefix(name, "refs/") || name == "HEAD") {
+			if !showRefQuiet {
+				fmt.Printf("Failed to verify ref: '%s' - not a valid ref\n", name)
+			}
+			return false
+		}
+		printShowRef(refs.Ref{Name: name, Hash: hash})
+	}
+	return true
+}
+
+func printShowRef(ref refs.Ref) {
+	if showRefQuiet {
+		return
+	}
+	showRefLine(ref.Hash, ref.Name)
+
+	if showRefDereference {
+		r := &listedRef{Ref: ref}
+		if tag, err := r.readTag(); err == nil && tag != nil {
+			if peeled, err := r.peeled(); err == nil {
+				showRefLine(peeled, ref.Name+"^{}")
+			}
+		}
+	}
+}
+
+func showRefLine(hash string, name string) {
+	if showRefAbbrev > 0 {
+		hash = abbreviateHash(hash, showRefAbbrev)
+	}
+	if showRefHash > 0 {
+		if showRefHash < len(hash) {
+			hash = abbreviateHash(hash, showRefHash)
+		}
+		fmt.Println(hash)
+		return
+	}
+	fmt.Printf("%s %s\n", hash, name)
+}
+
+func abbreviateHash(hash string, length int) string {
+	if length < 4 {
+		length = 4
+	}
+	if length > len(hash) {
+		length = len(hash)
+	}
+	return hash[:length]
+}
@@ -2,11 +2,9 @@ package cmd
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
 
 	"github.com/mattherman/mhgit/index"
-	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pathspec"
 	"github.com/mattherman/mhgit/refs"
 
 	"github.com/spf13/cobra"
@@ -14,10 +12,10 @@ import (
 
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
-	Use:   "status",
+	Use:   "status [pathspec...]",
 	Short: "Show the working tree status",
 	Run: func(cmd *cobra.Command, args []string) {
-		showStatus()
+		showStatus(args)
 	},
 }
 
@@ -25,86 +23,105 @@ func init() {
 	rootCmd.AddCommand(statusCmd)
 }
 
-func showStatus() {
-	currentBranch, err := refs.CurrentBranch()
+func showStatus(args []string) {
+	spec, err := pathspec.Parse(args)
 	if err != nil {
-		fmt.Printf("Failed to determine current branch: %v\n", err)
+		fmt.Printf("Failed to parse the pathspec: %v\n", err)
+		return
 	}
 
-	workingDir, err := getWorkingDirectoryFiles()
+	currentBranch, err := refs.CurrentBranch()
 	if err != nil {
-		fmt.Printf("Failed to retrieve working directory: %v\n", err)
+		fmt.Printf("Failed to determine current branch: %v\n", err)
 	}
 
-	index, err := index.ReadIndex()
+	status, err := getStatus(spec)
 	if err != nil {
-		fmt.Printf("Failed to retrieve indexed files: %v\n", err)
+		fmt.Printf("Failed to determine the status of the working tree: %v\n", err)
 	}
 
-	status := getStatus(index.Entries, workingDir)
 	printStatus(currentBranch, status)
 }
 
-func getWorkingDirectoryFiles() ([]string, error) {
-	var files []string
-	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
-
-		// Do not add directories to collection and enforce exclusion of '.git'
-		if info.IsDir() {
-			if info.Name() == ".git" {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		files = append(files, path)
-		return nil
-	})
-
-	return files, err
-}
-
 type status struct {
 	added    []string
 	modified []string
 	removed  []string
+	unmerged []string
 }
 
-type hashPair struct {
-	indexHash      string
-	workingDirHash string
-}
+func getStatus(spec *pathspec.Pathspec) (status, error) {
+	ctx, cancel := commandContext()
+	defer cancel()
 
-func getStatus(indexEntries []index.Entry, workingDir []string) status {
-	statusMap := make(map[string]hashPair)
-	var added []string
-	var modified []string
-	var removed []string
+	modified, removed, err := index.Refresh(ctx)
+	if err != nil {
+		return status{}, err
+	}
 
-	for _, entry := range indexEntries {
-		statusMap[entry.Path] = hashPair{indexHash: entry.Hash}
+	untracked, err := index.UntrackedFiles()
+	if err != nil {
+		return status{}, err
 	}
-	for _, path := range workingDir {
-		hash, _ := objects.HashFile(path, false)
-		existing := statusMap[path]
-		existing.workingDirHash = hash
-		statusMap[path] = existing
+
+	index, err := index.ReadIndex()
+	if err != nil {
+		return status{}, err
 	}
-	for k, v := range statusMap {
-		if v.indexHash != "" && v.workingDirHash != "" && v.indexHash != v.workingDirHash {
-			modified = append(modified, k)
-		} else if v.indexHash == "" && v.workingDirHash != "" {
-			added = append(added, k)
-		} else if v.indexHash != "" && v.workingDirHash == "" {
-			removed = append(removed, k)
+
+	var unmerged []string
+	for _, conflict := range index.Conflicts() {
+		if !spec.Match(conflict.Path) {
+			continue
 		}
+		unmerged = append(unmerged, fmt.Sprintf("%s: %s", describeConflict(conflict), conflict.Path))
 	}
 
-	return status{added: added, modified: modified, removed: removed}
+	return status{
+		added:    filterPaths(spec, untracked),
+		modified: filterPaths(spec, modified),
+		removed:  filterPaths(spec, removed),
+		unmerged: unmerged,
+	}, nil
+}
+
+// describeConflict names the kind of conflict based on which
+// sides of the merge contain the path
+func describeConflict(conflict index.Conflict) string {
+	base, ours, theirs := conflict.Base != nil, conflict.Ours != nil, conflict.Theirs != nil
+	switch {
+	case ours && theirs && base:
+		return "both modified"
+	case ours && theirs:
+		return "both added"
+	case base && ours:
+		return "deleted by them"
+	case base && theirs:
+		return "deleted by us"
+	case ours:
+		return "added by us"
+	case theirs:
+		return "added by them"
+	default:
+		return "both deleted"
+	}
 }
 
 func printStatus(branch string, status status) {
-	fmt.Printf("On branch %s\n", branch)
+	if branch != "" {
+		fmt.Printf("On branch %s\n", branch)
+	} else if commitHash, err := refs.LatestCommit(); err == nil {
+		fmt.Printf("HEAD detached at %s\n", commitHash[:7])
+	}
+	if len(status.unmerged) > 0 {
+		fmt.Print("Unmerged paths:\n\n")
+		for _, path := range status.unmerged {
+			fmt.Printf("\t%s\n", path)
+		}
+
+		fmt.Println()
+	}
+
 	if len(status.modified) > 0 || len(status.removed) > 0 {
 		fmt.Print("Changes not staged for commit:\n\n")
 		for _, path := range status.modified {
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattherman/mhgit/refs"
+	"github.com/spf13/cobra"
+)
+
+// symbolicRefCmd represents the symbolic-ref command
+var symbolicRefCmd = &cobra.Command{
+	Use:   "symbolic-ref <name> [<ref>]",
+	Short: "Read, modify and delete symbolic refs",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		switch {
+		case symbolicRefDelete:
+			err = refs.DeleteSymbolicRef(args[0])
+		case len(args) == 2:
+			err = setSymbolicRef(args[0], args[1])
+		default:
+			err = showSymbolicRef(args[0])
+		}
+
+		if err != nil && !(symbolicRefQuiet && len(args) == 1) {
+			fmt.Printf("Failed to update the symbolic ref: %v\n", err)
+		}
+	},
+}
+
+var symbolicRefQuiet bool
+var symbolicRefShort bool
+var symbolicRefDelete bool
+var symbolicRefMessage string
+
+func init() {
+	rootCmd.AddCommand(symbolicRefCmd)
+	symbolicRefCmd.Flags().BoolVarP(&symbolicRefQuiet, "quiet", "q", false, "Do not print an error if the name is not a symbolic ref.")
+	symbolicRefCmd.Flags().BoolVar(&symbolicRefShort, "short", false, "Shorten the ref name, such as refs/heads/main to main.")
+	symbolicRefCmd.Flags().BoolVarP(&symbolicRefDelete, "delete", "d", false, "Delete the symbolic ref.")
+	symbolicRefCmd.Flags().StringVarP(&symbolicRefMessage, "message", "m", "", "Record the update in the reflog with the given reason.")
+}
+
+func showSymbolicRef(name string) error {
+	target, err := refs.ReadSymbolicRef(name)
+	if err != nil {
+		return err
+	}
+
+	if symbolicRefShort {
+		target = shortRefName(target)
+	}
+	fmt.Println(target)
+	return nil
+}
+
+// setSymbolicRef points a symbolic ref at another ref, which may not
+// exist yet, as with the branch of a new repository
+func setSymbolicRef(name string, target string) error {
+	if name == "HEAD" && !strings.HasPrefix(target, "refs/") {
+		return fmt.Errorf("refusing to point HEAD outside of refs/")
+	}
+	if err := refs.CheckRefFormat(target, false); err != nil {
+		return fmt.Errorf("refusing to point %s at invalid ref: %v", name, err)
+	}
+	return refs.UpdateSymbolicRef(name, target, symbolicRefMessage)
+}
+
+// shortRefName removes the prefix of a branch, tag or remote ref
+func shortRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/", "refs/"} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return name
+}
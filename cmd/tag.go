@@ -0,0 +1,371 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/mattherman/mhgit/wildmatch"
+	"github.com/spf13/cobra"
+)
+
+const (
+	tagPrefix      string = "refs/tags/"
+	tagMessageFile string = "TAG_EDITMSG"
+	signatureStart string = "-----BEGIN PGP SIGNATURE-----"
+)
+
+// tagCmd represents the tag command
+var tagCmd = &cobra.Command{
+	Use:   "tag [-a] [-m <msg> | -F <file>] [-f] <tagname> [<object>] | -d <tagname>... | -v <tagname>... | [-l] [<pattern>...]",
+	Short: "Create, list, delete or verify tags",
+	Long: `Create, list, delete or verify tags.
+
+Without arguments, the tags are listed. Given a name, a lightweight tag
+pointing to the object, HEAD by default, is created. With -a, -m or -F
+an annotated tag object is created instead, which records the tagger
+and a message.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		switch {
+		case tagDelete:
+			deleteTags(args)
+		case tagVerify:
+			verifyTags(args)
+		case len(args) > 0 && !tagListMode(cmd):
+			createTag(args, cmd.Flags().Changed("annotate") || len(tagMessages) > 0 || tagMessageFilename != "")
+		default:
+			listTags(args)
+		}
+	},
+}
+
+var tagAnnotate bool
+var tagMessages []string
+var tagMessageFilename string
+var tagForce bool
+var tagDelete bool
+var tagVerify bool
+var tagList bool
+var tagLines int
+var tagSort []string
+var tagContains string
+var tagPointsAt string
+var tagFormat string
+
+func init() {
+	rootCmd.AddCommand(tagCmd)
+	flags := tagCmd.Flags()
+	flags.BoolVarP(&tagAnnotate, "annotate", "a", false, "Create an annotated tag object, asking for a message if none is given.")
+	flags.StringArrayVarP(&tagMessages, "message", "m", nil, "Use the message for an annotated tag. Several are joined as separate paragraphs.")
+	flags.StringVarP(&tagMessageFilename, "file", "F", "", "Read the message of an annotated tag from the file.")
+	flags.BoolVarP(&tagForce, "force", "f", false, "Replace an existing tag instead of failing.")
+	flags.BoolVarP(&tagDelete, "delete", "d", false, "Delete the tags.")
+	flags.BoolVarP(&tagVerify, "verify", "v", false, "Verify that the tag objects are well formed and point to existing objects of their declared type.")
+	flags.BoolVarP(&tagList, "list", "l", false, "List the tags matching the patterns.")
+	flags.IntVarP(&tagLines, "lines", "n", 0, "Show up to the number of lines of the message of each tag, given as -n=<num>, one by default.")
+	flags.StringSliceVar(&tagSort, "sort", nil, "Sort by the key, such as version:refname or -creatordate. Can be given more than once.")
+	flags.StringVar(&tagContains, "contains", "", "Only list tags containing the commit, HEAD by default.")
+	flags.StringVar(&tagPointsAt, "points-at", "", "Only list tags pointing at the object, HEAD by default.")
+	flags.StringVar(&tagFormat, "format", "", "Print each tag using the format, such as '%(refname:short) %(taggerdate)'.")
+	flags.Lookup("lines").NoOptDefVal = "1"
+	flags.Lookup("contains").NoOptDefVal = "HEAD"
+	flags.Lookup("points-at").NoOptDefVal = "HEAD"
+}
+
+// tagListMode returns true if the arguments are patterns of tags to list
+// rather than a tag to create
+func tagListMode(cmd *cobra.Command) bool {
+	for _, flag := range []string{"list", "lines", "sort", "contains", "points-at", "format"} {
+		if cmd.Flags().Changed(flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func createTag(args []string, annotated bool) {
+	if len(args) > 2 {
+		fmt.Println("Failed to create tag: too many arguments")
+		return
+	}
+
+	name := args[0]
+	target := "HEAD"
+	if len(args) == 2 {
+		target = args[1]
+	}
+
+	if err := refs.CheckRefFormat(tagPrefix+name, false); err != nil || strings.HasPrefix(name, "-") {
+		fmt.Printf("Failed to create tag: '%s' is not a valid tag name.\n", name)
+		return
+	}
+
+	oldHash, err := refs.ResolveRef(tagPrefix + name)
+	if err == nil && !tagForce {
+		fmt.Printf("Failed to create tag: tag '%s' already exists\n", name)
+		return
+	}
+
+	objectHash, err := revision.Resolve(target)
+	if err != nil {
+		fmt.Printf("Failed to create tag: not a valid object name: '%s'\n", target)
+		return
+	}
+
+	tagHash := objectHash
+	if annotated {
+		tagHash, err = writeTagObject(name, objectHash)
+		if err != nil {
+			fmt.Printf("Failed to create tag: %v\n", err)
+			return
+		}
+	}
+
+	expected := refs.ZeroHash
+	if tagForce {
+		expected = ""
+	}
+	err = refs.UpdateRef(tagPrefix+name, tagHash, expected, "")
+	if err != nil {
+		fmt.Printf("Failed to create tag: %v\n", err)
+		return
+	}
+	if oldHash != "" && oldHash != tagHash {
+		fmt.Printf("Updated tag '%s' (was %s)\n", name, oldHash[:7])
+	}
+}
+
+// writeTagObject writes an annotated tag object for the object, asking
+// for a message if none was given
+func writeTagObject(name string, objectHash string) (string, error) {
+	obj, err := objects.ReadObject(objectHash)
+	if err != nil {
+		return "", err
+	}
+
+	message, err := tagMessage(name)
+	if err != nil {
+		return "", err
+	}
+
+	tagger, err := ident.Committer()
+	if err != nil {
+		return "", err
+	}
+
+	tag := objects.Tag{Object: objectHash, Type: obj.Type(), Name: name, Tagger: tagger.String(), Message: message}
+	return objects.HashObject(objects.Object{ObjectType: "tag", Data: tag.Data()}, true)
+}
+
+// tagMessage returns the message of a new annotated tag, from -m, -F or
+// the editor. Comment lines and surrounding blank lines are removed.
+func tagMessage(name string) (string, error) {
+	var message string
+	switch {
+	case len(tagMessages) > 0:
+		message = strings.Join(tagMessages, "\n\n")
+	case tagMessageFilename != "":
+		data, err := ioutil.ReadFile(tagMessageFilename)
+		if err != nil {
+			return "", err
+		}
+		message = string(data)
+	default:
+		template := fmt.Sprintf("\n#\n# Write a message for tag:\n#   %s\n# Lines starting with '#' will be ignored.\n", name)
+		err := ioutil.WriteFile(gitdir.Path(tagMessageFile), []byte(template), 0644)
+		if err != nil {
+			return "", err
+		}
+		err = runEditor(gitdir.Path(tagMessageFile))
+		if err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadFile(gitdir.Path(tagMessageFile))
+		if err != nil {
+			return "", err
+		}
+		message = stripCommentLines(string(data))
+		if strings.TrimSpace(message) == "" {
+			return "", fmt.Errorf("no tag message?")
+		}
+	}
+
+	message = strings.Trim(message, "\n")
+	if message == "" {
+		return "", nil
+	}
+	return message + "\n", nil
+}
+
+func stripCommentLines(text string) string {
+	var kept []string
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			kept = append(kept, strings.TrimRight(line, " \t"))
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+func deleteTags(names []string) {
+	if len(names) == 0 {
+		fmt.Println("Failed to delete tag: tag name required")
+		return
+	}
+
+	for _, name := range names {
+		hash, err := refs.ResolveRef(tagPrefix + name)
+		if err != nil {
+			fmt.Printf("Failed to delete tag: tag '%s' not found.\n", name)
+			continue
+		}
+		err = refs.DeleteRef(tagPrefix+name, hash)
+		if err != nil {
+			fmt.Printf("Failed to delete tag '%s': %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Deleted tag '%s' (was %s)\n", name, hash[:7])
+	}
+}
+
+// verifyTags checks that each tag object is well formed, names the tag
+// it is stored as and points to an existing object of its declared type.
+// Signatures cannot be checked and are only reported.
+func verifyTags(names []string) {
+	for _, name := range names {
+		hash, err := refs.ResolveRef(tagPrefix + name)
+		if err != nil {
+			fmt.Printf("Failed to verify tag: tag '%s' not found.\n", name)
+			continue
+		}
+
+		obj, err := objects.ReadObject(hash)
+		if err != nil {
+			fmt.Printf("Failed to verify tag '%s': %v\n", name, err)
+			continue
+		}
+		if obj.Type() != "tag" {
+			fmt.Printf("Failed to verify tag '%s': it is a lightweight tag pointing to a %s\n", name, obj.Type())
+			continue
+		}
+
+		err = verifyTagObject(name, obj)
+		if err != nil {
+			fmt.Printf("Failed to verify tag '%s': %v\n", name, err)
+			continue
+		}
+		fmt.Print(obj)
+		if strings.Contains(string(obj.Data), signatureStart) {
+			fmt.Printf("The signature of tag '%s' was not checked.\n", name)
+		}
+	}
+}
+
+func verifyTagObject(name string, obj objects.Object) error {
+	tag, err := objects.ParseTag(obj.Data)
+	if err != nil {
+		return err
+	}
+	if tag.Name != name {
+		return fmt.Errorf("the tag object is named '%s'", tag.Name)
+	}
+	if _, err := ident.Parse(tag.Tagger); err != nil {
+		return fmt.Errorf("invalid tagger: %v", err)
+	}
+
+	target, err := objects.ReadObject(tag.Object)
+	if err != nil {
+		return fmt.Errorf("the tagged object %s is missing", tag.Object)
+	}
+	if target.Type() != tag.Type {
+		return fmt.Errorf("the tagged object %s is a %s, not a %s", tag.Object, target.Type(), tag.Type)
+	}
+	return nil
+}
+
+func listTags(patterns []string) {
+	refList, err := refs.IterRefs(tagPrefix)
+	if err != nil {
+		fmt.Printf("Failed to retrieve tags: %v\n", err)
+		return
+	}
+
+	for _, filter := range []*string{&tagContains, &tagPointsAt} {
+		if *filter == "HEAD" && len(patterns) > 0 {
+			if _, err := revision.Resolve(patterns[0]); err == nil {
+				*filter = patterns[0]
+				patterns = patterns[1:]
+			}
+		}
+	}
+
+	var matched []refs.Ref
+	for _, ref := range refList {
+		name := strings.TrimPrefix(ref.Name, tagPrefix)
+		if len(patterns) == 0 {
+			matched = append(matched, ref)
+			continue
+		}
+		for _, pattern := range patterns {
+			if wildmatch.Match(pattern, name, 0) {
+				matched = append(matched, ref)
+				break
+			}
+		}
+	}
+
+	listed := newListedRefs(matched)
+	listed, err = filterRefs(listed, "", "", tagContains)
+	if err == nil && tagPointsAt != "" {
+		listed, err = pointsAt(listed, tagPointsAt)
+	}
+	if err != nil {
+		fmt.Printf("Failed to filter tags: %v\n", err)
+		return
+	}
+	err = sortRefs(listed, tagSort)
+	if err != nil {
+		fmt.Printf("Failed to sort tags: %v\n", err)
+		return
+	}
+
+	for _, r := range listed {
+		name := strings.TrimPrefix(r.Name, tagPrefix)
+		switch {
+		case tagFormat != "":
+			line, err := formatRef(tagFormat, r)
+			if err != nil {
+				fmt.Printf("Failed to format tag: %v\n", err)
+				return
+			}
+			fmt.Println(line)
+		case tagLines > 0:
+			fmt.Printf("%-15s %s\n", name, tagPreview(r, tagLines))
+		default:
+			fmt.Println(name)
+		}
+	}
+}
+
+// tagPreview returns the first lines of the message of the tag, or of
+// the commit a lightweight tag points to
+func tagPreview(r *listedRef, lines int) string {
+	message := r.message()
+	if signature := strings.Index(message, signatureStart); signature != -1 {
+		message = message[:signature]
+	}
+
+	var kept []string
+	for _, line := range strings.Split(strings.Trim(message, "\n"), "\n") {
+		if len(kept) == lines {
+			break
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n    ")
+}
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
 	"github.com/mattherman/mhgit/index"
 	"github.com/spf13/cobra"
@@ -11,32 +13,144 @@ import (
 var updateIndexCmd = &cobra.Command{
 	Use:   "update-index [file]",
 	Short: "Register file contents in the working tree to the index.",
-	Args:  cobra.MinimumNArgs(1),
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && indexVersion == 0 && !untrackedCache && !noUntrackedCache && !refresh && !useFsmonitor && !noFsmonitor {
+			return errors.New("requires at least 1 arg(s), only received 0")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		filepath := args[0]
-		updateIndex(filepath, add, remove)
+		if indexVersion != 0 {
+			err := index.SetVersion(uint32(indexVersion))
+			if err != nil {
+				fmt.Printf("Failed to change the index version: %v\n", err)
+				return
+			}
+		}
+
+		if untrackedCache || noUntrackedCache {
+			err := index.SetUntrackedCache(untrackedCache)
+			if err != nil {
+				fmt.Printf("Failed to update the untracked cache: %v\n", err)
+				return
+			}
+		}
+
+		if useFsmonitor || noFsmonitor {
+			err := index.SetFsmonitor(useFsmonitor)
+			if err != nil {
+				fmt.Printf("Failed to update the fsmonitor setting: %v\n", err)
+				return
+			}
+		}
+
+		if refresh {
+			refreshIndex()
+		}
+
+		if len(args) == 0 {
+			return
+		}
+
+		if skipWorktree || noSkipWorktree {
+			setSkipWorktree(args, skipWorktree)
+		} else {
+			updateIndex(args, add, remove)
+		}
 	},
 }
 
 var add bool
 var remove bool
+var indexVersion int
+var skipWorktree bool
+var noSkipWorktree bool
+var untrackedCache bool
+var noUntrackedCache bool
+var refresh bool
+var useFsmonitor bool
+var noFsmonitor bool
 
 func init() {
 	rootCmd.AddCommand(updateIndexCmd)
 	updateIndexCmd.Flags().BoolVarP(&add, "add", "a", false, "If a specified file isn’t in the index already then it’s added. Default behaviour is to ignore new files.")
 	updateIndexCmd.Flags().BoolVarP(&remove, "remove", "r", false, "If a specified file is in the index but is missing then it’s removed. Default behavior is to ignore removed file.")
+	updateIndexCmd.Flags().IntVar(&indexVersion, "index-version", 0, "Write the resulting index out in the named on-disk format version. Supported versions are 2, 3 and 4.")
+	updateIndexCmd.Flags().BoolVar(&skipWorktree, "skip-worktree", false, "Set the skip-worktree bit for the paths.")
+	updateIndexCmd.Flags().BoolVar(&noSkipWorktree, "no-skip-worktree", false, "Unset the skip-worktree bit for the paths.")
+	updateIndexCmd.Flags().BoolVar(&refresh, "refresh", false, "Check whether the files in the index need updating and refresh the stat information of the ones that do not.")
+	updateIndexCmd.Flags().BoolVar(&untrackedCache, "untracked-cache", false, "Enable the untracked cache feature.")
+	updateIndexCmd.Flags().BoolVar(&noUntrackedCache, "no-untracked-cache", false, "Disable the untracked cache feature.")
+	updateIndexCmd.Flags().BoolVar(&useFsmonitor, "fsmonitor", false, "Use the fsmonitor daemon to find changed files.")
+	updateIndexCmd.Flags().BoolVar(&noFsmonitor, "no-fsmonitor", false, "Stop using the fsmonitor daemon to find changed files.")
 }
 
-func updateIndex(filepath string, add bool, remove bool) {
+func updateIndex(filepaths []string, add bool, remove bool) {
+	batch, err := index.NewBatch()
+	if err != nil {
+		fmt.Printf("Failed to update the index: %v\n", err)
+		return
+	}
+	defer batch.Rollback()
+
 	if remove {
-		err := index.Remove(filepath)
-		if err != nil {
-			fmt.Printf("Failed to remove the index entry: %v\n", err)
+		for _, filepath := range filepaths {
+			if _, err := os.Stat(filepath); err == nil {
+				fmt.Printf("Failed to remove the index entry: %s exists and cannot be removed from index\n", filepath)
+				return
+			}
+			batch.Remove(filepath)
 		}
 	} else {
-		err := index.Add(filepath)
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		err = batch.Add(ctx, filepaths)
 		if err != nil {
 			fmt.Printf("Failed to create the index entry: %v\n", err)
+			return
 		}
 	}
+
+	err = batch.Commit()
+	if err != nil {
+		fmt.Printf("Failed to write the index: %v\n", err)
+	}
+}
+
+func setSkipWorktree(filepaths []string, skip bool) {
+	batch, err := index.NewBatch()
+	if err != nil {
+		fmt.Printf("Failed to update the index: %v\n", err)
+		return
+	}
+	defer batch.Rollback()
+
+	for _, filepath := range filepaths {
+		err = batch.SetSkipWorktree(filepath, skip)
+		if err != nil {
+			fmt.Printf("Failed to update the skip-worktree bit: %v\n", err)
+			return
+		}
+	}
+
+	err = batch.Commit()
+	if err != nil {
+		fmt.Printf("Failed to write the index: %v\n", err)
+	}
+}
+
+func refreshIndex() {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	modified, deleted, err := index.Refresh(ctx)
+	if err != nil {
+		fmt.Printf("Failed to refresh the index: %v\n", err)
+		return
+	}
+
+	for _, path := range append(modified, deleted...) {
+		fmt.Printf("%s: needs update\n", path)
+	}
 }
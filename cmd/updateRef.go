@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/revision"
+	"github.com/spf13/cobra"
+)
+
+// updateRefCmd represents the update-ref command
+var updateRefCmd = &cobra.Command{
+	Use:   "update-ref [-m <reason>] [--no-deref] (-d <ref> [<old>] | <ref> <new> [<old>] | --stdin)",
+	Short: "Update the object name stored in a ref safely",
+	Long: `Update the object name stored in a ref safely.
+
+If <old> is given, the ref is only updated if it currently points to
+<old>. An empty or all-zero <old> requires that the ref does not exist.
+
+With --stdin, commands are read one per line and applied together, so
+that either every ref is updated or none of them are:
+
+  update <ref> <new> [<old>]
+  create <ref> <new>
+  delete <ref> [<old>]
+  verify <ref> [<old>]
+  option no-deref
+
+Without "start", the commands are committed once the input ends. The
+"start", "prepare", "commit" and "abort" commands control the
+transaction explicitly, and each prints "<command>: ok" once done.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		switch {
+		case updateRefStdin:
+			if len(args) > 0 {
+				err = fmt.Errorf("--stdin does not take arguments")
+			} else {
+				err = updateRefsFromInput(os.Stdin)
+			}
+		case updateRefDelete:
+			err = deleteRefArgs(args)
+		default:
+			err = updateRefArgs(args)
+		}
+
+		if err != nil {
+			fmt.Printf("Failed to update refs: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var updateRefMessage string
+var updateRefDelete bool
+var updateRefNoDeref bool
+var updateRefStdin bool
+
+func init() {
+	rootCmd.AddCommand(updateRefCmd)
+	updateRefCmd.Flags().StringVarP(&updateRefMessage, "message", "m", "", "Record the update in the reflog with the given reason.")
+	updateRefCmd.Flags().BoolVarP(&updateRefDelete, "delete", "d", false, "Delete the ref.")
+	updateRefCmd.Flags().BoolVar(&updateRefNoDeref, "no-deref", false, "Update a symbolic ref itself rather than the ref it points to.")
+	updateRefCmd.Flags().BoolVar(&updateRefStdin, "stdin", false, "Read updates from the standard input and apply them together.")
+}
+
+func updateRefArgs(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf("expected <ref> <new> [<old>]")
+	}
+	newHash, err := refValue(args[1])
+	if err != nil {
+		return err
+	}
+	oldHash := ""
+	if len(args) == 3 {
+		oldHash, err = oldRefValue(args[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	transaction := refs.NewTransaction()
+	err = queueRefUpdate(transaction, args[0], newHash, oldHash, updateRefNoDeref)
+	if err != nil {
+		return err
+	}
+	return transaction.Commit()
+}
+
+func deleteRefArgs(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("expected <ref> [<old>]")
+	}
+	oldHash := ""
+	if len(args) == 2 {
+		var err error
+		oldHash, err = refValue(args[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	transaction := refs.NewTransaction()
+	err := queueRefUpdate(transaction, args[0], refs.ZeroHash, oldHash, updateRefNoDeref)
+	if err != nil {
+		return err
+	}
+	return transaction.Commit()
+}
+
+// queueRefUpdate adds the update to the transaction after checking the
+// name of the ref
+func queueRefUpdate(transaction *refs.Transaction, name string, newHash string, oldHash string, noDeref bool) error {
+	if err := refs.CheckRefNameSafe(name); err != nil {
+		return fmt.Errorf("refusing to update ref with bad name '%s'", name)
+	}
+	if newHash == refs.ZeroHash && oldHash == refs.ZeroHash {
+		return fmt.Errorf("cannot delete '%s' with a zero old value", name)
+	}
+	return transaction.Update(name, newHash, oldHash, updateRefMessage, noDeref)
+}
+
+// refValue resolves the new or expected value of a ref, where an
+// all-zero hash stands for a ref which does not exist
+func refValue(rev string) (string, error) {
+	if rev == "" {
+		return "", fmt.Errorf("missing value")
+	}
+	if rev == refs.ZeroHash {
+		return rev, nil
+	}
+	hash, err := revision.Resolve(rev)
+	if err != nil {
+		return "", fmt.Errorf("%s: not a valid SHA1", rev)
+	}
+	return hash, nil
+}
+
+// oldRefValue resolves the expected value of a ref, where an empty
+// value also requires that the ref does not exist
+func oldRefValue(rev string) (string, error) {
+	if rev == "" {
+		return refs.ZeroHash, nil
+	}
+	return refValue(rev)
+}
+
+// updateRefsFromInput runs the commands read from the input. Any error
+// aborts the open transaction so that no ref is changed by it.
+func updateRefsFromInput(input io.Reader) error {
+	transaction := refs.NewTransaction()
+	explicit, closed := false, false
+	noDeref := updateRefNoDeref
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := scanner.Text()
+		command, rest := line, ""
+		if space := strings.IndexByte(line, ' '); space != -1 {
+			command, rest = line[:space], line[space+1:]
+		}
+
+		// Once a transaction is done, only a new one can be started
+		if closed && command != "start" {
+			return fmt.Errorf("%s: not allowed after commit or abort", command)
+		}
+
+		var err error
+		switch command {
+		case "start":
+			if explicit && !closed {
+				err = fmt.Errorf("start: a transaction was already started")
+				break
+			}
+			if closed {
+				transaction = refs.NewTransaction()
+			}
+			explicit, closed = true, false
+			fmt.Println("start: ok")
+		case "prepare":
+			err = transaction.Prepare()
+			if err == nil {
+				fmt.Println("prepare: ok")
+			}
+		case "commit":
+			err = transaction.Commit()
+			if err == nil {
+				fmt.Println("commit: ok")
+				closed = true
+			}
+		case "abort":
+			transaction.Abort()
+			fmt.Println("abort: ok")
+			closed = true
+		case "option":
+			if rest != "no-deref" {
+				err = fmt.Errorf("option unknown: %s", rest)
+				break
+			}
+			noDeref = true
+			continue
+		case "update", "create", "delete", "verify":
+			err = queueInputCommand(transaction, command, strings.Split(rest, " "), noDeref)
+		default:
+			err = fmt.Errorf("unknown command: %s", line)
+		}
+
+		if err != nil {
+			transaction.Abort()
+			return err
+		}
+		noDeref = updateRefNoDeref
+	}
+	if err := scanner.Err(); err != nil {
+		transaction.Abort()
+		return err
+	}
+
+	// An explicit transaction which was never committed is abandoned
+	if explicit || closed {
+		transaction.Abort()
+		return nil
+	}
+	return transaction.Commit()
+}
+
+// queueInputCommand adds an update, create, delete or verify command
+// of the input to the transaction
+func queueInputCommand(transaction *refs.Transaction, command string, fields []string, noDeref bool) error {
+	usage := map[string]string{
+		"update": "update <ref> <new> [<old>]",
+		"create": "create <ref> <new>",
+		"delete": "delete <ref> [<old>]",
+		"verify": "verify <ref> [<old>]",
+	}
+	minimum, maximum := 1, 2
+	switch command {
+	case "update":
+		minimum, maximum = 2, 3
+	case "create":
+		minimum, maximum = 2, 2
+	}
+	if len(fields) < minimum || len(fields) > maximum || fields[0] == "" {
+		return fmt.Errorf("%s: expected %s", command, usage[command])
+	}
+
+	name := fields[0]
+	values := make([]string, len(fields)-1)
+	for i, field := range fields[1:] {
+		if field == "" {
+			if command == "update" && i == 0 {
+				return fmt.Errorf("update %s: missing <new>", name)
+			}
+			values[i] = refs.ZeroHash
+			continue
+		}
+		value, err := refValue(field)
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", command, name, err)
+		}
+		values[i] = value
+	}
+
+	switch command {
+	case "update":
+		oldHash := ""
+		if len(values) == 2 {
+			oldHash = values[1]
+		}
+		return queueRefUpdate(transaction, name, values[0], oldHash, noDeref)
+	case "create":
+		if values[0] == refs.ZeroHash {
+			return fmt.Errorf("create %s: zero <new>", name)
+		}
+		return queueRefUpdate(transaction, name, values[0], refs.ZeroHash, noDeref)
+	case "delete":
+		oldHash := ""
+		if len(values) == 1 {
+			oldHash = values[0]
+		}
+		return queueRefUpdate(transaction, name, refs.ZeroHash, oldHash, noDeref)
+	}
+
+	oldHash := refs.ZeroHash
+	if len(values) == 1 {
+		oldHash = values[0]
+	}
+	if err := refs.CheckRefFormat(name, true); err != nil {
+		return fmt.Errorf("refusing to verify ref with bad name '%s'", name)
+	}
+	return transaction.Verify(name, oldHash, noDeref)
+}
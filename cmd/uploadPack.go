@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/transport"
+	"github.com/spf13/cobra"
+)
+
+// uploadPackCmd represents the upload-pack command
+var uploadPackCmd = &cobra.Command{
+	Use:   "upload-pack <directory>",
+	Short: "Send objects packed back to git-fetch-pack",
+	Long: `Serve a fetch from the repository in the directory over standard input
+and output.
+
+The refs of the repository are advertised, then the commits the other
+side has are negotiated with multi_ack_detailed and a pack of the objects
+it is missing is sent, thin if it asks for that, with progress messages
+on side band 2. This is run by fetch and clone rather than by hand.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := serveRepository(args[0], transport.UploadPack)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+			os.Exit(128)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(uploadPackCmd)
+}
+
+// serveRepository will run a service for the repository in the
+// directory, talking over standard input and output
+func serveRepository(directory string, service func(io.Reader, io.Writer) error) error {
+	dir, err := transport.FindRepository(directory)
+	if err != nil {
+		return err
+	}
+	gitdir.Set(dir)
+	return service(os.Stdin, os.Stdout)
+}
@@ -1,11 +1,9 @@
 package cmd
 
 import (
-	"encoding/hex"
 	"fmt"
 
 	"github.com/mattherman/mhgit/index"
-	"github.com/mattherman/mhgit/objects"
 
 	"github.com/spf13/cobra"
 )
@@ -29,21 +27,5 @@ func init() {
 }
 
 func writeTree() (string, error) {
-	index, err := index.ReadIndex()
-	if err != nil {
-		return "", err
-	}
-
-	var blobBytes []byte
-	for _, entry := range index.Entries {
-		hashAsBytes, _ := hex.DecodeString(entry.Hash)
-		// TODO do not hardcode the file mode
-		blob := fmt.Sprintf("100644 %s\000%s", entry.Path, hashAsBytes)
-		blobBytes = append(blobBytes, []byte(blob)...)
-	}
-
-	obj := objects.Object{ObjectType: "tree", Data: blobBytes}
-
-	hash, err := objects.HashObject(obj, true)
-	return hash, err
+	return index.WriteTree()
 }
@@ -0,0 +1,341 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+const repositoryConfigFile string = "config"
+
+// Config represents the combined settings of the user's global
+// configuration and the repository's configuration. Settings read later
+// take precedence, so repository settings override global ones.
+type Config struct {
+	entries []entry
+}
+
+type entry struct {
+	section    string
+	subsection string
+	name       string
+	value      string
+	hasValue   bool
+}
+
+// Read will read the global configuration files of the user followed
+// by the configuration of the repository. Missing files are skipped.
+func Read() (*Config, error) {
+	config := &Config{}
+	for _, filename := range configFiles() {
+		entries, err := readFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		config.entries = append(config.entries, entries...)
+	}
+	return config, nil
+}
+
+// configFiles returns the files to read, in increasing order
+// of precedence
+func configFiles() []string {
+	var files []string
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		files = append(files, filepath.Join(xdg, "git", "config"))
+	} else if home := os.Getenv("HOME"); home != "" {
+		files = append(files, filepath.Join(home, ".config", "git", "config"))
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		files = append(files, filepath.Join(home, ".gitconfig"))
+	}
+	return append(files, gitdir.Path(repositoryConfigFile))
+}
+
+// IsBare returns true if the repository has no working tree. core.bare
+// decides when it is set, and otherwise the repository is bare unless it
+// is the .git directory of a working tree.
+func IsBare() bool {
+	bare := filepath.Base(filepath.Clean(gitdir.Get())) != ".git"
+	config, err := Read()
+	if err != nil {
+		return bare
+	}
+	if value, err := config.Bool("core.bare", bare); err == nil {
+		return value
+	}
+	return bare
+}
+
+// Get returns the last value of the key, which has the form
+// "section.name" or "section.subsection.name"
+func (c *Config) Get(key string) (string, bool) {
+	values := c.GetAll(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// GetAll returns every value of a key that may be given more than once
+func (c *Config) GetAll(key string) []string {
+	section, subsection, name := splitKey(key)
+	var values []string
+	for _, e := range c.entries {
+		if e.section == section && e.subsection == subsection && e.name == name {
+			values = append(values, e.value)
+		}
+	}
+	return values
+}
+
+// Bool returns the value of a boolean key, or the default if the key
+// is not set. A key given without a value is true.
+func (c *Config) Bool(key string, defaultValue bool) (bool, error) {
+	section, subsection, name := splitKey(key)
+	for i := len(c.entries) - 1; i >= 0; i-- {
+		e := c.entries[i]
+		if e.section != section || e.subsection != subsection || e.name != name {
+			continue
+		}
+		if !e.hasValue {
+			return true, nil
+		}
+		return parseBool(e.value)
+	}
+	return defaultValue, nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off", "":
+		return false, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return false, fmt.Errorf("bad boolean config value '%s'", value)
+	}
+	return number != 0, nil
+}
+
+// Int returns the value of a numeric key, or the default if the key is
+// not set. The value may end in k, m or g to scale it by 1024, 1024^2
+// or 1024^3.
+func (c *Config) Int(key string, defaultValue int) (int, error) {
+	value, ok := c.Get(key)
+	if !ok {
+		return defaultValue, nil
+	}
+
+	number, scale := strings.TrimSpace(value), 1
+	switch {
+	case strings.HasSuffix(strings.ToLower(number), "k"):
+		scale = 1 << 10
+	case strings.HasSuffix(strings.ToLower(number), "m"):
+		scale = 1 << 20
+	case strings.HasSuffix(strings.ToLower(number), "g"):
+		scale = 1 << 30
+	}
+	if scale != 1 {
+		number = number[:len(number)-1]
+	}
+
+	result, err := strconv.Atoi(number)
+	if err != nil {
+		return 0, fmt.Errorf("bad numeric config value '%s' for '%s'", value, key)
+	}
+	return result * scale, nil
+}
+
+// Subsections returns the distinct subsections of a section, such as
+// the names of the configured remotes
+func (c *Config) Subsections(section string) []string {
+	section = strings.ToLower(section)
+	seen := make(map[string]bool)
+	var subsections []string
+	for _, e := range c.entries {
+		if e.section == section && e.subsection != "" && !seen[e.subsection] {
+			seen[e.subsection] = true
+			subsections = append(subsections, e.subsection)
+		}
+	}
+	return subsections
+}
+
+// splitKey splits a key into its parts. Section and variable names are
+// case-insensitive, while subsection names are not.
+func splitKey(key string) (string, string, string) {
+	first := strings.Index(key, ".")
+	last := strings.LastIndex(key, ".")
+	if first == -1 {
+		return strings.ToLower(key), "", ""
+	}
+	if first == last {
+		return strings.ToLower(key[:first]), "", strings.ToLower(key[last+1:])
+	}
+	return strings.ToLower(key[:first]), key[first+1 : last], strings.ToLower(key[last+1:])
+}
+
+func readFile(filename string) ([]entry, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []entry
+	var section, subsection string
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		// A backslash at the end of a line continues the value
+		for strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") && scanner.Scan() {
+			lineNumber++
+			line = line[:len(line)-1] + scanner.Text()
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			continue
+		}
+
+		if trimmed[0] == '[' {
+			var rest string
+			section, subsection, rest, err = parseSectionHeader(trimmed)
+			if err != nil {
+				return nil, fmt.Errorf("bad config line %d in file %s", lineNumber, filename)
+			}
+			trimmed = strings.TrimSpace(rest)
+			if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+				continue
+			}
+		}
+
+		if section == "" {
+			return nil, fmt.Errorf("bad config line %d in file %s", lineNumber, filename)
+		}
+
+		e := entry{section: section, subsection: subsection}
+		equals := strings.Index(trimmed, "=")
+		if equals == -1 {
+			e.name = strings.ToLower(strings.TrimSpace(stripComment(trimmed)))
+		} else {
+			e.name = strings.ToLower(strings.TrimSpace(trimmed[:equals]))
+			e.hasValue = true
+			e.value, err = parseValue(trimmed[equals+1:])
+			if err != nil {
+				return nil, fmt.Errorf("bad config line %d in file %s", lineNumber, filename)
+			}
+		}
+		if e.name == "" {
+			return nil, fmt.Errorf("bad config line %d in file %s", lineNumber, filename)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseSectionHeader parses "[section]", "[section "subsection"]" or the
+// deprecated "[section.subsection]", returning anything after the header
+func parseSectionHeader(line string) (string, string, string, error) {
+	end := strings.LastIndex(line, "]")
+	if end == -1 {
+		return "", "", "", fmt.Errorf("unterminated section header")
+	}
+	header := strings.TrimSpace(line[1:end])
+	rest := line[end+1:]
+
+	quote := strings.Index(header, "\"")
+	if quote == -1 {
+		dot := strings.Index(header, ".")
+		if dot == -1 {
+			return strings.ToLower(header), "", rest, nil
+		}
+		return strings.ToLower(header[:dot]), strings.ToLower(header[dot+1:]), rest, nil
+	}
+
+	section := strings.ToLower(strings.TrimSpace(header[:quote]))
+	quoted := header[quote+1:]
+	if !strings.HasSuffix(quoted, "\"") {
+		return "", "", "", fmt.Errorf("unterminated subsection")
+	}
+	quoted = quoted[:len(quoted)-1]
+
+	var subsection strings.Builder
+	for i := 0; i < len(quoted); i++ {
+		if quoted[i] == '\\' && i+1 < len(quoted) {
+			i++
+		}
+		subsection.WriteByte(quoted[i])
+	}
+	return section, subsection.String(), rest, nil
+}
+
+// parseValue handles quoting, escapes and comments in a value
+func parseValue(raw string) (string, error) {
+	var value strings.Builder
+	inQuotes := false
+	pendingSpace := ""
+	raw = strings.TrimLeft(raw, " \t")
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '\\':
+			if i+1 >= len(raw) {
+				return "", fmt.Errorf("trailing backslash")
+			}
+			i++
+			value.WriteString(pendingSpace)
+			pendingSpace = ""
+			switch raw[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'b':
+				value.WriteByte('\b')
+			case '\\', '"':
+				value.WriteByte(raw[i])
+			default:
+				return "", fmt.Errorf("invalid escape")
+			}
+		case !inQuotes && (c == '#' || c == ';'):
+			return value.String(), nil
+		case !inQuotes && (c == ' ' || c == '\t'):
+			// Whitespace is only kept if more of the value follows it
+			pendingSpace += string(c)
+		default:
+			value.WriteString(pendingSpace)
+			pendingSpace = ""
+			value.WriteByte(c)
+		}
+	}
+	if inQuotes {
+		return "", fmt.Errorf("unterminated quote")
+	}
+	return value.String(), nil
+}
+
+func stripComment(text string) string {
+	if i := strings.IndexAny(text, "#;"); i != -1 {
+		return text[:i]
+	}
+	return text
+}
@@ -0,0 +1,280 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/lockfile"
+)
+
+// How long to wait for another process to finish changing the config
+const configLockTimeout = time.Second
+
+// line represents a line of a config file along with the section it
+// belongs to and, for a variable, its name
+type line struct {
+	text       string
+	header     bool
+	section    string
+	subsection string
+	name       string
+}
+
+// Set will set a key in the repository configuration. If the key is
+// already set its last value is replaced, otherwise it is added to
+// the end of its section, which is created if needed.
+func Set(key string, value string) error {
+	section, subsection, name := splitKey(key)
+	if section == "" || name == "" {
+		return fmt.Errorf("key does not contain a section: %s", key)
+	}
+
+	return editRepositoryConfig(func(lines []line) []line {
+		variable := newVariable(key, value)
+
+		last := -1
+		end := -1
+		for i, l := range lines {
+			if l.section != section || l.subsection != subsection {
+				continue
+			}
+			end = i
+			if l.name == name {
+				last = i
+			}
+		}
+
+		if last != -1 {
+			lines[last] = variable
+			return lines
+		}
+		if end != -1 {
+			return insertLines(lines, end+1, variable)
+		}
+		header := line{text: formatHeader(section, subsection), header: true, section: section, subsection: subsection}
+		return append(lines, header, variable)
+	})
+}
+
+// Add will add a value to a key that may be given more than once, after
+// the values it already has
+func Add(key string, value string) error {
+	section, subsection, name := splitKey(key)
+	if section == "" || name == "" {
+		return fmt.Errorf("key does not contain a section: %s", key)
+	}
+
+	return editRepositoryConfig(func(lines []line) []line {
+		variable := newVariable(key, value)
+
+		end := -1
+		for i, l := range lines {
+			if l.section == section && l.subsection == subsection {
+				end = i
+			}
+		}
+		if end != -1 {
+			return insertLines(lines, end+1, variable)
+		}
+		header := line{text: formatHeader(section, subsection), header: true, section: section, subsection: subsection}
+		return append(lines, header, variable)
+	})
+}
+
+// Unset will remove every value of a key from the repository configuration
+func Unset(key string) error {
+	return UnsetMatching(key, func(string) bool { return true })
+}
+
+// UnsetMatching will remove the values of a key for which the match
+// function returns true. A section left without any lines is removed.
+func UnsetMatching(key string, match func(value string) bool) error {
+	section, subsection, name := splitKey(key)
+	return editRepositoryConfig(func(lines []line) []line {
+		var kept []line
+		removed := false
+		for _, l := range lines {
+			if !l.header && l.section == section && l.subsection == subsection && l.name == name && match(l.value()) {
+				removed = true
+				continue
+			}
+			kept = append(kept, l)
+		}
+		if !removed {
+			return kept
+		}
+
+		var result []line
+		for i, l := range kept {
+			empty := i+1 == len(kept) || kept[i+1].header
+			if l.header && l.section == section && l.subsection == subsection && empty {
+				continue
+			}
+			result = append(result, l)
+		}
+		return result
+	})
+}
+
+// RenameSection will rename a section such as "branch.old" to
+// "branch.new" in the repository configuration. An empty new name
+// removes the section instead.
+func RenameSection(oldName string, newName string) error {
+	oldSection, oldSubsection := splitSection(oldName)
+	newSection, newSubsection := splitSection(newName)
+	return editRepositoryConfig(func(lines []line) []line {
+		var kept []line
+		for _, l := range lines {
+			if l.section == oldSection && l.subsection == oldSubsection {
+				if newName == "" {
+					continue
+				}
+				if l.header {
+					l.text = formatHeader(newSection, newSubsection)
+				}
+				l.section, l.subsection = newSection, newSubsection
+			}
+			kept = append(kept, l)
+		}
+		return kept
+	})
+}
+
+// CopySection will copy the variables of a section such as "branch.old"
+// to a new section at the end of the repository configuration
+func CopySection(oldName string, newName string) error {
+	oldSection, oldSubsection := splitSection(oldName)
+	newSection, newSubsection := splitSection(newName)
+	return editRepositoryConfig(func(lines []line) []line {
+		var copied []line
+		for _, l := range lines {
+			if l.header || l.name == "" || l.section != oldSection || l.subsection != oldSubsection {
+				continue
+			}
+			l.section, l.subsection = newSection, newSubsection
+			copied = append(copied, l)
+		}
+		if len(copied) == 0 {
+			return lines
+		}
+		header := line{text: formatHeader(newSection, newSubsection), header: true, section: newSection, subsection: newSubsection}
+		return append(append(lines, header), copied...)
+	})
+}
+
+// splitSection splits "section.subsection" into its parts
+func splitSection(name string) (string, string) {
+	dot := strings.Index(name, ".")
+	if dot == -1 {
+		return strings.ToLower(name), ""
+	}
+	return strings.ToLower(name[:dot]), name[dot+1:]
+}
+
+// editRepositoryConfig rewrites the repository configuration with the
+// lines returned by the edit function, while holding its lock
+func editRepositoryConfig(edit func([]line) []line) error {
+	lock, err := lockfile.LockWithTimeout(gitdir.Path(repositoryConfigFile), configLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	data, err := ioutil.ReadFile(gitdir.Path(repositoryConfigFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := edit(parseLines(string(data)))
+
+	var builder strings.Builder
+	for _, l := range lines {
+		builder.WriteString(l.text)
+		builder.WriteString("\n")
+	}
+	_, err = lock.Write([]byte(builder.String()))
+	if err != nil {
+		return err
+	}
+	return lock.Commit()
+}
+
+// parseLines splits a config file into lines, keeping track of the
+// section each line belongs to so that lines can be edited in place
+func parseLines(data string) []line {
+	var lines []line
+	var section, subsection string
+	texts := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	if data == "" {
+		texts = nil
+	}
+	for _, text := range texts {
+		l := line{text: text, section: section, subsection: subsection}
+		trimmed := strings.TrimSpace(text)
+		if strings.HasPrefix(trimmed, "[") {
+			if s, sub, _, err := parseSectionHeader(trimmed); err == nil {
+				section, subsection = s, sub
+				l.header = true
+				l.section, l.subsection = s, sub
+			}
+		} else if trimmed != "" && trimmed[0] != '#' && trimmed[0] != ';' {
+			name := trimmed
+			if equals := strings.Index(trimmed, "="); equals != -1 {
+				name = trimmed[:equals]
+			}
+			l.name = strings.ToLower(strings.TrimSpace(stripComment(name)))
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// value returns the value of a variable line, which is true for a
+// variable without one
+func (l line) value() string {
+	equals := strings.Index(l.text, "=")
+	if equals == -1 {
+		return "true"
+	}
+	value, err := parseValue(l.text[equals+1:])
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// newVariable returns the line setting a key, keeping the case of its
+// name as given, such as "tagOpt"
+func newVariable(key string, value string) line {
+	section, subsection, name := splitKey(key)
+	text := fmt.Sprintf("\t%s = %s", key[strings.LastIndex(key, ".")+1:], quoteValue(value))
+	return line{text: text, section: section, subsection: subsection, name: name}
+}
+
+func insertLines(lines []line, at int, inserted ...line) []line {
+	result := append([]line{}, lines[:at]...)
+	result = append(result, inserted...)
+	return append(result, lines[at:]...)
+}
+
+func formatHeader(section string, subsection string) string {
+	if subsection == "" {
+		return fmt.Sprintf("[%s]", section)
+	}
+	escaped := strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(subsection)
+	return fmt.Sprintf("[%s \"%s\"]", section, escaped)
+}
+
+// quoteValue quotes a value if it would otherwise not be read back
+// as the same value
+func quoteValue(value string) string {
+	escaped := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t").Replace(value)
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;") {
+		return "\"" + escaped + "\""
+	}
+	return escaped
+}
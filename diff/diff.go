@@ -0,0 +1,542 @@
+package diff
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The number of unchanged lines shown around each change
+const contextLines = 3
+
+// The search for the middle of a shortest path gives up after this many
+// steps, or more for large files, accepting a longer path
+const minTooExpensive = 4096
+
+// Line represents a single line of a hunk. The kind is ' ' for context,
+// '-' for a removed line and '+' for an added line. The text includes
+// the trailing newline, unless it is the last line of a file that does
+// not end with one.
+type Line struct {
+	Kind byte
+	Text string
+}
+
+// Hunk represents a group of nearby changes along with the unchanged
+// lines surrounding them. OldPos and NewPos are the zero-based positions
+// of the first line of the hunk in the old and new files.
+type Hunk struct {
+	OldPos int
+	NewPos int
+	Lines  []Line
+}
+
+// SplitLines will split file content into lines, keeping the newline
+// at the end of each
+func SplitLines(data []byte) []string {
+	var lines []string
+	text := string(data)
+	for len(text) > 0 {
+		end := strings.IndexByte(text, '\n')
+		if end == -1 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:end+1])
+		text = text[end+1:]
+	}
+	return lines
+}
+
+// Diff will compare two files line by line and return the hunks
+// needed to turn the old file into the new one
+func Diff(oldLines []string, newLines []string) []Hunk {
+	script := editScript(oldLines, newLines)
+
+	// Changes close enough to share their context belong to one hunk
+	var hunks []Hunk
+	oldPos, newPos := 0, 0
+	pos := 0
+	for i := 0; i < len(script); i++ {
+		if script[i].Kind == ' ' {
+			continue
+		}
+
+		start := i - contextLines
+		if start < pos {
+			start = pos
+		}
+		end := i
+		for j := i; j < len(script) && j <= end+2*contextLines+1; j++ {
+			if script[j].Kind != ' ' {
+				end = j
+			}
+		}
+		end += contextLines + 1
+		if end > len(script) {
+			end = len(script)
+		}
+
+		oldPos, newPos = advance(script[pos:start], oldPos, newPos)
+		hunks = append(hunks, Hunk{OldPos: oldPos, NewPos: newPos, Lines: script[start:end]})
+		oldPos, newPos = advance(script[start:end], oldPos, newPos)
+		pos = end
+		i = end - 1
+	}
+
+	return hunks
+}
+
+// advance returns the positions in the old and new files after
+// the given lines
+func advance(lines []Line, oldPos int, newPos int) (int, int) {
+	for _, line := range lines {
+		if line.Kind != '+' {
+			oldPos++
+		}
+		if line.Kind != '-' {
+			newPos++
+		}
+	}
+	return oldPos, newPos
+}
+
+// editScript computes the shortest sequence of removed, added and
+// unchanged lines turning the old file into the new one, using the
+// linear space refinement of the algorithm described in Myers' "An
+// O(ND) Difference Algorithm", so that large files can be compared.
+// Lines found in only one of the files cannot be unchanged, so they are
+// left out of the search, as GNU diff and git do.
+func editScript(a []string, b []string) []Line {
+	ids := make(map[string]int)
+	inA, inB := make(map[int]bool), make(map[int]bool)
+	aIDs, bIDs := make([]int, len(a)), make([]int, len(b))
+	for i, text := range a {
+		if _, ok := ids[text]; !ok {
+			ids[text] = len(ids)
+		}
+		aIDs[i] = ids[text]
+		inA[aIDs[i]] = true
+	}
+	for i, text := range b {
+		if _, ok := ids[text]; !ok {
+			ids[text] = len(ids)
+		}
+		bIDs[i] = ids[text]
+		inB[bIDs[i]] = true
+	}
+
+	var aKept, bKept []int
+	var aLines, bLines []int
+	for i, id := range aIDs {
+		if inB[id] {
+			aKept, aLines = append(aKept, id), append(aLines, i)
+		}
+	}
+	for i, id := range bIDs {
+		if inA[id] {
+			bKept, bLines = append(bKept, id), append(bLines, i)
+		}
+	}
+
+	size := 2*(len(aKept)+len(bKept)) + 3
+	d := &differ{a: aKept, b: bKept, forward: make([]int, size), backward: make([]int, size), tooExpensive: 1}
+	// As in GNU diff, the limit grows with the square root of the size
+	for diagonals := size; diagonals != 0; diagonals >>= 2 {
+		d.tooExpensive <<= 1
+	}
+	if d.tooExpensive < minTooExpensive {
+		d.tooExpensive = minTooExpensive
+	}
+	d.compare(0, len(aKept), 0, len(bKept))
+
+	// The lines left out are put back as removed or added
+	var script []Line
+	i, j, p, q := 0, 0, 0, 0
+	for _, kind := range d.kinds {
+		switch kind {
+		case ' ':
+			for ; i < aLines[p]; i++ {
+				script = append(script, Line{Kind: '-', Text: a[i]})
+			}
+			for ; j < bLines[q]; j++ {
+				script = append(script, Line{Kind: '+', Text: b[j]})
+			}
+			script = append(script, Line{Kind: ' ', Text: a[i]})
+			i, j, p, q = i+1, j+1, p+1, q+1
+		case '-':
+			for ; i <= aLines[p]; i++ {
+				script = append(script, Line{Kind: '-', Text: a[i]})
+			}
+			p++
+		case '+':
+			for ; j <= bLines[q]; j++ {
+				script = append(script, Line{Kind: '+', Text: b[j]})
+			}
+			q++
+		}
+	}
+	for ; i < len(a); i++ {
+		script = append(script, Line{Kind: '-', Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		script = append(script, Line{Kind: '+', Text: b[j]})
+	}
+
+	// Within each change the removed lines come before the added ones
+	for start := 0; start < len(script); {
+		if script[start].Kind == ' ' {
+			start++
+			continue
+		}
+		end := start
+		for end < len(script) && script[end].Kind != ' ' {
+			end++
+		}
+		sort.SliceStable(script[start:end], func(i, j int) bool {
+			return script[start+i].Kind == '-' && script[start+j].Kind == '+'
+		})
+		start = end
+	}
+	return script
+}
+
+// differ holds the state of a comparison of the lines of two files,
+// each line given by a number identifying its text. The furthest
+// reaching paths of each diagonal are kept for both directions.
+type differ struct {
+	a        []int
+	b        []int
+	forward  []int
+	backward []int
+	kinds    []byte
+
+	tooExpensive int
+}
+
+// compare appends the edit script turning a[aLo:aHi] into b[bLo:bHi],
+// splitting the comparison at the middle snake of its shortest path
+func (d *differ) compare(aLo int, aHi int, bLo int, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.kinds = append(d.kinds, ' ')
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+		suffix++
+	}
+
+	switch {
+	case aLo == aHi:
+		d.appendKinds('+', bHi-bLo)
+	case bLo == bHi:
+		d.appendKinds('-', aHi-aLo)
+	default:
+		x, y, u, v := d.middleSnake(aLo, aHi, bLo, bHi)
+		d.compare(aLo, x, bLo, y)
+		d.appendKinds(' ', u-x)
+		d.compare(u, aHi, v, bHi)
+	}
+	d.appendKinds(' ', suffix)
+}
+
+func (d *differ) appendKinds(kind byte, count int) {
+	for i := 0; i < count; i++ {
+		d.kinds = append(d.kinds, kind)
+	}
+}
+
+// middleSnake finds the snake in the middle of a shortest path from the
+// start of both files to their end, by searching from both ends at once
+// until the paths meet. It returns where the snake starts and ends. When
+// that takes too long, the furthest point reached is used instead.
+func (d *differ) middleSnake(aLo int, aHi int, bLo int, bHi int) (int, int, int, int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	offset := (n+m+1)/2 + 1
+	vf, vb := d.forward, d.backward
+	vf[offset+1], vb[offset+1] = 0, 0
+
+	for step := 0; step <= (n+m+1)/2; step++ {
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && d.a[aLo+x] == d.b[bLo+y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+
+			// The backward path on the same diagonal is on diagonal
+			// delta-k from the end
+			if reverse := delta - k; odd && reverse >= -(step-1) && reverse <= step-1 && x+vb[offset+reverse] >= n {
+				return aLo + startX, bLo + startY, aLo + x, bLo + y
+			}
+		}
+
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && vb[offset+k-1] < vb[offset+k+1]) {
+				x = vb[offset+k+1]
+			} else {
+				x = vb[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && d.a[aHi-1-x] == d.b[bHi-1-y] {
+				x++
+				y++
+			}
+			vb[offset+k] = x
+
+			if forward := delta - k; !odd && forward >= -step && forward <= step && x+vf[offset+forward] >= n {
+				return aHi - x, bHi - y, aHi - startX, bHi - startY
+			}
+		}
+
+		if step >= d.tooExpensive {
+			return d.furthestPoint(aLo, aHi, bLo, bHi, step, offset)
+		}
+	}
+	// The paths always meet by the middle of the shortest one
+	return aLo, bLo, aLo, bLo
+}
+
+// furthestPoint returns the point the search got furthest to from
+// either end, as an empty snake to split the comparison at
+func (d *differ) furthestPoint(aLo int, aHi int, bLo int, bHi int, step int, offset int) (int, int, int, int) {
+	n, m := aHi-aLo, bHi-bLo
+	bestX, bestY, best := 0, 0, -1
+	for k := -step; k <= step; k += 2 {
+		x := d.forward[offset+k]
+		if x > n {
+			x = n
+		}
+		y := x - k
+		if y < 0 || y > m {
+			continue
+		}
+		if x+y > best {
+			bestX, bestY, best = x, y, x+y
+		}
+		x = d.backward[offset+k]
+		if x > n {
+			x = n
+		}
+		y = x - k
+		if y < 0 || y > m {
+			continue
+		}
+		if x+y > best {
+			bestX, bestY, best = n-x, m-y, x+y
+		}
+	}
+	return aLo + bestX, bLo + bestY, aLo + bestX, bLo + bestY
+}
+
+// Counts returns the number of lines of the hunk in the old and
+// new files
+func (h Hunk) Counts() (int, int) {
+	return advance(h.Lines, 0, 0)
+}
+
+// Header returns the "@@ -a,b +c,d @@" line of the hunk
+func (h Hunk) Header() string {
+	oldCount, newCount := h.Counts()
+	return fmt.Sprintf("@@ -%s +%s @@", formatRange(h.OldPos, oldCount), formatRange(h.NewPos, newCount))
+}
+
+// An empty range is described by the line before it
+func formatRange(pos int, count int) string {
+	start := pos + 1
+	if count == 0 {
+		start = pos
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// String formats the hunk in the unified diff format
+func (h Hunk) String() string {
+	var builder strings.Builder
+	builder.WriteString(h.Header())
+	builder.WriteString("\n")
+	for _, line := range h.Lines {
+		builder.WriteByte(line.Kind)
+		builder.WriteString(line.Text)
+		if !strings.HasSuffix(line.Text, "\n") {
+			builder.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	return builder.String()
+}
+
+// Reverse returns the hunk that undoes this one
+func (h Hunk) Reverse() Hunk {
+	reversed := Hunk{OldPos: h.NewPos, NewPos: h.OldPos}
+	for _, line := range h.Lines {
+		switch line.Kind {
+		case '+':
+			line.Kind = '-'
+		case '-':
+			line.Kind = '+'
+		}
+		reversed.Lines = append(reversed.Lines, line)
+	}
+	return reversed
+}
+
+// Split will split the hunk into smaller hunks at every run of context
+// lines between changes. Neighbouring hunks share the context between
+// them. A hunk that cannot be split is returned by itself.
+func (h Hunk) Split() []Hunk {
+	var hunks []Hunk
+	oldPos, newPos := h.OldPos, h.NewPos
+	start := 0
+	i := 0
+	for i < len(h.Lines) {
+		// Skip to the end of the current group of changes
+		for i < len(h.Lines) && h.Lines[i].Kind == ' ' {
+			i++
+		}
+		for i < len(h.Lines) && h.Lines[i].Kind != ' ' {
+			i++
+		}
+		contextStart := i
+		for i < len(h.Lines) && h.Lines[i].Kind == ' ' {
+			i++
+		}
+
+		hunk := Hunk{OldPos: oldPos, NewPos: newPos, Lines: h.Lines[start:i]}
+		hunks = append(hunks, hunk)
+
+		// The next hunk starts with the context that ends this one
+		oldPos, newPos = advance(h.Lines[start:contextStart], oldPos, newPos)
+		start = contextStart
+		if i == len(h.Lines) {
+			break
+		}
+	}
+	return hunks
+}
+
+// Apply will apply the hunks to the lines of a file. The hunks must be
+// in order and their context and removed lines must match the file.
+// Hunks from Split may overlap on their shared context lines.
+func Apply(lines []string, hunks []Hunk) ([]string, error) {
+	var result []string
+	pos := 0
+	for _, hunk := range hunks {
+		start := hunk.OldPos
+		hunkLines := hunk.Lines
+		for start < pos {
+			if len(hunkLines) == 0 || hunkLines[0].Kind != ' ' {
+				return nil, fmt.Errorf("hunk %s overlaps the previous hunk", hunk.Header())
+			}
+			hunkLines = hunkLines[1:]
+			start++
+		}
+		if start > len(lines) {
+			return nil, fmt.Errorf("hunk %s is past the end of the file", hunk.Header())
+		}
+
+		result = append(result, lines[pos:start]...)
+		pos = start
+		for _, line := range hunkLines {
+			if line.Kind == '+' {
+				result = append(result, line.Text)
+				continue
+			}
+			if pos >= len(lines) || lines[pos] != line.Text {
+				return nil, fmt.Errorf("hunk %s does not apply", hunk.Header())
+			}
+			if line.Kind == ' ' {
+				result = append(result, line.Text)
+			}
+			pos++
+		}
+	}
+	return append(result, lines[pos:]...), nil
+}
+
+// ParseHunk will parse a single hunk in the unified diff format, such as
+// one edited by the user. The line counts of the header are ignored and
+// recomputed from the lines of the hunk.
+func ParseHunk(text string) (Hunk, error) {
+	lines := SplitLines([]byte(text))
+	if len(lines) == 0 {
+		return Hunk{}, fmt.Errorf("hunk is empty")
+	}
+
+	var hunk Hunk
+	var oldStart, oldCount, newStart, newCount int
+	header := strings.TrimRight(lines[0], "\n")
+	if !parseRange(header, &oldStart, &oldCount, &newStart, &newCount) {
+		return Hunk{}, fmt.Errorf("invalid hunk header '%s'", header)
+	}
+	hunk.OldPos = rangePos(oldStart, oldCount)
+	hunk.NewPos = rangePos(newStart, newCount)
+
+	for _, text := range lines[1:] {
+		if strings.HasPrefix(text, "\\") {
+			// The previous line has no newline at the end of the file
+			if len(hunk.Lines) > 0 {
+				last := &hunk.Lines[len(hunk.Lines)-1]
+				last.Text = strings.TrimSuffix(last.Text, "\n")
+			}
+			continue
+		}
+		if text == "\n" {
+			// Editors often strip the space of empty context lines
+			text = " \n"
+		}
+
+		kind := text[0]
+		if kind != ' ' && kind != '-' && kind != '+' {
+			return Hunk{}, fmt.Errorf("invalid hunk line '%s'", strings.TrimRight(text, "\n"))
+		}
+		hunk.Lines = append(hunk.Lines, Line{Kind: kind, Text: text[1:]})
+	}
+
+	return hunk, nil
+}
+
+// parseRange parses a hunk header, where either count may be left out
+// when it is one
+func parseRange(header string, oldStart, oldCount, newStart, newCount *int) bool {
+	var oldRange, newRange string
+	_, err := fmt.Sscanf(header, "@@ -%s +%s @@", &oldRange, &newRange)
+	if err != nil {
+		return false
+	}
+	return parseStartCount(oldRange, oldStart, oldCount) && parseStartCount(newRange, newStart, newCount)
+}
+
+func parseStartCount(text string, start *int, count *int) bool {
+	*count = 1
+	if strings.Contains(text, ",") {
+		_, err := fmt.Sscanf(text, "%d,%d", start, count)
+		return err == nil
+	}
+	_, err := fmt.Sscanf(text, "%d", start)
+	return err == nil
+}
+
+func rangePos(start int, count int) int {
+	if count == 0 {
+		return start
+	}
+	return start - 1
+}
@@ -0,0 +1,101 @@
+package fsmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+const (
+	socketFile string = "fsmonitor--daemon.ipc"
+
+	// A path of "/" in a response means every path may have changed
+	everythingChanged string = "/"
+
+	dialTimeout time.Duration = time.Second
+)
+
+// Result describes the paths that changed in the working tree since
+// the token given to Query was issued.
+type Result struct {
+	// Token identifies this point in the daemon's journal and should
+	// be given to the next query
+	Token string
+	// Trivial is true when the daemon cannot tell what changed, for
+	// example because it was restarted, and every path must be checked
+	Trivial bool
+	// Paths are the changed paths relative to the working tree. Any
+	// path may be a directory, in which case everything beneath it
+	// may have changed as well.
+	Paths []string
+}
+
+// Query will ask the daemon watching the working tree for the paths
+// that changed since the token was issued. An empty token always
+// results in a trivial response.
+func Query(token string) (Result, error) {
+	response, err := send("query " + token)
+	if err != nil {
+		return Result{}, err
+	}
+
+	fields := bytes.Split(response, []byte{0})
+	if len(fields) < 1 || len(fields[0]) == 0 {
+		return Result{}, fmt.Errorf("fsmonitor daemon sent a malformed response")
+	}
+
+	result := Result{Token: string(fields[0])}
+	for _, field := range fields[1:] {
+		path := string(field)
+		if path == "" {
+			continue
+		}
+		if path == everythingChanged {
+			result.Trivial = true
+			continue
+		}
+		result.Paths = append(result.Paths, path)
+	}
+
+	return result, nil
+}
+
+// Status will return the working tree watched by the daemon, or an
+// error if no daemon is running for this repository.
+func Status() (string, error) {
+	response, err := send("status")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(response)), nil
+}
+
+// Stop will ask the daemon for this repository to exit.
+func Stop() error {
+	_, err := send("stop")
+	return err
+}
+
+func send(command string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", gitdir.Path(socketFile), dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("fsmonitor daemon is not running: %v", err)
+	}
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	writer.WriteString(command + "\n")
+	err = writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(conn)
+}
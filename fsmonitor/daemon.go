@@ -0,0 +1,229 @@
+package fsmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+// The journal only remembers this many changes. Tokens older than the
+// oldest remembered change get a trivial response.
+const maxJournalLength int = 100000
+
+// daemon watches a working tree for changes and records every changed
+// path in a journal. Clients exchange tokens for the paths changed
+// since the token was issued.
+type daemon struct {
+	workTree string
+	watcher  *fsnotify.Watcher
+	listener net.Listener
+
+	mutex sync.Mutex
+	// instance identifies this run of the daemon, so tokens issued by
+	// an earlier run are never mistaken for ones issued by this run
+	instance string
+	// Sequence number of the first change in the journal
+	firstSequence uint64
+	journal       []string
+}
+
+// Run will watch the working tree in the current directory until the
+// daemon is asked to stop. It listens for clients on a Unix socket in
+// the .git directory.
+func Run() error {
+	workTree, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// A socket left behind by a daemon that died would stop us listening
+	if _, err := Status(); err == nil {
+		return fmt.Errorf("fsmonitor daemon is already running")
+	}
+	os.Remove(gitdir.Path(socketFile))
+
+	listener, err := net.Listen("unix", gitdir.Path(socketFile))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(gitdir.Path(socketFile))
+	defer listener.Close()
+
+	d := &daemon{
+		workTree: workTree,
+		watcher:  watcher,
+		listener: listener,
+	}
+	d.reset()
+
+	err = d.watchTree(".")
+	if err != nil {
+		return err
+	}
+
+	go d.handleEvents()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// The listener is closed when the daemon is stopped
+			return nil
+		}
+		go d.handleClient(conn)
+	}
+}
+
+// reset forgets every recorded change, which makes every existing
+// token result in a trivial response
+func (d *daemon) reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.instance = strconv.FormatInt(time.Now().UnixNano(), 10)
+	d.firstSequence = 0
+	d.journal = nil
+}
+
+// watchTree adds a watch for the directory and every directory beneath
+// it, skipping the .git directory
+func (d *daemon) watchTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Directories can disappear while they are being walked
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		return d.watcher.Add(path)
+	})
+}
+
+func (d *daemon) handleEvents() {
+	for {
+		select {
+		case event, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			path := filepath.ToSlash(filepath.Clean(event.Name))
+			if path == ".git" || strings.HasPrefix(path, ".git/") {
+				continue
+			}
+
+			// New directories need their own watches. Anything created in
+			// them before the watch was added is covered by recording the
+			// directory itself as changed.
+			if event.Op&fsnotify.Create != 0 {
+				info, err := os.Lstat(event.Name)
+				if err == nil && info.IsDir() {
+					d.watchTree(event.Name)
+				}
+			}
+			d.record(path)
+
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events were lost, so nothing can be known about what changed
+			if err == fsnotify.ErrEventOverflow {
+				d.reset()
+			}
+		}
+	}
+}
+
+func (d *daemon) record(path string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.journal = append(d.journal, path)
+	if len(d.journal) > maxJournalLength {
+		trimmed := len(d.journal) - maxJournalLength
+		d.journal = append([]string(nil), d.journal[trimmed:]...)
+		d.firstSequence += uint64(trimmed)
+	}
+}
+
+func (d *daemon) handleClient(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	command := strings.SplitN(strings.TrimSpace(line), " ", 2)
+
+	switch command[0] {
+	case "query":
+		token := ""
+		if len(command) > 1 {
+			token = command[1]
+		}
+		conn.Write(d.query(token))
+	case "status":
+		fmt.Fprintf(conn, "%s\n", d.workTree)
+	case "stop":
+		d.listener.Close()
+	}
+}
+
+// query builds the response listing the paths changed since the token.
+// Tokens have the form "mhgit:<instance>:<sequence>".
+func (d *daemon) query(token string) []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	lastSequence := d.firstSequence + uint64(len(d.journal))
+	var response bytes.Buffer
+	fmt.Fprintf(&response, "mhgit:%s:%d\000", d.instance, lastSequence)
+
+	sequence, ok := d.parseToken(token)
+	if !ok || sequence < d.firstSequence || sequence > lastSequence {
+		response.WriteString(everythingChanged + "\000")
+		return response.Bytes()
+	}
+
+	seen := make(map[string]bool)
+	for _, path := range d.journal[sequence-d.firstSequence:] {
+		if !seen[path] {
+			seen[path] = true
+			response.WriteString(path + "\000")
+		}
+	}
+
+	return response.Bytes()
+}
+
+// parseToken returns the journal sequence number of a token issued by
+// this run of the daemon
+func (d *daemon) parseToken(token string) (uint64, bool) {
+	parts := strings.Split(token, ":")
+	if len(parts) != 3 || parts[0] != "mhgit" || parts[1] != d.instance {
+		return 0, false
+	}
+
+	sequence, err := strconv.ParseUint(parts[2], 10, 64)
+	return sequence, err == nil
+}
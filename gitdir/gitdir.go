@@ -0,0 +1,58 @@
+package gitdir
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// The directory holding the repository, relative to the working tree
+// unless the repository is bare or GIT_DIR names another directory
+var dir = ".git"
+
+// Path returns the path of a file or directory of the repository, such
+// as Path("refs", "heads") for the branches
+func Path(elem ...string) string {
+	return filepath.Join(append([]string{dir}, elem...)...)
+}
+
+// Get returns the directory of the repository
+func Get() string {
+	return dir
+}
+
+// Set will make the repository in the directory the one that is used
+func Set(path string) {
+	dir = path
+}
+
+// Discover will find the repository of the current directory. GIT_DIR
+// takes precedence, then the .git directory of the working tree, and
+// otherwise the current directory is used if it is a bare repository.
+func Discover() {
+	if env := os.Getenv("GIT_DIR"); env != "" {
+		dir = env
+		return
+	}
+
+	dir = ".git"
+	if _, err := os.Stat(dir); os.IsNotExist(err) && IsRepository(".") {
+		dir = "."
+	}
+}
+
+// IsRepository returns true if the directory has the layout of a
+// repository, as a bare repository or the .git directory of a working
+// tree does
+func IsRepository(path string) bool {
+	head, err := os.Stat(filepath.Join(path, "HEAD"))
+	if err != nil || head.IsDir() {
+		return false
+	}
+	for _, sub := range []string{"objects", "refs"} {
+		info, err := os.Stat(filepath.Join(path, sub))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package ident
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts accepted for dates given by the user, besides git's
+// internal format
+var dateLayouts = []string{
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+var dateUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// ParseDate will parse a date in git's internal "<seconds> <offset>"
+// format, the RFC 2822 format or the ISO 8601 format
+func ParseDate(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	if when, err := parseRawDate(text); err == nil {
+		return when, nil
+	}
+	for _, layout := range dateLayouts {
+		if when, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+			return when, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date '%s'", text)
+}
+
+// ParseApproxDate will parse a date relative to now, such as
+// "yesterday" or "2.weeks.ago", falling back to ParseDate for
+// absolute dates
+func ParseApproxDate(text string, now time.Time) (time.Time, error) {
+	normalized := strings.ToLower(strings.TrimSpace(text))
+	normalized = strings.NewReplacer(".", " ", "_", " ").Replace(normalized)
+
+	switch normalized {
+	case "now":
+		return now, nil
+	case "yesterday":
+		return now.AddDate(0, 0, -1), nil
+	}
+
+	fields := strings.Fields(normalized)
+	if len(fields) == 3 && fields[2] == "ago" {
+		count, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date '%s'", text)
+		}
+		unit := strings.TrimSuffix(fields[1], "s")
+		switch unit {
+		case "month":
+			return now.AddDate(0, -count, 0), nil
+		case "year":
+			return now.AddDate(-count, 0, 0), nil
+		}
+		if duration, ok := dateUnits[unit]; ok {
+			return now.Add(-time.Duration(count) * duration), nil
+		}
+		return time.Time{}, fmt.Errorf("invalid date '%s'", text)
+	}
+
+	return ParseDate(text)
+}
+
+// RelativeDate describes how long before now the date was, such as
+// "3 days ago" or "2 years, 1 month ago", rounding the way git does
+func RelativeDate(when time.Time, now time.Time) string {
+	if when.After(now) {
+		return "in the future"
+	}
+
+	diff := int64(now.Sub(when) / time.Second)
+	if diff < 90 {
+		return ago(diff, "second")
+	}
+	diff = (diff + 30) / 60
+	if diff < 90 {
+		return ago(diff, "minute")
+	}
+	diff = (diff + 30) / 60
+	if diff < 36 {
+		return ago(diff, "hour")
+	}
+	diff = (diff + 12) / 24
+	switch {
+	case diff < 14:
+		return ago(diff, "day")
+	case diff < 70:
+		return ago((diff+3)/7, "week")
+	case diff < 365:
+		return ago((diff+15)/30, "month")
+	case diff < 1825:
+		months := (diff*12*2 + 365) / (365 * 2)
+		if months%12 == 0 {
+			return ago(months/12, "year")
+		}
+		return plural(months/12, "year") + ", " + ago(months%12, "month")
+	}
+	return ago((diff+183)/365, "year")
+}
+
+func ago(count int64, unit string) string {
+	return plural(count, unit) + " ago"
+}
+
+func plural(count int64, unit string) string {
+	if count == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
+}
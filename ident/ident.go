@@ -0,0 +1,151 @@
+package ident
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/config"
+)
+
+// Identity represents the person recorded in commits and reflog entries
+// along with the time they made the change
+type Identity struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// Author returns the identity of the author of a new commit, taken from
+// the GIT_AUTHOR_* environment variables or the user.name and user.email
+// settings
+func Author() (Identity, error) {
+	return lookup("AUTHOR")
+}
+
+// Committer returns the identity of whoever records a new commit or
+// ref update, taken from the GIT_COMMITTER_* environment variables or the
+// user.name and user.email settings
+func Committer() (Identity, error) {
+	return lookup("COMMITTER")
+}
+
+func lookup(role string) (Identity, error) {
+	cfg, err := config.Read()
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{When: time.Now()}
+	identity.Name = firstSet(os.Getenv("GIT_"+role+"_NAME"), configValue(cfg, "user.name"))
+	identity.Email = firstSet(os.Getenv("GIT_"+role+"_EMAIL"), configValue(cfg, "user.email"), os.Getenv("EMAIL"))
+
+	// Like git, fall back to the login and host names when nothing is set
+	if identity.Name == "" || identity.Email == "" {
+		login := "unknown"
+		if current, err := user.Current(); err == nil {
+			login = current.Username
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		identity.Name = firstSet(identity.Name, login)
+		identity.Email = firstSet(identity.Email, login+"@"+hostname)
+	}
+
+	if date := os.Getenv("GIT_" + role + "_DATE"); date != "" {
+		identity.When, err = ParseDate(date)
+		if err != nil {
+			return Identity{}, fmt.Errorf("invalid date format: %s", date)
+		}
+	}
+	return identity, nil
+}
+
+func configValue(cfg *config.Config, key string) string {
+	value, _ := cfg.Get(key)
+	return value
+}
+
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// String formats the identity the way it is stored in commits and the
+// reflog, such as "Jane Doe <jane@example.com> 1500000000 +0200"
+func (i Identity) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", i.Name, i.Email, i.When.Unix(), i.When.Format("-0700"))
+}
+
+// Parse will parse an identity in the format written by String
+func Parse(text string) (Identity, error) {
+	open := strings.Index(text, "<")
+	close := strings.LastIndex(text, ">")
+	if open == -1 || close < open {
+		return Identity{}, fmt.Errorf("invalid identity '%s'", text)
+	}
+
+	identity := Identity{
+		Name:  strings.TrimSpace(text[:open]),
+		Email: text[open+1 : close],
+	}
+	when, err := parseRawDate(strings.TrimSpace(text[close+1:]))
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid identity '%s'", text)
+	}
+	identity.When = when
+	return identity, nil
+}
+
+// parseRawDate parses git's internal "<seconds> <offset>" format
+func parseRawDate(text string) (time.Time, error) {
+	fields := strings.Fields(strings.TrimPrefix(text, "@"))
+	if len(fields) == 0 || len(fields) > 2 {
+		return time.Time{}, fmt.Errorf("invalid date '%s'", text)
+	}
+
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	when := time.Unix(seconds, 0)
+	if len(fields) == 1 {
+		return when, nil
+	}
+
+	zone, err := parseZone(fields[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return when.In(zone), nil
+}
+
+// parseZone parses an offset such as "+0200" or "-0530"
+func parseZone(offset string) (*time.Location, error) {
+	if len(offset) != 5 || (offset[0] != '+' && offset[0] != '-') {
+		return nil, fmt.Errorf("invalid time zone '%s'", offset)
+	}
+	hours, err := strconv.Atoi(offset[1:3])
+	if err != nil {
+		return nil, err
+	}
+	minutes, err := strconv.Atoi(offset[3:])
+	if err != nil {
+		return nil, err
+	}
+
+	seconds := hours*60*60 + minutes*60
+	if offset[0] == '-' {
+		seconds = -seconds
+	}
+	return time.FixedZone("", seconds), nil
+}
@@ -0,0 +1,193 @@
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/wildmatch"
+)
+
+const (
+	infoExcludeFile   string = "info/exclude"
+	perDirExcludeFile string = ".gitignore"
+)
+
+// Matcher decides which untracked files are ignored, using the patterns
+// in .git/info/exclude and the .gitignore file of each directory. The
+// .gitignore files are read the first time a path inside their
+// directory is checked.
+type Matcher struct {
+	infoExclude []pattern
+	perDir      map[string][]pattern
+	ignoredDirs map[string]bool
+}
+
+type pattern struct {
+	pattern  string
+	base     string
+	negated  bool
+	dirOnly  bool
+	anchored bool
+}
+
+// NewMatcher will create a matcher for the working tree, reading the
+// repository's exclude file.
+func NewMatcher() (*Matcher, error) {
+	infoExclude, err := readPatterns(gitdir.Path(infoExcludeFile), "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Matcher{
+		infoExclude: infoExclude,
+		perDir:      make(map[string][]pattern),
+		ignoredDirs: make(map[string]bool),
+	}, nil
+}
+
+// Ignored returns true if the path is ignored. A path inside an ignored
+// directory is always ignored, since a pattern cannot re-include a file
+// whose parent directory is excluded.
+func (m *Matcher) Ignored(filepath string, isDir bool) bool {
+	dir := path.Dir(filepath)
+	if dir != "." && m.dirIgnored(dir) {
+		return true
+	}
+	return m.matches(filepath, isDir)
+}
+
+func (m *Matcher) dirIgnored(dir string) bool {
+	ignored, ok := m.ignoredDirs[dir]
+	if !ok {
+		ignored = m.Ignored(dir, true)
+		m.ignoredDirs[dir] = ignored
+	}
+	return ignored
+}
+
+// matches evaluates every pattern that applies to the path. Patterns in
+// deeper directories take precedence, and within a file the last
+// matching pattern decides.
+func (m *Matcher) matches(filepath string, isDir bool) bool {
+	ignored := false
+	check := func(patterns []pattern) {
+		for _, p := range patterns {
+			if p.matches(filepath, isDir) {
+				ignored = !p.negated
+			}
+		}
+	}
+
+	check(m.infoExclude)
+	check(m.patterns(""))
+	components := strings.Split(filepath, "/")
+	for i := 1; i < len(components); i++ {
+		check(m.patterns(strings.Join(components[:i], "/")))
+	}
+
+	return ignored
+}
+
+// patterns returns the patterns of the .gitignore file in the directory,
+// where the root of the working tree is the empty string
+func (m *Matcher) patterns(dir string) []pattern {
+	patterns, ok := m.perDir[dir]
+	if !ok {
+		// An unreadable .gitignore is treated the same as a missing one
+		patterns, _ = readPatterns(path.Join(dir, perDirExcludeFile), dir)
+		m.perDir[dir] = patterns
+	}
+	return patterns
+}
+
+func readPatterns(filename string, base string) ([]pattern, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []pattern
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		p, ok := parsePattern(scanner.Text(), base)
+		if ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// parsePattern parses a line of an exclude file, returning false if the
+// line is blank or a comment
+func parsePattern(line string, base string) (pattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	line = trimTrailingSpaces(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false
+	}
+
+	p := pattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negated = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+
+	// A slash anywhere but the end ties the pattern to the directory of
+	// the exclude file, otherwise it matches names at any depth
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	p.pattern = line
+
+	return p, true
+}
+
+// trimTrailingSpaces removes trailing spaces that are not escaped
+// with a backslash
+func trimTrailingSpaces(line string) string {
+	end := len(line)
+	for end > 0 && line[end-1] == ' ' {
+		if end > 1 && line[end-2] == '\\' {
+			return line[:end-2] + " "
+		}
+		end--
+	}
+	return line[:end]
+}
+
+func (p pattern) matches(filepath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	relative := filepath
+	if p.base != "" {
+		if !strings.HasPrefix(filepath, p.base+"/") {
+			return false
+		}
+		relative = filepath[len(p.base)+1:]
+	}
+
+	if p.anchored {
+		return wildmatch.Match(p.pattern, relative, wildmatch.Pathname)
+	}
+	return wildmatch.Match(p.pattern, path.Base(relative), wildmatch.Pathname)
+}
@@ -0,0 +1,214 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/mattherman/mhgit/lockfile"
+	"github.com/mattherman/mhgit/objects"
+)
+
+// Batch represents a set of changes to the index. The index is locked
+// and read once when the batch is created, and written once when the
+// batch is committed, no matter how many files are changed.
+type Batch struct {
+	lock  *lockfile.Lockfile
+	index Index
+}
+
+// NewBatch will lock the index and read it so that changes can be
+// made to it. The batch must be committed or rolled back to release
+// the lock.
+func NewBatch() (*Batch, error) {
+	lock, index, err := lockIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Batch{lock: lock, index: index}, nil
+}
+
+// Index returns the index as currently modified by the batch
+func (b *Batch) Index() Index {
+	return b.index
+}
+
+// Add will add the specified files to the index. The files are hashed
+// and written to the object database in parallel. Directories holding
+// another repository are added as gitlinks to the commit checked out in
+// them. If any file cannot be added, or the context is cancelled, the
+// index is left unchanged.
+func (b *Batch) Add(ctx context.Context, filepaths []string) error {
+	hashes := make([]string, len(filepaths))
+	var files []string
+	var fileIndexes []int
+	for i, filepath := range filepaths {
+		info, err := os.Lstat(filepath)
+		if err != nil || !info.IsDir() {
+			files = append(files, filepath)
+			fileIndexes = append(fileIndexes, i)
+			continue
+		}
+
+		if !isNestedRepository(filepath) {
+			return errors.New(filepath + " is a directory")
+		}
+		hashes[i], err = gitlinkHead(filepath)
+		if err != nil {
+			return err
+		}
+	}
+
+	fileHashes, err := objects.HashFiles(ctx, files, true)
+	if err != nil {
+		return err
+	}
+	for f, i := range fileIndexes {
+		hashes[i] = fileHashes[f]
+	}
+
+	entries := make([]Entry, len(filepaths))
+	for i, filepath := range filepaths {
+		entries[i], err = newEntry(filepath, hashes[i], b.previousMode(filepath))
+		if err != nil {
+			return err
+		}
+	}
+
+	b.index.setEntries(entries)
+	return nil
+}
+
+// previousMode returns the mode of the stage 0 entry of the path, or
+// zero if there is none
+func (b *Batch) previousMode(filepath string) int32 {
+	entryIndex := findEntry(b.index, filepath, StageMerged)
+	if entryIndex == -1 {
+		return 0
+	}
+	return b.index.Entries[entryIndex].Mode
+}
+
+// IntentToAdd will record that the specified files will be added
+// later. Their entries have the hash of an empty blob and are left out
+// of trees until the files are added for real. Files that are already
+// in the index are left unchanged.
+func (b *Batch) IntentToAdd(filepaths []string) error {
+	emptyBlobHash, err := objects.HashObject(objects.Object{ObjectType: "blob"}, false)
+	if err != nil {
+		return err
+	}
+
+	var entries []Entry
+	for _, filepath := range filepaths {
+		if findEntry(b.index, filepath, StageMerged) != -1 || b.index.IsUnmerged(filepath) {
+			continue
+		}
+
+		entry, err := newEntry(filepath, emptyBlobHash, 0)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry.SetIntentToAdd(true))
+	}
+
+	b.index.setEntries(entries)
+	return nil
+}
+
+// AddCacheInfo will add an entry for an object that is already in the
+// object database, such as a partially staged file. The entry has no
+// stat information, so the file will be rehashed when the index is
+// next refreshed.
+func (b *Batch) AddCacheInfo(mode int32, hash string, filepath string) {
+	b.index.setEntries([]Entry{{Mode: mode, Hash: hash, Path: filepath}})
+}
+
+// Remove will remove every stage of the specified file from the index.
+// The file in the working tree is not changed.
+func (b *Batch) Remove(filepath string) {
+	b.index.removePath(filepath)
+}
+
+// Rename will move the index entry of a file to a new path, keeping its
+// content and stat information. Any entry already at the new path is
+// replaced.
+func (b *Batch) Rename(oldPath string, newPath string) error {
+	if b.index.IsUnmerged(oldPath) {
+		return errors.New("file is unmerged: " + oldPath)
+	}
+	entryIndex := findEntry(b.index, oldPath, StageMerged)
+	if entryIndex == -1 {
+		return errors.New("file is not in the index: " + oldPath)
+	}
+
+	entry := b.index.Entries[entryIndex]
+	entry.Path = newPath
+	b.index.removePath(oldPath)
+	b.index.setEntries([]Entry{entry})
+	return nil
+}
+
+// SetSkipWorktree will set or clear the skip-worktree flag of the
+// index entry for the given path.
+func (b *Batch) SetSkipWorktree(filepath string, skip bool) error {
+	entryIndex := findEntry(b.index, filepath, StageMerged)
+	if entryIndex == -1 {
+		return errors.New("file is not in the index: " + filepath)
+	}
+
+	b.index.Entries[entryIndex] = b.index.Entries[entryIndex].SetSkipWorktree(skip)
+	return nil
+}
+
+// Commit will write the modified index and release the lock
+func (b *Batch) Commit() error {
+	return writeIndex(b.lock, b.index)
+}
+
+// Rollback will release the lock without writing the index. It does
+// nothing if the batch was already committed.
+func (b *Batch) Rollback() {
+	b.lock.Rollback()
+}
+
+// setEntries replaces every stage of the paths of the given entries
+// with the entries themselves, in a single pass over the index
+func (index *Index) setEntries(entries []Entry) {
+	replaced := make(map[string]Entry, len(entries))
+	for _, entry := range entries {
+		replaced[entry.Path] = entry
+	}
+
+	// Staging a file at stage 0 resolves any conflict for the path
+	conflicted := make(map[string]bool)
+	for _, entry := range index.Entries {
+		if _, ok := replaced[entry.Path]; ok && entry.Stage() != StageMerged {
+			conflicted[entry.Path] = true
+		}
+	}
+	for path := range conflicted {
+		recordResolveUndo(index, path)
+	}
+
+	remaining := index.Entries[:0]
+	for _, entry := range index.Entries {
+		if _, ok := replaced[entry.Path]; !ok {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		// Only the last entry for a path given more than once is kept
+		if replaced[entry.Path] != entry {
+			continue
+		}
+		delete(replaced, entry.Path)
+
+		index.invalidatePath(entry.Path)
+		remaining = append(remaining, entry)
+	}
+
+	index.Entries = remaining
+}
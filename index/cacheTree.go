@@ -0,0 +1,263 @@
+package index
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattherman/mhgit/objects"
+)
+
+// CacheTree represents a node of the TREE index extension, which
+// remembers the tree object built from a directory of the index.
+// An EntryCount of -1 means the directory changed since its tree
+// was written and the tree must be rebuilt.
+type CacheTree struct {
+	Name       string
+	EntryCount int
+	Hash       string
+	Subtrees   []*CacheTree
+}
+
+// Valid returns true if the cached tree hash can still be used
+func (t *CacheTree) Valid() bool {
+	return t.EntryCount >= 0
+}
+
+func (t *CacheTree) subtree(name string) *CacheTree {
+	for _, subtree := range t.Subtrees {
+		if subtree.Name == name {
+			return subtree
+		}
+	}
+	return nil
+}
+
+// invalidate marks the tree of every directory containing the path as
+// changed, down to the directory holding the path itself.
+func (t *CacheTree) invalidate(path string) {
+	t.EntryCount = -1
+
+	slash := strings.IndexByte(path, '/')
+	if slash == -1 {
+		// A file replacing a directory of the same name removes the directory
+		for i, subtree := range t.Subtrees {
+			if subtree.Name == path {
+				t.Subtrees = append(t.Subtrees[:i], t.Subtrees[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	subtree := t.subtree(path[:slash])
+	if subtree != nil {
+		subtree.invalidate(path[slash+1:])
+	}
+}
+
+// invalidatePath marks the cached trees containing the path as changed
+func (index *Index) invalidatePath(path string) {
+	if index.CacheTree != nil {
+		index.CacheTree.invalidate(path)
+	}
+	if index.Untracked != nil {
+		index.Untracked.invalidate(path)
+	}
+}
+
+func readCacheTree(data []byte) (*CacheTree, error) {
+	tree, remaining, err := readCacheTreeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(remaining) > 0 {
+		return nil, errors.New("unexpected data after the root tree")
+	}
+	return tree, nil
+}
+
+// Each node is stored as its null-terminated name followed by the
+// entry and subtree counts in ASCII, the tree hash if the node is
+// valid, and then each of its subtrees.
+func readCacheTreeNode(data []byte) (*CacheTree, []byte, error) {
+	nameLength := bytes.IndexByte(data, 0)
+	if nameLength == -1 {
+		return nil, nil, errors.New("tree name is not terminated")
+	}
+	tree := &CacheTree{Name: string(data[:nameLength])}
+	data = data[nameLength+1:]
+
+	lineLength := bytes.IndexByte(data, '\n')
+	if lineLength == -1 {
+		return nil, nil, errors.New("tree counts are not terminated")
+	}
+	counts := strings.Split(string(data[:lineLength]), " ")
+	data = data[lineLength+1:]
+	if len(counts) != 2 {
+		return nil, nil, errors.New("tree counts are malformed")
+	}
+
+	entryCount, err := strconv.Atoi(counts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	subtreeCount, err := strconv.Atoi(counts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	tree.EntryCount = entryCount
+
+	if tree.Valid() {
+		if len(data) < hashLength {
+			return nil, nil, errors.New("tree hash is truncated")
+		}
+		tree.Hash = hex.EncodeToString(data[:hashLength])
+		data = data[hashLength:]
+	}
+
+	for i := 0; i < subtreeCount; i++ {
+		var subtree *CacheTree
+		subtree, data, err = readCacheTreeNode(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		tree.Subtrees = append(tree.Subtrees, subtree)
+	}
+
+	return tree, data, nil
+}
+
+func writeCacheTree(tree *CacheTree) []byte {
+	var buffer bytes.Buffer
+	writeCacheTreeNode(&buffer, tree)
+	return buffer.Bytes()
+}
+
+func writeCacheTreeNode(buffer *bytes.Buffer, tree *CacheTree) {
+	fmt.Fprintf(buffer, "%s\000%d %d\n", tree.Name, tree.EntryCount, len(tree.Subtrees))
+	if tree.Valid() {
+		hashBytes, _ := hex.DecodeString(tree.Hash)
+		buffer.Write(hashBytes)
+	}
+	for _, subtree := range tree.Subtrees {
+		writeCacheTreeNode(buffer, subtree)
+	}
+}
+
+// WriteTree will create tree objects for the contents of the index and
+// return the hash of the root tree. Directories whose trees are still
+// valid in the cached tree extension are reused without being rehashed.
+func WriteTree() (string, error) {
+	lock, index, err := lockIndex()
+	if err != nil {
+		return "", err
+	}
+	defer lock.Rollback()
+
+	conflicts := index.Conflicts()
+	if len(conflicts) > 0 {
+		return "", fmt.Errorf("%s: unmerged (resolve the conflict before writing a tree)", conflicts[0].Path)
+	}
+
+	if index.CacheTree == nil {
+		index.CacheTree = &CacheTree{EntryCount: -1}
+	}
+
+	if index.CacheTree.Valid() {
+		return index.CacheTree.Hash, nil
+	}
+
+	_, err = buildTree(index.Entries, "", index.CacheTree)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeIndex(lock, index)
+	if err != nil {
+		return "", err
+	}
+
+	return index.CacheTree.Hash, nil
+}
+
+// buildTree writes the tree for the directory with the given prefix,
+// starting at the first entry of the slice, and returns the number
+// of entries that belong to the directory.
+func buildTree(entries []Entry, prefix string, tree *CacheTree) (int, error) {
+	var treeBytes []byte
+	var subtrees []*CacheTree
+	intentToAdd := false
+
+	i := 0
+	for i < len(entries) && strings.HasPrefix(entries[i].Path, prefix) {
+		entry := entries[i]
+		name := entry.Path[len(prefix):]
+
+		slash := strings.IndexByte(name, '/')
+		if slash == -1 {
+			i++
+			// Entries only marked for addition are not part of any tree
+			if entry.IntentToAdd() {
+				intentToAdd = true
+				continue
+			}
+			hashAsBytes, _ := hex.DecodeString(entry.Hash)
+			treeBytes = append(treeBytes, fmt.Sprintf("%o %s\000%s", canonicalMode(entry.Mode), name, hashAsBytes)...)
+			continue
+		}
+
+		name = name[:slash]
+		subtree := tree.subtree(name)
+		if subtree == nil {
+			subtree = &CacheTree{Name: name, EntryCount: -1}
+		}
+
+		count := subtree.EntryCount
+		if !subtree.Valid() {
+			var err error
+			count, err = buildTree(entries[i:], prefix+name+"/", subtree)
+			if err != nil {
+				return 0, err
+			}
+		}
+		i += count
+
+		if subtree.Hash != "" {
+			hashAsBytes, _ := hex.DecodeString(subtree.Hash)
+			treeBytes = append(treeBytes, fmt.Sprintf("40000 %s\000%s", name, hashAsBytes)...)
+			subtrees = append(subtrees, subtree)
+		}
+	}
+
+	// Directories with nothing to record do not get a tree, unless
+	// it is the root tree of an empty index
+	tree.Hash = ""
+	if len(treeBytes) > 0 || prefix == "" {
+		hash, err := objects.HashObject(objects.Object{ObjectType: "tree", Data: treeBytes}, true)
+		if err != nil {
+			return 0, err
+		}
+		tree.Hash = hash
+	}
+
+	// Subtrees are kept in the order git uses, shortest name first
+	sort.Slice(subtrees, func(a, b int) bool {
+		if len(subtrees[a].Name) != len(subtrees[b].Name) {
+			return len(subtrees[a].Name) < len(subtrees[b].Name)
+		}
+		return subtrees[a].Name < subtrees[b].Name
+	})
+	tree.Subtrees = subtrees
+
+	tree.EntryCount = i
+	if intentToAdd || tree.Hash == "" {
+		tree.EntryCount = -1
+	}
+
+	return i, nil
+}
@@ -0,0 +1,88 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Reads an EWAH compressed bitmap, as used by the untracked cache
+// extension, and returns the set bits along with the number of bytes
+// consumed. The bitmap is stored as its size in bits, the number of
+// 64-bit words, the words themselves and the position of the last
+// run length word.
+func readEwahBitmap(data []byte) ([]bool, int, error) {
+	if len(data) < 8 {
+		return nil, 0, errors.New("bitmap header is truncated")
+	}
+	wordCount := int(binary.BigEndian.Uint32(data[4:8]))
+	length := 8 + wordCount*8 + 4
+	if len(data) < length {
+		return nil, 0, errors.New("bitmap is truncated")
+	}
+
+	words := make([]uint64, wordCount)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint64(data[8+i*8:])
+	}
+
+	// Each run length word describes a run of identical words followed
+	// by a number of literal words that are stored verbatim
+	var bits []bool
+	for position := 0; position < wordCount; {
+		runLengthWord := words[position]
+		runningBit := runLengthWord&1 != 0
+		runningLength := int((runLengthWord >> 1) & 0xFFFFFFFF)
+		literalWords := int(runLengthWord >> 33)
+		position++
+
+		for i := 0; i < runningLength*64; i++ {
+			bits = append(bits, runningBit)
+		}
+
+		if position+literalWords > wordCount {
+			return nil, 0, errors.New("bitmap literal words are truncated")
+		}
+		for _, word := range words[position : position+literalWords] {
+			for bit := uint(0); bit < 64; bit++ {
+				bits = append(bits, word&(1<<bit) != 0)
+			}
+		}
+		position += literalWords
+	}
+
+	return bits, length, nil
+}
+
+// Writes the bits as an EWAH bitmap using a single run length word
+// followed by the bits as literal words.
+func writeEwahBitmap(bits []bool) []byte {
+	bitSize := 0
+	literalWords := make([]uint64, (len(bits)+63)/64)
+	for i, set := range bits {
+		if set {
+			literalWords[i/64] |= 1 << uint(i%64)
+			bitSize = i + 1
+		}
+	}
+
+	data := make([]byte, 8, 8+(len(literalWords)+1)*8+4)
+	binary.BigEndian.PutUint32(data[0:4], uint32(bitSize))
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(literalWords)+1))
+
+	var word [8]byte
+	binary.BigEndian.PutUint64(word[:], uint64(len(literalWords))<<33)
+	data = append(data, word[:]...)
+	for _, literal := range literalWords {
+		binary.BigEndian.PutUint64(word[:], literal)
+		data = append(data, word[:]...)
+	}
+
+	// The last (and only) run length word is the first word
+	return append(data, 0, 0, 0, 0)
+}
+
+// isSet returns whether the bit is set, treating bits past the end of
+// the bitmap as unset
+func isSet(bits []bool, bit int) bool {
+	return bit < len(bits) && bits[bit]
+}
@@ -0,0 +1,206 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	extensionHeaderLength int = 8
+	hashLength            int = 20
+)
+
+// Signatures of the extensions understood by this package
+const (
+	cacheTreeSignature      = "TREE"
+	resolveUndoSignature    = "REUC"
+	untrackedCacheSignature = "UNTR"
+)
+
+// Extensions that describe byte offsets within the index file and
+// become invalid as soon as the file is rewritten
+var offsetExtensions = map[string]bool{
+	"EOIE": true,
+	"IEOT": true,
+}
+
+// Extension represents an index extension that is not understood
+// by this package but is preserved when the index is rewritten.
+type Extension struct {
+	Signature string
+	Data      []byte
+}
+
+// ResolveUndo records the conflict stages of a path that has since
+// been resolved so the conflict can be recreated. Stages which were
+// missing from the conflict have a zero mode.
+type ResolveUndo struct {
+	Path   string
+	Modes  [3]int32
+	Hashes [3]string
+}
+
+// readExtensions parses the extensions found between the last
+// index entry and the checksum.
+func readExtensions(index *Index, data []byte) error {
+	for len(data) > 0 {
+		if len(data) < extensionHeaderLength {
+			return errors.New("index extension header is truncated")
+		}
+
+		signature := string(data[0:4])
+		size := int(binary.BigEndian.Uint32(data[4:8]))
+		if extensionHeaderLength+size > len(data) {
+			return fmt.Errorf("index extension %s is truncated", signature)
+		}
+		extensionData := data[extensionHeaderLength : extensionHeaderLength+size]
+		data = data[extensionHeaderLength+size:]
+
+		var err error
+		switch signature {
+		case cacheTreeSignature:
+			index.CacheTree, err = readCacheTree(extensionData)
+		case resolveUndoSignature:
+			index.ResolveUndo, err = readResolveUndo(extensionData)
+		case untrackedCacheSignature:
+			index.Untracked, err = readUntrackedCache(extensionData)
+		case fsmonitorSignature:
+			err = readFsmonitor(index, extensionData)
+		default:
+			// Extensions starting with an uppercase letter are optional
+			// and can be ignored, all others must be understood
+			if signature[0] < 'A' || signature[0] > 'Z' {
+				return fmt.Errorf("index uses the %s extension, which is not supported", signature)
+			}
+			if !offsetExtensions[signature] {
+				index.Extensions = append(index.Extensions, Extension{Signature: signature, Data: extensionData})
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("index extension %s is malformed: %v", signature, err)
+		}
+	}
+
+	return nil
+}
+
+// writeExtensions appends every extension of the index to the buffer
+func writeExtensions(buffer *bytes.Buffer, index Index) {
+	if index.CacheTree != nil {
+		writeExtension(buffer, cacheTreeSignature, writeCacheTree(index.CacheTree))
+	}
+	if len(index.ResolveUndo) > 0 {
+		writeExtension(buffer, resolveUndoSignature, writeResolveUndo(index.ResolveUndo))
+	}
+	if index.Untracked != nil {
+		writeExtension(buffer, untrackedCacheSignature, writeUntrackedCache(index.Untracked))
+	}
+	if index.fsmonitorEnabled {
+		writeExtension(buffer, fsmonitorSignature, writeFsmonitor(index))
+	}
+	for _, extension := range index.Extensions {
+		writeExtension(buffer, extension.Signature, extension.Data)
+	}
+}
+
+func writeExtension(buffer *bytes.Buffer, signature string, data []byte) {
+	var header [8]byte
+	copy(header[0:4], signature)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(data)))
+	buffer.Write(header[:])
+	buffer.Write(data)
+}
+
+func readResolveUndo(data []byte) ([]ResolveUndo, error) {
+	var entries []ResolveUndo
+	for len(data) > 0 {
+		entry := ResolveUndo{}
+
+		pathLength := bytes.IndexByte(data, 0)
+		if pathLength == -1 {
+			return nil, errors.New("path is not terminated")
+		}
+		entry.Path = string(data[:pathLength])
+		data = data[pathLength+1:]
+
+		for stage := 0; stage < 3; stage++ {
+			modeLength := bytes.IndexByte(data, 0)
+			if modeLength == -1 {
+				return nil, errors.New("mode is not terminated")
+			}
+			mode, err := strconv.ParseInt(string(data[:modeLength]), 8, 32)
+			if err != nil {
+				return nil, err
+			}
+			entry.Modes[stage] = int32(mode)
+			data = data[modeLength+1:]
+		}
+
+		for stage := 0; stage < 3; stage++ {
+			if entry.Modes[stage] == 0 {
+				continue
+			}
+			if len(data) < hashLength {
+				return nil, errors.New("hash is truncated")
+			}
+			entry.Hashes[stage] = hex.EncodeToString(data[:hashLength])
+			data = data[hashLength:]
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func writeResolveUndo(entries []ResolveUndo) []byte {
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		buffer.WriteString(entry.Path)
+		buffer.WriteByte(0)
+		for stage := 0; stage < 3; stage++ {
+			buffer.WriteString(strconv.FormatInt(int64(entry.Modes[stage]), 8))
+			buffer.WriteByte(0)
+		}
+		for stage := 0; stage < 3; stage++ {
+			if entry.Modes[stage] != 0 {
+				hashBytes, _ := hex.DecodeString(entry.Hashes[stage])
+				buffer.Write(hashBytes)
+			}
+		}
+	}
+	return buffer.Bytes()
+}
+
+// recordResolveUndo remembers the conflict stages of the path, if any,
+// before they are removed from the index
+func recordResolveUndo(index *Index, path string) {
+	entry := ResolveUndo{Path: path}
+	found := false
+	for _, indexEntry := range index.Entries {
+		if indexEntry.Path == path && indexEntry.Stage() != StageMerged {
+			entry.Modes[indexEntry.Stage()-1] = indexEntry.Mode
+			entry.Hashes[indexEntry.Stage()-1] = indexEntry.Hash
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	for i, existing := range index.ResolveUndo {
+		if existing.Path == path {
+			index.ResolveUndo[i] = entry
+			return
+		}
+	}
+	index.ResolveUndo = append(index.ResolveUndo, entry)
+	sort.Slice(index.ResolveUndo, func(i, j int) bool {
+		return index.ResolveUndo[i].Path < index.ResolveUndo[j].Path
+	})
+}
@@ -0,0 +1,152 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattherman/mhgit/fsmonitor"
+)
+
+const (
+	fsmonitorSignature = "FSMN"
+	fsmonitorVersion1  = 1
+	fsmonitorVersion2  = 2
+)
+
+// readFsmonitor parses the FSMN extension, which stores the token of
+// the last fsmonitor query and a bitmap of the entries that were not
+// known to be unchanged at that point.
+func readFsmonitor(index *Index, data []byte) error {
+	if len(data) < 4 {
+		return errors.New("version is truncated")
+	}
+	version := binary.BigEndian.Uint32(data)
+	data = data[4:]
+
+	switch version {
+	case fsmonitorVersion1:
+		// Version 1 tokens are timestamps for the hook based monitor,
+		// which cannot be used with the daemon
+		if len(data) < 8 {
+			return errors.New("timestamp is truncated")
+		}
+		data = data[8:]
+	case fsmonitorVersion2:
+		tokenLength := bytes.IndexByte(data, 0)
+		if tokenLength == -1 {
+			return errors.New("token is not terminated")
+		}
+		index.fsmonitorToken = string(data[:tokenLength])
+		data = data[tokenLength+1:]
+	default:
+		return fmt.Errorf("version %d is not supported", version)
+	}
+
+	if len(data) < 4 {
+		return errors.New("bitmap size is truncated")
+	}
+	data = data[4:]
+
+	dirtyBits, _, err := readEwahBitmap(data)
+	if err != nil {
+		return err
+	}
+
+	index.fsmonitorEnabled = true
+	for i := range index.Entries {
+		index.Entries[i].fsmonitorValid = !isSet(dirtyBits, i)
+	}
+	return nil
+}
+
+func writeFsmonitor(index Index) []byte {
+	dirtyBits := make([]bool, len(index.Entries))
+	for i, entry := range index.Entries {
+		dirtyBits[i] = !entry.fsmonitorValid
+	}
+	bitmap := writeEwahBitmap(dirtyBits)
+
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.BigEndian, uint32(fsmonitorVersion2))
+	buffer.WriteString(index.fsmonitorToken)
+	buffer.WriteByte(0)
+	binary.Write(&buffer, binary.BigEndian, uint32(len(bitmap)))
+	buffer.Write(bitmap)
+	return buffer.Bytes()
+}
+
+// SetFsmonitor will enable or disable the use of the fsmonitor daemon
+// to find the files that changed since the index was last written.
+func SetFsmonitor(enabled bool) error {
+	lock, index, err := lockIndex()
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	index.fsmonitorEnabled = enabled
+	index.fsmonitorToken = ""
+	index.invalidateFsmonitor()
+
+	return writeIndex(lock, index)
+}
+
+func (index *Index) invalidateFsmonitor() {
+	for i := range index.Entries {
+		index.Entries[i].fsmonitorValid = false
+	}
+}
+
+// applyFsmonitor asks the fsmonitor daemon what changed since the index
+// was last written, marking the entries and untracked cache directories
+// of every changed path as needing to be checked. It returns true if
+// the remaining entries and directories are known to be unchanged.
+func (index *Index) applyFsmonitor() bool {
+	if !index.fsmonitorEnabled {
+		return false
+	}
+
+	result, err := fsmonitor.Query(index.fsmonitorToken)
+	if err != nil {
+		// Without a running daemon everything has to be checked
+		index.fsmonitorToken = ""
+		index.invalidateFsmonitor()
+		return false
+	}
+
+	index.fsmonitorToken = result.Token
+	if result.Trivial {
+		index.invalidateFsmonitor()
+		return false
+	}
+
+	for _, path := range result.Paths {
+		// The path may be a file or a directory, and either may contain
+		// entries or be part of an untracked cache directory. The
+		// entries under a directory are searched for separately, since
+		// names such as "a-b" sort between "a" and "a/".
+		first := sort.Search(len(index.Entries), func(i int) bool {
+			return index.Entries[i].Path >= path
+		})
+		for i := first; i < len(index.Entries) && index.Entries[i].Path == path; i++ {
+			index.Entries[i].fsmonitorValid = false
+		}
+		first = sort.Search(len(index.Entries), func(i int) bool {
+			return index.Entries[i].Path >= path+"/"
+		})
+		for i := first; i < len(index.Entries) && strings.HasPrefix(index.Entries[i].Path, path+"/"); i++ {
+			index.Entries[i].fsmonitorValid = false
+		}
+
+		if index.Untracked != nil {
+			index.Untracked.invalidate(path)
+			index.Untracked.invalidate(path + "/")
+		}
+	}
+
+	return true
+}
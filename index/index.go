@@ -2,30 +2,74 @@ package index
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sort"
 	"syscall"
+	"time"
 
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/lockfile"
 	"github.com/mattherman/mhgit/objects"
 )
 
 const (
 	fixedSizeIndexEntryLength int    = 62
+	extendedFlagsLength       int    = 2
 	checksumLength            int    = 20
-	indexFile                 string = ".git/index"
+	indexFile                 string = "index"
+	minIndexVersion           uint32 = 2
+	maxIndexVersion           uint32 = 4
+)
+
+// Bits of the 16-bit flags field stored with each index entry
+const (
+	flagAssumeValid uint16 = 0x8000
+	flagExtended    uint16 = 0x4000
+	flagStageMask   uint16 = 0x3000
+	flagStageShift  uint   = 12
+	flagNameMask    uint16 = 0x0FFF
+)
+
+// Bits of the extended flags stored after the flags field in
+// version 3 and 4 entries
+const (
+	extendedFlagSkipWorktree uint16 = 0x4000
+	extendedFlagIntentToAdd  uint16 = 0x2000
+)
+
+// Stage numbers used for index entries. Entries in a stage other
+// than StageMerged represent one side of an unresolved conflict.
+const (
+	StageMerged = 0
+	StageBase   = 1
+	StageOurs   = 2
+	StageTheirs = 3
 )
 
 // Index represents the git index
 type Index struct {
-	Signature  string
-	Version    uint32
-	EntryCount uint32
-	Entries    []Entry
-	Checksum   string
+	Signature   string
+	Version     uint32
+	EntryCount  uint32
+	Entries     []Entry
+	CacheTree   *CacheTree
+	ResolveUndo []ResolveUndo
+	Untracked   *UntrackedCache
+	Extensions  []Extension
+	Checksum    string
+	// modTime is when the index file was last written, which decides
+	// whether the stat information of an entry can be trusted
+	modTime time.Time
+	// The fsmonitor token of the last query whose changes have been
+	// applied to the entries
+	fsmonitorEnabled bool
+	fsmonitorToken   string
 }
 
 // Entry represents a file in the git index.
@@ -42,18 +86,108 @@ type Entry struct {
 	FileSize  int32
 	Hash      string
 	Flags     uint16
-	Path      string
+	// ExtendedFlags is only present in version 3 and 4 indexes
+	ExtendedFlags uint16
+	Path          string
+	// fsmonitorValid is set when the fsmonitor daemon reported no
+	// changes to the file since it was last checked
+	fsmonitorValid bool
+}
+
+// Stage returns the merge stage of the entry. Stage 0 is a normal
+// entry, stages 1-3 are the base, ours and theirs versions of a
+// conflicted path.
+func (e Entry) Stage() int {
+	return int((e.Flags & flagStageMask) >> flagStageShift)
+}
+
+// SetStage returns a copy of the entry with the given merge stage.
+func (e Entry) SetStage(stage int) Entry {
+	e.Flags = (e.Flags &^ flagStageMask) | (uint16(stage)<<flagStageShift)&flagStageMask
+	return e
+}
+
+// AssumeValid returns true if the entry has the assume-valid flag set,
+// meaning the working tree file should not be checked for changes.
+func (e Entry) AssumeValid() bool {
+	return e.Flags&flagAssumeValid != 0
+}
+
+// SetAssumeValid returns a copy of the entry with the assume-valid flag
+// set or cleared.
+func (e Entry) SetAssumeValid(valid bool) Entry {
+	if valid {
+		e.Flags |= flagAssumeValid
+	} else {
+		e.Flags &^= flagAssumeValid
+	}
+	return e
+}
+
+// Extended returns true if the entry has the extended flag set.
+func (e Entry) Extended() bool {
+	return e.Flags&flagExtended != 0
+}
+
+// SkipWorktree returns true if the entry has the skip-worktree flag set,
+// meaning the file is intentionally absent from the working tree.
+func (e Entry) SkipWorktree() bool {
+	return e.ExtendedFlags&extendedFlagSkipWorktree != 0
+}
+
+// SetSkipWorktree returns a copy of the entry with the skip-worktree flag
+// set or cleared.
+func (e Entry) SetSkipWorktree(skip bool) Entry {
+	if skip {
+		e.ExtendedFlags |= extendedFlagSkipWorktree
+	} else {
+		e.ExtendedFlags &^= extendedFlagSkipWorktree
+	}
+	return e
+}
+
+// IntentToAdd returns true if the entry only records that the path
+// will be added later. The hash of such an entry is the empty blob.
+func (e Entry) IntentToAdd() bool {
+	return e.ExtendedFlags&extendedFlagIntentToAdd != 0
+}
+
+// SetIntentToAdd returns a copy of the entry with the intent-to-add flag
+// set or cleared.
+func (e Entry) SetIntentToAdd(intent bool) Entry {
+	if intent {
+		e.ExtendedFlags |= extendedFlagIntentToAdd
+	} else {
+		e.ExtendedFlags &^= extendedFlagIntentToAdd
+	}
+	return e
+}
+
+// Conflict groups the unmerged index entries for a single path. Any of
+// the stages may be nil if that side did not contain the path.
+type Conflict struct {
+	Path   string
+	Base   *Entry
+	Ours   *Entry
+	Theirs *Entry
 }
 
 // NewEntry will create a new index entry based on the filepath given.
 // The hash of the file will be included in the entry, but no object
 // will be created in the database.
-func newEntry(filepath string, hash string) (Entry, error) {
-	stat, err := os.Stat(filepath)
+func newEntry(filepath string, hash string, previousMode int32) (Entry, error) {
+	stat, err := os.Lstat(filepath)
 	if err != nil {
 		return Entry{}, err
 	}
 
+	return newEntryFromStat(filepath, hash, stat, previousMode), nil
+}
+
+// newEntryFromStat creates an index entry using stat information
+// that has already been retrieved for the file. The previous mode of
+// the entry is used when the mode of the file cannot be trusted.
+func newEntryFromStat(filepath string, hash string, stat os.FileInfo, previousMode int32) Entry {
 	var ctimesec int32
 	var ctimenano int32
 	var mtimesec int32
@@ -62,7 +196,6 @@ func newEntry(filepath string, hash string) (Entry, error) {
 	var dev int32
 	var uid int32
 	var gid int32
-	var mode int32
 
 	statUnix, infoIsAvailable := stat.Sys().(*syscall.Stat_t)
 	if infoIsAvailable {
@@ -74,7 +207,6 @@ func newEntry(filepath string, hash string) (Entry, error) {
 		dev = int32(statUnix.Dev)
 		uid = int32(statUnix.Uid)
 		gid = int32(statUnix.Gid)
-		mode = int32(statUnix.Mode)
 	}
 
 	return Entry{
@@ -86,11 +218,11 @@ func newEntry(filepath string, hash string) (Entry, error) {
 		Ino:       ino,
 		UID:       uid,
 		GID:       gid,
-		Mode:      mode,
+		Mode:      entryMode(stat, previousMode),
 		FileSize:  int32(stat.Size()),
 		Hash:      hash,
 		Path:      filepath,
-	}, nil
+	}
 }
 
 func (e Entry) toFixedSizeEntry(path string) fixedSizeIndexEntry {
@@ -99,7 +231,13 @@ func (e Entry) toFixedSizeEntry(path string) fixedSizeIndexEntry {
 	hashBytes, _ := hex.DecodeString(e.Hash)
 	copy(hashArray[:], hashBytes)
 
-	flags := uint16(len(path)) & 0x0FFF
+	// Paths too long for the name field are stored with the maximum
+	// length and found by their null terminator when read back
+	nameLength := uint16(flagNameMask)
+	if len(path) < int(flagNameMask) {
+		nameLength = uint16(len(path))
+	}
+	flags := (e.Flags &^ flagNameMask) | nameLength
 
 	return fixedSizeIndexEntry{
 		CTimeSec:  e.CTimeSec,
@@ -137,7 +275,7 @@ type fixedSizeIndexEntry struct {
 }
 
 func (e fixedSizeIndexEntry) getPathLength() int {
-	return int(e.Flags & 0x0FFF)
+	return int(e.Flags & flagNameMask)
 }
 
 func (e fixedSizeIndexEntry) toFullEntry(path string) Entry {
@@ -153,6 +291,7 @@ func (e fixedSizeIndexEntry) toFullEntry(path string) Entry {
 		GID:       e.GID,
 		FileSize:  e.FileSize,
 		Hash:      hex.EncodeToString(e.Hash[:]),
+		Flags:     e.Flags &^ flagNameMask,
 		Path:      path,
 	}
 }
@@ -160,76 +299,159 @@ func (e fixedSizeIndexEntry) toFullEntry(path string) Entry {
 // Add will add the specified file to the index if it exists
 // in the working directory
 func Add(filepath string) error {
-	_, err := os.Stat(filepath)
-	if os.IsNotExist(err) {
+	batch, err := NewBatch()
+	if err != nil {
 		return err
 	}
+	defer batch.Rollback()
 
-	hash, err := objects.HashFile(filepath, true)
+	err = batch.Add(context.Background(), []string{filepath})
 	if err != nil {
 		return err
 	}
 
-	entry, err := newEntry(filepath, hash)
+	return batch.Commit()
+}
+
+// Remove will remove the specified file from the index if it
+// does not exist in the working directory
+func Remove(filepath string) error {
+	batch, err := NewBatch()
 	if err != nil {
 		return err
 	}
+	defer batch.Rollback()
 
-	index, err := ReadIndex()
+	_, err = os.Stat(filepath)
+	if err == nil {
+		return errors.New("file exists and cannot be removed from index")
+	}
+
+	batch.Remove(filepath)
+	return batch.Commit()
+}
+
+// SetSkipWorktree will set or clear the skip-worktree flag of the
+// index entry for the given path.
+func SetSkipWorktree(filepath string, skip bool) error {
+	batch, err := NewBatch()
 	if err != nil {
 		return err
 	}
+	defer batch.Rollback()
 
-	entryIndex := findEntry(index, filepath)
-
-	if entryIndex != -1 {
-		index.Entries[entryIndex] = entry
-	} else {
-		index.Entries = append(index.Entries, []Entry{entry}...)
+	err = batch.SetSkipWorktree(filepath, skip)
+	if err != nil {
+		return err
 	}
-	// TODO add to index instead of overwriting it
-	err = writeIndex(index.Entries)
 
-	return err
+	return batch.Commit()
 }
 
-// Remove will remove the specified file from the index if it
-// does not exist in the working directory
-func Remove(filepath string) error {
-	_, err := os.Stat(filepath)
-	if err == nil {
-		return errors.New("file exists and cannot be removed from index")
-	}
-
-	index, err := ReadIndex()
+// Resolve will mark a conflicted path as resolved. The stage 1-3 entries
+// for the path are replaced by a stage 0 entry for the working tree file,
+// or dropped entirely if the file was deleted from the working tree.
+func Resolve(filepath string) error {
+	batch, err := NewBatch()
 	if err != nil {
 		return err
 	}
+	defer batch.Rollback()
 
-	entryIndex := findEntry(index, filepath)
-	if entryIndex == -1 {
-		return nil
+	if !batch.index.IsUnmerged(filepath) {
+		return errors.New("path is not unmerged: " + filepath)
+	}
+
+	_, err = os.Stat(filepath)
+	if os.IsNotExist(err) {
+		batch.index.removePath(filepath)
+	} else {
+		err = batch.Add(context.Background(), []string{filepath})
+		if err != nil {
+			return err
+		}
+	}
+
+	return batch.Commit()
+}
+
+// IsUnmerged returns true if the index holds conflict stages for the path.
+func (index Index) IsUnmerged(path string) bool {
+	for _, entry := range index.Entries {
+		if entry.Path == path && entry.Stage() != StageMerged {
+			return true
+		}
 	}
+	return false
+}
 
-	index.Entries = append(index.Entries[:entryIndex], index.Entries[entryIndex+1:]...)
-	err = writeIndex(index.Entries)
+// Conflicts returns the unmerged paths in the index, grouping
+// the base, ours and theirs entries of each path together.
+func (index Index) Conflicts() []Conflict {
+	var conflicts []Conflict
+	for i := range index.Entries {
+		entry := &index.Entries[i]
+		if entry.Stage() == StageMerged {
+			continue
+		}
 
-	return err
+		if len(conflicts) == 0 || conflicts[len(conflicts)-1].Path != entry.Path {
+			conflicts = append(conflicts, Conflict{Path: entry.Path})
+		}
+		conflict := &conflicts[len(conflicts)-1]
+
+		switch entry.Stage() {
+		case StageBase:
+			conflict.Base = entry
+		case StageOurs:
+			conflict.Ours = entry
+		case StageTheirs:
+			conflict.Theirs = entry
+		}
+	}
+	return conflicts
 }
 
-func findEntry(index Index, path string) int {
+func findEntry(index Index, path string, stage int) int {
 	for i, entry := range index.Entries {
-		if entry.Path == path {
+		if entry.Path == path && entry.Stage() == stage {
 			return i
 		}
 	}
 	return -1
 }
 
+// removePath drops every stage of the given path from the index,
+// remembering any conflict it resolves and invalidating the cached
+// trees and untracked files containing it
+func (index *Index) removePath(path string) {
+	recordResolveUndo(index, path)
+	index.invalidatePath(path)
+
+	remaining := index.Entries[:0]
+	for _, entry := range index.Entries {
+		if entry.Path != path {
+			remaining = append(remaining, entry)
+		}
+	}
+	index.Entries = remaining
+}
+
+// sortEntries orders entries by path and then by stage, as
+// required by the index format.
+func sortEntries(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Path != entries[j].Path {
+			return entries[i].Path < entries[j].Path
+		}
+		return entries[i].Stage() < entries[j].Stage()
+	})
+}
+
 // ReadIndex will show information about files in the
 // index and the working tree
 func ReadIndex() (Index, error) {
-	_, err := os.Stat(indexFile)
+	indexInfo, err := os.Stat(gitdir.Path(indexFile))
 	if os.IsNotExist(err) {
 		return Index{
 			Signature:  "DIRC",
@@ -239,51 +461,110 @@ func ReadIndex() (Index, error) {
 		}, nil
 	}
 
-	indexBytes, err := ioutil.ReadFile(indexFile)
+	indexBytes, err := ioutil.ReadFile(gitdir.Path(indexFile))
 	if err != nil {
 		return Index{}, err
 	}
 
 	indexSize := len(indexBytes)
+	if indexSize < 12+checksumLength {
+		return Index{}, errors.New("index file is too short")
+	}
 
 	headerBytes := indexBytes[0:12]
 	checksumBytes := indexBytes[(indexSize - checksumLength):]
 
-	index := Index{}
+	index := Index{modTime: indexInfo.ModTime()}
 	index.Signature = string(headerBytes[0:4])
 	index.Version = binary.BigEndian.Uint32(headerBytes[4:8])
 	index.EntryCount = binary.BigEndian.Uint32(headerBytes[8:12])
 	index.Checksum = hex.EncodeToString(checksumBytes)
 
+	if index.Signature != "DIRC" {
+		return Index{}, errors.New("index file has an invalid signature")
+	}
+	if index.Version < minIndexVersion || index.Version > maxIndexVersion {
+		return Index{}, fmt.Errorf("index file version %d is not supported", index.Version)
+	}
+
 	digest := objects.ComputeSha1(indexBytes[:(indexSize - checksumLength)])
 	if digest != index.Checksum {
 		return Index{}, errors.New("index content did not match the checksum")
 	}
 
 	index.Entries = make([]Entry, index.EntryCount)
-	if index.EntryCount > 0 {
+	entryListBytes := indexBytes[12:(indexSize - checksumLength)]
 
-		entryListBytes := indexBytes[12:(indexSize - checksumLength)]
+	entryIndex := 0
+	previousPath := ""
+	for i := 0; i < int(index.EntryCount); i++ {
+		if entryIndex+fixedSizeIndexEntryLength > len(entryListBytes) {
+			return Index{}, errors.New("index entries are truncated")
+		}
 
-		entryIndex := 0
-		for i := 0; i < int(index.EntryCount); i++ {
-			// Convert fixed size portion of the entry to a fixedSizeIndexEntry
-			fixedSizeEntryBytes := entryListBytes[entryIndex:(entryIndex + fixedSizeIndexEntryLength)]
-			fixedSizeIndexEntry := readIndexEntry(fixedSizeEntryBytes)
+		// Convert fixed size portion of the entry to a fixedSizeIndexEntry
+		fixedSizeEntryBytes := entryListBytes[entryIndex:(entryIndex + fixedSizeIndexEntryLength)]
+		fixedSizeIndexEntry := readIndexEntry(fixedSizeEntryBytes)
+		entryLength := fixedSizeIndexEntryLength
+
+		// Version 3 and above store a second set of flags when the extended bit is set
+		var extendedFlags uint16
+		if fixedSizeIndexEntry.Flags&flagExtended != 0 {
+			if index.Version < 3 {
+				return Index{}, errors.New("index entry has extended flags in a version 2 index")
+			}
+			if entryIndex+entryLength+extendedFlagsLength > len(entryListBytes) {
+				return Index{}, errors.New("index entries are truncated")
+			}
+			extendedFlags = binary.BigEndian.Uint16(entryListBytes[entryIndex+entryLength:])
+			entryLength += extendedFlagsLength
+		}
 
-			// Get bytes for index entry's path field
-			startPathIndex := entryIndex + fixedSizeIndexEntryLength
+		// Get bytes for index entry's path field
+		startPathIndex := entryIndex + entryLength
+		var path string
+		if index.Version == 4 {
+			// Version 4 stores how many bytes to drop from the end of the previous
+			// path followed by the null-terminated suffix to append to it
+			strip, varintLength := decodeVarint(entryListBytes[startPathIndex:])
+			if varintLength == 0 || strip > len(previousPath) {
+				return Index{}, errors.New("index entry has a malformed path")
+			}
+			suffixStart := startPathIndex + varintLength
+			suffixLength := bytes.IndexByte(entryListBytes[suffixStart:], 0)
+			if suffixLength == -1 {
+				return Index{}, errors.New("index entry has a malformed path")
+			}
+			path = previousPath[:len(previousPath)-strip] + string(entryListBytes[suffixStart:suffixStart+suffixLength])
+
+			// No padding follows the null terminator in version 4
+			entryIndex = suffixStart + suffixLength + 1
+		} else {
 			pathLength := fixedSizeIndexEntry.getPathLength()
-			entryPathBytes := entryListBytes[startPathIndex:(startPathIndex + pathLength)]
-
-			// Convert the fixedSizeIndexEntry + path to a full IndexEntry
-			index.Entries[i] = fixedSizeIndexEntry.toFullEntry(string(entryPathBytes))
+			if pathLength == int(flagNameMask) {
+				pathLength = bytes.IndexByte(entryListBytes[startPathIndex:], 0)
+			}
+			if pathLength == -1 || startPathIndex+pathLength > len(entryListBytes) {
+				return Index{}, errors.New("index entry has a malformed path")
+			}
+			path = string(entryListBytes[startPathIndex:(startPathIndex + pathLength)])
 
 			// Advance the entry index by the length of the previous entry plus enough
 			// null padding to extend the entry to a multiple of 8 bytes
-			totalEntryLength := len(fixedSizeEntryBytes) + pathLength
+			totalEntryLength := entryLength + pathLength
 			entryIndex += totalEntryLength + nullPaddingLength(totalEntryLength)
 		}
+
+		// Convert the fixedSizeIndexEntry + path to a full IndexEntry
+		index.Entries[i] = fixedSizeIndexEntry.toFullEntry(path)
+		index.Entries[i].ExtendedFlags = extendedFlags
+		previousPath = path
+	}
+
+	// Everything between the last entry and the checksum is extensions
+	err = readExtensions(&index, entryListBytes[entryIndex:])
+	if err != nil {
+		return Index{}, err
 	}
 
 	return index, nil
@@ -313,24 +594,81 @@ func nullPaddingLength(pathLength int) int {
 	return 8 - (pathLength % 8)
 }
 
-// WriteIndex will write the index file with the specified entries
-func writeIndex(entries []Entry) error {
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Path < entries[j].Path
-	})
+// SetVersion will rewrite the index using the given format version.
+func SetVersion(version uint32) error {
+	if version < minIndexVersion || version > maxIndexVersion {
+		return fmt.Errorf("index version %d is not supported, must be between %d and %d", version, minIndexVersion, maxIndexVersion)
+	}
+
+	lock, index, err := lockIndex()
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	index.Version = version
+	return writeIndex(lock, index)
+}
+
+// lockIndex acquires the index lock and then reads the index, so that
+// the index cannot change between reading it and writing it back
+func lockIndex() (*lockfile.Lockfile, Index, error) {
+	lock, err := lockfile.Lock(gitdir.Path(indexFile))
+	if err != nil {
+		return nil, Index{}, err
+	}
 
-	index := Index{
-		Signature:  "DIRC",
-		Version:    2,
-		EntryCount: uint32(len(entries)),
-		Entries:    entries,
+	index, err := ReadIndex()
+	if err != nil {
+		lock.Rollback()
+		return nil, Index{}, err
 	}
 
-	f, err := os.Create(indexFile)
-	defer f.Close()
+	return lock, index, nil
+}
+
+// writeRefreshedIndex writes back an index whose caches were refreshed
+// by a read-only operation. Refreshing is only an optimization, so the
+// index is left alone if another process holds the lock or changed the
+// index since it was read.
+func writeRefreshedIndex(index Index) error {
+	lock, current, err := lockIndex()
+	if _, locked := err.(*lockfile.LockedError); locked {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	defer lock.Rollback()
+
+	if current.Checksum != index.Checksum {
+		return nil
+	}
+
+	return writeIndex(lock, index)
+}
+
+// WriteIndex will write the index file with the specified entries
+// using the format version of the given index. The index is written
+// to the lock file, which then replaces the index.
+func writeIndex(lock *lockfile.Lockfile, index Index) error {
+	sortEntries(index.Entries)
+
+	index.Signature = "DIRC"
+	index.EntryCount = uint32(len(index.Entries))
+	if index.Version == 0 {
+		index.Version = 2
+	}
+
+	// Extended flags cannot be represented in version 2
+	if index.Version == 2 {
+		for _, entry := range index.Entries {
+			if entry.ExtendedFlags != 0 {
+				index.Version = 3
+				break
+			}
+		}
+	}
 
 	var header [12]byte
 	copy(header[0:4], index.Signature)
@@ -338,9 +676,18 @@ func writeIndex(entries []Entry) error {
 	binary.BigEndian.PutUint32(header[8:12], index.EntryCount)
 
 	var entryBuffer bytes.Buffer
+	previousPath := ""
 	for _, entry := range index.Entries {
-		writeIndexEntry(&entryBuffer, entry)
+		// A racily clean entry would look clean once the index is newer
+		// than its file, so its size is zeroed as git does to make sure
+		// the file is hashed again
+		if index.isRacilyClean(entry) {
+			entry.FileSize = 0
+		}
+		writeIndexEntry(&entryBuffer, entry, index.Version, previousPath)
+		previousPath = entry.Path
 	}
+	writeExtensions(&entryBuffer, index)
 
 	indexAndEntries := append(header[:], entryBuffer.Bytes()...)
 	checksum := objects.ComputeSha1(indexAndEntries)
@@ -350,20 +697,86 @@ func writeIndex(entries []Entry) error {
 	}
 
 	fullIndex := append(indexAndEntries, checksumBytes...)
-	_, err = f.Write(fullIndex)
+	_, err = lock.Write(fullIndex)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return lock.Commit()
 }
 
-func writeIndexEntry(buffer *bytes.Buffer, entry Entry) {
-	// Write the fixed size portion of the entry to the buffer, followed by the path
-	binary.Write(buffer, binary.BigEndian, entry.toFixedSizeEntry(entry.Path))
+func writeIndexEntry(buffer *bytes.Buffer, entry Entry, version uint32, previousPath string) {
+	// Write the fixed size portion of the entry to the buffer
+	fixedSizeEntry := entry.toFixedSizeEntry(entry.Path)
+	entryLength := fixedSizeIndexEntryLength
+	if entry.ExtendedFlags != 0 {
+		fixedSizeEntry.Flags |= flagExtended
+	} else {
+		fixedSizeEntry.Flags &^= flagExtended
+	}
+	binary.Write(buffer, binary.BigEndian, fixedSizeEntry)
+	if entry.ExtendedFlags != 0 {
+		binary.Write(buffer, binary.BigEndian, entry.ExtendedFlags)
+		entryLength += extendedFlagsLength
+	}
+
+	if version == 4 {
+		// Write the path as the number of bytes to strip from the previous path
+		// and the null-terminated suffix that differs from it
+		common := commonPrefixLength(previousPath, entry.Path)
+		buffer.Write(encodeVarint(len(previousPath) - common))
+		buffer.WriteString(entry.Path[common:])
+		buffer.WriteByte(0)
+		return
+	}
+
 	binary.Write(buffer, binary.BigEndian, []byte(entry.Path))
 
 	// Add enough null padding to extend the entry to a multiple of 8 bytes with null-termination
-	entryLength := fixedSizeIndexEntryLength + len(entry.Path)
+	entryLength += len(entry.Path)
 	binary.Write(buffer, binary.BigEndian, make([]byte, nullPaddingLength(entryLength)))
 }
+
+func commonPrefixLength(a string, b string) int {
+	length := 0
+	for length < len(a) && length < len(b) && a[length] == b[length] {
+		length++
+	}
+	return length
+}
+
+// Encodes a number using the variable length encoding git uses for
+// path prefixes, where each continuation adds one to the value so
+// that every number has exactly one representation.
+func encodeVarint(value int) []byte {
+	var encoded [16]byte
+	position := len(encoded) - 1
+	encoded[position] = byte(value & 0x7F)
+	for value >>= 7; value != 0; value >>= 7 {
+		value--
+		position--
+		encoded[position] = 0x80 | byte(value&0x7F)
+	}
+	return encoded[position:]
+}
+
+// Decodes a number written by encodeVarint and returns it along with
+// the number of bytes consumed, or zero bytes if the data is truncated.
+func decodeVarint(data []byte) (int, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+
+	position := 0
+	c := data[position]
+	value := int(c & 0x7F)
+	for c&0x80 != 0 {
+		position++
+		if position >= len(data) {
+			return 0, 0
+		}
+		c = data[position]
+		value = ((value + 1) << 7) | int(c&0x7F)
+	}
+	return value, position + 1
+}
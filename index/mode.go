@@ -0,0 +1,146 @@
+package index
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/objects"
+)
+
+// worktreeSettings holds the configuration deciding how the file types
+// and permissions of the working tree are recorded
+type worktreeSettings struct {
+	fileMode bool
+	symlinks bool
+}
+
+var settings worktreeSettings
+var settingsOnce sync.Once
+
+func loadSettings() worktreeSettings {
+	settingsOnce.Do(func() {
+		settings = worktreeSettings{fileMode: true, symlinks: true}
+		cfg, err := config.Read()
+		if err != nil {
+			return
+		}
+		if fileMode, err := cfg.Bool("core.fileMode", true); err == nil {
+			settings.fileMode = fileMode
+		}
+		if symlinks, err := cfg.Bool("core.symlinks", true); err == nil {
+			settings.symlinks = symlinks
+		}
+	})
+	return settings
+}
+
+// entryMode returns the mode recorded in the index for a file in the
+// working tree. The previous mode of the entry is kept where the
+// working tree cannot be trusted, such as when the file system does
+// not support executable bits or symbolic links.
+func entryMode(info os.FileInfo, previousMode int32) int32 {
+	s := loadSettings()
+	if info.Mode()&os.ModeSymlink != 0 {
+		return objects.ModeSymlink
+	}
+	if info.IsDir() {
+		return objects.ModeGitlink
+	}
+
+	// Without symbolic links, links are checked out as plain files
+	// containing the target
+	if !s.symlinks && previousMode == objects.ModeSymlink {
+		return objects.ModeSymlink
+	}
+	if !s.fileMode {
+		if previousMode == objects.ModeExecutable {
+			return objects.ModeExecutable
+		}
+		return objects.ModeFile
+	}
+	if info.Mode()&0111 != 0 {
+		return objects.ModeExecutable
+	}
+	return objects.ModeFile
+}
+
+// canonicalMode returns the mode of an entry as stored in a tree.
+// Indexes written by older versions may contain the raw mode of a
+// regular file, of which only the executable bit is kept.
+func canonicalMode(mode int32) int32 {
+	const typeMask = 0170000
+	if mode&typeMask == objects.ModeFile&typeMask && mode != objects.ModeFile && mode != objects.ModeExecutable {
+		if mode&0111 != 0 {
+			return objects.ModeExecutable
+		}
+		return objects.ModeFile
+	}
+	return mode
+}
+
+// isNestedRepository returns true if the directory is the working tree
+// of another repository, which is recorded in the index as a gitlink
+func isNestedRepository(dir string) bool {
+	_, err := os.Lstat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// gitlinkHead returns the commit checked out in a nested repository
+func gitlinkHead(dir string) (string, error) {
+	gitDir := filepath.Join(dir, ".git")
+	info, err := os.Stat(gitDir)
+	if err != nil {
+		return "", err
+	}
+
+	// The repository may be stored elsewhere, with a file pointing to it
+	if !info.IsDir() {
+		data, err := ioutil.ReadFile(gitDir)
+		if err != nil {
+			return "", err
+		}
+		line := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(line, "gitdir: ") {
+			return "", errors.New("invalid gitfile format: " + gitDir)
+		}
+		gitDir = strings.TrimPrefix(line, "gitdir: ")
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(dir, gitDir)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	head := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(head, "ref: ") {
+		return head, nil
+	}
+
+	name := strings.TrimPrefix(head, "ref: ")
+	data, err = ioutil.ReadFile(filepath.Join(gitDir, name))
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	packed, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return "", errors.New("repository has no commits: " + dir)
+	}
+	defer packed.Close()
+	scanner := bufio.NewScanner(packed)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == name {
+			return fields[0], nil
+		}
+	}
+	return "", errors.New("repository has no commits: " + dir)
+}
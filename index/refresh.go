@@ -0,0 +1,153 @@
+package index
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"github.com/mattherman/mhgit/objects"
+)
+
+// Compares the stat information of an entry against the file. The mode
+// of the file has already been normalised to one git records, so a
+// change of file type or executable bit is detected too.
+func statMatches(entry Entry, stat Entry) bool {
+	return entry.CTimeSec == stat.CTimeSec &&
+		entry.CTimeNano == stat.CTimeNano &&
+		entry.MTimeSec == stat.MTimeSec &&
+		entry.MTimeNano == stat.MTimeNano &&
+		entry.Dev == stat.Dev &&
+		entry.Ino == stat.Ino &&
+		entry.UID == stat.UID &&
+		entry.GID == stat.GID &&
+		entry.FileSize == stat.FileSize &&
+		entry.Mode == stat.Mode
+}
+
+// isRacilyClean returns true if the file of the entry was modified no
+// earlier than the index was written. The file could have changed again
+// within the same timestamp after it was hashed, so its stat information
+// cannot prove that it is unchanged.
+func (index Index) isRacilyClean(entry Entry) bool {
+	if index.modTime.IsZero() {
+		return false
+	}
+
+	indexSec := int32(index.modTime.Unix())
+	indexNano := int32(index.modTime.Nanosecond())
+	return entry.MTimeSec > indexSec || (entry.MTimeSec == indexSec && entry.MTimeNano >= indexNano)
+}
+
+// gitlinkModified returns true if a different commit is checked out in
+// the nested repository of a gitlink. A nested repository that has not
+// been checked out is not modified.
+func gitlinkModified(entry Entry) bool {
+	if !isNestedRepository(entry.Path) {
+		return false
+	}
+	head, err := gitlinkHead(entry.Path)
+	return err != nil || head != entry.Hash
+}
+
+// Refresh will compare the stage 0 entries of the index against the
+// working tree and return the paths that were modified or deleted. Files
+// are only rehashed when their stat information differs from the index
+// or cannot be trusted, and are rehashed in parallel. Entries whose files
+// were rehashed but did not change have their stat information updated
+// in the index, so they will not need to be rehashed again.
+func Refresh(ctx context.Context) ([]string, []string, error) {
+	index, err := ReadIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Entries the fsmonitor daemon knows are unchanged need no stat at all
+	trusted := index.applyFsmonitor()
+
+	var modified []string
+	var deleted []string
+	var candidates []int
+	var candidatePaths []string
+	statEntries := make(map[int]Entry)
+
+	for i, entry := range index.Entries {
+		if entry.Stage() != StageMerged || entry.AssumeValid() || entry.SkipWorktree() {
+			continue
+		}
+		if trusted && entry.fsmonitorValid && !entry.IntentToAdd() {
+			continue
+		}
+
+		stat, err := os.Lstat(entry.Path)
+		if os.IsNotExist(err) {
+			deleted = append(deleted, entry.Path)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if entry.Mode == objects.ModeGitlink {
+			if gitlinkModified(entry) {
+				modified = append(modified, entry.Path)
+			}
+			continue
+		}
+
+		// A file replaced by a directory no longer exists as a file
+		if stat.IsDir() {
+			deleted = append(deleted, entry.Path)
+			continue
+		}
+
+		// The content of an intent-to-add entry has not been staged yet
+		if entry.IntentToAdd() {
+			modified = append(modified, entry.Path)
+			continue
+		}
+
+		statEntry := newEntryFromStat(entry.Path, entry.Hash, stat, entry.Mode)
+		if statMatches(entry, statEntry) && !index.isRacilyClean(entry) {
+			index.Entries[i].fsmonitorValid = true
+			continue
+		}
+
+		candidates = append(candidates, i)
+		candidatePaths = append(candidatePaths, entry.Path)
+		statEntries[i] = statEntry
+	}
+
+	hashes, err := objects.HashFiles(ctx, candidatePaths, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for c, i := range candidates {
+		entry := index.Entries[i]
+		if hashes[c] != entry.Hash || statEntries[i].Mode != entry.Mode {
+			modified = append(modified, entry.Path)
+			continue
+		}
+
+		// The file is unchanged, so keep the stat information that matches
+		// it. Writing the index also resolves entries that were racily
+		// clean, since the index will then be newer than the file.
+		statEntry := statEntries[i]
+		statEntry.Flags = entry.Flags
+		statEntry.ExtendedFlags = entry.ExtendedFlags
+		statEntry.fsmonitorValid = true
+		index.Entries[i] = statEntry
+	}
+
+	// Every rehashed file that was not modified had its entry refreshed,
+	// and the fsmonitor token changes with every query
+	if len(candidates) > len(modified) || index.fsmonitorEnabled {
+		err = writeRefreshedIndex(index)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sort.Strings(modified)
+	return modified, deleted, nil
+}
@@ -0,0 +1,552 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/ignore"
+	"github.com/mattherman/mhgit/objects"
+)
+
+const (
+	statDataLength     int    = 36
+	perDirExcludeFile  string = ".gitignore"
+	infoExcludeFile    string = "info/exclude"
+	untrackedDirFlags  uint32 = 0
+	onDiskUntrackedLen int    = 2*statDataLength + 4
+)
+
+// UntrackedCache represents the UNTR index extension, which remembers
+// the untracked files of each directory so that directories which
+// have not changed since they were last scanned do not need to be
+// read again.
+type UntrackedCache struct {
+	ident            string
+	infoExclude      statData
+	excludesFile     statData
+	dirFlags         uint32
+	infoExcludeHash  string
+	excludesFileHash string
+	excludePerDir    string
+	root             *untrackedDir
+}
+
+type untrackedDir struct {
+	name        string
+	untracked   []string
+	dirs        []*untrackedDir
+	valid       bool
+	checkOnly   bool
+	stat        statData
+	excludeHash string
+}
+
+// The stat information stored for directories and exclude files,
+// which is the same as an index entry without the mode
+type statData struct {
+	CTimeSec  int32
+	CTimeNano int32
+	MTimeSec  int32
+	MTimeNano int32
+	Dev       int32
+	Ino       int32
+	UID       int32
+	GID       int32
+	FileSize  int32
+}
+
+func newStatData(info os.FileInfo) statData {
+	data := statData{FileSize: int32(info.Size())}
+	statUnix, infoIsAvailable := info.Sys().(*syscall.Stat_t)
+	if infoIsAvailable {
+		data.CTimeSec = int32(statUnix.Ctim.Sec)
+		data.CTimeNano = int32(statUnix.Ctim.Nsec)
+		data.MTimeSec = int32(statUnix.Mtim.Sec)
+		data.MTimeNano = int32(statUnix.Mtim.Nsec)
+		data.Dev = int32(statUnix.Dev)
+		data.Ino = int32(statUnix.Ino)
+		data.UID = int32(statUnix.Uid)
+		data.GID = int32(statUnix.Gid)
+	}
+	return data
+}
+
+func (d *untrackedDir) subdir(name string) *untrackedDir {
+	for _, dir := range d.dirs {
+		if dir.name == name {
+			return dir
+		}
+	}
+	return nil
+}
+
+// invalidate forces the directory containing the path to be scanned
+// again, since adding or removing it from the index changes which of
+// the directory's files are untracked.
+func (c *UntrackedCache) invalidate(path string) {
+	dir := c.root
+	components := strings.Split(path, "/")
+	for _, name := range components[:len(components)-1] {
+		if dir == nil {
+			return
+		}
+		dir = dir.subdir(name)
+	}
+	if dir != nil {
+		dir.valid = false
+	}
+}
+
+// invalidateAll forces the directory and all of its subdirectories to
+// be scanned again, since the patterns of an exclude file apply to
+// every directory below it.
+func (d *untrackedDir) invalidateAll() {
+	d.valid = false
+	for _, subdir := range d.dirs {
+		subdir.invalidateAll()
+	}
+}
+
+// Identifies the worktree and system the cache was created for, since
+// the cached stat information is meaningless anywhere else
+func untrackedCacheIdent() string {
+	workTree, _ := os.Getwd()
+	system := strings.ToUpper(runtime.GOOS[:1]) + runtime.GOOS[1:]
+	return fmt.Sprintf("Location %s, system %s\000", workTree, system)
+}
+
+func newUntrackedCache() *UntrackedCache {
+	return &UntrackedCache{
+		ident:         untrackedCacheIdent(),
+		dirFlags:      untrackedDirFlags,
+		excludePerDir: perDirExcludeFile,
+	}
+}
+
+// SetUntrackedCache will enable or disable the untracked cache
+// extension of the index.
+func SetUntrackedCache(enabled bool) error {
+	lock, index, err := lockIndex()
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	if !enabled {
+		index.Untracked = nil
+	} else if index.Untracked == nil {
+		index.Untracked = newUntrackedCache()
+	}
+
+	return writeIndex(lock, index)
+}
+
+// UntrackedFiles will return the files in the working tree that are not
+// in the index and are not ignored. If the untracked cache is enabled,
+// directories which have not changed since the last scan are not read
+// again and the refreshed cache is written back to the index.
+func UntrackedFiles() ([]string, error) {
+	index, err := ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	matcher, err := ignore.NewMatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := untrackedScanner{
+		tracked:   make(map[string]bool),
+		ignore:    matcher,
+		scanStart: time.Now().Unix(),
+		trusted:   index.applyFsmonitor(),
+	}
+	for _, entry := range index.Entries {
+		scanner.tracked[entry.Path] = true
+	}
+
+	root := &untrackedDir{}
+	cache := index.Untracked
+	if cache != nil {
+		// A cache created elsewhere or with different settings cannot be reused
+		if cache.ident != untrackedCacheIdent() || cache.dirFlags != untrackedDirFlags {
+			index.Untracked = newUntrackedCache()
+			cache = index.Untracked
+		}
+		if cache.root == nil {
+			cache.root = root
+		}
+		root = cache.root
+
+		// The exclude file applies to every directory
+		infoExclude, infoExcludeHash, err := readInfoExclude()
+		if err != nil {
+			return nil, err
+		}
+		if cache.infoExclude != infoExclude || cache.infoExcludeHash != infoExcludeHash {
+			root.invalidateAll()
+			cache.infoExclude = infoExclude
+			cache.infoExcludeHash = infoExcludeHash
+			scanner.changed = true
+		}
+	}
+
+	files, err := scanner.scan(".", "", root)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	if cache != nil && (scanner.changed || index.fsmonitorEnabled) {
+		err = writeRefreshedIndex(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// readInfoExclude returns the stat information and hash of the
+// repository's exclude file, which are empty if it does not exist
+func readInfoExclude() (statData, string, error) {
+	info, err := os.Lstat(gitdir.Path(infoExcludeFile))
+	if os.IsNotExist(err) {
+		return statData{}, "", nil
+	}
+	if err != nil {
+		return statData{}, "", err
+	}
+
+	hash, err := objects.HashFile(gitdir.Path(infoExcludeFile), false)
+	if err != nil {
+		return statData{}, "", err
+	}
+	return newStatData(info), hash, nil
+}
+
+type untrackedScanner struct {
+	tracked   map[string]bool
+	ignore    *ignore.Matcher
+	scanStart int64
+	changed   bool
+	// trusted is set when the fsmonitor daemon has invalidated every
+	// directory that changed, so valid directories need no stat
+	trusted bool
+}
+
+func (s *untrackedScanner) scan(dirPath string, prefix string, dir *untrackedDir) ([]string, error) {
+	if s.trusted && dir.valid {
+		return s.scanCached(dirPath, prefix, dir)
+	}
+
+	info, err := os.Lstat(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	stat := newStatData(info)
+
+	excludeHash := ""
+	excludePath := filepath.Join(dirPath, perDirExcludeFile)
+	if _, err := os.Lstat(excludePath); err == nil {
+		excludeHash, err = objects.HashFile(excludePath, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dir.excludeHash != excludeHash {
+		dir.invalidateAll()
+	}
+	if dir.valid && dir.stat == stat {
+		return s.scanCached(dirPath, prefix, dir)
+	}
+
+	var files []string
+	children, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var untracked []string
+	var dirs []*untrackedDir
+	for _, child := range children {
+		name := child.Name()
+		if child.IsDir() {
+			if name == ".git" || s.tracked[prefix+name] || s.ignore.Ignored(prefix+name, true) {
+				continue
+			}
+			// Another repository is a single untracked entry, which is
+			// recorded with a trailing slash like git does
+			if isNestedRepository(filepath.Join(dirPath, name)) {
+				untracked = append(untracked, name+"/")
+				files = append(files, prefix+name)
+				continue
+			}
+			subdir := dir.subdir(name)
+			if subdir == nil {
+				subdir = &untrackedDir{name: name}
+			}
+			subdirFiles, err := s.scan(filepath.Join(dirPath, name), prefix+name+"/", subdir)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subdirFiles...)
+			dirs = append(dirs, subdir)
+		} else if !s.tracked[prefix+name] && !s.ignore.Ignored(prefix+name, false) {
+			untracked = append(untracked, name)
+			files = append(files, prefix+name)
+		}
+	}
+
+	dir.untracked = untracked
+	dir.dirs = dirs
+	dir.stat = stat
+	dir.excludeHash = excludeHash
+	dir.checkOnly = false
+	// A directory modified in the same second as the scan may change
+	// again without its modification time changing
+	dir.valid = int64(stat.MTimeSec) < s.scanStart
+	s.changed = true
+
+	return files, nil
+}
+
+// scanCached returns the untracked files of an unchanged directory,
+// which has the same files and subdirectories as before. The
+// subdirectories themselves may have changed.
+func (s *untrackedScanner) scanCached(dirPath string, prefix string, dir *untrackedDir) ([]string, error) {
+	var files []string
+	for _, name := range dir.untracked {
+		files = append(files, prefix+strings.TrimSuffix(name, "/"))
+	}
+	for _, subdir := range dir.dirs {
+		subdirFiles, err := s.scan(filepath.Join(dirPath, subdir.name), prefix+subdir.name+"/", subdir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, subdirFiles...)
+	}
+	return files, nil
+}
+
+func readUntrackedCache(data []byte) (*UntrackedCache, error) {
+	cache := &UntrackedCache{}
+
+	identLength, varintLength := decodeVarint(data)
+	if varintLength == 0 || varintLength+identLength > len(data) {
+		return nil, errors.New("ident is truncated")
+	}
+	data = data[varintLength:]
+	cache.ident = string(data[:identLength])
+	data = data[identLength:]
+
+	if len(data) < onDiskUntrackedLen+2*hashLength {
+		return nil, errors.New("header is truncated")
+	}
+	reader := bytes.NewReader(data[:onDiskUntrackedLen])
+	binary.Read(reader, binary.BigEndian, &cache.infoExclude)
+	binary.Read(reader, binary.BigEndian, &cache.excludesFile)
+	binary.Read(reader, binary.BigEndian, &cache.dirFlags)
+	data = data[onDiskUntrackedLen:]
+
+	cache.infoExcludeHash = readOptionalHash(data)
+	cache.excludesFileHash = readOptionalHash(data[hashLength:])
+	data = data[2*hashLength:]
+
+	nameLength := bytes.IndexByte(data, 0)
+	if nameLength == -1 {
+		return nil, errors.New("exclude file name is not terminated")
+	}
+	cache.excludePerDir = string(data[:nameLength])
+	data = data[nameLength+1:]
+
+	dirCount, varintLength := decodeVarint(data)
+	if varintLength == 0 || dirCount == 0 {
+		return cache, nil
+	}
+	data = data[varintLength:]
+
+	// Directories are stored depth first, followed by the bitmaps and
+	// the stat data and hashes for the directories that have them
+	var dirs []*untrackedDir
+	root, data, err := readUntrackedDir(data, &dirs)
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) != dirCount {
+		return nil, errors.New("directory count does not match")
+	}
+	cache.root = root
+
+	var bitmaps [3][]bool
+	for i := range bitmaps {
+		bits, length, err := readEwahBitmap(data)
+		if err != nil {
+			return nil, err
+		}
+		bitmaps[i] = bits
+		data = data[length:]
+	}
+	validBits, checkOnlyBits, hashValidBits := bitmaps[0], bitmaps[1], bitmaps[2]
+
+	for i, dir := range dirs {
+		dir.checkOnly = isSet(checkOnlyBits, i)
+		if !isSet(validBits, i) {
+			continue
+		}
+		if len(data) < statDataLength {
+			return nil, errors.New("directory stat data is truncated")
+		}
+		dir.valid = true
+		binary.Read(bytes.NewReader(data[:statDataLength]), binary.BigEndian, &dir.stat)
+		data = data[statDataLength:]
+	}
+
+	for i, dir := range dirs {
+		if !isSet(hashValidBits, i) {
+			continue
+		}
+		if len(data) < hashLength {
+			return nil, errors.New("directory exclude hash is truncated")
+		}
+		dir.excludeHash = hex.EncodeToString(data[:hashLength])
+		data = data[hashLength:]
+	}
+
+	return cache, nil
+}
+
+func readUntrackedDir(data []byte, dirs *[]*untrackedDir) (*untrackedDir, []byte, error) {
+	dir := &untrackedDir{}
+	*dirs = append(*dirs, dir)
+
+	untrackedCount, varintLength := decodeVarint(data)
+	if varintLength == 0 {
+		return nil, nil, errors.New("directory is truncated")
+	}
+	data = data[varintLength:]
+	dirCount, varintLength := decodeVarint(data)
+	if varintLength == 0 {
+		return nil, nil, errors.New("directory is truncated")
+	}
+	data = data[varintLength:]
+
+	names := make([]string, untrackedCount+1)
+	for i := range names {
+		nameLength := bytes.IndexByte(data, 0)
+		if nameLength == -1 {
+			return nil, nil, errors.New("directory name is not terminated")
+		}
+		names[i] = string(data[:nameLength])
+		data = data[nameLength+1:]
+	}
+	dir.name = names[0]
+	dir.untracked = names[1:]
+
+	for i := 0; i < dirCount; i++ {
+		var subdir *untrackedDir
+		var err error
+		subdir, data, err = readUntrackedDir(data, dirs)
+		if err != nil {
+			return nil, nil, err
+		}
+		dir.dirs = append(dir.dirs, subdir)
+	}
+
+	return dir, data, nil
+}
+
+func readOptionalHash(data []byte) string {
+	hash := data[:hashLength]
+	if bytes.Equal(hash, make([]byte, hashLength)) {
+		return ""
+	}
+	return hex.EncodeToString(hash)
+}
+
+func writeOptionalHash(buffer *bytes.Buffer, hash string) {
+	hashBytes := make([]byte, hashLength)
+	if hash != "" {
+		hashBytes, _ = hex.DecodeString(hash)
+	}
+	buffer.Write(hashBytes)
+}
+
+func writeUntrackedCache(cache *UntrackedCache) []byte {
+	var buffer bytes.Buffer
+	buffer.Write(encodeVarint(len(cache.ident)))
+	buffer.WriteString(cache.ident)
+	binary.Write(&buffer, binary.BigEndian, cache.infoExclude)
+	binary.Write(&buffer, binary.BigEndian, cache.excludesFile)
+	binary.Write(&buffer, binary.BigEndian, cache.dirFlags)
+	writeOptionalHash(&buffer, cache.infoExcludeHash)
+	writeOptionalHash(&buffer, cache.excludesFileHash)
+	buffer.WriteString(cache.excludePerDir)
+	buffer.WriteByte(0)
+
+	if cache.root == nil {
+		buffer.Write(encodeVarint(0))
+		return buffer.Bytes()
+	}
+
+	var dirs []*untrackedDir
+	var dirBuffer bytes.Buffer
+	writeUntrackedDir(&dirBuffer, cache.root, &dirs)
+	buffer.Write(encodeVarint(len(dirs)))
+	buffer.Write(dirBuffer.Bytes())
+
+	validBits := make([]bool, len(dirs))
+	checkOnlyBits := make([]bool, len(dirs))
+	hashValidBits := make([]bool, len(dirs))
+	var statBuffer bytes.Buffer
+	var hashBuffer bytes.Buffer
+	for i, dir := range dirs {
+		if dir.valid {
+			validBits[i] = true
+			binary.Write(&statBuffer, binary.BigEndian, dir.stat)
+		}
+		checkOnlyBits[i] = dir.checkOnly
+		if dir.excludeHash != "" {
+			hashValidBits[i] = true
+			writeOptionalHash(&hashBuffer, dir.excludeHash)
+		}
+	}
+
+	buffer.Write(writeEwahBitmap(validBits))
+	buffer.Write(writeEwahBitmap(checkOnlyBits))
+	buffer.Write(writeEwahBitmap(hashValidBits))
+	buffer.Write(statBuffer.Bytes())
+	buffer.Write(hashBuffer.Bytes())
+	buffer.WriteByte(0)
+
+	return buffer.Bytes()
+}
+
+func writeUntrackedDir(buffer *bytes.Buffer, dir *untrackedDir, dirs *[]*untrackedDir) {
+	*dirs = append(*dirs, dir)
+	buffer.Write(encodeVarint(len(dir.untracked)))
+	buffer.Write(encodeVarint(len(dir.dirs)))
+	buffer.WriteString(dir.name)
+	buffer.WriteByte(0)
+	for _, name := range dir.untracked {
+		buffer.WriteString(name)
+		buffer.WriteByte(0)
+	}
+	for _, subdir := range dir.dirs {
+		writeUntrackedDir(buffer, subdir, dirs)
+	}
+}
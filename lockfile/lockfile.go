@@ -0,0 +1,152 @@
+package lockfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockSuffix string = ".lock"
+
+	// Locks are only held for the duration of a single command, so one
+	// this old was almost certainly left behind by a process that died
+	staleLockAge time.Duration = 10 * time.Minute
+)
+
+// Lockfile represents an exclusive lock on a file in the repository.
+// The new contents of the file are written to "<path>.lock", which
+// replaces the file when the lock is committed. Other processes
+// cannot lock the file while the lock file exists.
+type Lockfile struct {
+	Path     string
+	lockPath string
+	file     *os.File
+	done     bool
+}
+
+// LockedError is returned when a lock cannot be acquired because
+// the lock file already exists.
+type LockedError struct {
+	LockPath string
+	Age      time.Duration
+}
+
+func (e *LockedError) Error() string {
+	message := fmt.Sprintf("unable to create '%s': file exists. Another mhgit process seems to be running in this repository", e.LockPath)
+	if e.Stale() {
+		return fmt.Sprintf("%s, but the lock file is %v old and is probably stale. If no other mhgit process is running, remove the file and try again", message, e.Age.Round(time.Second))
+	}
+	return message + ". Please make sure all processes are terminated and try again"
+}
+
+// Stale returns true if the lock file is old enough that the
+// process that created it has most likely died
+func (e *LockedError) Stale() bool {
+	return e.Age >= staleLockAge
+}
+
+// Lock will acquire the lock for the given file by exclusively
+// creating its lock file.
+func Lock(path string) (*Lockfile, error) {
+	lockPath := path + lockSuffix
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		lockedErr := &LockedError{LockPath: lockPath}
+		info, statErr := os.Stat(lockPath)
+		if statErr == nil {
+			lockedErr.Age = time.Since(info.ModTime())
+		}
+		return nil, lockedErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create '%s': %v", lockPath, err)
+	}
+
+	return &Lockfile{Path: path, lockPath: lockPath, file: f}, nil
+}
+
+// LockWithTimeout will acquire the lock for the given file, retrying
+// with a growing backoff while another process holds it until the
+// timeout has elapsed.
+func LockWithTimeout(path string, timeout time.Duration) (*Lockfile, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := time.Millisecond
+	for {
+		lock, err := Lock(path)
+		if _, locked := err.(*LockedError); !locked || time.Now().Add(backoff).After(deadline) {
+			return lock, err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Write will write to the lock file. The data replaces the contents
+// of the locked file once the lock is committed.
+func (l *Lockfile) Write(data []byte) (int, error) {
+	return l.file.Write(data)
+}
+
+// Commit will flush the lock file to disk and atomically rename
+// it over the locked file, releasing the lock.
+func (l *Lockfile) Commit() error {
+	if l.done {
+		return fmt.Errorf("lock on '%s' was already released", l.Path)
+	}
+	l.done = true
+
+	err := l.file.Sync()
+	if err == nil {
+		err = l.file.Close()
+	} else {
+		l.file.Close()
+	}
+	if err == nil {
+		err = os.Rename(l.lockPath, l.Path)
+	}
+	if err != nil {
+		os.Remove(l.lockPath)
+		return fmt.Errorf("unable to write '%s': %v", l.Path, err)
+	}
+
+	return nil
+}
+
+// Rollback will discard the lock file and release the lock without
+// changing the locked file. It does nothing if the lock was already
+// committed, so it can be deferred right after acquiring the lock.
+func (l *Lockfile) Rollback() error {
+	if l.done {
+		return nil
+	}
+	l.done = true
+
+	l.file.Close()
+	return os.Remove(l.lockPath)
+}
+
+// WriteFile will replace the contents of the file while holding
+// its lock, waiting up to the timeout for the lock to be released.
+func WriteFile(path string, data []byte, timeout time.Duration) error {
+	lock, err := LockWithTimeout(path, timeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	_, err = lock.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return lock.Commit()
+}
@@ -0,0 +1,76 @@
+package objects
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Commit represents a parsed commit object
+type Commit struct {
+	Tree      string
+	Parents   []string
+	Author    string
+	Committer string
+	Message   string
+}
+
+// ParseCommit will parse the headers and message of a commit object
+func ParseCommit(data []byte) (Commit, error) {
+	var commit Commit
+
+	headerEnd := bytes.Index(data, []byte("\n\n"))
+	if headerEnd == -1 {
+		headerEnd = len(data)
+	} else {
+		commit.Message = string(data[headerEnd+2:])
+	}
+
+	for _, line := range strings.Split(string(data[:headerEnd]), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		switch parts[0] {
+		case "tree":
+			commit.Tree = parts[1]
+		case "parent":
+			commit.Parents = append(commit.Parents, parts[1])
+		case "author":
+			commit.Author = parts[1]
+		case "committer":
+			commit.Committer = parts[1]
+		}
+	}
+
+	if commit.Tree == "" {
+		return Commit{}, errors.New("commit has no tree")
+	}
+	return commit, nil
+}
+
+// ReadCommit will read and parse the commit object with the given hash
+func ReadCommit(hash string) (Commit, error) {
+	obj, err := ReadObject(hash)
+	if err != nil {
+		return Commit{}, err
+	}
+	if obj.Type() != "commit" {
+		return Commit{}, fmt.Errorf("object %s is a %s, not a commit", hash, obj.Type())
+	}
+	return ParseCommit(obj.Data)
+}
+
+// Data returns the content of the commit object in the format it is
+// stored in
+func (c Commit) Data() []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "tree %s\n", c.Tree)
+	for _, parent := range c.Parents {
+		fmt.Fprintf(&buffer, "parent %s\n", parent)
+	}
+	fmt.Fprintf(&buffer, "author %s\ncommitter %s\n\n", c.Author, c.Committer)
+	buffer.WriteString(c.Message)
+	return buffer.Bytes()
+}
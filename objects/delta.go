@@ -0,0 +1,106 @@
+package objects
+
+import (
+	"bytes"
+)
+
+const (
+	// Blocks of the base are indexed by their content, so copies shorter
+	// than a block are not found
+	deltaBlockSize = 16
+
+	// The most data a single copy or insert instruction can hold
+	maxDeltaCopy   = 0x10000
+	maxDeltaInsert = 0x7f
+)
+
+// createDelta returns a delta that builds the target from the base, in
+// the format read by applyDelta. Blocks of the target found in the base
+// are copied from it, and everything else is inserted.
+func createDelta(base []byte, target []byte) []byte {
+	var delta bytes.Buffer
+	writeDeltaSize(&delta, len(base))
+	writeDeltaSize(&delta, len(target))
+
+	index := make(map[string]int)
+	for offset := 0; offset+deltaBlockSize <= len(base); offset += deltaBlockSize {
+		block := string(base[offset : offset+deltaBlockSize])
+		if _, ok := index[block]; !ok {
+			index[block] = offset
+		}
+	}
+
+	var pending []byte
+	flushInserts := func() {
+		for len(pending) > 0 {
+			size := len(pending)
+			if size > maxDeltaInsert {
+				size = maxDeltaInsert
+			}
+			delta.WriteByte(byte(size))
+			delta.Write(pending[:size])
+			pending = pending[size:]
+		}
+	}
+
+	for position := 0; position < len(target); {
+		offset, ok := -1, false
+		if position+deltaBlockSize <= len(target) {
+			offset, ok = index[string(target[position:position+deltaBlockSize])]
+		}
+		if !ok {
+			pending = append(pending, target[position])
+			position++
+			continue
+		}
+
+		length := deltaBlockSize
+		for offset+length < len(base) && position+length < len(target) && base[offset+length] == target[position+length] {
+			length++
+		}
+		flushInserts()
+		for copied := 0; copied < length; {
+			size := length - copied
+			if size > maxDeltaCopy {
+				size = maxDeltaCopy
+			}
+			writeDeltaCopy(&delta, offset+copied, size)
+			copied += size
+		}
+		position += length
+	}
+	flushInserts()
+	return delta.Bytes()
+}
+
+func writeDeltaSize(delta *bytes.Buffer, size int) {
+	for size >= 0x80 {
+		delta.WriteByte(byte(size&0x7f) | 0x80)
+		size >>= 7
+	}
+	delta.WriteByte(byte(size))
+}
+
+// writeDeltaCopy writes an instruction to copy part of the base, where
+// only the non-zero bytes of the offset and size are stored
+func writeDeltaCopy(delta *bytes.Buffer, offset int, size int) {
+	op := byte(0x80)
+	var args []byte
+	for i := uint(0); i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			op |= 1 << i
+			args = append(args, b)
+		}
+	}
+	// A size of 0x10000 is written as no size at all
+	if size != maxDeltaCopy {
+		for i := uint(0); i < 3; i++ {
+			if b := byte(size >> (8 * i)); b != 0 {
+				op |= 1 << (4 + i)
+				args = append(args, b)
+			}
+		}
+	}
+	delta.WriteByte(op)
+	delta.Write(args)
+}
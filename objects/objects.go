@@ -1,21 +1,33 @@
 package objects
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattherman/mhgit/gitdir"
 )
 
+// The longest header of a loose object, which is its type and size
+const maxObjectHeaderLength = 32
+
 // Object represents a Git object. It can be of type "blob",
-// "commit", or "tree".
+// "commit", "tree", or "tag".
 type Object struct {
 	Data       []byte
 	ObjectType string
@@ -31,14 +43,41 @@ func (o Object) Size() int {
 	return len(o.Data)
 }
 
-// String prints the object based on its type
+// String prints the object based on its type. Trees are printed one
+// entry per line, the way ls-tree shows them.
 func (o Object) String() string {
 	if o.ObjectType != "tree" {
-		return fmt.Sprintf("%s", o.Data)
+		return string(o.Data)
 	}
 
-	// TODO properly parse the tree and output it
-	return fmt.Sprintf("%s", o.Data)
+	entries, err := ParseTree(o.Data)
+	if err != nil {
+		return string(o.Data)
+	}
+	var builder strings.Builder
+	for _, entry := range entries {
+		mode, _ := strconv.ParseUint(entry.Mode, 8, 32)
+		fmt.Fprintf(&builder, "%06o %s %s\t%s\n", mode, entry.Type(), entry.Hash, entry.Name)
+	}
+	return builder.String()
+}
+
+// CheckObject will return an error if the object is not of a known
+// type or its content cannot be parsed as that type
+func CheckObject(obj Object) error {
+	var err error
+	switch obj.ObjectType {
+	case "blob":
+	case "tree":
+		_, err = ParseTree(obj.Data)
+	case "commit":
+		_, err = ParseCommit(obj.Data)
+	case "tag":
+		_, err = ParseTag(obj.Data)
+	default:
+		err = fmt.Errorf("invalid object type \"%s\"", obj.ObjectType)
+	}
+	return err
 }
 
 // HashFile will compute the SHA1 hash of a file. If write is true, the
@@ -54,6 +93,79 @@ func HashFile(filename string, write bool) (string, error) {
 	return HashObject(obj, write)
 }
 
+// HashFiles will compute the SHA1 hashes of many files using a bounded
+// pool of workers. The hashes are returned in the same order as the
+// filenames. Hashing stops at the first failure or when the context is
+// cancelled, and the error for the earliest failed file is returned.
+// Symbolic links are hashed as the path they point to, which is how
+// they are stored in the repository.
+func HashFiles(ctx context.Context, filenames []string, write bool) ([]string, error) {
+	hashes := make([]string, len(filenames))
+	errs := make([]error, len(filenames))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := runtime.NumCPU()
+	if workers > len(filenames) {
+		workers = len(filenames)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				hashes[i], errs[i] = hashPath(filenames[i], write)
+				if errs[i] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range filenames {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filenames[i], err)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return hashes, nil
+}
+
+// hashPath hashes a file, or the target of a symbolic link
+func hashPath(filename string, write bool) (string, error) {
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return "", errors.New("The file was not found")
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return HashFile(filename, write)
+	}
+
+	target, err := os.Readlink(filename)
+	if err != nil {
+		return "", err
+	}
+	return HashObject(Object{Data: []byte(target), ObjectType: "blob"}, write)
+}
+
 // HashObject will compute the SHA1 hash of the object and its headers.
 // If write is true, the object will be written to file with zlib compression.
 func HashObject(objectToHash Object, write bool) (string, error) {
@@ -64,11 +176,17 @@ func HashObject(objectToHash Object, write bool) (string, error) {
 	sha1 := ComputeSha1(fullData)
 
 	if write {
-		objectPath := filepath.Join("./.git/objects", sha1[:2])
+		objectPath := gitdir.Path("objects", sha1[:2])
 
 		os.Mkdir(objectPath, 0700)
 		fileName := filepath.Join(objectPath, sha1[2:])
 
+		// Objects are immutable, so an existing object is not rewritten.
+		// It is freshened instead, so that prune counts it as just written.
+		if freshenLoose(fileName) || freshenPacked(sha1) {
+			return sha1, nil
+		}
+
 		err := writeCompressedFile(fileName, fullData)
 
 		if err != nil {
@@ -79,6 +197,13 @@ func HashObject(objectToHash Object, write bool) (string, error) {
 	return sha1, nil
 }
 
+// freshenLoose sets the modification time of the loose object file to
+// now, returning false if the file is missing or cannot be changed
+func freshenLoose(fileName string) bool {
+	now := time.Now()
+	return os.Chtimes(fileName, now, now) == nil
+}
+
 // ComputeSha1 returns the SHA-1 hash of the
 // provided byte array as a string.
 func ComputeSha1(data []byte) string {
@@ -87,26 +212,176 @@ func ComputeSha1(data []byte) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-// FindObject will attempt to find an object using the given prefix and
-// return the filepath to the object. The prefix must at least three
-// characters and must be long enough to be unique among all other objects.
-func FindObject(hash string) (string, error) {
+// AmbiguousError is returned for a prefix shared by the hashes of more
+// than one object
+type AmbiguousError struct {
+	Prefix string
+}
+
+func (e *AmbiguousError) Error() string {
+	return "Found multiple matches for " + e.Prefix + "."
+}
+
+// ExpandHash will return the full hash of the loose or packed object
+// with the given prefix. The prefix must be at least three characters and
+// must be long enough to be unique among all other objects.
+func ExpandHash(hash string) (string, error) {
 	if len(hash) < 3 {
 		return "", errors.New("Prefix provided must be at least three characters")
 	}
 
-	hashDirectory := "./.git/objects/" + hash[:2]
-	hashRemainder := hash[2:]
-
-	files, _ := filepath.Glob(hashDirectory + "/" + hashRemainder + "*")
+	matches := make(map[string]bool)
+	files, _ := filepath.Glob(gitdir.Path("objects", hash[:2], hash[2:]+"*"))
+	for _, file := range files {
+		matches[filepath.Base(filepath.Dir(file))+filepath.Base(file)] = true
+	}
+	list, err := loadedPacks()
+	if err != nil {
+		return "", err
+	}
+	for _, pack := range list {
+		for _, match := range pack.findPrefix(hash) {
+			matches[match] = true
+		}
+	}
 
-	if len(files) == 0 {
+	if len(matches) == 0 {
 		return "", errors.New("Object " + hash + " not found.")
-	} else if len(files) > 1 {
-		return "", errors.New("Found multiple matches for " + hash + ".")
-	} else {
-		return files[0], nil
+	} else if len(matches) > 1 {
+		return "", &AmbiguousError{Prefix: hash}
 	}
+	for match := range matches {
+		hash = match
+	}
+	return hash, nil
+}
+
+// ListObjects will return the hashes of every object in the repository,
+// loose or packed, sorted
+func ListObjects() ([]string, error) {
+	loose, err := LooseObjects()
+	if err != nil {
+		return nil, err
+	}
+	packed, err := packedObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var hashes []string
+	for _, hash := range append(loose, packed...) {
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// LooseObjects will return the hashes of the objects stored in their own
+// files rather than in a pack, sorted
+func LooseObjects() ([]string, error) {
+	dirs, err := filepath.Glob(gitdir.Path("objects", "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			hash := filepath.Base(dir) + file.Name()
+			if _, err := hex.DecodeString(hash); err == nil && len(hash) == 40 {
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// LooseObjectPath returns the file a loose object is stored in
+func LooseObjectPath(hash string) string {
+	return gitdir.Path("objects", hash[:2], hash[2:])
+}
+
+// IsHash returns true if the text is a full object name, 40 lowercase
+// hexadecimal digits
+func IsHash(text string) bool {
+	if len(text) != 40 {
+		return false
+	}
+	for i := 0; i < len(text); i++ {
+		if !(text[i] >= '0' && text[i] <= '9') && !(text[i] >= 'a' && text[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Exists returns true if the repository has the object, either loose
+// or in a pack
+func Exists(hash string) bool {
+	if !IsHash(hash) {
+		return false
+	}
+	if _, err := os.Stat(LooseObjectPath(hash)); err == nil {
+		return true
+	}
+	return IsPacked(hash)
+}
+
+// RemoveLooseObject will delete the file of a loose object, along with
+// its directory once that is empty
+func RemoveLooseObject(hash string) error {
+	path := LooseObjectPath(hash)
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	// The directory is kept if other objects are still in it
+	os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// LoosenObject will write a packed object to its own file, with the
+// given modification time, so it can be kept when its pack is removed
+func LoosenObject(hash string, modTime time.Time) error {
+	obj, err := ReadObject(hash)
+	if err != nil {
+		return err
+	}
+
+	path := LooseObjectPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	os.Mkdir(filepath.Dir(path), 0700)
+	data := append([]byte(obj.ObjectType+" "+strconv.Itoa(len(obj.Data))+"\000"), obj.Data...)
+	err = writeCompressedFile(path, data)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
+
+// ObjectStorage will return the number of bytes the object takes in the
+// repository and, if it is stored as a delta, the hash of its base
+func ObjectStorage(hash string) (int64, string, error) {
+	info, err := os.Stat(LooseObjectPath(hash))
+	if err == nil {
+		return info.Size(), "", nil
+	}
+	size, base, found, err := packedObjectStorage(hash)
+	if err == nil && !found {
+		err = errors.New("Object " + hash + " not found.")
+	}
+	return size, base, err
 }
 
 // ReadObject will attempt to find an object using the given prefix and
@@ -114,59 +389,137 @@ func FindObject(hash string) (string, error) {
 // The prefix must at least three characters and must be long enough to
 // be unique among all other objects.
 func ReadObject(hash string) (Object, error) {
-	objectPath, err := FindObject(hash)
-
-	if err != nil {
-		return Object{}, err
+	var err error
+	if len(hash) != 40 {
+		hash, err = ExpandHash(hash)
+		if err != nil {
+			return Object{}, err
+		}
 	}
 
-	content, err := readCompressedFile(objectPath)
-
+	content, err := readCompressedFile(LooseObjectPath(hash))
+	if os.IsNotExist(err) {
+		obj, found, err := readPacked(hash)
+		if err == nil && !found {
+			err = errors.New("Object " + hash + " not found.")
+		}
+		return obj, err
+	}
 	if err != nil {
 		return Object{}, err
 	}
 
 	nullIndex := bytes.IndexByte(content, 0)
-
 	if nullIndex == -1 {
-		return Object{}, err
+		return Object{}, fmt.Errorf("object %s is corrupt: its header is not terminated", hash)
 	}
 
-	header := string(content[:nullIndex-1])
+	header := string(content[:nullIndex])
 	headerParts := strings.Split(header, " ")
+	if len(headerParts) != 2 {
+		return Object{}, fmt.Errorf("object %s is corrupt: invalid header '%s'", hash, header)
+	}
 
-	if len(headerParts) < 2 {
-		return Object{}, err
+	size, err := strconv.Atoi(headerParts[1])
+	if err != nil || size != len(content)-nullIndex-1 {
+		return Object{}, fmt.Errorf("object %s is corrupt: its size does not match its header", hash)
 	}
 
-	return Object{Data: content[nullIndex:], ObjectType: headerParts[0]}, nil
+	return Object{Data: content[nullIndex+1:], ObjectType: headerParts[0]}, nil
 }
 
+// ReadObjectHeader will return the type and size of the object without
+// reading its content. Only the header of a loose object is inflated,
+// and only the headers of the entries of a packed one are read.
+func ReadObjectHeader(hash string) (string, int, error) {
+	var err error
+	if len(hash) != 40 {
+		hash, err = ExpandHash(hash)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	file, err := os.Open(LooseObjectPath(hash))
+	if os.IsNotExist(err) {
+		objectType, size, found, err := readPackedHeader(hash)
+		if err == nil && !found {
+			err = errors.New("Object " + hash + " not found.")
+		}
+		return objectType, size, err
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	r, err := zlib.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return "", 0, fmt.Errorf("object %s is corrupt: %v", hash, err)
+	}
+	defer r.Close()
+	header, err := bufio.NewReader(io.LimitReader(r, maxObjectHeaderLength)).ReadString(0)
+	if err != nil {
+		return "", 0, fmt.Errorf("object %s is corrupt: its header is not terminated", hash)
+	}
+
+	headerParts := strings.Split(strings.TrimSuffix(header, "\000"), " ")
+	if len(headerParts) != 2 {
+		return "", 0, fmt.Errorf("object %s is corrupt: invalid header '%s'", hash, header)
+	}
+	size, err := strconv.Atoi(headerParts[1])
+	if err != nil || size < 0 {
+		return "", 0, fmt.Errorf("object %s is corrupt: invalid size in its header", hash)
+	}
+	return headerParts[0], size, nil
+}
+
+// Writes the compressed data to a temporary file that is renamed into
+// place, so that concurrent writers of the same object never expose a
+// partially written file.
 func writeCompressedFile(filename string, uncompressedData []byte) error {
 	var buf bytes.Buffer
 	w := zlib.NewWriter(&buf)
 	w.Write(uncompressedData)
 	w.Close()
 
-	return ioutil.WriteFile(filename, buf.Bytes(), 0700)
+	f, err := ioutil.TempFile(filepath.Dir(filename), "tmp_obj_")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0444)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
 }
 
 func readCompressedFile(filename string) ([]byte, error) {
-	fileContent, err := ioutil.ReadFile(filename)
+	file, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer file.Close()
 
-	buf := bytes.NewReader(fileContent)
-	r, err := zlib.NewReader(buf)
-	defer r.Close()
+	r, err := zlib.NewReader(file)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("unable to read %s: %v", filename, err)
 	}
+	defer r.Close()
 
 	result, err := ioutil.ReadAll(r)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("unable to read %s: %v", filename, err)
 	}
 
 	return result, nil
@@ -0,0 +1,26 @@
+package objects
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHashObjectFreshensExistingObject(t *testing.T) {
+	useTestRepository(t)
+	hash := writeTestObject(t, "blob", []byte("content\n"))
+	old := time.Now().Add(-48 * time.Hour)
+	err := os.Chtimes(LooseObjectPath(hash), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestObject(t, "blob", []byte("content\n"))
+	info, err := os.Stat(LooseObjectPath(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(old.Add(time.Hour)) {
+		t.Errorf("writing the object again left it modified at %v", info.ModTime())
+	}
+}
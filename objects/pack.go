@@ -0,0 +1,877 @@
+package objects
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+const (
+	packDir       string = "objects/pack"
+	packListDir   string = "objects/info"
+	packSignature string = "PACK"
+	idxSignature  string = "\377tOc"
+	packVersion          = 2
+	idxVersion           = 2
+
+	// Deltas based on other deltas are only followed this deep
+	maxDeltaDepth = 64
+)
+
+// The types of the entries of a pack
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var packTypeNames = map[int]string{
+	packCommit: "commit",
+	packTree:   "tree",
+	packBlob:   "blob",
+	packTag:    "tag",
+}
+
+// PackInfo describes a pack in the repository
+type PackInfo struct {
+	Name    string
+	Objects int
+	Size    int64
+	ModTime time.Time
+}
+
+// packfile is a pack along with its index, which gives the offset of
+// each object in the pack
+type packfile struct {
+	path    string
+	file    *os.File
+	size    int64
+	modTime time.Time
+	fanout  [256]uint32
+	hashes  []byte
+	offsets []int64
+}
+
+// The packs of the repository are opened once and kept open, until a
+// pack is written or removed or another repository is used
+var packs struct {
+	sync.Mutex
+	dir  string
+	list []*packfile
+}
+
+func loadedPacks() ([]*packfile, error) {
+	packs.Lock()
+	defer packs.Unlock()
+	dir, err := filepath.Abs(gitdir.Get())
+	if err != nil {
+		return nil, err
+	}
+	if packs.dir == dir {
+		return packs.list, nil
+	}
+	closePacksLocked()
+
+	indexes, err := filepath.Glob(gitdir.Path(packDir, "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		pack, err := openPack(index)
+		if os.IsNotExist(err) {
+			// An index whose pack is gone is left for count-objects to
+			// report as garbage
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		packs.list = append(packs.list, pack)
+	}
+	packs.dir = dir
+	return packs.list, nil
+}
+
+// ReloadPacks will make the packs of the repository be opened again when
+// next read, so that those written by other processes are found
+func ReloadPacks() {
+	closePacks()
+}
+
+func closePacks() {
+	packs.Lock()
+	defer packs.Unlock()
+	closePacksLocked()
+}
+
+func closePacksLocked() {
+	for _, pack := range packs.list {
+		pack.file.Close()
+	}
+	packs.list = nil
+	packs.dir = ""
+}
+
+// openPack reads a version 2 pack index and opens the pack it describes
+func openPack(indexPath string) (*packfile, error) {
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8+256*4+40 || string(data[:4]) != idxSignature || binary.BigEndian.Uint32(data[4:]) != idxVersion {
+		return nil, fmt.Errorf("%s is not a version %d pack index", indexPath, idxVersion)
+	}
+
+	pack := &packfile{path: strings.TrimSuffix(indexPath, ".idx") + ".pack"}
+	for i := range pack.fanout {
+		pack.fanout[i] = binary.BigEndian.Uint32(data[8+i*4:])
+	}
+	count := int(pack.fanout[255])
+
+	hashesStart := 8 + 256*4
+	offsetsStart := hashesStart + count*20 + count*4
+	largeStart := offsetsStart + count*4
+	if len(data) < largeStart+40 {
+		return nil, fmt.Errorf("%s is truncated", indexPath)
+	}
+	pack.hashes = data[hashesStart : hashesStart+count*20]
+
+	pack.offsets = make([]int64, count)
+	for i := range pack.offsets {
+		offset := binary.BigEndian.Uint32(data[offsetsStart+i*4:])
+		if offset&0x80000000 == 0 {
+			pack.offsets[i] = int64(offset)
+			continue
+		}
+
+		// Offsets past 2GB are stored in a separate table
+		large := largeStart + int(offset&0x7fffffff)*8
+		if large+8 > len(data)-40 {
+			return nil, fmt.Errorf("%s is truncated", indexPath)
+		}
+		pack.offsets[i] = int64(binary.BigEndian.Uint64(data[large:]))
+	}
+
+	pack.file, err = os.Open(pack.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := pack.file.Stat()
+	if err != nil {
+		pack.file.Close()
+		return nil, err
+	}
+	pack.size = info.Size()
+	pack.modTime = info.ModTime()
+	return pack, nil
+}
+
+func (p *packfile) count() int {
+	return len(p.offsets)
+}
+
+func (p *packfile) hashAt(i int) string {
+	return hex.EncodeToString(p.hashes[i*20 : i*20+20])
+}
+
+// find returns the position of the object in the index
+func (p *packfile) find(hash string) (int, bool) {
+	raw, err := hex.DecodeString(hash)
+	if err != nil || len(raw) != 20 {
+		return 0, false
+	}
+
+	low := 0
+	if raw[0] > 0 {
+		low = int(p.fanout[raw[0]-1])
+	}
+	high := int(p.fanout[raw[0]])
+	i := low + sort.Search(high-low, func(i int) bool {
+		return bytes.Compare(p.hashes[(low+i)*20:(low+i)*20+20], raw) >= 0
+	})
+	return i, i < high && bytes.Equal(p.hashes[i*20:i*20+20], raw)
+}
+
+// findPrefix returns the objects of the pack whose hashes start with
+// the prefix
+func (p *packfile) findPrefix(prefix string) []string {
+	first, err := hex.DecodeString(prefix[:2])
+	if err != nil {
+		return nil
+	}
+
+	low := 0
+	if first[0] > 0 {
+		low = int(p.fanout[first[0]-1])
+	}
+	var matches []string
+	for i := low; i < int(p.fanout[first[0]]); i++ {
+		if hash := p.hashAt(i); strings.HasPrefix(hash, prefix) {
+			matches = append(matches, hash)
+		}
+	}
+	return matches
+}
+
+// entryHeader reads the type and size of the entry at the offset,
+// returning the number of bytes the header takes
+func (p *packfile) entryHeader(offset int64) (int, int64, int, error) {
+	var buffer [10]byte
+	n, err := p.file.ReadAt(buffer[:], offset)
+	if n == 0 && err != nil {
+		return 0, 0, 0, err
+	}
+
+	entryType := int(buffer[0]>>4) & 7
+	size := int64(buffer[0] & 0x0f)
+	shift := uint(4)
+	used := 1
+	for buffer[used-1]&0x80 != 0 {
+		if used >= n {
+			return 0, 0, 0, fmt.Errorf("%s: corrupt entry at offset %d", p.path, offset)
+		}
+		size |= int64(buffer[used]&0x7f) << shift
+		shift += 7
+		used++
+	}
+	return entryType, size, used, nil
+}
+
+// inflate decompresses the data starting at the offset
+func (p *packfile) inflate(offset int64, size int64) ([]byte, error) {
+	r, err := zlib.NewReader(bufio.NewReader(io.NewSectionReader(p.file, offset, p.size-offset)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: corrupt entry at offset %d: %v", p.path, offset, err)
+	}
+	defer r.Close()
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: corrupt entry at offset %d: %v", p.path, offset, err)
+	}
+	return data, nil
+}
+
+// readAt reads the object stored at the offset, applying deltas to
+// their base objects
+func (p *packfile) readAt(offset int64, depth int) (Object, error) {
+	if depth > maxDeltaDepth {
+		return Object{}, fmt.Errorf("%s: delta chain at offset %d is too long", p.path, offset)
+	}
+
+	entryType, size, used, err := p.entryHeader(offset)
+	if err != nil {
+		return Object{}, err
+	}
+	dataStart := offset + int64(used)
+
+	var base Object
+	switch entryType {
+	case packCommit, packTree, packBlob, packTag:
+		data, err := p.inflate(dataStart, size)
+		if err != nil {
+			return Object{}, err
+		}
+		return Object{Data: data, ObjectType: packTypeNames[entryType]}, nil
+	case packOfsDelta:
+		baseOffset, used, err := p.deltaOffset(dataStart)
+		if err != nil {
+			return Object{}, err
+		}
+		if baseOffset <= 0 || baseOffset >= offset {
+			return Object{}, fmt.Errorf("%s: invalid delta base at offset %d", p.path, offset)
+		}
+		base, err = p.readAt(offset-baseOffset, depth+1)
+		if err != nil {
+			return Object{}, err
+		}
+		dataStart += int64(used)
+	case packRefDelta:
+		var raw [20]byte
+		_, err := p.file.ReadAt(raw[:], dataStart)
+		if err != nil {
+			return Object{}, err
+		}
+		base, err = ReadObject(hex.EncodeToString(raw[:]))
+		if err != nil {
+			return Object{}, err
+		}
+		dataStart += 20
+	default:
+		return Object{}, fmt.Errorf("%s: unknown entry type %d at offset %d", p.path, entryType, offset)
+	}
+
+	delta, err := p.inflate(dataStart, size)
+	if err != nil {
+		return Object{}, err
+	}
+	data, err := applyDelta(base.Data, delta)
+	if err != nil {
+		return Object{}, fmt.Errorf("%s: invalid delta at offset %d: %v", p.path, offset, err)
+	}
+	return Object{Data: data, ObjectType: base.ObjectType}, nil
+}
+
+// headerAt reads the type and size of the object stored at the offset.
+// The type of a delta is that of its base and its size is recorded at
+// the start of the delta, so no delta has to be applied.
+func (p *packfile) headerAt(offset int64, depth int) (string, int, error) {
+	if depth > maxDeltaDepth {
+		return "", 0, fmt.Errorf("%s: delta chain at offset %d is too long", p.path, offset)
+	}
+
+	entryType, size, used, err := p.entryHeader(offset)
+	if err != nil {
+		return "", 0, err
+	}
+	dataStart := offset + int64(used)
+
+	var objectType string
+	switch entryType {
+	case packCommit, packTree, packBlob, packTag:
+		return packTypeNames[entryType], int(size), nil
+	case packOfsDelta:
+		baseOffset, used, err := p.deltaOffset(dataStart)
+		if err != nil {
+			return "", 0, err
+		}
+		if baseOffset <= 0 || baseOffset >= offset {
+			return "", 0, fmt.Errorf("%s: invalid delta base at offset %d", p.path, offset)
+		}
+		objectType, _, err = p.headerAt(offset-baseOffset, depth+1)
+		if err != nil {
+			return "", 0, err
+		}
+		dataStart += int64(used)
+	case packRefDelta:
+		var raw [20]byte
+		_, err := p.file.ReadAt(raw[:], dataStart)
+		if err != nil {
+			return "", 0, err
+		}
+		objectType, _, err = ReadObjectHeader(hex.EncodeToString(raw[:]))
+		if err != nil {
+			return "", 0, err
+		}
+		dataStart += 20
+	default:
+		return "", 0, fmt.Errorf("%s: unknown entry type %d at offset %d", p.path, entryType, offset)
+	}
+
+	// The delta starts with the sizes of the base and of the object, each
+	// a varint of at most 10 bytes
+	length := size
+	if length > 20 {
+		length = 20
+	}
+	start, err := p.inflate(dataStart, length)
+	if err != nil {
+		return "", 0, err
+	}
+	_, rest := deltaSize(start)
+	targetSize, _ := deltaSize(rest)
+	return objectType, targetSize, nil
+}
+
+// deltaOffset reads how far before a delta its base is stored
+func (p *packfile) deltaOffset(offset int64) (int64, int, error) {
+	var buffer [10]byte
+	n, err := p.file.ReadAt(buffer[:], offset)
+	if n == 0 && err != nil {
+		return 0, 0, err
+	}
+
+	c := buffer[0]
+	value := int64(c & 0x7f)
+	used := 1
+	for c&0x80 != 0 {
+		if used >= n {
+			return 0, 0, fmt.Errorf("%s: corrupt delta offset at %d", p.path, offset)
+		}
+		c = buffer[used]
+		value = ((value + 1) << 7) | int64(c&0x7f)
+		used++
+	}
+	return value, used, nil
+}
+
+// applyDelta builds an object from its base and a delta, which is made
+// of instructions to copy ranges of the base and to insert new data
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	sourceSize, delta := deltaSize(delta)
+	if sourceSize != len(base) {
+		return nil, errors.New("base size does not match")
+	}
+	targetSize, delta := deltaSize(delta)
+
+	result := make([]byte, 0, targetSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 == 0 {
+			if op == 0 || int(op) > len(delta) {
+				return nil, errors.New("invalid insert instruction")
+			}
+			result = append(result, delta[:op]...)
+			delta = delta[op:]
+			continue
+		}
+
+		var offset, size int
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, errors.New("truncated copy instruction")
+			}
+			if i < 4 {
+				offset |= int(delta[0]) << (8 * i)
+			} else {
+				size |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+		if offset+size > len(base) {
+			return nil, errors.New("copy instruction is out of range")
+		}
+		result = append(result, base[offset:offset+size]...)
+	}
+
+	if len(result) != targetSize {
+		return nil, errors.New("result size does not match")
+	}
+	return result, nil
+}
+
+func deltaSize(delta []byte) (int, []byte) {
+	size := 0
+	shift := uint(0)
+	for i, c := range delta {
+		size |= int(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			return size, delta[i+1:]
+		}
+	}
+	return size, nil
+}
+
+// readPacked reads an object from whichever pack holds it
+func readPacked(hash string) (Object, bool, error) {
+	list, err := loadedPacks()
+	if err != nil {
+		return Object{}, false, err
+	}
+	for _, pack := range list {
+		if i, ok := pack.find(hash); ok {
+			obj, err := pack.readAt(pack.offsets[i], 0)
+			return obj, true, err
+		}
+	}
+	return Object{}, false, nil
+}
+
+// readPackedHeader reads the type and size of an object from whichever
+// pack holds it
+func readPackedHeader(hash string) (string, int, bool, error) {
+	list, err := loadedPacks()
+	if err != nil {
+		return "", 0, false, err
+	}
+	for _, pack := range list {
+		if i, ok := pack.find(hash); ok {
+			objectType, size, err := pack.headerAt(pack.offsets[i], 0)
+			return objectType, size, true, err
+		}
+	}
+	return "", 0, false, nil
+}
+
+// packedObjectStorage returns the size an object takes in its pack and
+// the hash of the object its delta is based on, if any
+func packedObjectStorage(hash string) (int64, string, bool, error) {
+	list, err := loadedPacks()
+	if err != nil {
+		return 0, "", false, err
+	}
+	for _, pack := range list {
+		i, ok := pack.find(hash)
+		if !ok {
+			continue
+		}
+
+		offset := pack.offsets[i]
+		next := pack.size - 20
+		for _, other := range pack.offsets {
+			if other > offset && other < next {
+				next = other
+			}
+		}
+
+		entryType, _, used, err := pack.entryHeader(offset)
+		if err != nil {
+			return 0, "", true, err
+		}
+		base := ""
+		switch entryType {
+		case packOfsDelta:
+			distance, _, err := pack.deltaOffset(offset + int64(used))
+			if err != nil {
+				return 0, "", true, err
+			}
+			for j, other := range pack.offsets {
+				if other == offset-distance {
+					base = pack.hashAt(j)
+				}
+			}
+		case packRefDelta:
+			var raw [20]byte
+			_, err := pack.file.ReadAt(raw[:], offset+int64(used))
+			if err != nil {
+				return 0, "", true, err
+			}
+			base = hex.EncodeToString(raw[:])
+		}
+		return next - offset, base, true, nil
+	}
+	return 0, "", false, nil
+}
+
+// IsPacked returns true if the object is stored in a pack
+func IsPacked(hash string) bool {
+	list, err := loadedPacks()
+	if err != nil {
+		return false
+	}
+	for _, pack := range list {
+		if _, ok := pack.find(hash); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// freshenPacked sets the modification time of a pack holding the object
+// to now, returning false if no pack holds it or none can be changed
+func freshenPacked(hash string) bool {
+	list, err := loadedPacks()
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	for _, pack := range list {
+		if _, ok := pack.find(hash); ok && os.Chtimes(pack.path, now, now) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Packs will return the name, number of objects and size of each pack
+// in the repository
+func Packs() ([]PackInfo, error) {
+	list, err := loadedPacks()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []PackInfo
+	for _, pack := range list {
+		info := PackInfo{
+			Name:    filepath.Base(pack.path),
+			Objects: pack.count(),
+			Size:    pack.size,
+			ModTime: pack.modTime,
+		}
+		if idx, err := os.Stat(strings.TrimSuffix(pack.path, ".pack") + ".idx"); err == nil {
+			info.Size += idx.Size()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// PackContents will return the hashes of the objects in the named pack
+func PackContents(name string) ([]string, error) {
+	list, err := loadedPacks()
+	if err != nil {
+		return nil, err
+	}
+	for _, pack := range list {
+		if filepath.Base(pack.path) != name {
+			continue
+		}
+		hashes := make([]string, pack.count())
+		for i := range hashes {
+			hashes[i] = pack.hashAt(i)
+		}
+		return hashes, nil
+	}
+	return nil, fmt.Errorf("pack %s not found", name)
+}
+
+// packedObjects returns the hashes of the objects in every pack
+func packedObjects() ([]string, error) {
+	list, err := loadedPacks()
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	for _, pack := range list {
+		for i := 0; i < pack.count(); i++ {
+			hashes = append(hashes, pack.hashAt(i))
+		}
+	}
+	return hashes, nil
+}
+
+// WritePack will write the objects into a new pack along with its
+// index, returning the name of the pack. Objects are stored whole
+// rather than as deltas.
+func WritePack(hashes []string) (string, error) {
+	return WritePackTo(gitdir.Get(), hashes)
+}
+
+// WritePackTo will write the objects of the current repository into a
+// new pack of the repository in the directory, such as when copying
+// part of a repository into another
+func WritePackTo(repository string, hashes []string) (string, error) {
+	return writePackFile(repository, hashes, ReadObject)
+}
+
+// writePackFile writes the objects returned by the read function into
+// a new pack of the repository in the directory
+func writePackFile(repository string, hashes []string, read func(string) (Object, error)) (string, error) {
+	sorted := append([]string(nil), hashes...)
+	sort.Strings(sorted)
+
+	dir := filepath.Join(repository, packDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	temp, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	checksum := sha1.New()
+	out := bufio.NewWriter(io.MultiWriter(temp, checksum))
+	header := make([]byte, 12)
+	copy(header, packSignature)
+	binary.BigEndian.PutUint32(header[4:], packVersion)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(sorted)))
+	out.Write(header)
+
+	offsets := make([]int64, len(sorted))
+	crcs := make([]uint32, len(sorted))
+	offset := int64(len(header))
+	for i, hash := range sorted {
+		obj, err := read(hash)
+		if err != nil {
+			return "", err
+		}
+		entry, err := packEntry(hash, obj)
+		if err != nil {
+			return "", err
+		}
+		offsets[i] = offset
+		crcs[i] = crc32.ChecksumIEEE(entry)
+		offset += int64(len(entry))
+		out.Write(entry)
+	}
+	err = out.Flush()
+	if err != nil {
+		return "", err
+	}
+
+	packHash := checksum.Sum(nil)
+	_, err = temp.Write(packHash)
+	if err == nil {
+		err = temp.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	name := "pack-" + hex.EncodeToString(packHash)
+	index := packIndex(sorted, offsets, crcs, packHash)
+	err = writeFileAtomically(filepath.Join(dir, name+".idx"), index, 0444)
+	if err != nil {
+		return "", err
+	}
+
+	// The index is in place first, so the pack is usable as soon as
+	// it appears
+	err = os.Chmod(temp.Name(), 0444)
+	if err == nil {
+		err = os.Rename(temp.Name(), filepath.Join(dir, name+".pack"))
+	}
+	if err != nil {
+		os.Remove(filepath.Join(dir, name+".idx"))
+		return "", err
+	}
+
+	closePacks()
+	return name + ".pack", nil
+}
+
+// packEntry returns the header and compressed content of the object as
+// it is stored in a pack
+func packEntry(hash string, obj Object) ([]byte, error) {
+	entryType := 0
+	for number, name := range packTypeNames {
+		if name == obj.Type() {
+			entryType = number
+		}
+	}
+	if entryType == 0 {
+		return nil, fmt.Errorf("object %s has type %s, which cannot be packed", hash, obj.Type())
+	}
+	return encodeEntry(entryType, nil, obj.Data), nil
+}
+
+// encodeEntry returns an entry of a pack with its header, followed by
+// the extra data such as the base of a delta, and the compressed data
+func encodeEntry(entryType int, extra []byte, data []byte) []byte {
+	var entry bytes.Buffer
+	size := len(data)
+	c := byte(entryType<<4) | byte(size&0x0f)
+	size >>= 4
+	for size > 0 {
+		entry.WriteByte(c | 0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	entry.WriteByte(c)
+	entry.Write(extra)
+
+	w := zlib.NewWriter(&entry)
+	w.Write(data)
+	w.Close()
+	return entry.Bytes()
+}
+
+// packIndex returns a version 2 index of the sorted objects of a pack
+func packIndex(hashes []string, offsets []int64, crcs []uint32, packHash []byte) []byte {
+	var index bytes.Buffer
+	index.WriteString(idxSignature)
+	binary.Write(&index, binary.BigEndian, uint32(idxVersion))
+
+	var fanout [256]uint32
+	for _, hash := range hashes {
+		first, _ := hex.DecodeString(hash[:2])
+		for i := int(first[0]); i < 256; i++ {
+			fanout[i]++
+		}
+	}
+	binary.Write(&index, binary.BigEndian, fanout)
+
+	for _, hash := range hashes {
+		raw, _ := hex.DecodeString(hash)
+		index.Write(raw)
+	}
+	binary.Write(&index, binary.BigEndian, crcs)
+
+	var large []uint64
+	for _, offset := range offsets {
+		if offset < 0x80000000 {
+			binary.Write(&index, binary.BigEndian, uint32(offset))
+			continue
+		}
+		binary.Write(&index, binary.BigEndian, uint32(0x80000000|len(large)))
+		large = append(large, uint64(offset))
+	}
+	binary.Write(&index, binary.BigEndian, large)
+
+	index.Write(packHash)
+	checksum := sha1.Sum(index.Bytes())
+	index.Write(checksum[:])
+	return index.Bytes()
+}
+
+func writeFileAtomically(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "tmp_file_")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// WritePackList will list the packs of the repository in
+// objects/info/packs, which clients of the dumb protocols read since they
+// cannot list directories
+func WritePackList() error {
+	infos, err := Packs()
+	if err != nil {
+		return err
+	}
+
+	var list bytes.Buffer
+	for _, info := range infos {
+		fmt.Fprintf(&list, "P %s\n", info.Name)
+	}
+	list.WriteString("\n")
+
+	err = os.MkdirAll(gitdir.Path(packListDir), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(gitdir.Path(packListDir, "packs"), list.Bytes(), 0644)
+}
+
+// RemovePack will delete a pack and its index
+func RemovePack(name string) error {
+	closePacks()
+	base := gitdir.Path(packDir, strings.TrimSuffix(name, ".pack"))
+	err := os.Remove(base + ".idx")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(base + ".pack")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,609 @@
+package objects
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+// PackEntry is an object to send in a pack. An object with a delta base
+// is sent as a delta against it when that is smaller. The base does not
+// have to be in the pack if the receiver already has it, which makes
+// the pack thin.
+type PackEntry struct {
+	Hash      string
+	DeltaBase string
+}
+
+// WritePackStream will write a pack of the objects to the writer, such
+// as when sending them to another repository, returning how many were
+// sent as deltas
+func WritePackStream(w io.Writer, entries []PackEntry) (int, error) {
+	checksum := sha1.New()
+	out := bufio.NewWriter(io.MultiWriter(w, checksum))
+	header := make([]byte, 12)
+	copy(header, packSignature)
+	binary.BigEndian.PutUint32(header[4:], packVersion)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(entries)))
+	out.Write(header)
+
+	deltas := 0
+	for _, e := range entries {
+		obj, err := ReadObject(e.Hash)
+		if err != nil {
+			return 0, err
+		}
+		entry, err := packEntry(e.Hash, obj)
+		if err != nil {
+			return 0, err
+		}
+		if delta, ok := deltaEntry(obj, e.DeltaBase); ok && len(delta) < len(entry) {
+			entry = delta
+			deltas++
+		}
+		_, err = out.Write(entry)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := out.Flush()
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(checksum.Sum(nil))
+	return deltas, err
+}
+
+// deltaEntry returns the entry storing the object as a delta against
+// the base, identified by its hash
+func deltaEntry(obj Object, baseHash string) ([]byte, bool) {
+	if baseHash == "" {
+		return nil, false
+	}
+	base, err := ReadObject(baseHash)
+	if err != nil || base.Type() != obj.Type() || len(base.Data) == 0 {
+		return nil, false
+	}
+	raw, err := hex.DecodeString(baseHash)
+	if err != nil {
+		return nil, false
+	}
+	return encodeEntry(packRefDelta, raw, createDelta(base.Data, obj.Data)), true
+}
+
+// ReceivedPack is a pack received from another repository, which is
+// kept in a temporary file of the repository until its objects are
+// stored
+type ReceivedPack struct {
+	file *os.File
+}
+
+// NewReceivedPack returns an empty pack to write a received pack into
+func NewReceivedPack() (*ReceivedPack, error) {
+	dir := gitdir.Path(packDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return nil, err
+	}
+	return &ReceivedPack{file: file}, nil
+}
+
+func (p *ReceivedPack) Write(data []byte) (int, error) {
+	return p.file.Write(data)
+}
+
+// Close will remove the temporary file of the pack
+func (p *ReceivedPack) Close() error {
+	err := p.file.Close()
+	os.Remove(p.file.Name())
+	return err
+}
+
+// ReadPack will read a single pack from the stream into a temporary
+// file, stopping at its end so that whatever follows it can still be
+// read
+func ReadPack(r io.Reader) (*ReceivedPack, error) {
+	pack, err := NewReceivedPack()
+	if err != nil {
+		return nil, err
+	}
+	err = copyPack(pack, r)
+	if err != nil {
+		pack.Close()
+		return nil, err
+	}
+	return pack, nil
+}
+
+// copyPack copies the entries of one pack from the stream, inflating
+// each to find where it ends
+func copyPack(w io.Writer, r io.Reader) error {
+	byteReader, ok := r.(io.ByteReader)
+	if !ok {
+		br := bufio.NewReader(r)
+		r, byteReader = br, br
+	}
+	out := bufio.NewWriter(w)
+	in := &recordingReader{r: r, byteReader: byteReader, w: out}
+
+	header := make([]byte, 12)
+	_, err := io.ReadFull(in, header)
+	if err != nil {
+		return errors.New("the remote end hung up unexpectedly")
+	}
+	if string(header[:4]) != packSignature {
+		return errors.New("received data is not a pack")
+	}
+	count := binary.BigEndian.Uint32(header[8:12])
+
+	for i := uint32(0); i < count; i++ {
+		c, err := in.ReadByte()
+		entryType := int(c>>4) & 7
+		for err == nil && c&0x80 != 0 {
+			c, err = in.ReadByte()
+		}
+		if err == nil && entryType == packOfsDelta {
+			c, err = in.ReadByte()
+			for err == nil && c&0x80 != 0 {
+				c, err = in.ReadByte()
+			}
+		} else if err == nil && entryType == packRefDelta {
+			_, err = io.ReadFull(in, make([]byte, 20))
+		}
+		if err != nil {
+			return errors.New("pack is truncated")
+		}
+
+		// zlib reads a byte at a time from a ByteReader, so it stops at
+		// the end of the entry
+		z, err := zlib.NewReader(in)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, z)
+		}
+		if err != nil {
+			return fmt.Errorf("pack has a corrupt entry: %v", err)
+		}
+		z.Close()
+		if in.err != nil {
+			return in.err
+		}
+	}
+
+	_, err = io.ReadFull(in, make([]byte, sha1.Size))
+	if err != nil {
+		return errors.New("pack is truncated")
+	}
+	if in.err != nil {
+		return in.err
+	}
+	return out.Flush()
+}
+
+// recordingReader writes a copy of everything read through it
+type recordingReader struct {
+	r          io.Reader
+	byteReader io.ByteReader
+	w          *bufio.Writer
+	err        error
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if _, writeErr := rr.w.Write(p[:n]); writeErr != nil && rr.err == nil {
+		rr.err = writeErr
+	}
+	return n, err
+}
+
+func (rr *recordingReader) ReadByte() (byte, error) {
+	c, err := rr.byteReader.ReadByte()
+	if err == nil {
+		if writeErr := rr.w.WriteByte(c); writeErr != nil && rr.err == nil {
+			rr.err = writeErr
+		}
+	}
+	return c, err
+}
+
+// Each entry of a pack takes at least a byte of header and a zlib
+// stream of eight bytes
+const minPackEntrySize = 9
+
+// The resolved bases of deltas are kept up to this many bytes
+const deltaBaseCacheSize = 32 << 20
+
+// streamEntry is an entry of a received pack. Only where its data is
+// found is kept, so that its object is read from the pack when needed.
+type streamEntry struct {
+	offset     int64
+	dataOffset int64
+	entryType  int
+	size       int64
+	baseOffset int64
+	baseHash   string
+	objectType string
+	hash       string
+
+	// The entry the delta is based on, once it is resolved, or nil when
+	// the base is an object of this repository
+	base *streamEntry
+}
+
+// parsedPack is a received pack along with its entries
+type parsedPack struct {
+	file    *os.File
+	entries []*streamEntry
+	byHash  map[string]*streamEntry
+
+	// The objects of this repository that thin deltas are based on
+	external map[string]Object
+
+	cache     map[int64]Object
+	cacheSize int
+}
+
+// Store will store the objects of the pack, returning their hashes.
+// The bases of deltas may be objects of this repository that are not
+// in the pack. Packs with fewer objects than the unpack limit are
+// stored as loose objects, and larger ones as a pack.
+func (p *ReceivedPack) Store(unpackLimit int) ([]string, error) {
+	pack, err := parsePackStream(p.file)
+	if err != nil {
+		return nil, err
+	}
+	err = pack.resolveEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	for _, e := range pack.entries {
+		if pack.byHash[e.hash] == e {
+			hashes = append(hashes, e.hash)
+		}
+	}
+
+	// Trees naming paths that could not be checked out safely are
+	// refused before anything is stored
+	for _, hash := range hashes {
+		if pack.byHash[hash].objectType != "tree" {
+			continue
+		}
+		obj, err := pack.object(pack.byHash[hash])
+		if err != nil {
+			return nil, err
+		}
+		err = checkTree(obj.Data)
+		if err != nil {
+			return nil, fmt.Errorf("tree %s is invalid: %v", hash, err)
+		}
+	}
+
+	if len(hashes) < unpackLimit {
+		for _, hash := range hashes {
+			obj, err := pack.object(pack.byHash[hash])
+			if err == nil {
+				_, err = HashObject(obj, true)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return hashes, nil
+	}
+
+	if len(hashes) > 0 {
+		_, err = writePackFile(gitdir.Get(), hashes, func(hash string) (Object, error) {
+			return pack.object(pack.byHash[hash])
+		})
+	}
+	return hashes, err
+}
+
+// checkTree returns an error if the tree is corrupt or has an entry
+// whose name is not valid
+func checkTree(data []byte) error {
+	entries, err := ParseTree(data)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = CheckEntryName(entry.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.offset += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	c, err := cr.r.ReadByte()
+	if err == nil {
+		cr.offset++
+	}
+	return c, err
+}
+
+// parsePackStream reads the entries of a pack without resolving deltas,
+// hashing the objects that are not deltas as they are read
+func parsePackStream(file *os.File) (*parsedPack, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	header := make([]byte, 12)
+	if size < 12+sha1.Size {
+		return nil, errors.New("received data is not a pack")
+	}
+	_, err = file.ReadAt(header, 0)
+	if err != nil || string(header[:4]) != packSignature {
+		return nil, errors.New("received data is not a pack")
+	}
+	version := binary.BigEndian.Uint32(header[4:8])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("pack version %d is not supported", version)
+	}
+	bodySize := size - sha1.Size
+	count := int64(binary.BigEndian.Uint32(header[8:12]))
+	if count > (bodySize-12)/minPackEntrySize {
+		return nil, fmt.Errorf("pack claims %d objects, more than it can hold", count)
+	}
+
+	checksum := sha1.New()
+	_, err = io.Copy(checksum, io.NewSectionReader(file, 0, bodySize))
+	if err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, sha1.Size)
+	_, err = file.ReadAt(trailer, bodySize)
+	if err != nil || !bytes.Equal(checksum.Sum(nil), trailer) {
+		return nil, errors.New("pack is corrupt: checksum mismatch")
+	}
+
+	pack := &parsedPack{
+		file:     file,
+		byHash:   make(map[string]*streamEntry),
+		external: make(map[string]Object),
+		cache:    make(map[int64]Object),
+	}
+	r := &countingReader{r: bufio.NewReader(io.NewSectionReader(file, 12, bodySize-12)), offset: 12}
+	for i := int64(0); i < count; i++ {
+		e := &streamEntry{offset: r.offset}
+
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("pack is truncated")
+		}
+		e.entryType = int(c>>4) & 7
+		e.size = int64(c & 0x0f)
+		for shift := uint(4); c&0x80 != 0; shift += 7 {
+			c, err = r.ReadByte()
+			if err != nil || shift > 56 {
+				return nil, fmt.Errorf("pack has a corrupt entry at offset %d", e.offset)
+			}
+			e.size |= int64(c&0x7f) << shift
+		}
+
+		switch e.entryType {
+		case packCommit, packTree, packBlob, packTag:
+			e.objectType = packTypeNames[e.entryType]
+		case packOfsDelta:
+			c, err = r.ReadByte()
+			value := int64(c & 0x7f)
+			for err == nil && c&0x80 != 0 && value <= e.offset {
+				c, err = r.ReadByte()
+				value = ((value + 1) << 7) | int64(c&0x7f)
+			}
+			if err != nil || c&0x80 != 0 || value <= 0 || value > e.offset {
+				return nil, fmt.Errorf("pack has an invalid delta base at offset %d", e.offset)
+			}
+			e.baseOffset = e.offset - value
+		case packRefDelta:
+			var raw [20]byte
+			_, err = io.ReadFull(r, raw[:])
+			if err != nil {
+				return nil, errors.New("pack is truncated")
+			}
+			e.baseHash = hex.EncodeToString(raw[:])
+		default:
+			return nil, fmt.Errorf("pack has an unknown entry type %d at offset %d", e.entryType, e.offset)
+		}
+		e.dataOffset = r.offset
+
+		// The reader reads the compressed data a byte at a time, so it
+		// stops at the end of the entry. An object is hashed as it is
+		// inflated, without being kept.
+		var data io.Writer = ioutil.Discard
+		hash := sha1.New()
+		if e.objectType != "" {
+			fmt.Fprintf(hash, "%s %d\000", e.objectType, e.size)
+			data = hash
+		}
+		z, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("pack has a corrupt entry at offset %d: %v", e.offset, err)
+		}
+		inflated, err := io.Copy(data, io.LimitReader(z, e.size+1))
+		if err == nil && inflated == e.size {
+			_, err = io.Copy(ioutil.Discard, z)
+		}
+		if err == nil {
+			err = z.Close()
+		}
+		if err != nil || inflated != e.size {
+			return nil, fmt.Errorf("pack has a corrupt entry at offset %d", e.offset)
+		}
+		if e.objectType != "" {
+			e.hash = hex.EncodeToString(hash.Sum(nil))
+			if _, ok := pack.byHash[e.hash]; !ok {
+				pack.byHash[e.hash] = e
+			}
+		}
+		pack.entries = append(pack.entries, e)
+	}
+	if r.offset != bodySize {
+		return nil, errors.New("pack has junk at the end")
+	}
+	return pack, nil
+}
+
+// resolveEntries finds the type and hash of each delta once its base is
+// known. A base given by its hash may be an object that is not in the
+// pack.
+func (p *parsedPack) resolveEntries() error {
+	byOffset := make(map[int64]*streamEntry)
+	var pending []*streamEntry
+	for _, e := range p.entries {
+		byOffset[e.offset] = e
+		if e.hash == "" {
+			pending = append(pending, e)
+		}
+	}
+
+	// Deltas may be based on other deltas, so they are resolved in
+	// rounds until every base is known
+	for len(pending) > 0 {
+		var unresolved []*streamEntry
+		for _, e := range pending {
+			base, ok := p.findBase(e, byOffset)
+			if !ok {
+				unresolved = append(unresolved, e)
+				continue
+			}
+			e.base = base
+			obj, err := p.object(e)
+			if err != nil {
+				return err
+			}
+			e.objectType = obj.ObjectType
+			e.hash, _ = HashObject(obj, false)
+			if _, ok := p.byHash[e.hash]; !ok {
+				p.byHash[e.hash] = e
+			}
+		}
+
+		if len(unresolved) == len(pending) {
+			// The remaining bases must be objects this repository has
+			// already, as in a thin pack
+			progress := false
+			for _, e := range unresolved {
+				if _, ok := p.findBase(e, byOffset); ok || e.entryType != packRefDelta {
+					continue
+				}
+				base, err := ReadObject(e.baseHash)
+				if err != nil {
+					continue
+				}
+				p.external[e.baseHash] = base
+				progress = true
+			}
+			if !progress {
+				return fmt.Errorf("pack has %d unresolved deltas", len(unresolved))
+			}
+		}
+		pending = unresolved
+	}
+	return nil
+}
+
+// findBase returns the entry a delta is based on once that is resolved,
+// or nil when the base is an object of this repository
+func (p *parsedPack) findBase(e *streamEntry, byOffset map[int64]*streamEntry) (*streamEntry, bool) {
+	if e.entryType == packOfsDelta {
+		base := byOffset[e.baseOffset]
+		return base, base != nil && base.hash != ""
+	}
+	if base, ok := p.byHash[e.baseHash]; ok {
+		return base, true
+	}
+	_, ok := p.external[e.baseHash]
+	return nil, ok
+}
+
+// object reads the object of an entry from the pack, applying its
+// delta. The bases of deltas are cached, as they are often shared.
+func (p *parsedPack) object(e *streamEntry) (Object, error) {
+	if obj, ok := p.cache[e.offset]; ok {
+		return obj, nil
+	}
+	data, err := p.inflate(e)
+	if err != nil {
+		return Object{}, err
+	}
+	if e.entryType != packOfsDelta && e.entryType != packRefDelta {
+		return Object{ObjectType: e.objectType, Data: data}, nil
+	}
+
+	base, ok := p.external[e.baseHash]
+	if e.base != nil {
+		base, err = p.object(e.base)
+		if err != nil {
+			return Object{}, err
+		}
+		p.cacheBase(e.base.offset, base)
+	} else if !ok {
+		return Object{}, fmt.Errorf("pack has an unresolved delta at offset %d", e.offset)
+	}
+
+	result, err := applyDelta(base.Data, data)
+	if err != nil {
+		return Object{}, fmt.Errorf("pack has an invalid delta at offset %d: %v", e.offset, err)
+	}
+	return Object{ObjectType: base.ObjectType, Data: result}, nil
+}
+
+// cacheBase keeps the base of a delta, dropping every base once the
+// cache is full
+func (p *parsedPack) cacheBase(offset int64, base Object) {
+	if _, ok := p.cache[offset]; ok {
+		return
+	}
+	if p.cacheSize+len(base.Data) > deltaBaseCacheSize {
+		p.cache, p.cacheSize = make(map[int64]Object), 0
+	}
+	p.cache[offset] = base
+	p.cacheSize += len(base.Data)
+}
+
+// inflate reads the compressed data of an entry
+func (p *parsedPack) inflate(e *streamEntry) ([]byte, error) {
+	z, err := zlib.NewReader(bufio.NewReader(io.NewSectionReader(p.file, e.dataOffset, math.MaxInt64-e.dataOffset)))
+	if err != nil {
+		return nil, fmt.Errorf("pack has a corrupt entry at offset %d: %v", e.offset, err)
+	}
+	defer z.Close()
+	data := make([]byte, e.size)
+	_, err = io.ReadFull(z, data)
+	if err != nil {
+		return nil, fmt.Errorf("pack has a corrupt entry at offset %d: %v", e.offset, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,223 @@
+package objects
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+// useTestRepository will make an empty bare repository in a temporary
+// directory the one that is used
+func useTestRepository(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"objects", "refs/heads"} {
+		os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644)
+
+	previous := gitdir.Get()
+	gitdir.Set(dir)
+	t.Cleanup(func() {
+		gitdir.Set(previous)
+		ReloadPacks()
+	})
+}
+
+func writeTestObject(t *testing.T, objectType string, data []byte) string {
+	hash, err := HashObject(Object{Data: data, ObjectType: objectType}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// testObjects writes a tree holding a blob and a second version of it,
+// which is sent as a delta against the first
+func testObjects(t *testing.T) (map[string]Object, []PackEntry) {
+	original := []byte(strings.Repeat("line of the original file\n", 200))
+	changed := append(append([]byte{}, original...), "one more line\n"...)
+	originalHash := writeTestObject(t, "blob", original)
+	changedHash := writeTestObject(t, "blob", changed)
+	written := map[string]Object{
+		originalHash: {Data: original, ObjectType: "blob"},
+		changedHash:  {Data: changed, ObjectType: "blob"},
+	}
+
+	treeData, err := TreeData([]TreeEntry{{Mode: "100644", Name: "a.txt", Hash: originalHash}, {Mode: "100644", Name: "b.txt", Hash: changedHash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written[writeTestObject(t, "tree", treeData)] = Object{Data: treeData, ObjectType: "tree"}
+
+	var entries []PackEntry
+	for hash := range written {
+		entry := PackEntry{Hash: hash}
+		if hash == changedHash {
+			entry.DeltaBase = originalHash
+		}
+		entries = append(entries, entry)
+	}
+	return written, entries
+}
+
+func checkStored(t *testing.T, hashes []string, expected map[string]Object) {
+	if len(hashes) != len(expected) {
+		t.Fatalf("stored %d objects, expected %d", len(hashes), len(expected))
+	}
+	for _, hash := range hashes {
+		obj, err := ReadObject(hash)
+		if err != nil {
+			t.Fatalf("could not read stored object %s: %v", hash, err)
+		}
+		if obj.Type() != expected[hash].Type() || !bytes.Equal(obj.Data, expected[hash].Data) {
+			t.Errorf("object %s was not stored intact", hash)
+		}
+	}
+}
+
+func TestPackStreamRoundTrip(t *testing.T) {
+	for _, limit := range []int{100, 1} {
+		useTestRepository(t)
+		written, entries := testObjects(t)
+
+		var stream bytes.Buffer
+		deltas, err := WritePackStream(&stream, entries)
+		if err != nil {
+			t.Fatalf("WritePackStream failed: %v", err)
+		}
+		if deltas != 1 {
+			t.Errorf("sent %d deltas, expected 1", deltas)
+		}
+		stream.WriteString("what follows the pack")
+
+		useTestRepository(t)
+		pack, err := ReadPack(&stream)
+		if err != nil {
+			t.Fatalf("ReadPack failed: %v", err)
+		}
+		hashes, err := pack.Store(limit)
+		pack.Close()
+		if err != nil {
+			t.Fatalf("Store failed: %v", err)
+		}
+		if stream.String() != "what follows the pack" {
+			t.Errorf("ReadPack read past the end of the pack")
+		}
+
+		checkStored(t, hashes, written)
+		packed := len(hashes) >= limit
+		for hash := range written {
+			if IsPacked(hash) != packed {
+				t.Errorf("with an unpack limit of %d, object %s packed is %v", limit, hash, IsPacked(hash))
+			}
+		}
+	}
+}
+
+func TestThinPackUsesExistingBase(t *testing.T) {
+	useTestRepository(t)
+	written, entries := testObjects(t)
+	var thin []PackEntry
+	var base string
+	for _, entry := range entries {
+		if entry.DeltaBase != "" {
+			thin = append(thin, entry)
+			base = entry.DeltaBase
+		}
+	}
+	var stream bytes.Buffer
+	_, err := WritePackStream(&stream, thin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useTestRepository(t)
+	writeTestObject(t, "blob", written[base].Data)
+	pack, err := ReadPack(&stream)
+	if err != nil {
+		t.Fatalf("ReadPack failed: %v", err)
+	}
+	defer pack.Close()
+	hashes, err := pack.Store(100)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	checkStored(t, hashes, map[string]Object{thin[0].Hash: written[thin[0].Hash]})
+}
+
+func TestThinPackWithoutBaseFails(t *testing.T) {
+	useTestRepository(t)
+	_, entries := testObjects(t)
+	var thin []PackEntry
+	for _, entry := range entries {
+		if entry.DeltaBase != "" {
+			thin = append(thin, entry)
+		}
+	}
+	var stream bytes.Buffer
+	_, err := WritePackStream(&stream, thin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useTestRepository(t)
+	pack, err := ReadPack(&stream)
+	if err != nil {
+		t.Fatalf("ReadPack failed: %v", err)
+	}
+	defer pack.Close()
+	if _, err := pack.Store(100); err == nil {
+		t.Error("expected an error storing a delta whose base is missing")
+	}
+}
+
+func TestReadPackRejectsImpossibleCount(t *testing.T) {
+	useTestRepository(t)
+	header := make([]byte, 12)
+	copy(header, packSignature)
+	binary.BigEndian.PutUint32(header[4:], packVersion)
+	binary.BigEndian.PutUint32(header[8:], 0xffffffff)
+
+	pack, err := ReadPack(bytes.NewReader(append(header, make([]byte, 64)...)))
+	if err == nil {
+		pack.Close()
+		t.Error("expected an error reading a pack claiming more objects than it holds")
+	}
+}
+
+func TestStoreRefusesInvalidTreeNames(t *testing.T) {
+	for _, name := range []string{"..", ".git", ".GIT.", "git~1"} {
+		useTestRepository(t)
+		blob := writeTestObject(t, "blob", []byte("content\n"))
+		treeData, err := TreeData([]TreeEntry{{Mode: "100644", Name: name, Hash: blob}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := writeTestObject(t, "tree", treeData)
+		var stream bytes.Buffer
+		_, err = WritePackStream(&stream, []PackEntry{{Hash: blob}, {Hash: tree}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		useTestRepository(t)
+		pack, err := ReadPack(&stream)
+		if err != nil {
+			t.Fatalf("ReadPack failed: %v", err)
+		}
+		_, err = pack.Store(100)
+		pack.Close()
+		if err == nil {
+			t.Errorf("expected a tree with an entry named %q to be refused", name)
+		}
+		if Exists(blob) {
+			t.Errorf("objects were stored from a pack with an entry named %q", name)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package objects
+
+import (
+	"fmt"
+)
+
+// Reachable will return every object that can be reached from the
+// roots by following the trees and parents of commits, the entries of
+// trees and the objects of tags. The gitlinks of submodules are not
+// followed, since their commits live in another repository, and neither
+// are the parents of the commits at the edge of a shallow repository.
+// An error is returned if a reachable object is missing or corrupt.
+func Reachable(roots []string) (map[string]bool, error) {
+	return walkReachable(roots, false)
+}
+
+// ReachableExisting will return the objects that can be reached from the
+// roots like Reachable, but the objects that are missing or corrupt are
+// skipped, along with what only they lead to.
+func ReachableExisting(roots []string) (map[string]bool, error) {
+	return walkReachable(roots, true)
+}
+
+func walkReachable(roots []string, skipBroken bool) (map[string]bool, error) {
+	shallow, err := ReadShallow()
+	if err != nil {
+		return nil, err
+	}
+
+	reachable := make(map[string]bool)
+	pending := append([]string(nil), roots...)
+
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[hash] {
+			continue
+		}
+
+		obj, err := ReadObject(hash)
+		if err != nil {
+			if skipBroken {
+				continue
+			}
+			return nil, fmt.Errorf("unable to read reachable object %s: %v", hash, err)
+		}
+		reachable[hash] = true
+
+		links, err := objectLinks(hash, obj, shallow)
+		if err != nil && !skipBroken {
+			return nil, err
+		}
+		pending = append(pending, links...)
+	}
+	return reachable, nil
+}
+
+// objectLinks returns the objects Reachable follows from the object
+func objectLinks(hash string, obj Object, shallow map[string]bool) ([]string, error) {
+	switch obj.Type() {
+	case "commit":
+		commit, err := ParseCommit(obj.Data)
+		if err != nil {
+			return nil, fmt.Errorf("commit %s is corrupt: %v", hash, err)
+		}
+		if shallow[hash] {
+			return []string{commit.Tree}, nil
+		}
+		return append([]string{commit.Tree}, commit.Parents...), nil
+	case "tree":
+		entries, err := ParseTree(obj.Data)
+		if err != nil {
+			return nil, fmt.Errorf("tree %s is corrupt: %v", hash, err)
+		}
+		var links []string
+		for _, entry := range entries {
+			if entry.Type() != "commit" {
+				links = append(links, entry.Hash)
+			}
+		}
+		return links, nil
+	case "tag":
+		tag, err := ParseTag(obj.Data)
+		if err != nil {
+			return nil, fmt.Errorf("tag %s is corrupt: %v", hash, err)
+		}
+		return []string{tag.Object}, nil
+	}
+	return nil, nil
+}
+
+// History will return the commits at most depth commits away from the
+// tips, counting each tip as the first, along with the commits at the
+// edge whose parents are left out. A repository holding only these
+// commits is shallow, with the edge commits listed in .git/shallow.
+func History(tips []string, depth int) (map[string]bool, []string, error) {
+	shallow, err := ReadShallow()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The walk is breadth first, so each commit is first reached by its
+	// shortest path from a tip
+	commits := make(map[string]bool)
+	var edge []string
+	level := tips
+	for distance := 1; len(level) > 0; distance++ {
+		var next []string
+		for _, hash := range level {
+			if commits[hash] {
+				continue
+			}
+			commit, err := ReadCommit(hash)
+			if err != nil {
+				return nil, nil, err
+			}
+			commits[hash] = true
+
+			if len(commit.Parents) == 0 {
+				continue
+			}
+			if shallow[hash] || distance == depth {
+				edge = append(edge, hash)
+				continue
+			}
+			next = append(next, commit.Parents...)
+		}
+		level = next
+	}
+
+	// A commit at the edge may also be reached through a shorter path
+	var kept []string
+	for _, hash := range edge {
+		complete := !shallow[hash]
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, parent := range commit.Parents {
+			complete = complete && commits[parent]
+		}
+		if !complete {
+			kept = append(kept, hash)
+		}
+	}
+	return commits, kept, nil
+}
+
+// ReachableExcept will return the objects reachable from the roots that
+// cannot be reached from the excluded objects, as "rev-list --objects
+// <roots> --not <excluded>" does. Only the commits of the excluded
+// history are read, along with the trees of the excluded commits the
+// roots lead to, so the objects of the history both share are not read.
+// The blobs found are checked to exist without being read. An error is
+// returned if an object reachable only from the roots is missing or
+// corrupt.
+func ReachableExcept(roots []string, excluded []string) (map[string]bool, error) {
+	shallow, err := ReadShallow()
+	if err != nil {
+		return nil, err
+	}
+
+	// What cannot be read is simply not excluded
+	uninteresting := make(map[string]bool)
+	excludedCommits := make(map[string]bool)
+	var excludedTrees []string
+	pending := append([]string(nil), excluded...)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if uninteresting[hash] {
+			continue
+		}
+		obj, err := ReadObject(hash)
+		if err != nil {
+			continue
+		}
+		uninteresting[hash] = true
+
+		switch obj.Type() {
+		case "commit":
+			excludedCommits[hash] = true
+			commit, err := ParseCommit(obj.Data)
+			if err == nil && !shallow[hash] {
+				pending = append(pending, commit.Parents...)
+			}
+		case "tag":
+			tag, err := ParseTag(obj.Data)
+			if err == nil {
+				pending = append(pending, tag.Object)
+			}
+		case "tree":
+			excludedTrees = append(excludedTrees, hash)
+		}
+	}
+
+	// The commits are walked first, stopping at the excluded history,
+	// whose trees at the boundary hold the files the roots share with it
+	reachable := make(map[string]bool)
+	boundary := make(map[string]bool)
+	var contents []TreeEntry
+	pending = append(pending, roots...)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[hash] || uninteresting[hash] {
+			if excludedCommits[hash] {
+				boundary[hash] = true
+			}
+			continue
+		}
+
+		obj, err := ReadObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read reachable object %s: %v", hash, err)
+		}
+		reachable[hash] = true
+
+		switch obj.Type() {
+		case "commit":
+			commit, err := ParseCommit(obj.Data)
+			if err != nil {
+				return nil, fmt.Errorf("commit %s is corrupt: %v", hash, err)
+			}
+			contents = append(contents, TreeEntry{Mode: "40000", Hash: commit.Tree})
+			if !shallow[hash] {
+				pending = append(pending, commit.Parents...)
+			}
+		case "tag":
+			tag, err := ParseTag(obj.Data)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s is corrupt: %v", hash, err)
+			}
+			pending = append(pending, tag.Object)
+		case "tree":
+			// Its entries are walked along with those of the commits
+			delete(reachable, hash)
+			contents = append(contents, TreeEntry{Mode: "40000", Hash: hash})
+		}
+	}
+
+	for hash := range boundary {
+		commit, err := ReadCommit(hash)
+		if err == nil {
+			excludedTrees = append(excludedTrees, commit.Tree)
+		}
+	}
+	for _, hash := range excludedTrees {
+		markTreeUninteresting(hash, uninteresting)
+	}
+
+	for len(contents) > 0 {
+		entry := contents[len(contents)-1]
+		contents = contents[:len(contents)-1]
+		if reachable[entry.Hash] || uninteresting[entry.Hash] {
+			continue
+		}
+
+		switch entry.Type() {
+		case "tree":
+			entries, err := ReadTree(entry.Hash)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read reachable object %s: %v", entry.Hash, err)
+			}
+			contents = append(contents, entries...)
+		case "blob":
+			if !Exists(entry.Hash) {
+				return nil, fmt.Errorf("unable to read reachable object %s: Object %s not found.", entry.Hash, entry.Hash)
+			}
+		default:
+			// The commits of submodules live in another repository
+			continue
+		}
+		reachable[entry.Hash] = true
+	}
+	return reachable, nil
+}
+
+// markTreeUninteresting adds the tree and everything in it to the set,
+// reading only the trees
+func markTreeUninteresting(hash string, uninteresting map[string]bool) {
+	pending := []string{hash}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		entries, err := ReadTree(hash)
+		if err != nil {
+			continue
+		}
+		uninteresting[hash] = true
+		for _, entry := range entries {
+			if uninteresting[entry.Hash] {
+				continue
+			}
+			if entry.IsTree() {
+				pending = append(pending, entry.Hash)
+			} else {
+				uninteresting[entry.Hash] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package objects
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+const shallowFile string = "shallow"
+
+// ReadShallow will return the commits of a shallow repository whose
+// parents are missing, as listed in .git/shallow. History walks stop at
+// these commits, as if they had no parents.
+func ReadShallow() (map[string]bool, error) {
+	data, err := ioutil.ReadFile(gitdir.Path(shallowFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	shallow := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			shallow[line] = true
+		}
+	}
+	return shallow, nil
+}
+
+// WriteShallow will record the commits whose parents are missing. The
+// file is removed when there are none, since the history is complete.
+func WriteShallow(hashes []string) error {
+	if len(hashes) == 0 {
+		err := os.Remove(gitdir.Path(shallowFile))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	sorted := append([]string(nil), hashes...)
+	sort.Strings(sorted)
+	return writeFileAtomically(gitdir.Path(shallowFile), []byte(strings.Join(sorted, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,76 @@
+package objects
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Tag represents a parsed annotated tag object, which gives a name, a
+// message and the identity of the tagger to another object
+type Tag struct {
+	Object  string
+	Type    string
+	Name    string
+	Tagger  string
+	Message string
+}
+
+// ParseTag will parse the headers and message of a tag object
+func ParseTag(data []byte) (Tag, error) {
+	var tag Tag
+
+	headerEnd := bytes.Index(data, []byte("\n\n"))
+	if headerEnd == -1 {
+		headerEnd = len(data)
+	} else {
+		tag.Message = string(data[headerEnd+2:])
+	}
+
+	for _, line := range strings.Split(string(data[:headerEnd]), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		switch parts[0] {
+		case "object":
+			tag.Object = parts[1]
+		case "type":
+			tag.Type = parts[1]
+		case "tag":
+			tag.Name = parts[1]
+		case "tagger":
+			tag.Tagger = parts[1]
+		}
+	}
+
+	if tag.Object == "" || tag.Type == "" || tag.Name == "" {
+		return Tag{}, errors.New("tag is missing its object, type or name")
+	}
+	return tag, nil
+}
+
+// ReadTag will read and parse the tag object with the given hash
+func ReadTag(hash string) (Tag, error) {
+	obj, err := ReadObject(hash)
+	if err != nil {
+		return Tag{}, err
+	}
+	if obj.Type() != "tag" {
+		return Tag{}, fmt.Errorf("object %s is a %s, not a tag", hash, obj.Type())
+	}
+	return ParseTag(obj.Data)
+}
+
+// Data returns the content of the tag object in the format it is stored in
+func (t Tag) Data() []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "object %s\ntype %s\ntag %s\n", t.Object, t.Type, t.Name)
+	if t.Tagger != "" {
+		fmt.Fprintf(&buffer, "tagger %s\n", t.Tagger)
+	}
+	buffer.WriteString("\n")
+	buffer.WriteString(t.Message)
+	return buffer.Bytes()
+}
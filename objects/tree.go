@@ -0,0 +1,176 @@
+package objects
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TreeEntry represents a single entry of a tree object, which is
+// either a blob or another tree
+type TreeEntry struct {
+	Mode string
+	Name string
+	Hash string
+}
+
+// IsTree returns true if the entry refers to a subtree
+func (e TreeEntry) IsTree() bool {
+	return e.Mode == "40000"
+}
+
+// Type returns the type of the object the entry refers to, which is a
+// commit for the gitlink of a submodule
+func (e TreeEntry) Type() string {
+	switch e.Mode {
+	case "40000":
+		return "tree"
+	case "160000":
+		return "commit"
+	}
+	return "blob"
+}
+
+// CheckEntryName will return an error if the name of a tree entry
+// could not be checked out safely, as git's fsck does. It must not be
+// empty, "." or "..", hold a slash, or name the repository directory,
+// including the forms filesystems treat as ".git".
+func CheckEntryName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("empty name")
+	case name == "." || name == "..":
+		return fmt.Errorf("'%s' is not a valid name", name)
+	case strings.Contains(name, "/"):
+		return fmt.Errorf("'%s' contains a slash", name)
+	}
+	trimmed := strings.ToLower(strings.TrimRight(name, ". "))
+	if trimmed == ".git" || trimmed == "git~1" {
+		return fmt.Errorf("'%s' names the repository directory", name)
+	}
+	return nil
+}
+
+// CheckPath will return an error if a path of a tree, with its
+// components separated by slashes, could not be checked out safely
+func CheckPath(p string) error {
+	for _, component := range strings.Split(p, "/") {
+		if err := CheckEntryName(component); err != nil {
+			return fmt.Errorf("invalid path '%s': %v", p, err)
+		}
+	}
+	return nil
+}
+
+// ParseTree will parse the entries of a tree object
+func ParseTree(data []byte) ([]TreeEntry, error) {
+	var entries []TreeEntry
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		if space == -1 {
+			return nil, errors.New("tree entry has no mode")
+		}
+		null := bytes.IndexByte(data, 0)
+		if null == -1 || null < space || null+1+20 > len(data) {
+			return nil, errors.New("tree entry is truncated")
+		}
+
+		entries = append(entries, TreeEntry{
+			Mode: string(data[:space]),
+			Name: string(data[space+1 : null]),
+			Hash: hex.EncodeToString(data[null+1 : null+21]),
+		})
+		data = data[null+21:]
+	}
+	return entries, nil
+}
+
+// TreeData returns the content of a tree object holding the entries.
+// The entries are sorted the way git requires, where the name of a
+// subtree sorts as if it ended with a slash.
+func TreeData(entries []TreeEntry) ([]byte, error) {
+	sorted := append([]TreeEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].sortName() < sorted[j].sortName()
+	})
+
+	var buffer bytes.Buffer
+	for i, entry := range sorted {
+		if i > 0 && sorted[i-1].Name == entry.Name {
+			return nil, fmt.Errorf("duplicate tree entry %s", entry.Name)
+		}
+		mode, err := strconv.ParseUint(entry.Mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode %s for %s", entry.Mode, entry.Name)
+		}
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil || len(hash) != 20 {
+			return nil, fmt.Errorf("invalid object %s for %s", entry.Hash, entry.Name)
+		}
+		fmt.Fprintf(&buffer, "%o %s\000", mode, entry.Name)
+		buffer.Write(hash)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (e TreeEntry) sortName() string {
+	if e.IsTree() {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// ReadTree will read and parse the tree object with the given hash
+func ReadTree(hash string) ([]TreeEntry, error) {
+	obj, err := ReadObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Type() != "tree" {
+		return nil, fmt.Errorf("object %s is a %s, not a tree", hash, obj.Type())
+	}
+	return ParseTree(obj.Data)
+}
+
+// ReadTreeRecursive will return every blob below the tree with the
+// given hash. The name of each entry is its full path.
+func ReadTreeRecursive(hash string) ([]TreeEntry, error) {
+	return readTreeRecursive(hash, "")
+}
+
+func readTreeRecursive(hash string, prefix string) ([]TreeEntry, error) {
+	entries, err := ReadTree(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []TreeEntry
+	for _, entry := range entries {
+		entry.Name = path.Join(prefix, entry.Name)
+		if !entry.IsTree() {
+			blobs = append(blobs, entry)
+			continue
+		}
+
+		subtreeBlobs, err := readTreeRecursive(entry.Hash, entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, subtreeBlobs...)
+	}
+	return blobs, nil
+}
+
+// The modes of tree entries and index entries
+const (
+	ModeTree       = 040000
+	ModeFile       = 0100644
+	ModeExecutable = 0100755
+	ModeSymlink    = 0120000
+	ModeGitlink    = 0160000
+)
@@ -0,0 +1,185 @@
+package pathspec
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mattherman/mhgit/wildmatch"
+)
+
+// Pathspec represents a list of patterns limiting a command to some of
+// the paths in the repository. Each pattern may be prefixed with magic,
+// either in the long form ":(exclude,icase)pattern" or the short form
+// ":!pattern". An empty pathspec matches every path.
+type Pathspec struct {
+	items   []item
+	matched []bool
+}
+
+type item struct {
+	original string
+	pattern  string
+	exclude  bool
+	icase    bool
+	literal  bool
+	glob     bool
+}
+
+// Parse will parse the pathspec arguments of a command
+func Parse(args []string) (*Pathspec, error) {
+	spec := &Pathspec{}
+	for _, arg := range args {
+		item, err := parseItem(arg)
+		if err != nil {
+			return nil, err
+		}
+		spec.items = append(spec.items, item)
+	}
+	spec.matched = make([]bool, len(spec.items))
+	return spec, nil
+}
+
+func parseItem(arg string) (item, error) {
+	i := item{original: arg}
+	pattern := arg
+
+	if strings.HasPrefix(pattern, ":(") {
+		end := strings.Index(pattern, ")")
+		if end == -1 {
+			return item{}, fmt.Errorf("missing ')' at the end of pathspec magic in '%s'", arg)
+		}
+		for _, magic := range strings.Split(pattern[2:end], ",") {
+			switch strings.TrimSpace(magic) {
+			case "top", "":
+				// Commands always run from the top of the working tree
+			case "exclude":
+				i.exclude = true
+			case "icase":
+				i.icase = true
+			case "literal":
+				i.literal = true
+			case "glob":
+				i.glob = true
+			default:
+				return item{}, fmt.Errorf("invalid pathspec magic '%s' in '%s'", magic, arg)
+			}
+		}
+		pattern = pattern[end+1:]
+	} else if strings.HasPrefix(pattern, ":") {
+		pattern = pattern[1:]
+	shortMagic:
+		for len(pattern) > 0 {
+			switch pattern[0] {
+			case '/':
+			case '!', '^':
+				i.exclude = true
+			case ':':
+				pattern = pattern[1:]
+				break shortMagic
+			default:
+				break shortMagic
+			}
+			pattern = pattern[1:]
+		}
+	}
+
+	if i.literal && i.glob {
+		return item{}, fmt.Errorf("'literal' and 'glob' pathspec magic are incompatible in '%s'", arg)
+	}
+
+	pattern = path.Clean(pattern)
+	if pattern == "." || pattern == "/" {
+		pattern = ""
+	}
+	i.pattern = strings.TrimPrefix(pattern, "/")
+	if strings.HasPrefix(i.pattern, "../") || i.pattern == ".." {
+		return item{}, fmt.Errorf("'%s' is outside repository", arg)
+	}
+
+	return i, nil
+}
+
+// Empty returns true if the pathspec has no patterns and so
+// matches every path
+func (p *Pathspec) Empty() bool {
+	return len(p.items) == 0
+}
+
+// Match returns true if the path is matched by at least one of the
+// patterns and not excluded by any of them. If there are only exclude
+// patterns, every path that is not excluded is matched.
+func (p *Pathspec) Match(filepath string) bool {
+	included := true
+	var matchedItems []int
+	for i, item := range p.items {
+		if item.exclude {
+			if item.matches(filepath) {
+				return false
+			}
+			continue
+		}
+
+		included = false
+		if item.matches(filepath) {
+			matchedItems = append(matchedItems, i)
+		}
+	}
+
+	if len(matchedItems) == 0 {
+		return included
+	}
+	for _, i := range matchedItems {
+		p.matched[i] = true
+	}
+	return true
+}
+
+// Unmatched returns the patterns that have not matched any of the
+// paths passed to Match
+func (p *Pathspec) Unmatched() []string {
+	var unmatched []string
+	for i, item := range p.items {
+		if !item.exclude && !p.matched[i] {
+			unmatched = append(unmatched, item.original)
+		}
+	}
+	return unmatched
+}
+
+// Literals returns the paths named by patterns without any wildcards.
+// These may name files that would otherwise be skipped, such as
+// ignored files.
+func (p *Pathspec) Literals() []string {
+	var literals []string
+	for _, item := range p.items {
+		if !item.exclude && item.pattern != "" && (item.literal || !wildmatch.HasWildcard(item.pattern)) {
+			literals = append(literals, item.pattern)
+		}
+	}
+	return literals
+}
+
+// matches returns true if the item names the path or one of its
+// leading directories, or matches the path as a wildcard pattern
+func (i item) matches(filepath string) bool {
+	pattern := i.pattern
+	if i.icase {
+		pattern = strings.ToLower(pattern)
+		filepath = strings.ToLower(filepath)
+	}
+
+	if pattern == "" || filepath == pattern || strings.HasPrefix(filepath, pattern+"/") {
+		return true
+	}
+	if i.literal || !wildmatch.HasWildcard(pattern) {
+		return false
+	}
+
+	// Without glob magic a wildcard also matches slashes
+	flags := 0
+	if i.glob {
+		flags = wildmatch.Pathname
+	}
+	return wildmatch.Match(pattern, filepath, flags)
+}
@@ -0,0 +1,106 @@
+package pktline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// MaxPacketSize is the largest packet, including its length
+	MaxPacketSize = 65520
+
+	// MaxDataSize is the most data a single packet can carry
+	MaxDataSize = MaxPacketSize - 4
+
+	flushPacket = "0000"
+)
+
+// Reader reads the packets of the pkt-line format, where each packet
+// starts with its length as four hexadecimal digits. A length of zero
+// is a flush packet, which ends a section of the conversation.
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader returns a reader of the packets of the stream
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadPacket reads the next packet, returning nil for a flush packet
+func (r *Reader) ReadPacket() ([]byte, error) {
+	var header [4]byte
+	_, err := io.ReadFull(r.r, header[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("the remote end hung up unexpectedly")
+		}
+		return nil, err
+	}
+
+	length, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("protocol error: bad line length character: %q", header[:])
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	if length < 4 || length > MaxPacketSize {
+		return nil, fmt.Errorf("protocol error: bad line length %d", length)
+	}
+
+	data := make([]byte, length-4)
+	_, err = io.ReadFull(r.r, data)
+	if err != nil {
+		return nil, errors.New("the remote end hung up unexpectedly")
+	}
+	return data, nil
+}
+
+// ReadLine reads the next packet as a line without its trailing
+// newline. It returns false for a flush packet.
+func (r *Reader) ReadLine() (string, bool, error) {
+	data, err := r.ReadPacket()
+	if err != nil || data == nil {
+		return "", false, err
+	}
+	line := string(data)
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	return line, true, nil
+}
+
+// Writer writes packets of the pkt-line format
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a writer of packets to the stream
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WritePacket writes the data as a single packet
+func (w *Writer) WritePacket(data []byte) error {
+	if len(data) > MaxDataSize {
+		return fmt.Errorf("packet of %d bytes is too long", len(data))
+	}
+	packet := make([]byte, 4, len(data)+4)
+	copy(packet, fmt.Sprintf("%04x", len(data)+4))
+	_, err := w.w.Write(append(packet, data...))
+	return err
+}
+
+// WriteLine writes a formatted line as a packet, adding its newline
+func (w *Writer) WriteLine(format string, args ...interface{}) error {
+	return w.WritePacket([]byte(fmt.Sprintf(format, args...) + "\n"))
+}
+
+// Flush writes a flush packet
+func (w *Writer) Flush() error {
+	_, err := io.WriteString(w.w, flushPacket)
+	return err
+}
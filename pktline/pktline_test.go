@@ -0,0 +1,98 @@
+package pktline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLinesRoundTrip(t *testing.T) {
+	var buffer bytes.Buffer
+	w := NewWriter(&buffer)
+	w.WriteLine("want %s", strings.Repeat("a", 40))
+	w.WritePacket([]byte("no newline"))
+	w.Flush()
+	w.WriteLine("done")
+
+	if !strings.HasPrefix(buffer.String(), "0032want ") {
+		t.Fatalf("unexpected encoding %q", buffer.String())
+	}
+
+	r := NewReader(&buffer)
+	expected := []struct {
+		line string
+		ok   bool
+	}{
+		{"want " + strings.Repeat("a", 40), true},
+		{"no newline", true},
+		{"", false},
+		{"done", true},
+	}
+	for _, e := range expected {
+		line, ok, err := r.ReadLine()
+		if err != nil {
+			t.Fatalf("ReadLine failed: %v", err)
+		}
+		if line != e.line || ok != e.ok {
+			t.Errorf("got (%q, %v), expected (%q, %v)", line, ok, e.line, e.ok)
+		}
+	}
+	if _, _, err := r.ReadLine(); err == nil {
+		t.Error("expected an error at the end of the stream")
+	}
+}
+
+func TestReadPacketRejectsBadLengths(t *testing.T) {
+	for _, stream := range []string{"00zz", "0003", "fff1" + strings.Repeat("x", 65533), "0009abc"} {
+		_, err := NewReader(strings.NewReader(stream)).ReadPacket()
+		if err == nil {
+			t.Errorf("expected an error reading %.8q", stream)
+		}
+	}
+}
+
+func TestWritePacketRejectsLongData(t *testing.T) {
+	var buffer bytes.Buffer
+	err := NewWriter(&buffer).WritePacket(make([]byte, MaxDataSize+1))
+	if err == nil {
+		t.Error("expected an error writing a packet that is too long")
+	}
+}
+
+func TestSidebandRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+
+	var buffer bytes.Buffer
+	w := NewWriter(&buffer)
+	NewSidebandWriter(w, BandProgress).Write([]byte("Counting objects\n"))
+	n, err := NewSidebandWriter(w, BandData).Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Write returned (%d, %v)", n, err)
+	}
+	NewSidebandWriter(w, BandProgress).Write([]byte("done\n"))
+	w.Flush()
+
+	var received, progress bytes.Buffer
+	err = Demultiplex(NewReader(&buffer), &received, &progress)
+	if err != nil {
+		t.Fatalf("Demultiplex failed: %v", err)
+	}
+	if !bytes.Equal(received.Bytes(), data) {
+		t.Errorf("received %d bytes of data, expected %d", received.Len(), len(data))
+	}
+	if progress.String() != "Counting objects\ndone\n" {
+		t.Errorf("unexpected progress %q", progress.String())
+	}
+}
+
+func TestDemultiplexReturnsRemoteError(t *testing.T) {
+	var buffer bytes.Buffer
+	w := NewWriter(&buffer)
+	NewSidebandWriter(w, BandError).Write([]byte("access denied\n"))
+	w.Flush()
+
+	err := Demultiplex(NewReader(&buffer), &bytes.Buffer{}, nil)
+	if err == nil || err.Error() != "remote error: access denied" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package pktline
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The bands of a multiplexed stream
+const (
+	BandData     = 1
+	BandProgress = 2
+	BandError    = 3
+)
+
+// SidebandWriter writes data to one band of a stream multiplexed with
+// the side-band-64k capability, splitting it into packets
+type SidebandWriter struct {
+	w    *Writer
+	band byte
+}
+
+// NewSidebandWriter returns a writer of the band of the stream
+func NewSidebandWriter(w *Writer, band byte) *SidebandWriter {
+	return &SidebandWriter{w: w, band: band}
+}
+
+func (s *SidebandWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		size := len(data)
+		if size > MaxDataSize-1 {
+			size = MaxDataSize - 1
+		}
+		packet := append([]byte{s.band}, data[:size]...)
+		err := s.w.WritePacket(packet)
+		if err != nil {
+			return written, err
+		}
+		written += size
+		data = data[size:]
+	}
+	return written, nil
+}
+
+// Demultiplex reads a stream multiplexed with the side-band-64k
+// capability until its flush packet, writing the data band to data and
+// the progress band to progress, which may be nil. A message on the
+// error band is returned as an error.
+func Demultiplex(r *Reader, data io.Writer, progress io.Writer) error {
+	for {
+		packet, err := r.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if packet == nil {
+			return nil
+		}
+		if len(packet) == 0 {
+			continue
+		}
+
+		switch packet[0] {
+		case BandData:
+			_, err = data.Write(packet[1:])
+		case BandProgress:
+			if progress != nil {
+				_, err = progress.Write(packet[1:])
+			}
+		case BandError:
+			return fmt.Errorf("remote error: %s", strings.TrimSpace(string(packet[1:])))
+		default:
+			return fmt.Errorf("protocol error: bad band #%d", packet[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package refs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckRefFormat will return an error describing why the name cannot be
+// used for a ref, using the same rules as git. Names must have at least
+// two components, such as "heads/main", unless allowOneLevel is set.
+func CheckRefFormat(name string, allowOneLevel bool) error {
+	if name == "" {
+		return fmt.Errorf("ref name is empty")
+	}
+	if name == "@" {
+		return fmt.Errorf("'@' is not a valid ref name")
+	}
+	if strings.HasSuffix(name, "/") {
+		return fmt.Errorf("ref name '%s' ends with a slash", name)
+	}
+	if strings.HasSuffix(name, ".") {
+		return fmt.Errorf("ref name '%s' ends with a dot", name)
+	}
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("ref name '%s' contains '..'", name)
+	}
+	if strings.Contains(name, "@{") {
+		return fmt.Errorf("ref name '%s' contains '@{'", name)
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("ref name '%s' contains a control character", name)
+		}
+		if strings.IndexByte(" ~^:?*[\\", c) != -1 {
+			return fmt.Errorf("ref name '%s' contains '%c'", name, c)
+		}
+	}
+
+	components := strings.Split(name, "/")
+	for _, component := range components {
+		if component == "" {
+			return fmt.Errorf("ref name '%s' contains an empty component", name)
+		}
+		if strings.HasPrefix(component, ".") {
+			return fmt.Errorf("ref name '%s' has a component starting with a dot", name)
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return fmt.Errorf("ref name '%s' has a component ending with '.lock'", name)
+		}
+	}
+
+	if len(components) < 2 && !allowOneLevel {
+		return fmt.Errorf("ref name '%s' has only one level", name)
+	}
+	return nil
+}
+
+// CheckRefNameSafe will return an error if the name could not be
+// written safely as a file of the repository. As in git, a ref is either
+// under refs/ or a pseudo-ref such as HEAD or ORIG_HEAD whose name is
+// only capital letters and underscores, so that names like "config" or
+// "index" cannot overwrite the other files of the repository.
+func CheckRefNameSafe(name string) error {
+	if strings.HasPrefix(name, "refs/") {
+		return CheckRefFormat(name, false)
+	}
+	if name == "" {
+		return fmt.Errorf("ref name is empty")
+	}
+	for i := 0; i < len(name); i++ {
+		if (name[i] < 'A' || name[i] > 'Z') && name[i] != '_' {
+			return fmt.Errorf("refusing to update ref with bad name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// CheckSymbolicRefName will return an error if the name cannot be used
+// for a symbolic ref, which is either HEAD or a ref under refs/
+func CheckSymbolicRefName(name string) error {
+	if name == "HEAD" {
+		return nil
+	}
+	if !strings.HasPrefix(name, "refs/") {
+		return fmt.Errorf("refusing to use '%s' as a symbolic ref outside of refs/", name)
+	}
+	return CheckRefFormat(name, false)
+}
+
+// NormalizeRefName removes a leading slash and collapses repeated
+// slashes, as git does before checking a name given by the user
+func NormalizeRefName(name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if strings.HasSuffix(name, "/") && len(parts) > 0 {
+		// A trailing slash stays so the name is still rejected
+		return strings.Join(parts, "/") + "/"
+	}
+	return strings.Join(parts, "/")
+}
+
+// CheckBranchName will return an error if the name cannot be used
+// for a branch
+func CheckBranchName(name string) error {
+	if strings.HasPrefix(name, "-") {
+		return fmt.Errorf("'%s' is not a valid branch name", name)
+	}
+	if name == "HEAD" {
+		return fmt.Errorf("'HEAD' is not a valid branch name")
+	}
+	if err := CheckRefFormat(branchPrefix+name, false); err != nil {
+		return fmt.Errorf("'%s' is not a valid branch name", name)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package refs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+func TestCheckRefNameSafe(t *testing.T) {
+	for _, name := range []string{"HEAD", "ORIG_HEAD", "FETCH_HEAD", "refs/heads/master", "refs/tags/v1.0", "refs/stash"} {
+		if err := CheckRefNameSafe(name); err != nil {
+			t.Errorf("expected %q to be accepted, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "config", "index", "packed-refs", "objects/info", "Head", "refs/heads/../../config", "refs/", "../HEAD"} {
+		if err := CheckRefNameSafe(name); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestTransactionRejectsUnsafeNames(t *testing.T) {
+	for _, name := range []string{"config", "index", "packed-refs"} {
+		transaction := NewTransaction()
+		if err := transaction.Update(name, ZeroHash, "", "", true); err == nil {
+			t.Errorf("expected an update of %q to be rejected", name)
+		}
+	}
+	if err := NewTransaction().Update("refs/heads/master", ZeroHash, "", "", false); err != nil {
+		t.Errorf("expected an update of refs/heads/master to be accepted, got %v", err)
+	}
+}
+
+func TestSymbolicRefsRejectTraversalNames(t *testing.T) {
+	dir := t.TempDir()
+	repository := filepath.Join(dir, ".git")
+	os.MkdirAll(filepath.Join(repository, "refs", "heads"), 0755)
+	previous := gitdir.Get()
+	gitdir.Set(repository)
+	defer gitdir.Set(previous)
+
+	// A file outside the repository that a symbolic ref could be written
+	// over or deleted through
+	outside := filepath.Join(dir, "escaped")
+	ioutil.WriteFile(outside, []byte("ref: refs/heads/master\n"), 0644)
+
+	for _, name := range []string{"../escaped", "../../escaped", "refs/../../escaped", "refs/heads/../../../escaped", "config", "/tmp/escaped"} {
+		if err := CheckSymbolicRefName(name); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+		if err := UpdateSymbolicRef(name, "refs/heads/master", ""); err == nil {
+			t.Errorf("expected pointing %q at a branch to be refused", name)
+		}
+		if err := DeleteSymbolicRef(name); err == nil {
+			t.Errorf("expected deleting %q to be refused", name)
+		}
+	}
+	if data, err := ioutil.ReadFile(outside); err != nil || string(data) != "ref: refs/heads/master\n" {
+		t.Errorf("the file outside the repository was changed: %q %v", data, err)
+	}
+
+	for _, name := range []string{"HEAD", "refs/remotes/origin/HEAD"} {
+		if err := UpdateSymbolicRef(name, "refs/heads/master", ""); err != nil {
+			t.Errorf("expected pointing %s at a branch to succeed, got %v", name, err)
+		}
+	}
+	if err := DeleteSymbolicRef("refs/remotes/origin/HEAD"); err != nil {
+		t.Errorf("expected deleting refs/remotes/origin/HEAD to succeed, got %v", err)
+	}
+}
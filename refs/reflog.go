@@ -0,0 +1,278 @@
+package refs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/lockfile"
+)
+
+const logsDir string = "logs"
+
+// ReflogEntry represents one update of a ref, recording what it pointed
+// to before and after, who made the update and why
+type ReflogEntry struct {
+	Old      string
+	New      string
+	Identity ident.Identity
+	Message  string
+}
+
+// String formats the entry the way it is stored in the reflog
+func (e ReflogEntry) String() string {
+	return fmt.Sprintf("%s %s %s\t%s\n", e.Old, e.New, e.Identity, e.Message)
+}
+
+func reflogPath(name string) string {
+	return gitdir.Path(logsDir, filepath.FromSlash(name))
+}
+
+// ReflogExists returns true if updates of the ref are being logged
+func ReflogExists(name string) bool {
+	info, err := os.Stat(reflogPath(name))
+	return err == nil && !info.IsDir()
+}
+
+// shouldLog decides whether to log an update of the ref. Like git, the
+// updates of HEAD, branches, remote-tracking branches and notes are
+// logged unless core.logAllRefUpdates says otherwise, and a ref that
+// already has a reflog always keeps it up to date.
+func shouldLog(name string) bool {
+	if ReflogExists(name) {
+		return true
+	}
+
+	cfg, err := config.Read()
+	if err != nil {
+		return false
+	}
+	setting, _ := cfg.Get("core.logAllRefUpdates")
+	if strings.ToLower(setting) == "always" {
+		return true
+	}
+	enabled, err := cfg.Bool("core.logAllRefUpdates", true)
+	if err != nil || !enabled {
+		return false
+	}
+
+	if name == "HEAD" {
+		return true
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/", "refs/notes/"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendReflog adds an entry for an update of the ref, if it is logged
+func appendReflog(name string, oldHash string, newHash string, committer ident.Identity, message string) error {
+	if !shouldLog(name) {
+		return nil
+	}
+	if oldHash == "" {
+		oldHash = ZeroHash
+	}
+	if newHash == "" {
+		newHash = ZeroHash
+	}
+
+	// Messages are kept on a single line
+	message = strings.Join(strings.Fields(message), " ")
+
+	path := reflogPath(name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// The reflog is locked so that an entry cannot be lost to an expiry
+	// rewriting the reflog at the same time
+	lock, err := lockfile.LockWithTimeout(path, refLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entry := ReflogEntry{Old: oldHash, New: newHash, Identity: committer, Message: message}
+	_, err = file.WriteString(entry.String())
+	return err
+}
+
+// ReadReflog will return the entries of the reflog of the ref, newest
+// first, so that entry N is the value of the ref N updates ago
+func ReadReflog(name string) ([]ReflogEntry, error) {
+	file, err := os.Open(reflogPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []ReflogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry, err := parseReflogEntry(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("reflog of %s is corrupt: %v", name, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+func parseReflogEntry(line string) (ReflogEntry, error) {
+	var entry ReflogEntry
+	header := line
+	if tab := strings.Index(line, "\t"); tab != -1 {
+		header = line[:tab]
+		entry.Message = line[tab+1:]
+	}
+
+	fields := strings.SplitN(header, " ", 3)
+	if len(fields) != 3 {
+		return ReflogEntry{}, fmt.Errorf("invalid entry '%s'", line)
+	}
+	identity, err := ident.Parse(fields[2])
+	if err != nil {
+		return ReflogEntry{}, err
+	}
+	entry.Old = fields[0]
+	entry.New = fields[1]
+	entry.Identity = identity
+	return entry, nil
+}
+
+// ExpireReflog will remove the entries of the reflog of the ref that are
+// older than the given time, returning how many were removed
+func ExpireReflog(name string, before time.Time) (int, error) {
+	return rewriteReflog(name, func(n int, entry ReflogEntry) bool {
+		return entry.Identity.When.Before(before)
+	})
+}
+
+// DeleteReflogEntry will remove entry N of the reflog of the ref, where
+// entry 0 is the newest
+func DeleteReflogEntry(name string, n int) error {
+	entries, err := ReadReflog(name)
+	if err != nil {
+		return err
+	}
+	if n < 0 || n >= len(entries) {
+		return fmt.Errorf("reflog of %s does not have an entry %d", name, n)
+	}
+
+	_, err = rewriteReflog(name, func(i int, entry ReflogEntry) bool {
+		return i == n
+	})
+	return err
+}
+
+// rewriteReflog rewrites the reflog of the ref without the entries the
+// function selects. Entries are numbered newest first.
+func rewriteReflog(name string, remove func(int, ReflogEntry) bool) (int, error) {
+	lock, err := lockfile.LockWithTimeout(reflogPath(name), refLockTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Rollback()
+
+	entries, err := ReadReflog(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var buffer bytes.Buffer
+	removed := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		if remove(i, entries[i]) {
+			removed++
+			continue
+		}
+		buffer.WriteString(entries[i].String())
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	_, err = lock.Write(buffer.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return removed, lock.Commit()
+}
+
+// writeReflogData replaces the reflog of the ref with the data
+func writeReflogData(name string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(reflogPath(name)), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(reflogPath(name), data, 0644)
+}
+
+// deleteReflog removes the reflog of a deleted ref
+func deleteReflog(name string) error {
+	err := os.Remove(reflogPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	dir := filepath.Dir(reflogPath(name))
+	for dir != gitdir.Path(logsDir) && dir != "." {
+		if os.Remove(dir) != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+// ListReflogs returns the names of every ref that has a reflog
+func ListReflogs() ([]string, error) {
+	var names []string
+	err := filepath.Walk(gitdir.Path(logsDir), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(gitdir.Path(logsDir), path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
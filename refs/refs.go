@@ -3,93 +3,170 @@ package refs
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 )
 
-// CurrentBranch returns the name of the branch currently
-// pointed to by HEAD or empty string if the ref is not a branch
+// How long to wait for another process to release the lock on a ref,
+// since ref updates are quick and often happen concurrently
+const refLockTimeout = 100 * time.Millisecond
+
+const branchPrefix string = "refs/heads/"
+
+// ErrUnbornBranch is returned when the current branch does not have any
+// commits yet, such as in a new repository
+var ErrUnbornBranch = errors.New("the current branch does not have any commits yet")
+
+// CurrentBranch returns the name of the branch currently pointed to
+// by HEAD or empty string if HEAD is detached
 func CurrentBranch() (string, error) {
-	bytes, err := ioutil.ReadFile(".git/HEAD")
+	head, err := ReadRef("HEAD")
 	if err != nil {
 		return "", err
 	}
 
-	headString := string(bytes)
-	match := strings.HasPrefix(headString, "ref: refs/heads/")
-
-	if match {
-		splitHeadString := strings.Split(headString, "/")
-		return strings.Trim(splitHeadString[2], " \n"), nil
+	if strings.HasPrefix(head.Target, branchPrefix) {
+		return strings.TrimPrefix(head.Target, branchPrefix), nil
 	}
 
 	return "", nil
 }
 
-// ListBranches will return all the existing branches
+// ListBranches will return all the existing branches, both loose
+// and packed
 func ListBranches() ([]string, error) {
-	files, err := ioutil.ReadDir(".git/refs/heads")
+	refs, err := IterRefs(branchPrefix)
+	if err != nil {
+		return nil, err
+	}
 
-	var filenames []string
-	for _, file := range files {
-		filenames = append(filenames, file.Name())
+	var branches []string
+	for _, ref := range refs {
+		branches = append(branches, strings.TrimPrefix(ref.Name, branchPrefix))
 	}
-	return filenames, err
+	return branches, nil
 }
 
-// CreateBranch will create a new branch if it does not exist
-func CreateBranch(branchName string) error {
-	branches, err := ListBranches()
+// CreateBranch will create a new branch pointing to the commit, which
+// was found from the given start point. An existing branch is only
+// replaced if force is set.
+func CreateBranch(branchName string, commitHash string, startPoint string, force bool) error {
+	err := CheckBranchName(branchName)
 	if err != nil {
 		return err
 	}
 
-	for _, branch := range branches {
-		if branch == branchName {
-			return errors.New("branch already exists")
+	oldHash := ZeroHash
+	message := "branch: Created from " + startPoint
+	if force {
+		oldHash = ""
+		if _, err := ReadRef(branchPrefix + branchName); err == nil {
+			message = "branch: Reset to " + startPoint
 		}
 	}
 
-	commitHash, err := LatestCommit()
-	if err != nil {
-		return err
+	err = UpdateRef(branchPrefix+branchName, commitHash, oldHash, message)
+	if err != nil && strings.HasSuffix(err.Error(), "reference already exists") {
+		return fmt.Errorf("a branch named '%s' already exists", branchName)
 	}
 
-	filename := fmt.Sprintf(".git/refs/heads/%s", branchName)
-	err = ioutil.WriteFile(filename, []byte(commitHash), 0644)
-
 	return err
 }
 
-// LatestCommit will return the latest commit hash of the current branch
+// LatestCommit will return the commit HEAD points to, either through the
+// current branch or directly if HEAD is detached. ErrUnbornBranch is
+// returned if the current branch does not have any commits yet.
 func LatestCommit() (string, error) {
-	branch, err := CurrentBranch()
-	if err != nil {
-		return "", err
+	hash, err := ResolveRef("HEAD")
+	if err != ErrNotFound {
+		return hash, err
 	}
 
-	filename := fmt.Sprintf(".git/refs/heads/%s", branch)
-	bytes, err := ioutil.ReadFile(filename)
+	// HEAD itself must exist, only the branch it points to may not
+	head, err := ReadRef("HEAD")
 	if err != nil {
 		return "", err
 	}
-
-	return string(bytes), nil
+	if head.Symbolic() {
+		return "", ErrUnbornBranch
+	}
+	return "", ErrNotFound
 }
 
 // UpdateLatestCommit will update the latest commit of the current branch
-// to equal the provided hash.
-func UpdateLatestCommit(commitHash string) error {
-	branch, err := CurrentBranch()
+// to equal the provided hash. If HEAD is detached, HEAD itself is updated.
+// The message explains the update in the reflog.
+func UpdateLatestCommit(commitHash string, message string) error {
+	return UpdateRef("HEAD", commitHash, "", message)
+}
+
+// ReadSymbolicRef returns the name of the ref a symbolic ref points to
+func ReadSymbolicRef(name string) (string, error) {
+	ref, err := ReadRef(name)
 	if err != nil {
-		return err
+		return "", err
 	}
+	if !ref.Symbolic() {
+		return "", fmt.Errorf("ref %s is not a symbolic ref", name)
+	}
+	return ref.Target, nil
+}
 
-	filename := fmt.Sprintf(".git/refs/heads/%s", branch)
-	err = ioutil.WriteFile(filename, []byte(commitHash), 0644)
+// DeleteSymbolicRef will delete a symbolic ref, leaving the ref it
+// points to alone
+func DeleteSymbolicRef(name string) error {
+	if err := CheckSymbolicRefName(name); err != nil {
+		return err
+	}
+	_, err := ReadSymbolicRef(name)
 	if err != nil {
 		return err
 	}
+	return os.Remove(refPath(name))
+}
+
+// The rules git uses to find the full name of a ref given by the user
+var expandRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// ExpandRef returns the full name of an existing ref given a short name
+// such as "main" or "origin/main". ErrNotFound is returned if no ref
+// matches the name.
+func ExpandRef(name string) (string, error) {
+	for _, rule := range expandRules {
+		fullName := fmt.Sprintf(rule, name)
+		if rule == "%s" && !strings.HasPrefix(fullName, "refs/") && !isPseudoRef(fullName) {
+			continue
+		}
 
-	return nil
+		_, err := ResolveRef(fullName)
+		if err == nil {
+			return fullName, nil
+		}
+		if err != ErrNotFound {
+			return "", err
+		}
+	}
+	return "", ErrNotFound
+}
+
+// isPseudoRef returns true for refs such as HEAD and ORIG_HEAD that are
+// stored directly in the git directory
+func isPseudoRef(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,591 @@
+package refs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/lockfile"
+	"github.com/mattherman/mhgit/objects"
+)
+
+const (
+	packedRefsFile  string = "packed-refs"
+	packedRefsTitle string = "# pack-refs with: peeled fully-peeled sorted \n"
+	symrefPrefix    string = "ref: "
+
+	// ZeroHash can be given as the old value of UpdateRef to require
+	// that the ref does not exist yet
+	ZeroHash string = "0000000000000000000000000000000000000000"
+
+	// Symbolic refs pointing to each other are only followed this deep
+	maxSymrefDepth = 5
+
+	// Rewriting packed-refs takes longer than writing a single ref
+	packedRefsLockTimeout = time.Second
+)
+
+// ErrNotFound is returned when a ref does not exist
+var ErrNotFound = errors.New("ref not found")
+
+// Ref represents a reference to an object. A symbolic ref has the name
+// of the ref it points to as its target, and the hash of the object
+// that ref points to. Peeled is the object an annotated tag points to,
+// when it is known.
+type Ref struct {
+	Name   string
+	Hash   string
+	Target string
+	Peeled string
+}
+
+// Symbolic returns true if the ref points to another ref
+func (r Ref) Symbolic() bool {
+	return r.Target != ""
+}
+
+func refPath(name string) string {
+	return gitdir.Path(filepath.FromSlash(name))
+}
+
+// readLooseRef reads a ref stored in its own file, returning either its
+// hash or the name of the ref it points to
+func readLooseRef(name string) (string, string, error) {
+	data, err := ioutil.ReadFile(refPath(name))
+	if os.IsNotExist(err) || errors.Is(err, syscall.EISDIR) || errors.Is(err, syscall.ENOTDIR) {
+		return "", "", ErrNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	content := strings.TrimSpace(string(data))
+	if strings.HasPrefix(content, symrefPrefix) {
+		return "", strings.TrimSpace(strings.TrimPrefix(content, symrefPrefix)), nil
+	}
+	if len(content) != len(ZeroHash) {
+		return "", "", fmt.Errorf("ref %s is corrupt", name)
+	}
+	return content, "", nil
+}
+
+// readPackedRefs reads every ref in the packed-refs file
+func readPackedRefs() (map[string]Ref, error) {
+	refs := make(map[string]Ref)
+	file, err := os.Open(gitdir.Path(packedRefsFile))
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var last string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// A peeled line gives the object of the annotated tag above it
+		if strings.HasPrefix(line, "^") {
+			if ref, ok := refs[last]; ok {
+				ref.Peeled = line[1:]
+				refs[last] = ref
+			}
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != len(ZeroHash) {
+			return nil, fmt.Errorf("unexpected line in %s: %s", packedRefsFile, line)
+		}
+		refs[fields[1]] = Ref{Name: fields[1], Hash: fields[0]}
+		last = fields[1]
+	}
+	return refs, scanner.Err()
+}
+
+// ReadRef will read a ref without following it if it is symbolic.
+// Loose refs take precedence over packed refs of the same name.
+func ReadRef(name string) (Ref, error) {
+	hash, target, err := readLooseRef(name)
+	if err == nil {
+		return Ref{Name: name, Hash: hash, Target: target}, nil
+	}
+	if err != ErrNotFound {
+		return Ref{}, err
+	}
+
+	packed, err := readPackedRefs()
+	if err != nil {
+		return Ref{}, err
+	}
+	ref, ok := packed[name]
+	if !ok {
+		return Ref{}, ErrNotFound
+	}
+	return ref, nil
+}
+
+// ResolveRef will return the hash a ref points to, following symbolic
+// refs such as HEAD. ErrNotFound is returned if the ref, or the ref a
+// symbolic ref points to, does not exist.
+func ResolveRef(name string) (string, error) {
+	ref, err := resolve(name)
+	return ref.Hash, err
+}
+
+// resolve follows symbolic refs and returns the ref they end at
+func resolve(name string) (Ref, error) {
+	for depth := 0; depth < maxSymrefDepth; depth++ {
+		ref, err := ReadRef(name)
+		if err != nil {
+			return Ref{Name: name}, err
+		}
+		if !ref.Symbolic() {
+			return ref, nil
+		}
+		name = ref.Target
+	}
+	return Ref{}, fmt.Errorf("symbolic ref %s is nested too deeply", name)
+}
+
+// IterRefs will return every ref whose name starts with the prefix,
+// sorted by name. Symbolic refs are resolved to the hash of the ref
+// they point to, and skipped if that ref does not exist.
+func IterRefs(prefix string) ([]Ref, error) {
+	all, err := readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(refPath("refs"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(gitdir.Get(), path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		hash, target, err := readLooseRef(name)
+		if err != nil {
+			return err
+		}
+		all[name] = Ref{Name: name, Hash: hash, Target: target}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []Ref
+	for name, ref := range all {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if ref.Symbolic() {
+			resolved, err := resolve(ref.Target)
+			if err != nil {
+				continue
+			}
+			ref.Hash = resolved.Hash
+		}
+		refs = append(refs, ref)
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Name < refs[j].Name
+	})
+	return refs, nil
+}
+
+// UpdateRef will point the ref at a new hash. If the ref is symbolic,
+// the ref it points to is updated instead. If oldHash is not empty the
+// update only happens if the ref currently points to oldHash, where
+// ZeroHash means the ref must not exist yet. The check and the update
+// happen while the ref is locked, so concurrent updates cannot be lost.
+// The update is recorded in the reflog with the given message.
+func UpdateRef(name string, newHash string, oldHash string, message string) error {
+	transaction := NewTransaction()
+	err := transaction.Update(name, newHash, oldHash, message, false)
+	if err != nil {
+		return err
+	}
+	return transaction.Commit()
+}
+
+// UpdateSymbolicRef will point a symbolic ref such as HEAD at another
+// ref. If a message is given, the switch is recorded in the reflog.
+func UpdateSymbolicRef(name string, target string, message string) error {
+	if err := CheckSymbolicRefName(name); err != nil {
+		return err
+	}
+	lock, err := lockfile.LockWithTimeout(refPath(name), refLockTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot lock ref '%s': %v", name, err)
+	}
+	defer lock.Rollback()
+
+	_, err = lock.Write([]byte(symrefPrefix + target + "\n"))
+	if err != nil {
+		return err
+	}
+
+	if message != "" {
+		err = logSwitch(name, target, message)
+		if err != nil {
+			return err
+		}
+	}
+	return lock.Commit()
+}
+
+// DetachHead will point HEAD directly at a commit instead of a branch,
+// recording the switch in the reflog
+func DetachHead(commitHash string, message string) error {
+	lock, err := lockfile.LockWithTimeout(refPath("HEAD"), refLockTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot lock ref 'HEAD': %v", err)
+	}
+	defer lock.Rollback()
+
+	_, err = lock.Write([]byte(commitHash + "\n"))
+	if err != nil {
+		return err
+	}
+
+	err = logSwitch("HEAD", commitHash, message)
+	if err != nil {
+		return err
+	}
+	return lock.Commit()
+}
+
+// logSwitch records that a ref such as HEAD now points somewhere else,
+// which may be either a ref or a hash
+func logSwitch(name string, target string, message string) error {
+	committer, err := ident.Committer()
+	if err != nil {
+		return err
+	}
+
+	oldHash, err := ResolveRef(name)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	newHash := target
+	if strings.HasPrefix(target, "refs/") {
+		newHash, err = ResolveRef(target)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return appendReflog(name, oldHash, newHash, committer, message)
+}
+
+func verifyOldHash(name string, currentHash string, oldHash string) error {
+	if oldHash == "" {
+		return nil
+	}
+	if oldHash == ZeroHash {
+		if currentHash != "" {
+			return fmt.Errorf("cannot lock ref '%s': reference already exists", name)
+		}
+		return nil
+	}
+	if currentHash == "" {
+		return fmt.Errorf("cannot lock ref '%s': unable to resolve reference '%s'", name, name)
+	}
+	if currentHash != oldHash {
+		return fmt.Errorf("cannot lock ref '%s': is at %s but expected %s", name, currentHash, oldHash)
+	}
+	return nil
+}
+
+// checkNameConflicts makes sure a new ref neither is a directory of an
+// existing ref nor has an existing ref as one of its directories, since
+// both cannot be stored as files
+func checkNameConflicts(name string) error {
+	refs, err := IterRefs("refs/")
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if strings.HasPrefix(ref.Name, name+"/") || strings.HasPrefix(name, ref.Name+"/") {
+			return fmt.Errorf("cannot lock ref '%s': '%s' exists; cannot create '%s'", name, ref.Name, name)
+		}
+	}
+	return nil
+}
+
+// DeleteRef will delete the ref, both its loose file and its entry in
+// packed-refs. If oldHash is not empty the ref is only deleted if it
+// currently points to oldHash.
+func DeleteRef(name string, oldHash string) error {
+	if err := CheckRefNameSafe(name); err != nil {
+		return err
+	}
+	lock, err := lockfile.LockWithTimeout(refPath(name), refLockTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot lock ref '%s': %v", name, err)
+	}
+	defer lock.Rollback()
+
+	current, err := ReadRef(name)
+	if err != nil {
+		return err
+	}
+	if err := verifyOldHash(name, current.Hash, oldHash); err != nil {
+		return err
+	}
+
+	// The packed entry goes first, so a failure cannot leave an
+	// outdated packed value visible once the loose ref is removed
+	err = removePackedRef(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(refPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// The lock file has to be gone before its directory can be removed
+	lock.Rollback()
+	removeEmptyDirs(filepath.Dir(refPath(name)))
+	return deleteReflog(name)
+}
+
+// removePackedRef rewrites packed-refs without the given ref
+func removePackedRef(name string) error {
+	lock, err := lockfile.LockWithTimeout(gitdir.Path(packedRefsFile), packedRefsLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	return writePackedRefsWithout(lock, map[string]bool{name: true})
+}
+
+// writePackedRefsWithout rewrites packed-refs through its lock, leaving
+// out the given refs. The file is left alone if none of them are packed.
+func writePackedRefsWithout(lock *lockfile.Lockfile, names map[string]bool) error {
+	data, err := ioutil.ReadFile(gitdir.Path(packedRefsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	found := false
+	skipPeeled := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "^") && skipPeeled {
+			continue
+		}
+		skipPeeled = false
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+		if len(fields) == 2 && names[fields[1]] && !strings.HasPrefix(line, "#") {
+			found = true
+			skipPeeled = true
+			continue
+		}
+		buffer.WriteString(line)
+	}
+	if !found {
+		return nil
+	}
+
+	_, err = lock.Write(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	return lock.Commit()
+}
+
+// removeEmptyDirs removes directories left empty by deleting a ref,
+// stopping at the top level directories such as refs/heads
+func removeEmptyDirs(dir string) {
+	for {
+		rel, err := filepath.Rel(refPath("refs"), dir)
+		if err != nil || !strings.Contains(filepath.ToSlash(rel), "/") {
+			return
+		}
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// PackRefs will move every loose ref under refs/ into packed-refs, so
+// that repositories with many refs do not need a file for each.
+// Symbolic refs stay loose. A loose ref updated while the refs are
+// packed is kept, since its value is newer than the packed one.
+func PackRefs() error {
+	lock, err := lockfile.LockWithTimeout(gitdir.Path(packedRefsFile), packedRefsLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	refs, err := IterRefs("refs/")
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(packedRefsTitle)
+	var loose []Ref
+	for _, ref := range refs {
+		if ref.Symbolic() {
+			continue
+		}
+		fmt.Fprintf(&buffer, "%s %s\n", ref.Hash, ref.Name)
+		if ref.Peeled == "" {
+			ref.Peeled = peelTag(ref.Hash)
+		}
+		if ref.Peeled != "" {
+			fmt.Fprintf(&buffer, "^%s\n", ref.Peeled)
+		}
+		if _, err := os.Stat(refPath(ref.Name)); err == nil {
+			loose = append(loose, ref)
+		}
+	}
+
+	_, err = lock.Write(buffer.Bytes())
+	if err == nil {
+		err = lock.Commit()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range loose {
+		pruneLooseRef(ref)
+	}
+	return nil
+}
+
+// pruneLooseRef removes the loose file of a ref that has been packed,
+// unless it no longer holds the packed value
+func pruneLooseRef(ref Ref) {
+	lock, err := lockfile.LockWithTimeout(refPath(ref.Name), refLockTimeout)
+	if err != nil {
+		return
+	}
+	defer lock.Rollback()
+
+	hash, target, err := readLooseRef(ref.Name)
+	if err != nil || target != "" || hash != ref.Hash {
+		return
+	}
+	os.Remove(refPath(ref.Name))
+
+	// The lock file has to be gone before its directory can be removed
+	lock.Rollback()
+	removeEmptyDirs(filepath.Dir(refPath(ref.Name)))
+}
+
+// RenameRef will rename a ref along with its reflog, recording the
+// rename with the given message. A symbolic ref pointing to the old
+// name, such as HEAD, is updated to point to the new name.
+func RenameRef(oldName string, newName string, message string) error {
+	return moveRef(oldName, newName, message, true)
+}
+
+// CopyRef will create a new ref pointing to the same object as an
+// existing ref, along with a copy of its reflog
+func CopyRef(oldName string, newName string, message string) error {
+	return moveRef(oldName, newName, message, false)
+}
+
+func moveRef(oldName string, newName string, message string, remove bool) error {
+	ref, err := ReadRef(oldName)
+	if err != nil {
+		return err
+	}
+	if ref.Symbolic() {
+		return fmt.Errorf("refusing to rename symbolic ref %s", oldName)
+	}
+	if _, err := ReadRef(newName); err == nil {
+		return fmt.Errorf("cannot lock ref '%s': reference already exists", newName)
+	}
+
+	log, err := ioutil.ReadFile(reflogPath(oldName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	head, _ := ReadRef("HEAD")
+	if remove {
+		err = DeleteRef(oldName, ref.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The copy of the old reflog is kept until the new ref is written, so
+	// that a failure can put both back as they were
+	if log != nil {
+		err = writeReflogData(newName, log)
+	}
+	if err == nil {
+		err = UpdateRef(newName, ref.Hash, ZeroHash, message)
+	}
+	if err != nil {
+		// Put the old ref and its reflog back rather than losing them
+		deleteReflog(newName)
+		if remove && UpdateRef(oldName, ref.Hash, ZeroHash, message) == nil && log != nil {
+			writeReflogData(oldName, log)
+		}
+		return err
+	}
+
+	if remove && head.Target == oldName {
+		return UpdateSymbolicRef("HEAD", newName, "")
+	}
+	return nil
+}
+
+// peelTag returns the object an annotated tag finally points to, or an
+// empty string if the object is not an annotated tag. The header of
+// packed-refs promises that every annotated tag has its peeled value.
+func peelTag(hash string) string {
+	peeled := ""
+	for {
+		tag, err := objects.ReadTag(hash)
+		if err != nil {
+			return peeled
+		}
+		peeled = tag.Object
+		hash = tag.Object
+	}
+}
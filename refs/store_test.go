@@ -0,0 +1,50 @@
+package refs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattherman/mhgit/gitdir"
+)
+
+func TestFailedRenameKeepsReflog(t *testing.T) {
+	repository := filepath.Join(t.TempDir(), ".git")
+	os.MkdirAll(filepath.Join(repository, "refs", "heads"), 0755)
+	previous := gitdir.Get()
+	gitdir.Set(repository)
+	defer gitdir.Set(previous)
+	t.Setenv("GIT_COMMITTER_NAME", "A U Thor")
+	t.Setenv("GIT_COMMITTER_EMAIL", "author@example.com")
+
+	hash := "1111111111111111111111111111111111111111"
+	err := UpdateRef("refs/heads/topic", hash, ZeroHash, "branch: Created from master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(reflogPath("refs/heads/topic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new ref cannot be written while another process holds its lock
+	err = ioutil.WriteFile(refPath("refs/heads/renamed")+".lock", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RenameRef("refs/heads/topic", "refs/heads/renamed", "Branch: renamed refs/heads/topic to refs/heads/renamed")
+	if err == nil {
+		t.Fatal("expected renaming to a locked ref to fail")
+	}
+
+	if current, err := ResolveRef("refs/heads/topic"); err != nil || current != hash {
+		t.Errorf("refs/heads/topic is %s (%v), expected %s", current, err, hash)
+	}
+	if data, err := ioutil.ReadFile(reflogPath("refs/heads/topic")); err != nil || string(data) != string(log) {
+		t.Errorf("the reflog of refs/heads/topic is %q (%v), expected %q", data, err, log)
+	}
+	if ReflogExists("refs/heads/renamed") {
+		t.Error("a reflog was left for refs/heads/renamed")
+	}
+}
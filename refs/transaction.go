@@ -0,0 +1,277 @@
+package refs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/lockfile"
+)
+
+const (
+	transactionOpen = iota
+	transactionPrepared
+	transactionClosed
+)
+
+var errTransactionClosed = errors.New("the transaction was already committed or aborted")
+
+// Transaction collects updates to several refs and applies them
+// together, so that either every ref is updated or none of them are.
+// Prepare locks every ref and checks its old value before anything is
+// written, and Commit then replaces the refs while still holding all
+// of the locks.
+type Transaction struct {
+	updates    []*refUpdate
+	packedLock *lockfile.Lockfile
+	state      int
+}
+
+type refUpdate struct {
+	name    string
+	newHash string
+	oldHash string
+	message string
+	noDeref bool
+	current string
+	lock    *lockfile.Lockfile
+}
+
+// NewTransaction will return an empty transaction
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+// Update will queue pointing the ref at newHash, or deleting it if
+// newHash is ZeroHash. The old value is checked as it is by UpdateRef.
+// A symbolic ref has the ref it points to updated unless noDeref is
+// set, in which case the symbolic ref itself is replaced.
+func (t *Transaction) Update(name string, newHash string, oldHash string, message string, noDeref bool) error {
+	if t.state != transactionOpen {
+		return errTransactionClosed
+	}
+	// The name becomes a path, so it must not lead out of the refs or
+	// name another file of the repository
+	if err := CheckRefNameSafe(name); err != nil {
+		return err
+	}
+	for _, update := range t.updates {
+		if update.name == name {
+			return fmt.Errorf("multiple updates for ref '%s' not allowed", name)
+		}
+	}
+
+	t.updates = append(t.updates, &refUpdate{
+		name:    name,
+		newHash: newHash,
+		oldHash: oldHash,
+		message: message,
+		noDeref: noDeref,
+	})
+	return nil
+}
+
+// Create will queue creating a ref which must not exist yet
+func (t *Transaction) Create(name string, newHash string, message string, noDeref bool) error {
+	return t.Update(name, newHash, ZeroHash, message, noDeref)
+}
+
+// Delete will queue deleting a ref. If oldHash is not empty the ref is
+// only deleted if it currently points to oldHash.
+func (t *Transaction) Delete(name string, oldHash string, message string, noDeref bool) error {
+	return t.Update(name, ZeroHash, oldHash, message, noDeref)
+}
+
+// Verify will queue checking that the ref points to oldHash without
+// changing it. An empty oldHash requires that the ref does not exist.
+func (t *Transaction) Verify(name string, oldHash string, noDeref bool) error {
+	if oldHash == "" {
+		oldHash = ZeroHash
+	}
+	return t.Update(name, "", oldHash, "", noDeref)
+}
+
+// Prepare will lock every ref of the transaction and check their old
+// values. The transaction is aborted if any ref cannot be locked or
+// does not have the expected value.
+func (t *Transaction) Prepare() error {
+	switch t.state {
+	case transactionPrepared:
+		return nil
+	case transactionClosed:
+		return errTransactionClosed
+	}
+
+	err := t.lockRefs()
+	if err != nil {
+		t.Abort()
+		return err
+	}
+	t.state = transactionPrepared
+	return nil
+}
+
+func (t *Transaction) lockRefs() error {
+	referents := make(map[string]string)
+	deleting := false
+	for _, update := range t.updates {
+		requested := update.name
+		ref, err := ReadRef(update.name)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if !update.noDeref {
+			ref, err = resolve(update.name)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			update.name = ref.Name
+		}
+
+		if other, ok := referents[update.name]; ok {
+			return fmt.Errorf("multiple updates for '%s' (including one via '%s') are not allowed", update.name, other)
+		}
+		referents[update.name] = requested
+
+		if update.newHash == ZeroHash {
+			deleting = true
+		} else if update.newHash != "" && err == ErrNotFound {
+			if err := t.checkNameConflicts(update.name); err != nil {
+				return err
+			}
+		}
+
+		update.lock, err = lockfile.LockWithTimeout(refPath(update.name), refLockTimeout)
+		if err != nil {
+			return fmt.Errorf("cannot lock ref '%s': %v", update.name, err)
+		}
+
+		// The value is read again now that nobody else can change it
+		update.current, err = ResolveRef(update.name)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		err = verifyOldHash(update.name, update.current, update.oldHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Deleted refs may also have to be removed from packed-refs
+	if deleting {
+		lock, err := lockfile.LockWithTimeout(gitdir.Path(packedRefsFile), packedRefsLockTimeout)
+		if err != nil {
+			return err
+		}
+		t.packedLock = lock
+	}
+	return nil
+}
+
+// checkNameConflicts checks a new ref against the existing refs and
+// the other refs of the transaction
+func (t *Transaction) checkNameConflicts(name string) error {
+	for _, update := range t.updates {
+		if strings.HasPrefix(update.name, name+"/") || strings.HasPrefix(name, update.name+"/") {
+			return fmt.Errorf("cannot lock ref '%s': '%s' conflicts with '%s'", name, update.name, name)
+		}
+	}
+	return checkNameConflicts(name)
+}
+
+// Commit will prepare the transaction if that has not been done yet,
+// then write every ref and record the updates in their reflogs
+func (t *Transaction) Commit() error {
+	err := t.Prepare()
+	if err != nil {
+		return err
+	}
+	defer t.Abort()
+
+	committer, err := ident.Committer()
+	if err != nil {
+		return err
+	}
+	head, _ := ReadRef("HEAD")
+
+	// The packed entries go first, so a failure cannot leave an
+	// outdated packed value visible once the loose refs are removed
+	if t.packedLock != nil {
+		deleted := make(map[string]bool)
+		for _, update := range t.updates {
+			if update.newHash == ZeroHash {
+				deleted[update.name] = true
+			}
+		}
+		err = writePackedRefsWithout(t.packedLock, deleted)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, update := range t.updates {
+		switch update.newHash {
+		case "":
+			continue
+		case ZeroHash:
+			err = t.deleteRef(update)
+		default:
+			err = t.writeRef(update, head, committer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Transaction) writeRef(update *refUpdate, head Ref, committer ident.Identity) error {
+	_, err := update.lock.Write([]byte(update.newHash + "\n"))
+	if err != nil {
+		return err
+	}
+
+	err = appendReflog(update.name, update.current, update.newHash, committer, update.message)
+	if err != nil {
+		return err
+	}
+
+	// Updating the current branch also moves HEAD
+	if head.Target == update.name {
+		err = appendReflog("HEAD", update.current, update.newHash, committer, update.message)
+		if err != nil {
+			return err
+		}
+	}
+	return update.lock.Commit()
+}
+
+func (t *Transaction) deleteRef(update *refUpdate) error {
+	err := os.Remove(refPath(update.name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// The lock file has to be gone before its directory can be removed
+	update.lock.Rollback()
+	removeEmptyDirs(filepath.Dir(refPath(update.name)))
+	return deleteReflog(update.name)
+}
+
+// Abort will release every lock without changing any ref. Refs already
+// written by a failed Commit are not restored.
+func (t *Transaction) Abort() {
+	for _, update := range t.updates {
+		if update.lock != nil {
+			update.lock.Rollback()
+		}
+	}
+	if t.packedLock != nil {
+		t.packedLock.Rollback()
+	}
+	t.state = transactionClosed
+}
@@ -0,0 +1,219 @@
+package remote
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mattherman/mhgit/refs"
+)
+
+var fullHashPattern = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// Refspec represents a mapping between the refs of a remote and local
+// refs, such as "+refs/heads/*:refs/remotes/origin/*". A pattern has a
+// single '*' on each side, matching the same text. A negative refspec,
+// written "^refs/heads/wip/*", excludes the refs it matches from the
+// others. A refspec with only a colon pushes matching branches.
+type Refspec struct {
+	Source      string
+	Destination string
+	Force       bool
+	Pattern     bool
+	Negative    bool
+	Matching    bool
+}
+
+// ParseRefspec will parse a fetch or push refspec. The source of a
+// fetch refspec must be a ref or a full hash, while the source of a
+// push refspec may be any revision and is empty when deleting a ref.
+func ParseRefspec(spec string, fetch bool) (Refspec, error) {
+	invalid := fmt.Errorf("invalid refspec '%s'", spec)
+
+	if spec == "" {
+		return Refspec{}, invalid
+	}
+
+	var refspec Refspec
+	rest := spec
+	switch {
+	case strings.HasPrefix(rest, "^"):
+		refspec.Negative = true
+		rest = rest[1:]
+	case strings.HasPrefix(rest, "+"):
+		refspec.Force = true
+		rest = rest[1:]
+	}
+
+	if colon := strings.LastIndex(rest, ":"); colon != -1 {
+		refspec.Source, refspec.Destination = rest[:colon], rest[colon+1:]
+		if refspec.Negative {
+			return Refspec{}, invalid
+		}
+		if refspec.Source == "" && refspec.Destination == "" {
+			if fetch {
+				return Refspec{}, invalid
+			}
+			refspec.Matching = true
+			return refspec, nil
+		}
+	} else {
+		refspec.Source = rest
+	}
+
+	sourcePattern := strings.Contains(refspec.Source, "*")
+	destinationPattern := strings.Contains(refspec.Destination, "*")
+	if sourcePattern && refspec.Destination != "" && !destinationPattern || destinationPattern && !sourcePattern {
+		return Refspec{}, invalid
+	}
+	refspec.Pattern = sourcePattern
+
+	switch {
+	case refspec.Negative:
+		if refspec.Source == "" || fullHashPattern.MatchString(refspec.Source) || !validRefspecName(refspec.Source) {
+			return Refspec{}, invalid
+		}
+	case fetch:
+		// An empty source fetches HEAD
+		if refspec.Source != "" && !fullHashPattern.MatchString(refspec.Source) && !validRefspecName(refspec.Source) {
+			return Refspec{}, invalid
+		}
+	default:
+		if refspec.Pattern && !validRefspecName(refspec.Source) || strings.Count(refspec.Source, "*") > 1 {
+			return Refspec{}, invalid
+		}
+	}
+	if refspec.Destination != "" && !validRefspecName(refspec.Destination) {
+		return Refspec{}, invalid
+	}
+	return refspec, nil
+}
+
+// ParseRefspecs will parse several refspecs of the same kind
+func ParseRefspecs(specs []string, fetch bool) ([]Refspec, error) {
+	var refspecs []Refspec
+	for _, spec := range specs {
+		refspec, err := ParseRefspec(spec, fetch)
+		if err != nil {
+			return nil, err
+		}
+		refspecs = append(refspecs, refspec)
+	}
+	return refspecs, nil
+}
+
+// validRefspecName returns true if the name is a valid ref name once
+// its single '*', if any, is replaced. Names of one level such as
+// "main" are allowed, since they are expanded when matched.
+func validRefspecName(name string) bool {
+	if strings.Count(name, "*") > 1 {
+		return false
+	}
+	return refs.CheckRefFormat(strings.Replace(name, "*", "x", 1), true) == nil
+}
+
+// String returns the refspec as it is written in the configuration
+func (r Refspec) String() string {
+	if r.Matching {
+		return ":"
+	}
+	prefix := ""
+	switch {
+	case r.Negative:
+		prefix = "^"
+	case r.Force:
+		prefix = "+"
+	}
+	if r.Destination == "" && r.Source != "" {
+		return prefix + r.Source
+	}
+	return prefix + r.Source + ":" + r.Destination
+}
+
+// Match returns true if the name matches the source of the refspec
+func (r Refspec) Match(name string) bool {
+	_, ok := matchPattern(r.Source, name, r.Pattern)
+	return ok
+}
+
+// Map returns the destination a name matching the source is mapped to,
+// with the part matched by the '*' of a pattern put in place of the '*'
+// of the destination
+func (r Refspec) Map(name string) (string, bool) {
+	matched, ok := matchPattern(r.Source, name, r.Pattern)
+	if !ok {
+		return "", false
+	}
+	if !r.Pattern {
+		return r.Destination, true
+	}
+	return strings.Replace(r.Destination, "*", matched, 1), true
+}
+
+// Reverse returns the refspec mapping the destination back to the
+// source, such as for finding the remote ref of a remote-tracking ref
+func (r Refspec) Reverse() Refspec {
+	reversed := r
+	reversed.Source, reversed.Destination = r.Destination, r.Source
+	return reversed
+}
+
+// matchPattern matches a name against a ref or a pattern, returning the
+// text matched by the '*' of a pattern. A '*' may match several levels
+// of the name, so "refs/heads/*" matches "refs/heads/feature/x".
+func matchPattern(pattern string, name string, isPattern bool) (string, bool) {
+	if !isPattern {
+		return "", pattern == name
+	}
+	star := strings.Index(pattern, "*")
+	prefix, suffix := pattern[:star], pattern[star+1:]
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// Excluded returns true if a negative refspec matches the name
+func Excluded(refspecs []Refspec, name string) bool {
+	for _, refspec := range refspecs {
+		if refspec.Negative && refspec.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MapRef returns the destination of a name by the first positive
+// refspec whose source matches it, and whether that refspec forces the
+// update. Names matched by a negative refspec are not mapped.
+func MapRef(refspecs []Refspec, name string) (string, bool, bool) {
+	if Excluded(refspecs, name) {
+		return "", false, false
+	}
+	for _, refspec := range refspecs {
+		if refspec.Negative || refspec.Matching || refspec.Destination == "" {
+			continue
+		}
+		if destination, ok := refspec.Map(name); ok {
+			return destination, refspec.Force, true
+		}
+	}
+	return "", false, false
+}
+
+// ReverseMapRef returns the source a destination is mapped from by the
+// first positive refspec, unless a negative refspec excludes it
+func ReverseMapRef(refspecs []Refspec, destination string) (string, bool) {
+	for _, refspec := range refspecs {
+		if refspec.Negative || refspec.Matching || refspec.Destination == "" {
+			continue
+		}
+		if source, ok := refspec.Reverse().Map(destination); ok {
+			if Excluded(refspecs, source) {
+				return "", false
+			}
+			return source, true
+		}
+	}
+	return "", false
+}
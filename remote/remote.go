@@ -0,0 +1,166 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/refs"
+)
+
+// ErrNotFound is returned when no remote of the name is configured
+var ErrNotFound = errors.New("remote not found")
+
+// Remote represents a repository configured in a [remote "name"]
+// section. Fetch refspecs map the refs of the remote to local refs,
+// usually the remote-tracking refs in refs/remotes/<name>/, and push
+// refspecs map local refs to the refs of the remote.
+type Remote struct {
+	Name     string
+	URLs     []string
+	PushURLs []string
+	Fetch    []Refspec
+	Push     []Refspec
+
+	// TagOpt is "--tags" to fetch every tag, "--no-tags" to fetch none,
+	// or empty to fetch the tags pointing into the fetched history
+	TagOpt string
+
+	// Mirror makes a push update every ref of the remote to match the
+	// local refs, deleting the ones that no longer exist locally
+	Mirror bool
+
+	// UploadPack and ReceivePack are the programs run for the remote
+	// when fetching and pushing, if not the ones of mhgit
+	UploadPack  string
+	ReceivePack string
+}
+
+// Get will read the configuration of a remote
+func Get(name string) (*Remote, error) {
+	cfg, err := config.Read()
+	if err != nil {
+		return nil, err
+	}
+	if !exists(cfg, name) {
+		return nil, ErrNotFound
+	}
+
+	section := "remote." + name + "."
+	remote := &Remote{
+		Name:     name,
+		URLs:     cfg.GetAll(section + "url"),
+		PushURLs: cfg.GetAll(section + "pushurl"),
+	}
+	remote.TagOpt, _ = cfg.Get(section + "tagopt")
+	remote.UploadPack, _ = cfg.Get(section + "uploadpack")
+	remote.ReceivePack, _ = cfg.Get(section + "receivepack")
+	remote.Mirror, err = cfg.Bool(section+"mirror", false)
+	if err != nil {
+		return nil, err
+	}
+
+	remote.Fetch, err = ParseRefspecs(cfg.GetAll(section+"fetch"), true)
+	if err != nil {
+		return nil, fmt.Errorf("remote '%s': %v", name, err)
+	}
+	remote.Push, err = ParseRefspecs(cfg.GetAll(section+"push"), false)
+	if err != nil {
+		return nil, fmt.Errorf("remote '%s': %v", name, err)
+	}
+	return remote, nil
+}
+
+// List returns the names of the configured remotes, in the order they
+// appear in the configuration
+func List() ([]string, error) {
+	cfg, err := config.Read()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Subsections("remote"), nil
+}
+
+// Exists returns true if a remote of the name is configured
+func Exists(name string) bool {
+	cfg, err := config.Read()
+	return err == nil && exists(cfg, name)
+}
+
+func exists(cfg *config.Config, name string) bool {
+	for _, configured := range cfg.Subsections("remote") {
+		if configured == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckName returns an error if the name cannot be used for a remote,
+// because its remote-tracking refs would not have valid names
+func CheckName(name string) error {
+	if name == "" || refs.CheckRefFormat("refs/remotes/"+name+"/test", false) != nil {
+		return fmt.Errorf("'%s' is not a valid remote name", name)
+	}
+	return nil
+}
+
+// DefaultFetchRefspec returns the refspec that fetches every branch of
+// a remote into its remote-tracking branches
+func DefaultFetchRefspec(name string) string {
+	return "+refs/heads/*:" + TrackingPrefix(name) + "*"
+}
+
+// TrackingPrefix returns the prefix of the remote-tracking refs of a
+// remote, such as "refs/remotes/origin/"
+func TrackingPrefix(name string) string {
+	return "refs/remotes/" + name + "/"
+}
+
+// URL returns the URL fetched from, which is the first one configured
+func (r *Remote) URL() string {
+	if len(r.URLs) == 0 {
+		return ""
+	}
+	return r.URLs[0]
+}
+
+// PushURLList returns the URLs pushed to, which are the push URLs if
+// any are configured and otherwise the URLs fetched from
+func (r *Remote) PushURLList() []string {
+	if len(r.PushURLs) > 0 {
+		return r.PushURLs
+	}
+	return r.URLs
+}
+
+// TrackingRef returns the local ref a ref of the remote is fetched
+// into, according to the fetch refspecs
+func (r *Remote) TrackingRef(name string) (string, bool) {
+	destination, _, ok := MapRef(r.Fetch, name)
+	return destination, ok
+}
+
+// RemoteRef returns the ref of the remote that a local ref, such as a
+// remote-tracking branch, is fetched from
+func (r *Remote) RemoteRef(name string) (string, bool) {
+	return ReverseMapRef(r.Fetch, name)
+}
+
+// TrackingRefs returns the local refs the fetch refspecs of the remote
+// map refs into, such as the remote-tracking branches. Refs matched by
+// the destination of a refspec that fetches a single ref are included.
+func (r *Remote) TrackingRefs() ([]refs.Ref, error) {
+	all, err := refs.IterRefs("refs/")
+	if err != nil {
+		return nil, err
+	}
+
+	var tracking []refs.Ref
+	for _, ref := range all {
+		if _, ok := r.RemoteRef(ref.Name); ok {
+			tracking = append(tracking, ref)
+		}
+	}
+	return tracking, nil
+}
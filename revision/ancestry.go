@@ -0,0 +1,89 @@
+package revision
+
+import (
+	"github.com/mattherman/mhgit/objects"
+)
+
+// Ancestors returns the commit and every commit reachable from it
+// through its parents, stopping at the edge of a shallow repository
+func Ancestors(hash string) (map[string]bool, error) {
+	shallow, err := objects.ReadShallow()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	queue := []string{hash}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+
+		commit, err := objects.ReadCommit(current)
+		if err != nil {
+			return nil, err
+		}
+		if !shallow[current] {
+			queue = append(queue, commit.Parents...)
+		}
+	}
+	return seen, nil
+}
+
+// IsAncestor returns true if the first commit can be reached from the
+// second one, including when they are the same commit
+func IsAncestor(ancestor string, descendant string) (bool, error) {
+	if ancestor == descendant {
+		return true, nil
+	}
+	ancestors, err := Ancestors(descendant)
+	if err != nil {
+		return false, err
+	}
+	return ancestors[ancestor], nil
+}
+
+// IsFastForward returns true if updating a ref from the old object to
+// the new one is a fast-forward, that is if both peel to commits and the
+// new commit descends from the old one
+func IsFastForward(oldHash string, newHash string) bool {
+	oldCommit, err := Peel(oldHash, "commit")
+	if err != nil {
+		return false
+	}
+	newCommit, err := Peel(newHash, "commit")
+	if err != nil {
+		return false
+	}
+	ancestor, err := IsAncestor(oldCommit, newCommit)
+	return err == nil && ancestor
+}
+
+// AheadBehind returns how many commits can only be reached from the
+// first commit and how many can only be reached from the second one
+func AheadBehind(hash string, upstream string) (int, int, error) {
+	ours, err := Ancestors(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	theirs, err := Ancestors(upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ahead, behind := 0, 0
+	for commit := range ours {
+		if !theirs[commit] {
+			ahead++
+		}
+	}
+	for commit := range theirs {
+		if !ours[commit] {
+			behind++
+		}
+	}
+	return ahead, behind, nil
+}
@@ -0,0 +1,337 @@
+package revision
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/index"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+)
+
+const hashLength = 40
+
+// Resolve will return the hash of the object a revision names. A revision
+// is a hash, a possibly abbreviated hash or the name of a ref, optionally
+// followed by "@{N}" for its value N updates ago or "@{<date>}" for its
+// value at that time, and then by any number of "~N" and "^N" to select
+// ancestors of the commit. "<revision>:<path>" names the blob or tree at
+// the path in the tree of the revision, and ":<path>" or ":<N>:<path>"
+// names the entry of the index at the path and stage N.
+func Resolve(revision string) (string, error) {
+	if rev, path, ok := SplitPath(revision); ok {
+		return resolvePath(rev, path)
+	}
+
+	base, suffix := splitAncestry(revision)
+
+	hash, err := resolveBase(base)
+	if err != nil {
+		return "", err
+	}
+
+	for suffix != "" {
+		operator := suffix[0]
+		suffix = suffix[1:]
+
+		// "^{type}" peels tags until an object of the type is found
+		if operator == '^' && strings.HasPrefix(suffix, "{") {
+			end := strings.Index(suffix, "}")
+			if end == -1 {
+				return "", fmt.Errorf("ambiguous argument '%s': unknown revision", revision)
+			}
+			hash, err = Peel(hash, suffix[1:end])
+			if err != nil {
+				return "", err
+			}
+			suffix = suffix[end+1:]
+			continue
+		}
+
+		digits := 0
+		for digits < len(suffix) && suffix[digits] >= '0' && suffix[digits] <= '9' {
+			digits++
+		}
+		count := 1
+		if digits > 0 {
+			count, _ = strconv.Atoi(suffix[:digits])
+		}
+		suffix = suffix[digits:]
+
+		if operator == '~' {
+			for i := 0; i < count; i++ {
+				hash, err = parent(hash, 1, revision)
+				if err != nil {
+					return "", err
+				}
+			}
+		} else if count > 0 {
+			hash, err = parent(hash, count, revision)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return hash, nil
+}
+
+// ResolveCommit will return the commit a revision names, peeling
+// annotated tags to the commit they point to
+func ResolveCommit(revision string) (string, error) {
+	hash, err := Resolve(revision)
+	if err != nil {
+		return "", err
+	}
+	return Peel(hash, "commit")
+}
+
+// Peel will follow annotated tags starting from the object until an
+// object of the given type is found. An empty type follows tags to the
+// first object that is not a tag. The tree of a commit is returned when
+// peeling a commit to a tree.
+func Peel(hash string, objectType string) (string, error) {
+	for {
+		obj, err := objects.ReadObject(hash)
+		if err != nil {
+			return "", err
+		}
+		if obj.Type() == objectType || (objectType == "" && obj.Type() != "tag") {
+			return hash, nil
+		}
+
+		switch obj.Type() {
+		case "tag":
+			tag, err := objects.ParseTag(obj.Data)
+			if err != nil {
+				return "", err
+			}
+			hash = tag.Object
+		case "commit":
+			if objectType != "tree" {
+				return "", fmt.Errorf("%s is a commit, not a %s", hash, objectType)
+			}
+			commit, err := objects.ParseCommit(obj.Data)
+			if err != nil {
+				return "", err
+			}
+			return commit.Tree, nil
+		default:
+			return "", fmt.Errorf("%s is a %s, not a %s", hash, obj.Type(), objectType)
+		}
+	}
+}
+
+// splitAncestry splits the "~N", "^N" and "^{type}" suffixes from a
+// revision
+func splitAncestry(revision string) (string, string) {
+	// A date in braces may contain anything
+	start := 0
+	if at := strings.Index(revision, "@{"); at != -1 {
+		if close := strings.Index(revision[at:], "}"); close != -1 {
+			start = at + close
+		}
+	}
+	if i := strings.IndexAny(revision[start:], "~^"); i != -1 {
+		return revision[:start+i], revision[start+i:]
+	}
+	return revision, ""
+}
+
+// SplitPath splits "<revision>:<path>" into the revision and the path,
+// returning false if the revision does not name a path. Colons in a
+// date in braces do not separate a path.
+func SplitPath(revision string) (string, string, bool) {
+	start := 0
+	if at := strings.Index(revision, "@{"); at != -1 {
+		if close := strings.Index(revision[at:], "}"); close != -1 {
+			start = at + close
+		}
+	}
+	i := strings.IndexByte(revision[start:], ':')
+	if i == -1 {
+		return revision, "", false
+	}
+	return revision[:start+i], revision[start+i+1:], true
+}
+
+// resolvePath returns the object at the path in the tree of the
+// revision, or in the index if there is no revision
+func resolvePath(revision string, path string) (string, error) {
+	if revision == "" {
+		return resolveIndexPath(path)
+	}
+
+	hash, err := Resolve(revision)
+	if err != nil {
+		return "", err
+	}
+	hash, err = Peel(hash, "tree")
+	if err != nil {
+		return "", err
+	}
+
+	path = strings.Trim(strings.TrimPrefix(path, "./"), "/")
+	if path == "" {
+		return hash, nil
+	}
+	for _, name := range strings.Split(path, "/") {
+		entries, err := objects.ReadTree(hash)
+		if err != nil {
+			return "", fmt.Errorf("path '%s' does not exist in '%s'", path, revision)
+		}
+		found := false
+		for _, entry := range entries {
+			if entry.Name == name {
+				hash, found = entry.Hash, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("path '%s' does not exist in '%s'", path, revision)
+		}
+	}
+	return hash, nil
+}
+
+func resolveIndexPath(path string) (string, error) {
+	stage := 0
+	if len(path) > 2 && path[0] >= '0' && path[0] <= '3' && path[1] == ':' {
+		stage, path = int(path[0]-'0'), path[2:]
+	}
+
+	idx, err := index.ReadIndex()
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range idx.Entries {
+		if entry.Path == path && entry.Stage() == stage {
+			return entry.Hash, nil
+		}
+	}
+	return "", fmt.Errorf("path '%s' is not in the index at stage %d", path, stage)
+}
+
+// parent returns the Nth parent of a commit, peeling tags first
+func parent(hash string, n int, revision string) (string, error) {
+	hash, err := Peel(hash, "commit")
+	if err != nil {
+		return "", err
+	}
+	commit, err := objects.ReadCommit(hash)
+	if err != nil {
+		return "", err
+	}
+	if n > len(commit.Parents) {
+		return "", fmt.Errorf("ambiguous argument '%s': unknown revision", revision)
+	}
+	return commit.Parents[n-1], nil
+}
+
+func resolveBase(base string) (string, error) {
+	if base == "@" {
+		base = "HEAD"
+	}
+
+	if at := strings.Index(base, "@{"); at != -1 && strings.HasSuffix(base, "}") {
+		return resolveReflog(base[:at], base[at+2:len(base)-1])
+	}
+
+	if len(base) == hashLength && isHex(base) {
+		return base, nil
+	}
+
+	name, err := refs.ExpandRef(base)
+	if err == nil {
+		return refs.ResolveRef(name)
+	}
+	if err != refs.ErrNotFound {
+		return "", err
+	}
+
+	if len(base) >= 4 && isHex(base) {
+		hash, err := objects.ExpandHash(strings.ToLower(base))
+		if err == nil {
+			return hash, nil
+		}
+		if _, ok := err.(*objects.AmbiguousError); ok {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("ambiguous argument '%s': unknown revision", base)
+}
+
+// resolveReflog looks up the value of a ref in its reflog, either N
+// updates ago or at a point in time. Without a ref name the current
+// branch is used.
+func resolveReflog(name string, selector string) (string, error) {
+	var err error
+	if name == "" {
+		name, err = currentRef()
+	} else {
+		name, err = refs.ExpandRef(name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := refs.ReadReflog(name)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("log for '%s' is empty", shortName(name))
+	}
+
+	if n, err := strconv.Atoi(selector); err == nil && n >= 0 {
+		if n >= len(entries) {
+			return "", fmt.Errorf("log for '%s' only has %d entries", shortName(name), len(entries))
+		}
+		return entries[n].New, nil
+	}
+
+	date, err := ident.ParseApproxDate(selector, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("invalid reflog selector '@{%s}'", selector)
+	}
+	for _, entry := range entries {
+		if !entry.Identity.When.After(date) {
+			return entry.New, nil
+		}
+	}
+
+	// Like git, use the oldest known value when the log does not go
+	// back far enough
+	oldest := entries[len(entries)-1]
+	if oldest.Old == refs.ZeroHash {
+		return oldest.New, nil
+	}
+	return oldest.Old, nil
+}
+
+// currentRef returns the current branch, or HEAD if it is detached
+func currentRef() (string, error) {
+	branch, err := refs.CurrentBranch()
+	if err != nil {
+		return "", err
+	}
+	if branch == "" {
+		return "HEAD", nil
+	}
+	return "refs/heads/" + branch, nil
+}
+
+func shortName(name string) string {
+	return strings.TrimPrefix(name, "refs/heads/")
+}
+
+func isHex(text string) bool {
+	for _, c := range text {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"strings"
+
+	"github.com/mattherman/mhgit/pktline"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/revision"
+)
+
+// advertiseRefs will write the refs of the repository for the other
+// side, with the capabilities of the service after the first one. The
+// objects annotated tags point to follow them, marked with "^{}". The
+// advertised objects are returned, since only those may be wanted.
+func advertiseRefs(w *pktline.Writer, capabilities []string, withHead bool) (map[string]bool, error) {
+	all, err := refs.IterRefs("refs/")
+	if err != nil {
+		return nil, err
+	}
+	if withHead {
+		if head, err := refs.ResolveRef("HEAD"); err == nil {
+			all = append([]refs.Ref{{Name: "HEAD", Hash: head}}, all...)
+		}
+	}
+
+	advertised := make(map[string]bool)
+	suffix := "\x00" + strings.Join(capabilities, " ")
+	if len(all) == 0 {
+		err = w.WriteLine("%s capabilities^{}%s", refs.ZeroHash, suffix)
+		if err != nil {
+			return nil, err
+		}
+		return advertised, w.Flush()
+	}
+
+	for _, ref := range all {
+		err = w.WriteLine("%s %s%s", ref.Hash, ref.Name, suffix)
+		if err != nil {
+			return nil, err
+		}
+		suffix = ""
+		advertised[ref.Hash] = true
+
+		if !strings.HasPrefix(ref.Name, "refs/tags/") {
+			continue
+		}
+		if peeled, err := revision.Peel(ref.Hash, ""); err == nil && peeled != ref.Hash {
+			err = w.WriteLine("%s %s^{}", peeled, ref.Name)
+			if err != nil {
+				return nil, err
+			}
+			advertised[peeled] = true
+		}
+	}
+	return advertised, w.Flush()
+}
+
+// headSymref returns the capability naming the branch HEAD points to
+func headSymref() (string, bool) {
+	head, err := refs.ReadRef("HEAD")
+	if err != nil || !head.Symbolic() {
+		return "", false
+	}
+	return "symref=HEAD:" + head.Target, true
+}
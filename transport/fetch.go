@@ -0,0 +1,341 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/ident"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pktline"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/revision"
+)
+
+const (
+	// How many commits are offered between each flush
+	haveBatchSize = 32
+
+	// How many commits are offered after the last common one before
+	// giving up on finding more
+	maxInVain = 256
+)
+
+// Fetch will ask the service for the wanted objects and store the pack
+// of those missing from this repository, returning the hashes of the
+// objects received. The commits this repository has are offered so
+// that only what is missing is sent. Progress messages of the service
+// are written to progress, unless it is nil.
+func (c *Conn) Fetch(wants []string, includeTags bool, progress io.Writer) ([]string, error) {
+	defer c.Close()
+
+	var capabilities []string
+	for _, capability := range []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "ofs-delta"} {
+		if c.Supports(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	if progress == nil && c.Supports("no-progress") {
+		capabilities = append(capabilities, "no-progress")
+	}
+	if includeTags && c.Supports("include-tag") {
+		capabilities = append(capabilities, "include-tag")
+	}
+	capabilities = append(capabilities, agent)
+
+	request := &fetchRequest{conn: c, wants: wants, capabilities: capabilities}
+	err := request.start()
+	if err == nil && c.Supports("multi_ack_detailed") {
+		err = request.negotiate()
+	}
+	if err == nil && c.http != nil && request.rounds > 0 {
+		err = request.start()
+	}
+	if err == nil {
+		err = c.writer.WriteLine("done")
+	}
+	if err == nil {
+		err = c.send(true)
+	}
+	if err == nil {
+		err = c.readFinalAck()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pack *objects.ReceivedPack
+	if c.Supports("side-band-64k") {
+		pack, err = objects.NewReceivedPack()
+		if err == nil {
+			err = pktline.Demultiplex(c.reader, pack, progress)
+		}
+	} else {
+		pack, err = objects.ReadPack(c.output)
+	}
+	if pack != nil {
+		defer pack.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.Read()
+	if err != nil {
+		return nil, err
+	}
+	limit, err := unpackLimit(cfg, "fetch")
+	if err != nil {
+		return nil, err
+	}
+	return pack.Store(limit)
+}
+
+// fetchRequest is what is asked of the service when fetching
+type fetchRequest struct {
+	conn         *Conn
+	wants        []string
+	capabilities []string
+	walk         *haveWalk
+
+	// How many rounds of commits were offered
+	rounds int
+}
+
+// start writes the objects wanted, with the capabilities used after the
+// first one. A stateless service is told in each request, along with
+// the common commits found so far.
+func (f *fetchRequest) start() error {
+	w := f.conn.writer
+	for i, want := range f.wants {
+		var err error
+		if i == 0 {
+			err = w.WriteLine("want %s %s", want, strings.Join(f.capabilities, " "))
+		} else {
+			err = w.WriteLine("want %s", want)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := w.Flush()
+	if err != nil || f.walk == nil {
+		return err
+	}
+	for _, hash := range f.walk.commonTips {
+		err = w.WriteLine("have %s", hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// negotiate offers the commits of this repository, newest first, until
+// the service is ready to send the pack or nothing more is worth
+// offering
+func (f *fetchRequest) negotiate() error {
+	c := f.conn
+	walk, err := newHaveWalk()
+	if err != nil {
+		return err
+	}
+
+	f.walk = walk
+
+	inVain := 0
+	foundCommon := false
+	for {
+		var batch []string
+		for len(batch) < haveBatchSize {
+			hash, ok := walk.next()
+			if !ok {
+				break
+			}
+			batch = append(batch, hash)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if c.http != nil && f.rounds > 0 {
+			err = f.start()
+			if err != nil {
+				return err
+			}
+		}
+		f.rounds++
+		for _, hash := range batch {
+			err = c.writer.WriteLine("have %s", hash)
+			if err != nil {
+				return err
+			}
+		}
+		inVain += len(batch)
+		err = c.writer.Flush()
+		if err == nil {
+			err = c.send(false)
+		}
+		if err != nil {
+			return err
+		}
+
+		ready := false
+		for {
+			line, ok, err := c.reader.ReadLine()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("protocol error: expected ACK/NAK, got a flush packet")
+			}
+			if line == "NAK" {
+				break
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 3 || fields[0] != "ACK" {
+				return fmt.Errorf("protocol error: expected ACK/NAK, got '%s'", line)
+			}
+			switch fields[2] {
+			case "common":
+				foundCommon, inVain = true, 0
+				walk.markCommon(fields[1])
+			case "ready":
+				ready = true
+			}
+		}
+		if ready || (foundCommon && inVain >= maxInVain) {
+			return nil
+		}
+	}
+}
+
+// readFinalAck reads the answer of the service to "done", which names
+// a common commit, or is NAK when there is none. A stateless service
+// first acknowledges the common commits it was reminded of.
+func (c *Conn) readFinalAck() error {
+	for {
+		line, ok, err := c.reader.ReadLine()
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		switch {
+		case ok && line == "NAK":
+			return nil
+		case ok && len(fields) == 2 && fields[0] == "ACK":
+			return nil
+		case ok && len(fields) == 3 && fields[0] == "ACK":
+			continue
+		case ok && strings.HasPrefix(line, "ERR "):
+			return fmt.Errorf("remote error: %s", strings.TrimPrefix(line, "ERR "))
+		}
+		return fmt.Errorf("protocol error: expected ACK/NAK, got '%s'", line)
+	}
+}
+
+// haveWalk goes through the commits reachable from the refs of this
+// repository, newest first, skipping those known to be common
+type haveWalk struct {
+	// The commits the service said are common
+	commonTips []string
+
+	queue   []haveCommit
+	seen    map[string]bool
+	common  map[string]bool
+	shallow map[string]bool
+}
+
+type haveCommit struct {
+	hash    string
+	when    time.Time
+	parents []string
+}
+
+func newHaveWalk() (*haveWalk, error) {
+	shallow, err := objects.ReadShallow()
+	if err != nil {
+		return nil, err
+	}
+	walk := &haveWalk{seen: make(map[string]bool), common: make(map[string]bool), shallow: shallow}
+
+	all, err := refs.IterRefs("refs/")
+	if err != nil {
+		return nil, err
+	}
+	if head, err := refs.ResolveRef("HEAD"); err == nil {
+		all = append(all, refs.Ref{Name: "HEAD", Hash: head})
+	}
+	for _, ref := range all {
+		if commit, err := revision.Peel(ref.Hash, "commit"); err == nil {
+			walk.push(commit)
+		}
+	}
+	return walk, nil
+}
+
+// push adds the commit to the queue, which is kept sorted by date
+func (w *haveWalk) push(hash string) {
+	if w.seen[hash] {
+		return
+	}
+	w.seen[hash] = true
+	commit, err := objects.ReadCommit(hash)
+	if err != nil {
+		return
+	}
+	entry := haveCommit{hash: hash}
+	if committer, err := ident.Parse(commit.Committer); err == nil {
+		entry.when = committer.When
+	}
+	if !w.shallow[hash] {
+		entry.parents = commit.Parents
+	}
+
+	i := sort.Search(len(w.queue), func(i int) bool { return w.queue[i].when.Before(entry.when) })
+	w.queue = append(w.queue, haveCommit{})
+	copy(w.queue[i+1:], w.queue[i:])
+	w.queue[i] = entry
+}
+
+// next returns the newest commit not yet offered
+func (w *haveWalk) next() (string, bool) {
+	for len(w.queue) > 0 {
+		entry := w.queue[0]
+		w.queue = w.queue[1:]
+		if w.common[entry.hash] {
+			continue
+		}
+		for _, parent := range entry.parents {
+			w.push(parent)
+		}
+		return entry.hash, true
+	}
+	return "", false
+}
+
+// markCommon marks the ancestors of a common commit as common, since
+// offering them would tell the service nothing new
+func (w *haveWalk) markCommon(hash string) {
+	if !w.common[hash] {
+		w.commonTips = append(w.commonTips, hash)
+	}
+	pending := []string{hash}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if w.common[current] {
+			continue
+		}
+		w.common[current] = true
+		w.seen[current] = true
+		commit, err := objects.ReadCommit(current)
+		if err != nil || w.shallow[current] {
+			continue
+		}
+		pending = append(pending, commit.Parents...)
+	}
+}
@@ -0,0 +1,228 @@
+package transport
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+)
+
+// testServer serves the handler, recording the encoding of each request
+// it receives
+type testServer struct {
+	*httptest.Server
+	handler *HTTPHandler
+
+	mu        sync.Mutex
+	encodings []string
+}
+
+// newTestServer serves the repository in the directory. The handler and
+// the client share the repository in use, so each response is only sent
+// once the handler is done with it. When a password is given, requests
+// must authenticate as jane with it.
+func newTestServer(t *testing.T, dir string, password string) *testServer {
+	s := &testServer{handler: NewHTTPHandler(dir)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if password != "" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "jane" || pass != password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+		}
+		s.mu.Lock()
+		s.encodings = append(s.encodings, r.Header.Get("Content-Encoding"))
+		s.mu.Unlock()
+
+		recorder := httptest.NewRecorder()
+		s.handler.ServeHTTP(recorder, r)
+		for name, values := range recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) repositoryURL() string {
+	return s.URL + "/repo.git"
+}
+
+func TestHTTPFetch(t *testing.T) {
+	server, client := newTestRepository(t, ""), newTestRepository(t, "")
+	first, second := history(t, server, client)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", second) })
+	inRepository(client, func() {
+		updateRef(t, "refs/heads/master", first)
+		err := objects.RemoveLooseObject(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	s := newTestServer(t, server, "")
+
+	inRepository(client, func() {
+		conn, err := Connect(s.repositoryURL(), UploadPackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if len(conn.Refs) != 1 || conn.Refs[0].Hash != second {
+			t.Fatalf("unexpected advertised refs %v", conn.Refs)
+		}
+		hashes, err := conn.Fetch([]string{second}, false, nil)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		if len(hashes) == 0 || !Connected([]string{second}) {
+			t.Errorf("the fetched commit is not connected, received %v", hashes)
+		}
+	})
+}
+
+func TestHTTPPushIsRefusedUnlessAllowed(t *testing.T) {
+	server, client := newTestRepository(t, ""), newTestRepository(t, "")
+	first, second := history(t, server, client)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", first) })
+	s := newTestServer(t, server, "")
+
+	inRepository(client, func() {
+		_, err := Connect(s.repositoryURL(), ReceivePackService, "")
+		if err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("expected pushing to be forbidden, got %v", err)
+		}
+
+		s.handler.AllowPush = func(r *http.Request) bool { return true }
+		conn, err := Connect(s.repositoryURL(), ReceivePackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		update := &RefUpdate{Name: "refs/heads/master", OldHash: first, NewHash: second}
+		err = conn.Push([]*RefUpdate{update})
+		if err != nil || update.Error != "" {
+			t.Fatalf("Push failed: %v %s", err, update.Error)
+		}
+	})
+
+	inRepository(server, func() {
+		hash, err := refs.ResolveRef("refs/heads/master")
+		if err != nil || hash != second {
+			t.Errorf("master is %s (%v), expected %s", hash, err, second)
+		}
+	})
+}
+
+// largeCommit writes a commit of a file too random to compress, so that
+// the request pushing it is compressed
+func largeCommit(t *testing.T, parent string) string {
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 2*gzipRequestSize)
+	random.Read(data)
+	return writeCommit(t, map[string]string{"large.bin": string(data)}, "large", parent)
+}
+
+func TestHTTPPushCompressedRequest(t *testing.T) {
+	server := newTestRepository(t, "[http]\n\treceivepack = true\n")
+	client := newTestRepository(t, "")
+	first, _ := history(t, server, client)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", first) })
+	s := newTestServer(t, server, "")
+
+	var large string
+	inRepository(client, func() {
+		large = largeCommit(t, first)
+		conn, err := Connect(s.repositoryURL(), ReceivePackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		update := &RefUpdate{Name: "refs/heads/master", OldHash: first, NewHash: large}
+		err = conn.Push([]*RefUpdate{update})
+		if err != nil || update.Error != "" {
+			t.Fatalf("Push failed: %v %s", err, update.Error)
+		}
+	})
+
+	if last := s.encodings[len(s.encodings)-1]; last != "gzip" {
+		t.Errorf("the push was sent with encoding %q, expected gzip", last)
+	}
+	inRepository(server, func() {
+		hash, err := refs.ResolveRef("refs/heads/master")
+		if err != nil || hash != large {
+			t.Errorf("master is %s (%v), expected %s", hash, err, large)
+		}
+	})
+}
+
+func TestHTTPRequestSizeIsLimited(t *testing.T) {
+	server := newTestRepository(t, "[http]\n\treceivepack = true\n")
+	client := newTestRepository(t, "")
+	first, _ := history(t, server, client)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", first) })
+	s := newTestServer(t, server, "")
+	s.handler.MaxRequestSize = gzipRequestSize
+
+	inRepository(client, func() {
+		large := largeCommit(t, first)
+		conn, err := Connect(s.repositoryURL(), ReceivePackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		update := &RefUpdate{Name: "refs/heads/master", OldHash: first, NewHash: large}
+		err = conn.Push([]*RefUpdate{update})
+		if err == nil && update.Error == "" {
+			t.Error("expected a request over the limit to be refused")
+		}
+	})
+
+	inRepository(server, func() {
+		hash, err := refs.ResolveRef("refs/heads/master")
+		if err != nil || hash != first {
+			t.Errorf("master is %s (%v), expected %s", hash, err, first)
+		}
+	})
+}
+
+func TestHTTPCredentialLookup(t *testing.T) {
+	server, client := newTestRepository(t, ""), newTestRepository(t, "")
+	_, second := history(t, server)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", second) })
+	s := newTestServer(t, server, "secret")
+
+	inRepository(client, func() {
+		_, err := Connect(s.repositoryURL(), UploadPackService, "")
+		if err == nil || !strings.Contains(err.Error(), "Authentication failed") {
+			t.Fatalf("expected authentication to fail without a credential, got %v", err)
+		}
+
+		credentials := filepath.Join(os.Getenv("HOME"), ".git-credentials")
+		stored := strings.Replace(s.URL, "http://", "http://jane:secret@", 1) + "\n"
+		err = ioutil.WriteFile(credentials, []byte(stored), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(credentials)
+
+		conn, err := Connect(s.repositoryURL(), UploadPackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		_, err = conn.Fetch([]string{second}, false, nil)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		if !objects.Exists(second) {
+			t.Error("the fetched commit is missing")
+		}
+	})
+}
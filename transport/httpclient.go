@@ -0,0 +1,207 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mattherman/mhgit/pktline"
+)
+
+// HTTPClient is the client used for http:// and https:// remotes
+var HTTPClient = http.DefaultClient
+
+// Requests larger than this are compressed with gzip
+const gzipRequestSize = 64 * 1024
+
+// httpSession is the state of a connection to a service over HTTP,
+// where each request is sent once it is complete
+type httpSession struct {
+	url        *url.URL
+	service    string
+	credential *Credential
+	request    bytes.Buffer
+	response   io.ReadCloser
+}
+
+// connectHTTP will ask the repository at the URL for the refs of the
+// service, which starts a connection
+func connectHTTP(rawURL string, service string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL '%s': %v", rawURL, err)
+	}
+	s := &httpSession{url: u, service: service}
+	if password, ok := u.User.Password(); ok {
+		s.credential = &Credential{Username: u.User.Username(), Password: password}
+	}
+
+	resp, err := s.do(http.MethodGet, "info/refs?service=git-"+service, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != fmt.Sprintf("application/x-git-%s-advertisement", service) {
+		return nil, fmt.Errorf("repository '%s' does not support the smart HTTP protocol", s.displayURL())
+	}
+
+	conn := &Conn{
+		URL:          rawURL,
+		Capabilities: make(map[string]string),
+		reader:       pktline.NewReader(resp.Body),
+		writer:       pktline.NewWriter(&s.request),
+		input:        &s.request,
+		http:         s,
+	}
+	// The refs follow a line naming the service and a flush packet
+	line, ok, err := conn.reader.ReadLine()
+	if err == nil && (!ok || line != "# service=git-"+service) {
+		err = fmt.Errorf("protocol error: unexpected service line '%s'", line)
+	}
+	if err == nil {
+		_, ok, err = conn.reader.ReadLine()
+		if err == nil && ok {
+			err = fmt.Errorf("protocol error: expected a flush packet after the service line")
+		}
+	}
+	if err == nil {
+		err = conn.readAdvertisement()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read from remote repository '%s': %v", s.displayURL(), err)
+	}
+	return conn, nil
+}
+
+// post will send what was written to the service as a request, and
+// make its response what the connection reads
+func (s *httpSession) post(c *Conn) error {
+	s.close()
+
+	body := append([]byte(nil), s.request.Bytes()...)
+	s.request.Reset()
+	resp, err := s.do(http.MethodPost, "git-"+s.service, body)
+	if err != nil {
+		return err
+	}
+	if resp.Header.Get("Content-Type") != fmt.Sprintf("application/x-git-%s-result", s.service) {
+		resp.Body.Close()
+		return fmt.Errorf("unexpected response from '%s' of type '%s'", s.displayURL(), resp.Header.Get("Content-Type"))
+	}
+	s.response = resp.Body
+	c.reader = pktline.NewReader(resp.Body)
+	c.output = resp.Body
+	return nil
+}
+
+// do sends a request to the path of the service in the repository. The
+// request is sent again with a stored credential if the server asks
+// for one.
+func (s *httpSession) do(method string, path string, body []byte) (*http.Response, error) {
+	target := strings.TrimSuffix(s.url.String(), "/") + "/" + path
+	triedLookup := s.credential != nil
+	for {
+		req, err := s.newRequest(method, target, body)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := HTTPClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("unable to access '%s': %v", s.displayURL(), err)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return resp, nil
+		case http.StatusUnauthorized:
+			resp.Body.Close()
+			if !triedLookup {
+				triedLookup = true
+				if credential, ok := LookupCredential(s.url); ok {
+					s.credential = &credential
+					continue
+				}
+			}
+			return nil, fmt.Errorf("Authentication failed for '%s'", s.displayURL())
+		case http.StatusNotFound:
+			resp.Body.Close()
+			return nil, fmt.Errorf("repository '%s' not found", s.displayURL())
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to access '%s': The requested URL returned error: %d", s.displayURL(), resp.StatusCode)
+		}
+	}
+}
+
+// newRequest returns a request of the service, with a large body
+// compressed
+func (s *httpSession) newRequest(method string, target string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	encoding := ""
+	if body != nil {
+		reader = bytes.NewReader(body)
+		if len(body) > gzipRequestSize {
+			var compressed bytes.Buffer
+			gz := gzip.NewWriter(&compressed)
+			gz.Write(body)
+			gz.Close()
+			reader, encoding = &compressed, "gzip"
+		}
+	}
+
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	// The credential is sent explicitly rather than from the URL
+	req.URL.User = nil
+	if s.credential != nil {
+		req.SetBasicAuth(s.credential.Username, s.credential.Password)
+	}
+	req.Header.Set("User-Agent", strings.Replace(agent, "agent=", "", 1))
+	if body != nil {
+		req.Header.Set("Content-Type", fmt.Sprintf("application/x-git-%s-request", s.service))
+		req.Header.Set("Accept", fmt.Sprintf("application/x-git-%s-result", s.service))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+	}
+	return req, nil
+}
+
+// displayURL returns the URL without its credential
+func (s *httpSession) displayURL() string {
+	u := *s.url
+	u.User = nil
+	return u.String()
+}
+
+// DisplayURL returns the URL of a remote as it is shown to the user,
+// without the credential of an HTTP URL
+func DisplayURL(rawURL string) string {
+	if !isHTTP(rawURL) {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return (&httpSession{url: u}).displayURL()
+}
+
+// close will close the last response
+func (s *httpSession) close() error {
+	if s.response == nil {
+		return nil
+	}
+	// The rest of the response is read so the connection can be reused
+	io.Copy(ioutil.Discard, s.response)
+	err := s.response.Close()
+	s.response = nil
+	return err
+}
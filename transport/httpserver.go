@@ -0,0 +1,203 @@
+package transport
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pktline"
+)
+
+// The repository in use is global, so requests take turns serving theirs
+var repositoryLock sync.Mutex
+
+// The largest request accepted when the handler does not set one
+const defaultMaxRequestSize = 256 << 20
+
+// HTTPHandler serves a repository over git's smart HTTP protocol, where
+// the refs are advertised by "GET info/refs?service=<service>" and each
+// round of a fetch or push is a POST to the service. The paths are
+// matched by their ending, so the handler can be mounted under any
+// prefix.
+//
+// Fetching is allowed unless http.uploadpack is false in the
+// repository. Pushing is allowed when http.receivepack is true or, if it
+// is not set, when AllowPush accepts the request.
+//
+// The services work on the repository in use by the process, so only
+// one request is served at a time by all of the handlers of a process
+// together. A slow fetch or push delays every other request, including
+// those for other repositories.
+type HTTPHandler struct {
+	// Dir is the repository served, either a working tree or a bare
+	// repository
+	Dir string
+
+	// MaxRequestSize is the largest request body accepted, both as sent
+	// and once decompressed. Zero means 256 MiB.
+	MaxRequestSize int64
+
+	// AllowPush decides whether a request may push when http.receivepack
+	// is not set, such as once its credentials are checked. Pushing is
+	// refused when it is nil.
+	AllowPush func(r *http.Request) bool
+
+	// ErrorLog receives the errors of services that fail once their
+	// response has started. The standard logger is used when it is nil.
+	ErrorLog *log.Logger
+}
+
+// NewHTTPHandler returns a handler serving the repository in the
+// directory
+func NewHTTPHandler(dir string) *HTTPHandler {
+	return &HTTPHandler{Dir: dir}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/info/refs"):
+		h.serveInfoRefs(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/git-"+UploadPackService):
+		h.serveRPC(w, r, UploadPackService)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/git-"+ReceivePackService):
+		h.serveRPC(w, r, ReceivePackService)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveInfoRefs advertises the refs of the repository for a service
+func (h *HTTPHandler) serveInfoRefs(w http.ResponseWriter, r *http.Request) {
+	service := strings.TrimPrefix(r.URL.Query().Get("service"), "git-")
+	if service != UploadPackService && service != ReceivePackService {
+		http.Error(w, "dumb HTTP protocol not supported", http.StatusForbidden)
+		return
+	}
+
+	h.withRepository(w, r, service, func() error {
+		setNoCache(w)
+		w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-advertisement", service))
+		out := pktline.NewWriter(w)
+		err := out.WriteLine("# service=git-%s", service)
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		if service == UploadPackService {
+			_, err = advertiseUploadPack(out)
+			return err
+		}
+		return advertiseReceivePack(out)
+	})
+}
+
+// serveRPC runs one request of a service, whose body may be compressed
+// with gzip
+func (h *HTTPHandler) serveRPC(w http.ResponseWriter, r *http.Request, service string) {
+	if r.Header.Get("Content-Type") != fmt.Sprintf("application/x-git-%s-request", service) {
+		http.Error(w, "unexpected content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	limit := h.MaxRequestSize
+	if limit <= 0 {
+		limit = defaultMaxRequestSize
+	}
+	var body io.Reader = http.MaxBytesReader(w, r.Body, limit)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		// A small body could otherwise decompress into far more
+		body = http.MaxBytesReader(w, gz, limit)
+	}
+
+	h.withRepository(w, r, service, func() error {
+		setNoCache(w)
+		w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", service))
+		if service == UploadPackService {
+			return uploadPack(body, w, true)
+		}
+		return receivePack(body, w, true)
+	})
+}
+
+// withRepository runs the service with the repository of the handler as
+// the current repository, once the service is known to be enabled
+func (h *HTTPHandler) withRepository(w http.ResponseWriter, r *http.Request, service string, serve func() error) {
+	repositoryLock.Lock()
+	defer repositoryLock.Unlock()
+
+	dir, err := FindRepository(h.Dir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	current := gitdir.Get()
+	gitdir.Set(dir)
+	defer gitdir.Set(current)
+	// The repository may have been changed by another process since the
+	// last request
+	objects.ReloadPacks()
+
+	enabled, err := h.serviceEnabled(r, service)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		http.Error(w, fmt.Sprintf("service git-%s is not enabled", service), http.StatusForbidden)
+		return
+	}
+
+	// Once the response has started, an error can only end it early, so
+	// it is logged for the server
+	err = serve()
+	if err != nil {
+		h.logf("git-%s for %s: %v", service, h.Dir, err)
+	}
+}
+
+func (h *HTTPHandler) logf(format string, args ...interface{}) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// serviceEnabled returns true if the repository allows the service to
+// the client, as configured by http.uploadpack and http.receivepack
+func (h *HTTPHandler) serviceEnabled(r *http.Request, service string) (bool, error) {
+	cfg, err := config.Read()
+	if err != nil {
+		return false, err
+	}
+	if service == UploadPackService {
+		return cfg.Bool("http.uploadpack", true)
+	}
+	if _, ok := cfg.Get("http.receivepack"); ok {
+		return cfg.Bool("http.receivepack", false)
+	}
+	return h.AllowPush != nil && h.AllowPush(r), nil
+}
+
+// setNoCache keeps proxies from caching a response, since the refs
+// change with every push
+func setNoCache(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
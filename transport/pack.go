@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"path"
+	"sort"
+
+	"github.com/mattherman/mhgit/objects"
+)
+
+// How many of the commits the other side has are searched for the bases
+// of the deltas of a thin pack
+const maxThinBaseCommits = 16
+
+// The order objects are sent in, which keeps the objects of a commit
+// together the way git does
+var packOrder = map[string]int{"commit": 0, "tag": 1, "tree": 2, "blob": 3}
+
+// objectsToSend returns the objects reachable from the tips that cannot
+// be reached from the objects the other side has. The walk stops at
+// the commits in common, so the history before them is not read.
+func objectsToSend(tips []string, haves []string) (map[string]bool, error) {
+	return objects.ReachableExcept(tips, haves)
+}
+
+// packEntries returns the objects in the order they are sent. In a thin
+// pack, a changed file is sent as a delta against the version the other
+// side has at the same path.
+func packEntries(send map[string]bool, haves []string, thin bool) ([]objects.PackEntry, error) {
+	types := make(map[string]string)
+	var hashes []string
+	for hash := range send {
+		obj, err := objects.ReadObject(hash)
+		if err != nil {
+			return nil, err
+		}
+		types[hash] = obj.Type()
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if types[hashes[i]] != types[hashes[j]] {
+			return packOrder[types[hashes[i]]] < packOrder[types[hashes[j]]]
+		}
+		return hashes[i] < hashes[j]
+	})
+
+	var bases map[string]string
+	if thin && len(haves) > 0 {
+		var err error
+		bases, err = thinBases(send, types, haves)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]objects.PackEntry, len(hashes))
+	for i, hash := range hashes {
+		entries[i] = objects.PackEntry{Hash: hash, DeltaBase: bases[hash]}
+	}
+	return entries, nil
+}
+
+// thinBases pairs the blobs being sent with the blobs of the commits
+// the other side has at the same paths
+func thinBases(send map[string]bool, types map[string]string, haves []string) (map[string]string, error) {
+	had := make(map[string]string)
+	searched := 0
+	for _, hash := range haves {
+		if searched == maxThinBaseCommits {
+			break
+		}
+		commit, err := objects.ReadCommit(hash)
+		if err != nil {
+			continue
+		}
+		searched++
+		err = walkTree(commit.Tree, "", func(string) bool { return true }, func(name string, blob string) {
+			if _, ok := had[name]; !ok {
+				had[name] = blob
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bases := make(map[string]string)
+	for hash := range send {
+		if types[hash] != "commit" {
+			continue
+		}
+		commit, err := objects.ReadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		// Only the trees being sent can hold blobs being sent
+		err = walkTree(commit.Tree, "", func(tree string) bool { return send[tree] }, func(name string, blob string) {
+			base, ok := had[name]
+			if send[blob] && ok && base != blob && bases[blob] == "" {
+				bases[blob] = base
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bases, nil
+}
+
+// walkTree calls the function for each blob of the tree and of the
+// subtrees that descend returns true for
+func walkTree(hash string, prefix string, descend func(string) bool, fn func(string, string)) error {
+	if !descend(hash) {
+		return nil
+	}
+	obj, err := objects.ReadObject(hash)
+	if err != nil {
+		return err
+	}
+	entries, err := objects.ParseTree(obj.Data)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := path.Join(prefix, entry.Name)
+		switch entry.Type() {
+		case "tree":
+			err = walkTree(entry.Hash, name, descend, fn)
+			if err != nil {
+				return err
+			}
+		case "blob":
+			fn(name, entry.Hash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pktline"
+	"github.com/mattherman/mhgit/refs"
+)
+
+// RefUpdate is an update of a ref of the other repository, which is
+// deleted when the new hash is the zero hash. The service sets the
+// error when it refuses the update.
+type RefUpdate struct {
+	Name    string
+	OldHash string
+	NewHash string
+	Error   string
+}
+
+// Delete returns true if the update deletes the ref
+func (u *RefUpdate) Delete() bool {
+	return u.NewHash == refs.ZeroHash
+}
+
+// Push will ask the service to update its refs, sending a pack of the
+// objects it is missing. The result of each update is recorded in it.
+// An error is returned if the service could not store the objects.
+func (c *Conn) Push(updates []*RefUpdate) error {
+	defer c.Close()
+	if len(updates) == 0 {
+		return c.writer.Flush()
+	}
+
+	var capabilities []string
+	for _, capability := range []string{"report-status", "side-band-64k", "quiet"} {
+		if c.Supports(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	capabilities = append(capabilities, agent)
+
+	var tips []string
+	for i, u := range updates {
+		var err error
+		if i == 0 {
+			err = c.writer.WriteLine("%s %s %s\x00%s", u.OldHash, u.NewHash, u.Name, strings.Join(capabilities, " "))
+		} else {
+			err = c.writer.WriteLine("%s %s %s", u.OldHash, u.NewHash, u.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if !u.Delete() {
+			tips = append(tips, u.NewHash)
+		}
+	}
+	err := c.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if len(tips) > 0 {
+		err = c.sendObjects(tips)
+		if err != nil {
+			return err
+		}
+	}
+	// The service only answers once it has read everything
+	err = c.send(true)
+	if err != nil {
+		return err
+	}
+
+	if !c.Supports("report-status") {
+		return nil
+	}
+	report := c.reader
+	if c.Supports("side-band-64k") {
+		var data bytes.Buffer
+		err = pktline.Demultiplex(c.reader, &data, nil)
+		if err != nil {
+			return err
+		}
+		report = pktline.NewReader(&data)
+	}
+	return readReport(report, updates)
+}
+
+// sendObjects will send a pack of the objects reachable from the tips
+// that cannot be reached from the refs the service has. Unless the
+// service asks otherwise, the pack is thin.
+func (c *Conn) sendObjects(tips []string) error {
+	var haves []string
+	for _, ref := range c.Refs {
+		if objects.Exists(ref.Hash) {
+			haves = append(haves, ref.Hash)
+		}
+	}
+
+	send, err := objectsToSend(tips, haves)
+	if err != nil {
+		return err
+	}
+	entries, err := packEntries(send, haves, !c.Supports("no-thin"))
+	if err != nil {
+		return err
+	}
+	_, err = objects.WritePackStream(c.input, entries)
+	return err
+}
+
+// readReport reads the status of the unpacking of the objects and of
+// each update
+func readReport(r *pktline.Reader, updates []*RefUpdate) error {
+	line, ok, err := r.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !ok || !strings.HasPrefix(line, "unpack ") {
+		return fmt.Errorf("protocol error: expected the unpack status, got '%s'", line)
+	}
+	if status := strings.TrimPrefix(line, "unpack "); status != "ok" {
+		return fmt.Errorf("unpack failed: %s", status)
+	}
+
+	byName := make(map[string]*RefUpdate)
+	for _, u := range updates {
+		byName[u.Name] = u
+	}
+	for {
+		line, ok, err = r.ReadLine()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		switch {
+		case fields[0] == "ok" && len(fields) == 2 && byName[fields[1]] != nil:
+		case fields[0] == "ng" && len(fields) == 3 && byName[fields[1]] != nil:
+			byName[fields[1]].Error = fields[2]
+		default:
+			return errors.New("protocol error: invalid ref status from remote: " + line)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mattherman/mhgit/config"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pktline"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/revision"
+)
+
+// The capabilities of receive-pack
+var receivePackCapabilities = []string{"report-status", "delete-refs", "side-band-64k", "quiet"}
+
+// Packs with fewer objects than this are stored as loose objects
+const defaultUnpackLimit = 100
+
+// command is an update of a ref requested by a push
+type command struct {
+	oldHash string
+	newHash string
+	name    string
+	err     string
+}
+
+func (c *command) delete() bool {
+	return c.newHash == refs.ZeroHash
+}
+
+// ReceivePack will serve a push to the current repository. After the
+// refs are advertised, the other side sends the updates of refs it
+// wants along with a pack of the objects they need. Each update is
+// checked and applied, and the result of each is reported back.
+func ReceivePack(in io.Reader, out io.Writer) error {
+	return receivePack(in, out, false)
+}
+
+// receivePack serves a push. When stateless, as over HTTP, the refs
+// were advertised by an earlier request.
+func receivePack(in io.Reader, out io.Writer, stateless bool) error {
+	r, w := pktline.NewReader(in), pktline.NewWriter(out)
+	if !stateless {
+		err := advertiseReceivePack(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	commands, requested, err := readCommands(r)
+	if err != nil || len(commands) == 0 {
+		return err
+	}
+
+	unpackErr := receiveObjects(in, commands)
+	if unpackErr != nil {
+		for _, c := range commands {
+			c.err = "unpacker error"
+		}
+	} else {
+		applyCommands(commands)
+	}
+
+	if !requested["report-status"] {
+		return unpackErr
+	}
+	var report bytes.Buffer
+	reportWriter := pktline.NewWriter(&report)
+	if unpackErr != nil {
+		reportWriter.WriteLine("unpack %s", unpackErr)
+	} else {
+		reportWriter.WriteLine("unpack ok")
+	}
+	for _, c := range commands {
+		if c.err == "" {
+			reportWriter.WriteLine("ok %s", c.name)
+		} else {
+			reportWriter.WriteLine("ng %s %s", c.name, c.err)
+		}
+	}
+	reportWriter.Flush()
+
+	if requested["side-band-64k"] {
+		_, err = pktline.NewSidebandWriter(w, pktline.BandData).Write(report.Bytes())
+		if err == nil {
+			err = w.Flush()
+		}
+	} else {
+		_, err = out.Write(report.Bytes())
+	}
+	return err
+}
+
+// advertiseReceivePack will write the refs of the repository along with
+// the capabilities of receive-pack
+func advertiseReceivePack(w *pktline.Writer) error {
+	_, err := advertiseRefs(w, append(receivePackCapabilities, agent), false)
+	return err
+}
+
+// readCommands reads the updates of refs, the first of which also
+// carries the capabilities the other side uses
+func readCommands(r *pktline.Reader) ([]*command, map[string]bool, error) {
+	var commands []*command
+	requested := make(map[string]bool)
+	for {
+		line, ok, err := r.ReadLine()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return commands, requested, nil
+		}
+
+		if nul := strings.IndexByte(line, 0); nul != -1 {
+			for _, capability := range strings.Fields(line[nul+1:]) {
+				requested[strings.SplitN(capability, "=", 2)[0]] = true
+			}
+			line = line[:nul]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !objects.IsHash(fields[0]) || !objects.IsHash(fields[1]) {
+			return nil, nil, fmt.Errorf("protocol error: expected old/new/ref, got '%s'", line)
+		}
+		commands = append(commands, &command{oldHash: fields[0], newHash: fields[1], name: fields[2]})
+	}
+}
+
+// receiveObjects reads the pack that follows the commands, unless every
+// command deletes a ref, and stores its objects
+func receiveObjects(in io.Reader, commands []*command) error {
+	onlyDeletes := true
+	for _, c := range commands {
+		onlyDeletes = onlyDeletes && c.delete()
+	}
+	if onlyDeletes {
+		return nil
+	}
+
+	pack, err := objects.ReadPack(in)
+	if err != nil {
+		return err
+	}
+	defer pack.Close()
+	cfg, err := config.Read()
+	if err != nil {
+		return err
+	}
+	limit, err := unpackLimit(cfg, "receive")
+	if err != nil {
+		return err
+	}
+	_, err = pack.Store(limit)
+	return err
+}
+
+// unpackLimit returns the number of objects from which a received pack
+// is kept as a pack, set by <command>.unpackLimit or transfer.unpackLimit
+func unpackLimit(cfg *config.Config, command string) (int, error) {
+	limit, err := cfg.Int("transfer.unpacklimit", defaultUnpackLimit)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Int(command+".unpacklimit", limit)
+}
+
+// applyCommands checks and applies each update, recording why the ones
+// that are refused fail
+func applyCommands(commands []*command) {
+	cfg, err := config.Read()
+	if err != nil {
+		for _, c := range commands {
+			c.err = err.Error()
+		}
+		return
+	}
+	denyDeletes, _ := cfg.Bool("receive.denydeletes", false)
+	denyNonFastForwards, _ := cfg.Bool("receive.denynonfastforwards", false)
+	denyCurrentBranch, ok := cfg.Get("receive.denycurrentbranch")
+	if !ok {
+		denyCurrentBranch = "refuse"
+	}
+	bare := config.IsBare()
+	head, _ := refs.ReadRef("HEAD")
+
+	for _, c := range commands {
+		switch {
+		case !strings.HasPrefix(c.name, "refs/") || refs.CheckRefFormat(c.name, false) != nil:
+			c.err = "funny refname"
+		case c.delete() && denyDeletes && strings.HasPrefix(c.name, "refs/heads/"):
+			c.err = "deletion prohibited"
+		case !bare && c.name == head.Target && denyCurrentBranch != "ignore" && denyCurrentBranch != "warn" && denyCurrentBranch != "false":
+			if c.delete() {
+				c.err = "deletion of the current branch prohibited"
+			} else {
+				c.err = "branch is currently checked out"
+			}
+		case !c.delete() && !Connected([]string{c.newHash}):
+			c.err = "missing necessary objects"
+		case denyNonFastForwards && !c.delete() && c.oldHash != refs.ZeroHash && !revision.IsFastForward(c.oldHash, c.newHash):
+			c.err = "non-fast-forward"
+		}
+		if c.err != "" {
+			continue
+		}
+
+		if c.delete() {
+			err = refs.DeleteRef(c.name, c.oldHash)
+		} else {
+			err = refs.UpdateRef(c.name, c.newHash, c.oldHash, "push")
+		}
+		if err != nil {
+			c.err = "failed to update ref"
+		}
+	}
+}
+
+// Connected returns true if every object reachable from the hashes is
+// in the repository. Only what the refs of the repository do not
+// already reach is checked.
+func Connected(hashes []string) bool {
+	all, err := refs.IterRefs("refs/")
+	if err != nil {
+		return false
+	}
+	var tips []string
+	for _, ref := range all {
+		tips = append(tips, ref.Hash)
+	}
+	if head, err := refs.ResolveRef("HEAD"); err == nil {
+		tips = append(tips, head)
+	}
+	_, err = objects.ReachableExcept(hashes, tips)
+	return err == nil
+}
@@ -0,0 +1,285 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pktline"
+	"github.com/mattherman/mhgit/refs"
+)
+
+// The services a repository provides to other repositories
+const (
+	UploadPackService  string = "upload-pack"
+	ReceivePackService string = "receive-pack"
+)
+
+// agent identifies this implementation to the other side
+const agent string = "agent=mhgit/1.0"
+
+// Conn is a connection to the upload-pack or receive-pack service of
+// another repository, which starts by advertising its refs along with
+// the capabilities of the protocol it supports
+type Conn struct {
+	URL          string
+	Refs         []refs.Ref
+	Head         refs.Ref
+	Capabilities map[string]string
+
+	reader *pktline.Reader
+	writer *pktline.Writer
+	input  io.Writer
+	output io.Reader
+
+	// A service run as another process is talked to over its standard
+	// input and output
+	stdin io.WriteCloser
+	cmd   *exec.Cmd
+
+	// A service over HTTP is stateless, so what is written is sent as a
+	// request once it is complete
+	http *httpSession
+}
+
+// LocalPath returns the path of a repository on this machine named by
+// a URL, which is either a path or a file:// URL. It returns false for
+// the URLs of other protocols.
+func LocalPath(url string) (string, bool) {
+	if strings.HasPrefix(url, "file://") {
+		return strings.TrimPrefix(url, "file://"), true
+	}
+	if strings.Contains(url, "://") {
+		return "", false
+	}
+	// "host:path" is the scp-like syntax of ssh, unless a slash comes
+	// before the colon
+	colon := strings.Index(url, ":")
+	if colon != -1 && !strings.Contains(url[:colon], "/") {
+		return "", false
+	}
+	return url, true
+}
+
+// Supported returns true if the URL names a repository on this machine
+// or one served over HTTP
+func Supported(url string) bool {
+	if isHTTP(url) {
+		return true
+	}
+	_, ok := LocalPath(url)
+	return ok
+}
+
+func isHTTP(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// FindRepository returns the directory of the repository at the path,
+// which is either a working tree or a bare repository
+func FindRepository(path string) (string, error) {
+	switch {
+	case gitdir.IsRepository(filepath.Join(path, ".git")):
+		return filepath.Join(path, ".git"), nil
+	case gitdir.IsRepository(path):
+		return path, nil
+	}
+	return "", fmt.Errorf("'%s' does not appear to be a git repository", path)
+}
+
+// Connect will start the service for the repository at the URL and
+// read the refs it advertises. The service runs as another mhgit
+// process talking over its standard input and output, unless a program
+// such as "git-upload-pack" is given to run instead.
+func Connect(url string, service string, program string) (*Conn, error) {
+	if isHTTP(url) {
+		return connectHTTP(url, service)
+	}
+
+	path, ok := LocalPath(url)
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol in '%s'", url)
+	}
+
+	var cmd *exec.Cmd
+	if program == "" {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(self, service, path)
+	} else {
+		// Like git, the program is run by the shell so it may have arguments
+		cmd = exec.Command("sh", "-c", program+" "+shellQuote(path))
+	}
+	cmd.Env = serviceEnvironment()
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &Conn{
+		URL:          url,
+		Capabilities: make(map[string]string),
+		reader:       pktline.NewReader(stdout),
+		writer:       pktline.NewWriter(stdin),
+		input:        stdin,
+		output:       stdout,
+		stdin:        stdin,
+		cmd:          cmd,
+	}
+	err = conn.readAdvertisement()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not read from remote repository '%s'", url)
+	}
+	return conn, nil
+}
+
+// serviceEnvironment returns the environment of a service, without the
+// variables naming the repository of this process
+func serviceEnvironment() []string {
+	var env []string
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, "GIT_DIR=") && !strings.HasPrefix(variable, "GIT_WORK_TREE=") {
+			env = append(env, variable)
+		}
+	}
+	return env
+}
+
+func shellQuote(text string) string {
+	return "'" + strings.Replace(text, "'", `'\''`, -1) + "'"
+}
+
+// readAdvertisement reads the refs advertised by the service, where the
+// first ref also carries the capabilities after a NUL byte
+func (c *Conn) readAdvertisement() error {
+	first := true
+	for {
+		line, ok, err := c.reader.ReadLine()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		if first {
+			first = false
+			if nul := strings.IndexByte(line, 0); nul != -1 {
+				c.parseCapabilities(line[nul+1:])
+				line = line[:nul]
+			}
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || !objects.IsHash(fields[0]) {
+			return fmt.Errorf("protocol error: unexpected ref advertisement '%s'", line)
+		}
+		hash, name := fields[0], fields[1]
+		switch {
+		case name == "capabilities^{}":
+		case name != "HEAD" && refs.CheckRefFormat(strings.TrimSuffix(name, "^{}"), false) != nil:
+			// A ref that could not be stored here is ignored, as git does
+		case strings.HasSuffix(name, "^{}"):
+			for i := range c.Refs {
+				if c.Refs[i].Name == strings.TrimSuffix(name, "^{}") {
+					c.Refs[i].Peeled = hash
+				}
+			}
+		case name == "HEAD":
+			c.Head.Name, c.Head.Hash = name, hash
+		default:
+			c.Refs = append(c.Refs, refs.Ref{Name: name, Hash: hash})
+		}
+	}
+	return nil
+}
+
+func (c *Conn) parseCapabilities(text string) {
+	for _, capability := range strings.Fields(text) {
+		name, value := capability, ""
+		if equals := strings.Index(capability, "="); equals != -1 {
+			name, value = capability[:equals], capability[equals+1:]
+		}
+		if name == "symref" && strings.HasPrefix(value, "HEAD:") {
+			c.Head.Name = "HEAD"
+			c.Head.Target = strings.TrimPrefix(value, "HEAD:")
+		}
+		c.Capabilities[name] = value
+	}
+}
+
+// Supports returns true if the service advertised the capability
+func (c *Conn) Supports(capability string) bool {
+	_, ok := c.Capabilities[capability]
+	return ok
+}
+
+// End will tell the service that nothing more is wanted and close the
+// connection
+func (c *Conn) End() error {
+	err := c.writer.Flush()
+	closeErr := c.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// send will end what is written to the service, so that its response
+// can be read. Over HTTP this is a request, which is answered by a new
+// response. When nothing more will be written, the input of a service
+// process is closed.
+func (c *Conn) send(last bool) error {
+	if c.http != nil {
+		return c.http.post(c)
+	}
+	if last {
+		return c.stdin.Close()
+	}
+	return nil
+}
+
+// Close will close the connection and wait for the service to exit
+func (c *Conn) Close() error {
+	if c.http != nil {
+		return c.http.close()
+	}
+	c.stdin.Close()
+	err := c.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", filepath.Base(c.cmd.Path), err)
+	}
+	return nil
+}
+
+// ListRefs will return the refs of the repository at the URL along with
+// its HEAD, as advertised by its upload-pack service
+func ListRefs(url string, program string) ([]refs.Ref, refs.Ref, error) {
+	conn, err := Connect(url, UploadPackService, program)
+	if err != nil {
+		return nil, refs.Ref{}, err
+	}
+	err = conn.End()
+	if err != nil {
+		return nil, refs.Ref{}, err
+	}
+	return conn.Refs, conn.Head, nil
+}
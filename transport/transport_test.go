@@ -0,0 +1,382 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mattherman/mhgit/gitdir"
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/refs"
+)
+
+func TestMain(m *testing.M) {
+	// Connect runs the service as another process of this executable,
+	// which serves it rather than running the tests
+	if len(os.Args) == 3 && (os.Args[1] == UploadPackService || os.Args[1] == ReceivePackService) {
+		os.Exit(serveTestService(os.Args[1], os.Args[2]))
+	}
+
+	// The configuration of whoever runs the tests is not used
+	home, err := ioutil.TempDir("", "mhgit-home")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+func serveTestService(service string, path string) int {
+	dir, err := FindRepository(path)
+	if err == nil {
+		gitdir.Set(dir)
+		if service == UploadPackService {
+			err = UploadPack(os.Stdin, os.Stdout)
+		} else {
+			err = ReceivePack(os.Stdin, os.Stdout)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		return 128
+	}
+	return 0
+}
+
+// newTestRepository creates an empty bare repository with the given
+// configuration, returning its directory
+func newTestRepository(t *testing.T, config string) string {
+	dir := t.TempDir()
+	for _, sub := range []string{"objects", "refs/heads", "refs/tags"} {
+		os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "config"), []byte("[core]\n\tbare = true\n"+config), 0644)
+	return dir
+}
+
+// inRepository runs the function with the repository in the directory
+// as the one that is used
+func inRepository(dir string, fn func()) {
+	previous := gitdir.Get()
+	gitdir.Set(dir)
+	objects.ReloadPacks()
+	defer func() {
+		gitdir.Set(previous)
+		objects.ReloadPacks()
+	}()
+	fn()
+}
+
+// writeCommit writes a commit of a tree holding the files, along with
+// its tree and blobs, to the repository in use
+func writeCommit(t *testing.T, files map[string]string, message string, parents ...string) string {
+	var entries []objects.TreeEntry
+	for name, content := range files {
+		hash, err := objects.HashObject(objects.Object{Data: []byte(content), ObjectType: "blob"}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, objects.TreeEntry{Mode: "100644", Name: name, Hash: hash})
+	}
+	treeData, err := objects.TreeData(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := objects.HashObject(objects.Object{Data: treeData, ObjectType: "tree"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data strings.Builder
+	fmt.Fprintf(&data, "tree %s\n", tree)
+	for _, parent := range parents {
+		fmt.Fprintf(&data, "parent %s\n", parent)
+	}
+	fmt.Fprintf(&data, "author A U Thor <author@example.com> 1112911993 -0700\n")
+	fmt.Fprintf(&data, "committer C O Mitter <committer@example.com> 1112911993 -0700\n\n%s\n", message)
+	commit, err := objects.HashObject(objects.Object{Data: []byte(data.String()), ObjectType: "commit"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func updateRef(t *testing.T, name string, hash string) {
+	err := refs.UpdateRef(name, hash, "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// history writes the same two commits to each of the repositories,
+// the second of which changes a large file slightly so that it can be
+// sent as a delta against the first version
+func history(t *testing.T, dirs ...string) (string, string) {
+	original := strings.Repeat("a line of the file that does not change\n", 100)
+	var first, second string
+	for _, dir := range dirs {
+		inRepository(dir, func() {
+			first = writeCommit(t, map[string]string{"file.txt": original, "other.txt": "other\n"}, "first")
+			second = writeCommit(t, map[string]string{"file.txt": original + "a new line\n", "other.txt": "other\n"}, "second", first)
+		})
+	}
+	return first, second
+}
+
+func TestFetchSendsOnlyMissingObjects(t *testing.T) {
+	server, client := newTestRepository(t, ""), newTestRepository(t, "")
+	first, second := history(t, server)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", second) })
+
+	// The client only has the first commit
+	history(t, client)
+	var secondTree, changedBlob string
+	inRepository(client, func() {
+		updateRef(t, "refs/heads/master", first)
+		commit, err := objects.ReadCommit(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secondTree = commit.Tree
+		entries, err := objects.ReadTree(secondTree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changedBlob = entries[0].Hash
+
+		for _, hash := range []string{second, secondTree, changedBlob} {
+			err = objects.RemoveLooseObject(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	inRepository(client, func() {
+		conn, err := Connect("file://"+server, UploadPackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if len(conn.Refs) != 1 || conn.Refs[0].Name != "refs/heads/master" || conn.Refs[0].Hash != second {
+			t.Fatalf("unexpected advertised refs %v", conn.Refs)
+		}
+		if conn.Head.Target != "refs/heads/master" {
+			t.Errorf("HEAD was advertised as %v", conn.Head)
+		}
+		for _, capability := range []string{"multi_ack_detailed", "side-band-64k", "thin-pack"} {
+			if !conn.Supports(capability) {
+				t.Errorf("upload-pack does not advertise %s", capability)
+			}
+		}
+
+		// The blob that changed can only be resolved from the first
+		// version the client already has when the pack is thin
+		hashes, err := conn.Fetch([]string{second}, false, nil)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		sort.Strings(hashes)
+		expected := []string{second, secondTree, changedBlob}
+		sort.Strings(expected)
+		if strings.Join(hashes, " ") != strings.Join(expected, " ") {
+			t.Errorf("received %v, expected %v", hashes, expected)
+		}
+		if !Connected([]string{second}) {
+			t.Error("the fetched commit is not connected")
+		}
+	})
+}
+
+func TestFetchIntoEmptyRepository(t *testing.T) {
+	server, client := newTestRepository(t, ""), newTestRepository(t, "[fetch]\n\tunpackLimit = 1\n")
+	_, second := history(t, server)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", second) })
+
+	inRepository(client, func() {
+		conn, err := Connect("file://"+server, UploadPackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		hashes, err := conn.Fetch([]string{second}, false, nil)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		// Two commits, two trees and three blobs
+		if len(hashes) != 7 {
+			t.Errorf("received %d objects, expected 7", len(hashes))
+		}
+		for _, hash := range hashes {
+			if !objects.IsPacked(hash) {
+				t.Errorf("object %s was not kept in a pack", hash)
+			}
+		}
+		if _, err := objects.ReachableExcept([]string{second}, nil); err != nil {
+			t.Errorf("the fetched history is incomplete: %v", err)
+		}
+	})
+}
+
+func TestFetchRefusesUnadvertisedObjects(t *testing.T) {
+	server, client := newTestRepository(t, ""), newTestRepository(t, "")
+	first, second := history(t, server)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", first) })
+
+	inRepository(client, func() {
+		conn, err := Connect("file://"+server, UploadPackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		_, err = conn.Fetch([]string{second}, false, nil)
+		if err == nil {
+			t.Error("expected fetching an object no ref points to to fail")
+		}
+		if objects.Exists(second) {
+			t.Error("an object no ref points to was sent")
+		}
+	})
+}
+
+func TestPushUpdatesRefs(t *testing.T) {
+	server, client := newTestRepository(t, ""), newTestRepository(t, "")
+	first, _ := history(t, server)
+	inRepository(server, func() { updateRef(t, "refs/heads/master", first) })
+	_, second := history(t, client)
+
+	inRepository(client, func() {
+		conn, err := Connect("file://"+server, ReceivePackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		for _, capability := range []string{"report-status", "delete-refs", "side-band-64k"} {
+			if !conn.Supports(capability) {
+				t.Errorf("receive-pack does not advertise %s", capability)
+			}
+		}
+		updates := []*RefUpdate{
+			{Name: "refs/heads/master", OldHash: first, NewHash: second},
+			{Name: "refs/heads/topic", OldHash: refs.ZeroHash, NewHash: second},
+		}
+		err = conn.Push(updates)
+		if err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+		for _, u := range updates {
+			if u.Error != "" {
+				t.Errorf("update of %s failed: %s", u.Name, u.Error)
+			}
+		}
+	})
+
+	inRepository(server, func() {
+		for _, name := range []string{"refs/heads/master", "refs/heads/topic"} {
+			hash, err := refs.ResolveRef(name)
+			if err != nil || hash != second {
+				t.Errorf("%s is %s (%v), expected %s", name, hash, err, second)
+			}
+		}
+		if !Connected([]string{second}) {
+			t.Error("the pushed commit is not connected")
+		}
+	})
+}
+
+func TestPushReportsRejectedUpdates(t *testing.T) {
+	server := newTestRepository(t, "[receive]\n\tdenyNonFastForwards = true\n\tdenyDeletes = true\n")
+	client := newTestRepository(t, "")
+	first, second := history(t, server, client)
+	var sibling string
+	inRepository(client, func() {
+		sibling = writeCommit(t, map[string]string{"file.txt": "rewritten\n"}, "sibling", first)
+	})
+	inRepository(server, func() {
+		for _, name := range []string{"refs/heads/master", "refs/heads/stale", "refs/heads/kept"} {
+			updateRef(t, name, second)
+		}
+		updateRef(t, "refs/heads/old", first)
+	})
+
+	updates := []*RefUpdate{
+		{Name: "refs/heads/master", OldHash: second, NewHash: sibling},
+		{Name: "refs/heads/stale", OldHash: first, NewHash: sibling},
+		{Name: "refs/heads/kept", OldHash: second, NewHash: refs.ZeroHash},
+		{Name: "refs/heads/a..b", OldHash: refs.ZeroHash, NewHash: sibling},
+		{Name: "refs/heads/old", OldHash: first, NewHash: sibling},
+	}
+	inRepository(client, func() {
+		conn, err := Connect("file://"+server, ReceivePackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		err = conn.Push(updates)
+		if err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+	})
+
+	expected := []string{"non-fast-forward", "failed to update ref", "deletion prohibited", "funny refname", ""}
+	for i, u := range updates {
+		if u.Error != expected[i] {
+			t.Errorf("update of %s reported %q, expected %q", u.Name, u.Error, expected[i])
+		}
+	}
+	inRepository(server, func() {
+		for name, hash := range map[string]string{"refs/heads/master": second, "refs/heads/stale": second, "refs/heads/kept": second, "refs/heads/old": sibling} {
+			current, err := refs.ResolveRef(name)
+			if err != nil || current != hash {
+				t.Errorf("%s is %s (%v), expected %s", name, current, err, hash)
+			}
+		}
+	})
+}
+
+func TestPushWithMissingObjectsIsRejected(t *testing.T) {
+	server, client := newTestRepository(t, ""), newTestRepository(t, "")
+	first, second := history(t, server, client)
+	inRepository(server, func() {
+		updateRef(t, "refs/heads/master", first)
+		err := objects.RemoveLooseObject(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The client claims to push the second commit but only sends a pack
+	// of the first
+	inRepository(client, func() {
+		conn, err := Connect("file://"+server, ReceivePackService, "")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		conn.Refs = nil
+		update := &RefUpdate{Name: "refs/heads/master", OldHash: first, NewHash: second}
+		err = conn.writer.WriteLine("%s %s %s\x00report-status", first, second, update.Name)
+		if err == nil {
+			err = conn.writer.Flush()
+		}
+		if err == nil {
+			err = conn.sendObjects([]string{first})
+		}
+		if err == nil {
+			err = conn.send(true)
+		}
+		if err == nil {
+			err = readReport(conn.reader, []*RefUpdate{update})
+		}
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+		if update.Error != "missing necessary objects" {
+			t.Errorf("update reported %q, expected missing necessary objects", update.Error)
+		}
+	})
+}
@@ -0,0 +1,263 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mattherman/mhgit/objects"
+	"github.com/mattherman/mhgit/pktline"
+	"github.com/mattherman/mhgit/refs"
+	"github.com/mattherman/mhgit/revision"
+)
+
+// The capabilities of upload-pack, besides the branch HEAD points to
+var uploadPackCapabilities = []string{"multi_ack_detailed", "thin-pack", "side-band-64k", "no-progress", "include-tag"}
+
+// UploadPack will serve a fetch from the current repository. After the
+// refs are advertised, the other side says which objects it wants and
+// which commits it has, until both know which commits they have in
+// common. It is then sent a pack of the objects it is missing.
+func UploadPack(in io.Reader, out io.Writer) error {
+	return uploadPack(in, out, false)
+}
+
+// uploadPack serves a fetch. When stateless, as over HTTP, the refs
+// were advertised by an earlier request and each request repeats what
+// the other side wants along with the common commits found so far.
+// Such a request ends after one round of negotiation unless the other
+// side is done.
+func uploadPack(in io.Reader, out io.Writer, stateless bool) error {
+	r, w := pktline.NewReader(in), pktline.NewWriter(out)
+
+	advertisement := w
+	if stateless {
+		advertisement = pktline.NewWriter(ioutil.Discard)
+	}
+	advertised, err := advertiseUploadPack(advertisement)
+	if err != nil {
+		return err
+	}
+
+	wants, requested, err := readWants(r)
+	if err != nil || len(wants) == 0 {
+		// The other side only wanted to list the refs
+		return err
+	}
+	for _, want := range wants {
+		if !advertised[want] {
+			w.WriteLine("ERR upload-pack: not our ref %s", want)
+			return fmt.Errorf("not our ref %s", want)
+		}
+	}
+
+	n := &negotiation{wants: wants, common: make(map[string]bool), ancestors: make(map[string]map[string]bool)}
+	common, done, err := n.run(r, w, requested["multi_ack_detailed"], stateless)
+	if err != nil || !done {
+		return err
+	}
+	return sendPack(out, w, wants, common, requested)
+}
+
+// advertiseUploadPack will write the refs of the repository along with
+// the capabilities of upload-pack
+func advertiseUploadPack(w *pktline.Writer) (map[string]bool, error) {
+	capabilities := append([]string(nil), uploadPackCapabilities...)
+	if symref, ok := headSymref(); ok {
+		capabilities = append(capabilities, symref)
+	}
+	return advertiseRefs(w, append(capabilities, agent), true)
+}
+
+// readWants reads the objects the other side wants, the first of which
+// also carries the capabilities it uses
+func readWants(r *pktline.Reader) ([]string, map[string]bool, error) {
+	var wants []string
+	requested := make(map[string]bool)
+	for {
+		line, ok, err := r.ReadLine()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return wants, requested, nil
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "want" || !objects.IsHash(fields[1]) {
+			return nil, nil, fmt.Errorf("protocol error: expected a want line, got '%s'", line)
+		}
+		wants = append(wants, fields[1])
+		for _, capability := range fields[2:] {
+			requested[strings.SplitN(capability, "=", 2)[0]] = true
+		}
+	}
+}
+
+// negotiation finds the commits both sides have, from the commits the
+// other side says it has
+type negotiation struct {
+	wants     []string
+	common    map[string]bool
+	ancestors map[string]map[string]bool
+}
+
+// run reads the commits the other side has until it is done, saying
+// which ones are common. With multi_ack_detailed, it is told when
+// enough common commits are known for every wanted commit. When
+// stateless, it returns at the first flush without being done.
+func (n *negotiation) run(r *pktline.Reader, w *pktline.Writer, multiAck bool, stateless bool) ([]string, bool, error) {
+	var common []string
+	gotCommon, gotOther := false, false
+	last := ""
+	for {
+		line, ok, err := r.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch {
+		case !ok:
+			if multiAck && gotCommon && !gotOther && n.okToGiveUp() {
+				err = w.WriteLine("ACK %s ready", last)
+			}
+			if err == nil && (len(common) == 0 || multiAck) {
+				err = w.WriteLine("NAK")
+			}
+			if stateless {
+				return common, false, err
+			}
+			gotCommon, gotOther = false, false
+		case strings.HasPrefix(line, "have "):
+			hash := strings.TrimPrefix(line, "have ")
+			if !objects.IsHash(hash) {
+				return nil, false, fmt.Errorf("protocol error: expected a have line, got '%s'", line)
+			}
+			if !objects.Exists(hash) {
+				gotOther = true
+				if multiAck && n.okToGiveUp() {
+					err = w.WriteLine("ACK %s ready", hash)
+				}
+				break
+			}
+			gotCommon, last = true, hash
+			if !n.common[hash] {
+				n.common[hash] = true
+				common = append(common, hash)
+			}
+			if multiAck {
+				err = w.WriteLine("ACK %s common", hash)
+			} else if len(common) == 1 {
+				err = w.WriteLine("ACK %s", hash)
+			}
+		case line == "done":
+			if len(common) == 0 {
+				return nil, true, w.WriteLine("NAK")
+			}
+			if multiAck {
+				err = w.WriteLine("ACK %s", last)
+			}
+			return common, true, err
+		default:
+			return nil, false, fmt.Errorf("protocol error: expected a have line, got '%s'", line)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// okToGiveUp returns true when every wanted commit has an ancestor the
+// other side has, so the pack sent will not hold its whole history
+func (n *negotiation) okToGiveUp() bool {
+	for _, want := range n.wants {
+		if n.common[want] {
+			continue
+		}
+		ancestors, ok := n.ancestors[want]
+		if !ok {
+			ancestors, _ = revision.Ancestors(want)
+			n.ancestors[want] = ancestors
+		}
+
+		found := false
+		for hash := range n.common {
+			if ancestors[hash] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sendPack will send the objects the other side is missing, along with
+// progress messages if it asked for them
+func sendPack(out io.Writer, w *pktline.Writer, wants []string, common []string, requested map[string]bool) error {
+	data, progress := out, io.Writer(ioutil.Discard)
+	if requested["side-band-64k"] {
+		data = pktline.NewSidebandWriter(w, pktline.BandData)
+		if !requested["no-progress"] {
+			progress = pktline.NewSidebandWriter(w, pktline.BandProgress)
+		}
+	}
+
+	send, err := objectsToSend(wants, common)
+	if err == nil && requested["include-tag"] {
+		err = includeTags(send)
+	}
+	var entries []objects.PackEntry
+	if err == nil {
+		entries, err = packEntries(send, common, requested["thin-pack"])
+	}
+	if err != nil {
+		if requested["side-band-64k"] {
+			pktline.NewSidebandWriter(w, pktline.BandError).Write([]byte(err.Error()))
+		}
+		return err
+	}
+
+	fmt.Fprintf(progress, "Enumerating objects: %d, done.\n", len(entries))
+	deltas, err := objects.WritePackStream(data, entries)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(progress, "Total %d (delta %d), reused 0 (delta 0), pack-reused 0\n", len(entries), deltas)
+
+	if requested["side-band-64k"] {
+		return w.Flush()
+	}
+	return nil
+}
+
+// includeTags adds the annotated tags pointing to objects being sent,
+// so the other side can follow tags without asking for them
+func includeTags(send map[string]bool) error {
+	tags, err := refs.IterRefs("refs/tags/")
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range tags {
+		var chain []string
+		hash := ref.Hash
+		for {
+			tag, err := objects.ReadTag(hash)
+			if err != nil {
+				break
+			}
+			chain = append(chain, hash)
+			hash = tag.Object
+		}
+		if len(chain) > 0 && send[hash] {
+			for _, tag := range chain {
+				send[tag] = true
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package wildmatch
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Flags changing how patterns are matched
+const (
+	// Pathname makes wildcards stop at slashes, except for "**" which
+	// matches across any number of directories
+	Pathname = 1 << iota
+	// CaseFold makes matching case-insensitive
+	CaseFold
+)
+
+const (
+	match = iota
+	noMatch
+	abortAll
+	abortToStarStar
+)
+
+// Match will report whether the text matches the shell wildcard pattern,
+// following the same rules as git uses for pathspecs and ignore files.
+// The pattern may contain "*", "?", "[...]" character classes and
+// backslash escapes.
+func Match(pattern string, text string, flags int) bool {
+	return dowild([]byte(pattern), []byte(text), flags) == match
+}
+
+// HasWildcard returns true if the pattern contains any characters with
+// a special meaning to Match
+func HasWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
+func isGlobSpecial(c byte) bool {
+	return c == '*' || c == '?' || c == '[' || c == '\\'
+}
+
+// at returns the byte at position i, or 0 past the end of the slice,
+// mirroring the null-terminated strings of git's implementation
+func at(s []byte, i int) byte {
+	if i < 0 || i >= len(s) {
+		return 0
+	}
+	return s[i]
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// A port of dowild() from git's wildmatch.c
+func dowild(pattern []byte, text []byte, flags int) int {
+	p, t := 0, 0
+	for ; p < len(pattern); p, t = p+1, t+1 {
+		pCh := pattern[p]
+		tCh := at(text, t)
+		if tCh == 0 && pCh != '*' {
+			return abortAll
+		}
+		if flags&CaseFold != 0 {
+			tCh = lower(tCh)
+			pCh = lower(pCh)
+		}
+
+		switch pCh {
+		case '\\':
+			// Literal match with the following character
+			p++
+			pCh = at(pattern, p)
+			if flags&CaseFold != 0 {
+				pCh = lower(pCh)
+			}
+			if tCh != pCh {
+				return noMatch
+			}
+
+		case '?':
+			// Match anything but a slash
+			if flags&Pathname != 0 && tCh == '/' {
+				return noMatch
+			}
+
+		case '*':
+			var matchSlash bool
+			p++
+			if at(pattern, p) == '*' {
+				prevP := p - 2
+				for p++; at(pattern, p) == '*'; p++ {
+				}
+				if (prevP < 0 || pattern[prevP] == '/') &&
+					(at(pattern, p) == 0 || at(pattern, p) == '/' || (at(pattern, p) == '\\' && at(pattern, p+1) == '/')) {
+					// "**/" may match no directories at all, so try
+					// matching the rest of the pattern right away
+					if at(pattern, p) == '/' && dowild(pattern[p+1:], text[t:], flags) == match {
+						return match
+					}
+					matchSlash = true
+				} else {
+					matchSlash = flags&Pathname == 0
+				}
+			} else {
+				// Without Pathname "*" is the same as "**"
+				matchSlash = flags&Pathname == 0
+			}
+
+			if p >= len(pattern) {
+				// A trailing "**" matches everything, while a trailing "*"
+				// only matches if there are no more slashes
+				if !matchSlash && bytes.IndexByte(text[t:], '/') != -1 {
+					return noMatch
+				}
+				return match
+			} else if !matchSlash && pattern[p] == '/' {
+				// A single star followed by a slash matches the next directory
+				slash := bytes.IndexByte(text[t:], '/')
+				if slash == -1 {
+					return noMatch
+				}
+				t += slash
+				// The slash is consumed by the loop
+				continue
+			}
+
+			for {
+				if tCh == 0 {
+					break
+				}
+				// Skip ahead to the literal following the star, since
+				// everything before it must belong to the star
+				if !isGlobSpecial(pattern[p]) {
+					pCh = pattern[p]
+					if flags&CaseFold != 0 {
+						pCh = lower(pCh)
+					}
+					for tCh = at(text, t); tCh != 0 && (matchSlash || tCh != '/'); tCh = at(text, t) {
+						if flags&CaseFold != 0 {
+							tCh = lower(tCh)
+						}
+						if tCh == pCh {
+							break
+						}
+						t++
+					}
+					if tCh != pCh {
+						return noMatch
+					}
+				}
+
+				matched := dowild(pattern[p:], text[t:], flags)
+				if matched != noMatch {
+					if !matchSlash || matched != abortToStarStar {
+						return matched
+					}
+				} else if !matchSlash && tCh == '/' {
+					return abortToStarStar
+				}
+				t++
+				tCh = at(text, t)
+				if flags&CaseFold != 0 {
+					tCh = lower(tCh)
+				}
+			}
+			return abortAll
+
+		case '[':
+			p++
+			pCh = at(pattern, p)
+			if pCh == '^' {
+				pCh = '!'
+			}
+			negated := pCh == '!'
+			if negated {
+				p++
+				pCh = at(pattern, p)
+			}
+
+			var prevCh byte
+			matched := false
+			for {
+				if pCh == 0 {
+					return abortAll
+				}
+
+				if pCh == '\\' {
+					p++
+					pCh = at(pattern, p)
+					if pCh == 0 {
+						return abortAll
+					}
+					if tCh == pCh {
+						matched = true
+					}
+				} else if pCh == '-' && prevCh != 0 && at(pattern, p+1) != 0 && at(pattern, p+1) != ']' {
+					p++
+					pCh = at(pattern, p)
+					if pCh == '\\' {
+						p++
+						pCh = at(pattern, p)
+						if pCh == 0 {
+							return abortAll
+						}
+					}
+					if tCh <= pCh && tCh >= prevCh {
+						matched = true
+					} else if flags&CaseFold != 0 && upper(tCh) <= pCh && upper(tCh) >= prevCh {
+						matched = true
+					}
+					pCh = 0
+				} else if pCh == '[' && at(pattern, p+1) == ':' {
+					start := p + 2
+					end := start
+					for at(pattern, end) != 0 && at(pattern, end) != ']' {
+						end++
+					}
+					if at(pattern, end) == 0 {
+						return abortAll
+					}
+					if end-start-1 < 0 || pattern[end-1] != ':' {
+						// Not a "[:class:]", so treat the bracket literally
+						if tCh == '[' {
+							matched = true
+						}
+					} else {
+						p = end
+						class := string(pattern[start : end-1])
+						classMatched, ok := matchClass(class, tCh, flags)
+						if !ok {
+							return abortAll
+						}
+						if classMatched {
+							matched = true
+						}
+						pCh = 0
+					}
+				} else if tCh == pCh {
+					matched = true
+				}
+
+				prevCh = pCh
+				p++
+				pCh = at(pattern, p)
+				if pCh == ']' {
+					break
+				}
+			}
+
+			if matched == negated || (flags&Pathname != 0 && tCh == '/') {
+				return noMatch
+			}
+
+		default:
+			if tCh != pCh {
+				return noMatch
+			}
+		}
+	}
+
+	if t < len(text) {
+		return noMatch
+	}
+	return match
+}
+
+// matchClass tests a character against a named "[:class:]" and
+// returns false for ok if the class name is not known
+func matchClass(class string, c byte, flags int) (bool, bool) {
+	isUpper := c >= 'A' && c <= 'Z'
+	isLower := c >= 'a' && c <= 'z'
+	isDigit := c >= '0' && c <= '9'
+	isAlpha := isUpper || isLower
+	isPrint := c >= 0x20 && c < 0x7F
+
+	switch class {
+	case "alnum":
+		return isAlpha || isDigit, true
+	case "alpha":
+		return isAlpha, true
+	case "blank":
+		return c == ' ' || c == '\t', true
+	case "cntrl":
+		return c < 0x20 || c == 0x7F, true
+	case "digit":
+		return isDigit, true
+	case "graph":
+		return isPrint && c != ' ', true
+	case "lower":
+		return isLower || (flags&CaseFold != 0 && isUpper), true
+	case "print":
+		return isPrint, true
+	case "punct":
+		return isPrint && c != ' ' && !isAlpha && !isDigit, true
+	case "space":
+		return c == ' ' || (c >= '\t' && c <= '\r'), true
+	case "upper":
+		return isUpper || (flags&CaseFold != 0 && isLower), true
+	case "xdigit":
+		return isDigit || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F'), true
+	}
+	return false, false
+}